@@ -0,0 +1,217 @@
+// Package client is a Go client of the users API of golang-demo-api.
+//
+//	c := client.New("http://localhost:3000")
+//	u, err := c.CreateUser(ctx, client.UserParams{
+//		Name:                 client.String("Aditya Shedge"),
+//		Username:             client.String("aditya"),
+//		Email:                client.String("test@sample.com"),
+//		Password:             client.String("test123"),
+//		PasswordConfirmation: client.String("test123"),
+//	})
+//	if verr, ok := err.(*client.ValidationError); ok {
+//		log.Println(verr.Errors["email"])
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MediaType is the media type the API must be asked for.
+const MediaType = "application/vnd.demo_app.v1+json"
+
+// Defaults of the clients made by New.
+const (
+	DefaultTimeout    = 30 * time.Second
+	DefaultMaxRetries = 3
+	DefaultBackoff    = 500 * time.Millisecond
+)
+
+// Client calls the API at BaseURL. Its fields must not be changed once it
+// is in use.
+type Client struct {
+	// BaseURL is the root of the API, like "http://localhost:3000".
+	BaseURL string
+	// Token, when set, is sent as a bearer token.
+	Token string
+	// Organization, when set, is the slug of the organization the
+	// requests are made for, sent in the "X-Organization" header.
+	Organization string
+	// HTTPClient sends the requests, its Timeout bounds every attempt.
+	HTTPClient *http.Client
+	// MaxRetries is how many times a request is sent again when the API
+	// answers 429 Too Many Requests or 503 Service Unavailable.
+	MaxRetries int
+	// Backoff is the wait before the first retry, it doubles with every
+	// retry. The "Retry-After" header of the response wins over it.
+	Backoff time.Duration
+}
+
+// New returns a client of the API at baseURL with the default timeout and
+// retries.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+		MaxRetries: DefaultMaxRetries,
+		Backoff:    DefaultBackoff,
+	}
+}
+
+// ModelErrors are the errors of the fields of a model, by field name.
+type ModelErrors map[string][]string
+
+// String returns the errors on one line, like "email is already taken; name can't be blank".
+func (e ModelErrors) String() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var msgs []string
+	for _, field := range fields {
+		for _, msg := range e[field] {
+			msgs = append(msgs, field+" "+msg)
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Error is an error response of the API.
+type Error struct {
+	StatusCode int
+	Message    string
+	// RequestID is the "X-Request-ID" of the response, to find the
+	// request in the logs of the API.
+	RequestID string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("client: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("client: %d %s", e.StatusCode, e.Message)
+}
+
+// ValidationError is returned when the API refuses a model because of
+// the errors of its fields, with the status 422.
+type ValidationError struct {
+	Message   string
+	Errors    ModelErrors
+	RequestID string
+}
+
+func (e *ValidationError) Error() string {
+	return "client: " + e.Message + " " + e.Errors.String()
+}
+
+// envelope is the body of every response of the API.
+type envelope struct {
+	Message string `json:"message"`
+	Data    struct {
+		Total  int         `json:"total"`
+		Users  []User      `json:"users"`
+		User   *User       `json:"user"`
+		Errors ModelErrors `json:"errors"`
+	} `json:"data"`
+}
+
+// do sends a request to path with body encoded as JSON, retrying when
+// the API is busy, and decodes the envelope of a successful response.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body interface{}) (*envelope, error) {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, u, bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Accept", MediaType)
+		// the routes match the "Content-Type" of every request
+		req.Header.Set("Content-Type", "application/json")
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+		if c.Organization != "" {
+			req.Header.Set("X-Organization", c.Organization)
+		}
+
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) &&
+			attempt < c.MaxRetries {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if err = sleep(ctx, c.retryDelay(resp, attempt)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return decodeResponse(resp)
+	}
+}
+
+// retryDelay returns how long to wait before retrying after resp.
+func (c *Client) retryDelay(resp *http.Response, attempt int) time.Duration {
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second
+	}
+	return c.Backoff << uint(attempt)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// decodeResponse returns the envelope of resp, or its error.
+func decodeResponse(resp *http.Response) (*envelope, error) {
+	defer resp.Body.Close()
+	var env envelope
+	// some errors are sent without a body
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil && err != io.EOF {
+		if resp.StatusCode < 300 {
+			return nil, err
+		}
+	}
+	if resp.StatusCode < 300 {
+		return &env, nil
+	}
+
+	requestID := resp.Header.Get("X-Request-ID")
+	if len(env.Data.Errors) > 0 {
+		return nil, &ValidationError{Message: env.Message, Errors: env.Data.Errors, RequestID: requestID}
+	}
+	return nil, &Error{StatusCode: resp.StatusCode, Message: env.Message, RequestID: requestID}
+}
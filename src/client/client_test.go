@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestClient(url string) *Client {
+	c := New(url)
+	c.Backoff = time.Millisecond
+	return c
+}
+
+func TestRetries(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		attempts := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			attempts++
+			if attempts < 3 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(status)
+				return
+			}
+			w.Write([]byte(`{"data": {"user": {"id": "1", "name": "Test"}}}`))
+		}))
+
+		u, err := newTestClient(ts.URL).GetUser(context.Background(), "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Name != "Test" {
+			t.Errorf("expected name to be %s, but got %s", "Test", u.Name)
+		}
+		if attempts != 3 {
+			t.Errorf("%d: expected %d attempts, but got %d", status, 3, attempts)
+		}
+		ts.Close()
+	}
+}
+
+func TestRetriesGiveUp(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	c := newTestClient(ts.URL)
+	c.MaxRetries = 2
+	_, err := c.ListUsers(context.Background(), ListOptions{})
+	apiErr, ok := err.(*Error)
+	if !ok || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected a %d error, but got %v", http.StatusServiceUnavailable, err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected %d attempts, but got %d", 3, attempts)
+	}
+}
+
+func TestRequests(t *testing.T) {
+	var got *http.Request
+	var body map[string]map[string]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req
+		json.NewDecoder(req.Body).Decode(&body)
+		w.Write([]byte(`{"message": "User updated successfully.", "data": {"user": {"id": "1"}}}`))
+	}))
+	defer ts.Close()
+
+	c := newTestClient(ts.URL)
+	c.Token = "secret"
+	if _, err := c.PatchUser(context.Background(), "1", UserParams{Name: String("Test")}); err != nil {
+		t.Fatal(err)
+	}
+	if got.Method != "PATCH" || got.URL.Path != "/api/users/1" {
+		t.Errorf("expected PATCH /api/users/1, but got %s %s", got.Method, got.URL.Path)
+	}
+	if got.Header.Get("Accept") != MediaType {
+		t.Errorf("expected Accept to be %s, but got %s", MediaType, got.Header.Get("Accept"))
+	}
+	if got.Header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("expected Authorization to be %s, but got %s", "Bearer secret", got.Header.Get("Authorization"))
+	}
+	if len(body["user"]) != 1 || body["user"]["name"] != "Test" {
+		t.Errorf("expected only the name to be sent, but got %v", body)
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Request-ID", "abc")
+		w.WriteHeader(422)
+		w.Write([]byte(`{"message": "Unable to save user.", "data": {"errors": {"email": ["can't be blank"]}}}`))
+	}))
+	defer ts.Close()
+
+	_, err := newTestClient(ts.URL).CreateUser(context.Background(), UserParams{})
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, but got %v", err)
+	}
+	if verr.Errors.String() != "email can't be blank" {
+		t.Errorf("expected %s, but got %s", "email can't be blank", verr.Errors.String())
+	}
+	if verr.RequestID != "abc" {
+		t.Errorf("expected request id %s, but got %s", "abc", verr.RequestID)
+	}
+}
+
+func TestIterateUsers(t *testing.T) {
+	const total, perPage = 45, 20
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+		var users []User
+		for i := (page - 1) * perPage; i < page*perPage && i < total; i++ {
+			users = append(users, User{ID: fmt.Sprint(i)})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"users": users, "total": total},
+		})
+	}))
+	defer ts.Close()
+
+	it := newTestClient(ts.URL).IterateUsers(context.Background(), ListOptions{})
+	n := 0
+	for it.Next() {
+		if it.User().ID != fmt.Sprint(n) {
+			t.Errorf("expected user %d, but got %s", n, it.User().ID)
+		}
+		n++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != total {
+		t.Errorf("expected %d users, but got %d", total, n)
+	}
+	if requests != 3 {
+		t.Errorf("expected %d requests, but got %d", 3, requests)
+	}
+}
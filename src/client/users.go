@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// User is a user of the API.
+type User struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	Mobile    string    `json:"mobile,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Invited   bool      `json:"invited,omitempty"`
+	// OrganizationID is the ID of the organization of the user.
+	OrganizationID string `json:"organization_id,omitempty"`
+}
+
+// UserParams are the fields of a user to create or update. Fields left
+// nil aren't sent, so updates leave them unchanged.
+type UserParams struct {
+	Name                 *string `json:"name,omitempty"`
+	Username             *string `json:"username,omitempty"`
+	Email                *string `json:"email,omitempty"`
+	Mobile               *string `json:"mobile,omitempty"`
+	Password             *string `json:"password,omitempty"`
+	PasswordConfirmation *string `json:"password_confirmation,omitempty"`
+	// CurrentPassword is asked to the users changing their own password.
+	CurrentPassword *string `json:"current_password,omitempty"`
+}
+
+// String returns a pointer to s, for the fields of UserParams.
+func String(s string) *string {
+	return &s
+}
+
+// ListOptions filter the users listed. Zero values are left out.
+type ListOptions struct {
+	// Page is the page to list, from 1.
+	Page int
+	// Fields are the fields of the users returned, like "id" and "email".
+	// The API returns a compact set of fields when there are none.
+	Fields []string
+}
+
+func (o ListOptions) values() url.Values {
+	v := url.Values{}
+	if o.Page > 0 {
+		v.Set("page", strconv.Itoa(o.Page))
+	}
+	if len(o.Fields) > 0 {
+		v.Set("fields", strings.Join(o.Fields, ","))
+	}
+	return v
+}
+
+// UserPage is a page of users, newest first.
+type UserPage struct {
+	Users []User
+	// Total is the number of users on all the pages.
+	Total int
+}
+
+// ListUsers returns a page of the users.
+func (c *Client) ListUsers(ctx context.Context, opts ListOptions) (*UserPage, error) {
+	env, err := c.do(ctx, "GET", "/api/users", opts.values(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &UserPage{Users: env.Data.Users, Total: env.Data.Total}, nil
+}
+
+// IterateUsers returns an iterator over the users of all the pages,
+// starting with opts.Page.
+//
+//	it := c.IterateUsers(ctx, client.ListOptions{})
+//	for it.Next() {
+//		fmt.Println(it.User().Name)
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+func (c *Client) IterateUsers(ctx context.Context, opts ListOptions) *UserIterator {
+	if opts.Page < 1 {
+		opts.Page = 1
+	}
+	return &UserIterator{c: c, ctx: ctx, opts: opts}
+}
+
+// UserIterator lists the users page by page. The pages are requested
+// while iterating, so users created meanwhile can shift them.
+type UserIterator struct {
+	c    *Client
+	ctx  context.Context
+	opts ListOptions
+	page []User
+	seen int
+	user User
+	done bool
+	err  error
+}
+
+// Next advances to the next user, requesting the next page when needed.
+// It returns false at the end or on an error.
+func (it *UserIterator) Next() bool {
+	if len(it.page) == 0 && !it.done {
+		p, err := it.c.ListUsers(it.ctx, it.opts)
+		if err != nil {
+			it.err = err
+			it.done = true
+			return false
+		}
+		it.page = p.Users
+		it.opts.Page++
+		it.seen += len(p.Users)
+		if len(p.Users) == 0 || it.seen >= p.Total {
+			it.done = true
+		}
+	}
+	if len(it.page) == 0 {
+		return false
+	}
+	it.user, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// User returns the current user.
+func (it *UserIterator) User() User {
+	return it.user
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *UserIterator) Err() error {
+	return it.err
+}
+
+// GetUser returns the user with the id.
+func (c *Client) GetUser(ctx context.Context, id string) (*User, error) {
+	env, err := c.do(ctx, "GET", "/api/users/"+url.PathEscape(id), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return env.Data.User, nil
+}
+
+// CreateUser creates a user. Invalid fields are returned as a
+// *ValidationError.
+func (c *Client) CreateUser(ctx context.Context, params UserParams) (*User, error) {
+	return c.saveUser(ctx, "POST", "/api/users", params)
+}
+
+// UpdateUser updates the fields of params set on the user with the id.
+func (c *Client) UpdateUser(ctx context.Context, id string, params UserParams) (*User, error) {
+	return c.saveUser(ctx, "PUT", "/api/users/"+url.PathEscape(id), params)
+}
+
+// PatchUser is UpdateUser sent with the PATCH method.
+func (c *Client) PatchUser(ctx context.Context, id string, params UserParams) (*User, error) {
+	return c.saveUser(ctx, "PATCH", "/api/users/"+url.PathEscape(id), params)
+}
+
+func (c *Client) saveUser(ctx context.Context, method, path string, params UserParams) (*User, error) {
+	body := struct {
+		User UserParams `json:"user"`
+	}{params}
+	env, err := c.do(ctx, method, path, nil, body)
+	if err != nil {
+		return nil, err
+	}
+	return env.Data.User, nil
+}
+
+// DeleteUser deletes the user with the id.
+func (c *Client) DeleteUser(ctx context.Context, id string) error {
+	_, err := c.do(ctx, "DELETE", "/api/users/"+url.PathEscape(id), nil, nil)
+	return err
+}
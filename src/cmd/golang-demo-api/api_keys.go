@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Scopes of the API, given to the API keys and the OAuth clients.
+const (
+	scopeUsersRead  = "users:read"
+	scopeUsersWrite = "users:write"
+	// scopeAdmin gives the keys of the organization and of the admins the
+	// admin role, only to manage the API keys. OAuth clients can't have it.
+	scopeAdmin = "admin"
+)
+
+var apiScopes = []string{scopeUsersRead, scopeUsersWrite, scopeAdmin}
+
+// apiKeyPrefix starts the API keys, so they can be told from the access
+// tokens and found by secret scanners.
+const apiKeyPrefix = "dak_"
+
+const (
+	// defaultKeyOverlap is how long a rotated key keeps working, so its
+	// users can switch to the new one.
+	defaultKeyOverlap = 24 * time.Hour
+	maxKeyOverlap     = 30 * 24 * time.Hour
+	// keyUsageInterval is how often the last use of a key is saved.
+	keyUsageInterval = time.Minute
+)
+
+// apiKey lets a service call the API without the credentials of a user.
+// It is owned by a user, or by the organization when UserID is empty.
+type apiKey struct {
+	ID             bson.ObjectId `bson:"_id" json:"id"`
+	OrganizationID bson.ObjectId `bson:"organization_id" json:"-"`
+	UserID         bson.ObjectId `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	Name           string        `bson:"name" json:"name"`
+	// Prefix is the start of the key, to tell the keys apart.
+	Prefix string   `bson:"prefix" json:"prefix"`
+	Digest string   `bson:"digest" json:"-"`
+	Scopes []string `bson:"scopes" json:"scopes"`
+	// AllowedIPs are the addresses or CIDR ranges the key can be used
+	// from, any when empty.
+	AllowedIPs []string   `bson:"allowed_ips,omitempty" json:"allowed_ips,omitempty"`
+	ExpiresAt  *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	LastUsedIP string     `bson:"last_used_ip,omitempty" json:"last_used_ip,omitempty"`
+	// RotatedTo is the key replacing this one, which works until
+	// ExpiresAt.
+	RotatedTo bson.ObjectId `bson:"rotated_to,omitempty" json:"rotated_to,omitempty"`
+	CreatedAt time.Time     `bson:"created_at" json:"created_at"`
+	// Key is only returned on creation and rotation.
+	Key    string      `bson:"-" json:"key,omitempty"`
+	Errors ModelErrors `bson:"-" json:"errors,omitempty"`
+}
+
+type newAPIKey struct {
+	Name       *string    `json:"name,omitempty"`
+	UserID     *string    `json:"user_id,omitempty"`
+	Scopes     *[]string  `json:"scopes,omitempty"`
+	AllowedIPs *[]string  `json:"allowed_ips,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+// APIKeys represents a collection of apiKey objects
+type APIKeys []apiKey
+
+func init() {
+	keysRouter := router.Path("/api/api_keys").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Subrouter()
+
+	keysRouter.Methods("GET").Handler(requireScope(scopeAdmin, requireAdmin(apiKeysHandler)))
+	keysRouter.Methods("POST").Handler(requireScope(scopeAdmin, requireAdmin(createAPIKeyHandler)))
+
+	keyRouter := router.Path("/api/api_keys/{id}").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Subrouter()
+
+	keyRouter.Methods("GET").Handler(requireScope(scopeAdmin, requireAdmin(showAPIKeyHandler)))
+	keyRouter.Methods("DELETE").Handler(requireScope(scopeAdmin, requireAdmin(deleteAPIKeyHandler)))
+
+	router.Path("/api/api_keys/{id}/rotate").
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("POST").
+		Handler(requireScope(scopeAdmin, requireAdmin(rotateAPIKeyHandler)))
+
+	// the keys of deleted users are revoked, whatever deleted them
+	onUserEvent(func(e userEvent) {
+		if e.Type == userDeleted {
+			if _, err := config.apiKeysCollection.RemoveAll(bson.M{"user_id": e.User.ID}); err != nil {
+				log.Println(err)
+			}
+		}
+	})
+
+	keyID := pathParam("id", "ID of the API key")
+	documentOperations(
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/api_keys",
+			OperationID: "listAPIKeys",
+			Summary:     "Returns the API keys of the organization, newest first.",
+			Tags:        []string{"api_keys"},
+			Parameters:  []*openAPIParameter{queryParam("user_id", "Only the keys owned by this user", objectIDSchema)},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK)),
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/api_keys",
+			OperationID: "createAPIKey",
+			Summary:     "Creates an API key. The key is only returned here.",
+			Tags:        []string{"api_keys"},
+			RequestBody: jsonBody(struct {
+				APIKey newAPIKey `json:"api_key"`
+			}{}),
+			Responses: adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422)),
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/api_keys/{id}",
+			OperationID: "showAPIKey",
+			Summary:     "Returns an API key, with when it was last used.",
+			Tags:        []string{"api_keys"},
+			Parameters:  []*openAPIParameter{keyID},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+		&openAPIOperation{
+			Method:      "DELETE",
+			Path:        "/api/api_keys/{id}",
+			OperationID: "deleteAPIKey",
+			Summary:     "Revokes an API key.",
+			Tags:        []string{"api_keys"},
+			Parameters:  []*openAPIParameter{keyID},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/api_keys/{id}/rotate",
+			OperationID: "rotateAPIKey",
+			Summary:     "Replaces an API key by a new one, the old one working for a while longer.",
+			Tags:        []string{"api_keys"},
+			Parameters: []*openAPIParameter{
+				keyID,
+				queryParam("overlap", "Seconds the old key keeps working, a day by default", &openAPISchema{Type: "integer"}),
+			},
+			Responses: adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422)),
+		},
+	)
+}
+
+// ensureAPIKeyIndexes creates the indexes of the API keys. Expired keys
+// are listed for a week, then removed.
+func ensureAPIKeyIndexes() error {
+	if err := config.apiKeysCollection.EnsureIndex(mgo.Index{Key: []string{"digest"}, Unique: true}); err != nil {
+		return err
+	}
+	if err := config.apiKeysCollection.EnsureIndexKey("organization_id", "-_id"); err != nil {
+		return err
+	}
+	if err := config.apiKeysCollection.EnsureIndexKey("user_id"); err != nil {
+		return err
+	}
+	return config.apiKeysCollection.EnsureIndex(mgo.Index{Key: []string{"expires_at"}, ExpireAfter: 7 * 24 * time.Hour})
+}
+
+// Create saves the key with a new secret, returned once in Key.
+func (k *apiKey) Create() error {
+	k.ID = bson.NewObjectId()
+	if !k.Valid() {
+		return errors.New("API Key Invalid")
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	k.Key = apiKeyPrefix + secret
+	k.Prefix = k.Key[:len(apiKeyPrefix)+8]
+	k.Digest = hashToken(k.Key)
+	k.CreatedAt = k.ID.Time()
+	return config.apiKeysCollection.Insert(k)
+}
+
+// Valid checks the fields of the key. The owner is checked by the
+// handlers.
+func (k *apiKey) Valid() bool {
+	k.Errors = make(ModelErrors)
+	if strings.TrimSpace(k.Name) == "" {
+		k.Errors["name"] = append(k.Errors["name"], "can't be blank")
+	}
+	if len(k.Scopes) == 0 {
+		k.Errors["scopes"] = append(k.Errors["scopes"], "can't be blank")
+	}
+	for _, s := range k.Scopes {
+		if !containsString(apiScopes, s) {
+			k.Errors["scopes"] = append(k.Errors["scopes"], "must be any of "+strings.Join(apiScopes, ", "))
+			break
+		}
+	}
+	for _, ip := range k.AllowedIPs {
+		if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+			k.Errors["allowed_ips"] = append(k.Errors["allowed_ips"], ip+" is not an IP address or a CIDR range")
+		}
+	}
+	if k.ExpiresAt != nil && !k.ExpiresAt.After(bson.Now()) {
+		k.Errors["expires_at"] = append(k.Errors["expires_at"], "must be in the future")
+	}
+	return len(k.Errors) == 0
+}
+
+func (k *apiKey) copyFields(nk newAPIKey) {
+	if nk.Name != nil {
+		k.Name = *nk.Name
+	}
+	if nk.Scopes != nil {
+		k.Scopes = *nk.Scopes
+	}
+	if nk.AllowedIPs != nil {
+		k.AllowedIPs = *nk.AllowedIPs
+	}
+	if nk.ExpiresAt != nil {
+		k.ExpiresAt = nk.ExpiresAt
+	}
+}
+
+// expired tells whether the key stopped working at now.
+func (k *apiKey) expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// allows tells whether the key can be used from ip.
+func (k *apiKey) allows(ip string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	for _, allowed := range k.AllowedIPs {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if addr != nil && network.Contains(addr) {
+				return true
+			}
+		} else if a := net.ParseIP(allowed); a != nil && a.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyActor returns the actor of a request made with key, nil when the
+// key is unknown, expired, used from an address it doesn't allow or owned
+// by a deleted user. Only the keys with the admin scope have a role, the
+// one of their user or admin for the organization ones. The last use of
+// the key is saved.
+func apiKeyActor(req *http.Request, key string) (*actor, error) {
+	var k apiKey
+	err := config.apiKeysCollection.Find(bson.M{"digest": hashToken(key)}).One(&k)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	now := bson.Now()
+	ip := clientIP(req)
+	if k.expired(now) || !k.allows(ip) {
+		return nil, nil
+	}
+
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= keyUsageInterval || k.LastUsedIP != ip {
+		err = config.apiKeysCollection.UpdateId(k.ID, bson.M{"$set": bson.M{"last_used_at": now, "last_used_ip": ip}})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	role := roleAdmin
+	if k.UserID != "" {
+		var u user
+		err = config.usersCollection.FindId(k.UserID).Select(bson.M{"role": 1}).One(&u)
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		role = u.Role
+	}
+	a := &actor{Type: actorAPIKey, ID: k.ID.Hex(), OrganizationID: k.OrganizationID, Scopes: k.Scopes, Scoped: true}
+	if containsString(k.Scopes, scopeAdmin) {
+		a.Role = role
+	}
+	return a, nil
+}
+
+// apiKeysHandler returns the API keys of the organization.
+// URL: GET /api/api_keys
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"user_id": Only the keys owned by this user
+func apiKeysHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	filter := bson.M{"organization_id": requestOrganization(req).ID}
+	if id := req.URL.Query().Get("user_id"); bson.IsObjectIdHex(id) {
+		filter["user_id"] = bson.ObjectIdHex(id)
+	}
+	var keys APIKeys
+	if err := config.apiKeysCollection.Find(filter).Sort("-_id").All(&keys); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := response{data: &data{Total: len(keys), APIKeys: keys}}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// createAPIKeyHandler creates an API key, owned by the organization
+// unless a user is given. The response holds the key, it can't be read
+// again afterwards. Send it in the "X-API-Key" header, or as a bearer
+// token in the "Authorization" header.
+// URL: POST /api/api_keys
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// BODY:
+//	api_key[name]: What the key is used for. (required)
+//	api_key[scopes]: Any of users:read and users:write. (required)
+//	api_key[user_id]: ID of the user owning the key.
+//	api_key[allowed_ips]: Addresses or CIDR ranges the key can be used
+//	from, any by default.
+//	api_key[expires_at]: When the key stops working, never by default.
+// EXAMPLE:
+//	{
+//		"api_key": {
+//			"name": "Nightly sync",
+//			"scopes": ["users:read"],
+//			"allowed_ips": ["10.0.0.0/8"],
+//			"expires_at": "2027-01-01T00:00:00Z"
+//		}
+//	}
+func createAPIKeyHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var params struct {
+		APIKey newAPIKey `json:"api_key"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&params); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	orgID := requestOrganization(req).ID
+	k := &apiKey{OrganizationID: orgID}
+	k.copyFields(params.APIKey)
+	if a := requestActor(req); a.Scoped && !scopesWithin(k.Scopes, a.Scopes) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(response{Message: "The credentials can't give more scopes than their own."})
+		return
+	}
+	var err error
+	if params.APIKey.UserID != nil {
+		var u *user
+		if u, err = loadUser(orgID, *params.APIKey.UserID); err == nil {
+			k.UserID = u.ID
+		}
+	}
+	if err == nil {
+		err = k.Create()
+	} else {
+		k.Valid()
+		k.Errors["user_id"] = append(k.Errors["user_id"], "is not a user of the organization")
+	}
+
+	var resp *response
+	if err != nil {
+		log.Println(err)
+		resp = &response{
+			Message: "Unable to save API key. Please correct the errors and try again.",
+			data:    &data{Errors: k.Errors},
+		}
+		w.WriteHeader(422)
+	} else {
+		resp = &response{Message: "API key successfully created. Keep the key, it won't be shown again.", data: &data{apiKey: k}}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// showAPIKeyHandler returns an API key, without the key.
+// URL: GET /api/api_keys/:id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the API key
+func showAPIKeyHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var resp *response
+	if k, err := loadAPIKey(requestOrganization(req).ID, mux.Vars(req)["id"]); err != nil {
+		log.Println(err)
+		resp = &response{Message: "API key not found."}
+		w.WriteHeader(422)
+	} else {
+		resp = &response{data: &data{apiKey: k}}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// deleteAPIKeyHandler revokes an API key at once.
+// URL: DELETE /api/api_keys/:id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the API key
+func deleteAPIKeyHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var resp *response
+	if k, err := loadAPIKey(requestOrganization(req).ID, mux.Vars(req)["id"]); err != nil {
+		log.Println(err)
+		resp = &response{Message: "API key not found."}
+		w.WriteHeader(422)
+	} else if err = config.apiKeysCollection.RemoveId(k.ID); err != nil {
+		log.Println(err)
+		resp = &response{Message: "Unable to delete API key."}
+		w.WriteHeader(422)
+	} else {
+		resp = &response{Message: "API key deleted successfully."}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// rotateAPIKeyHandler replaces an API key by a new one with the same
+// owner, scopes, addresses and expiry. The old key keeps working for the
+// overlap, so the services using it can switch without downtime.
+// URL: POST /api/api_keys/:id/rotate
+// HEADERS:
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the API key
+//	"overlap": Seconds the old key keeps working, 86400 (a day) by
+//	default and 0 to revoke it at once
+func rotateAPIKeyHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	overlap := defaultKeyOverlap
+	if s := req.URL.Query().Get("overlap"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxKeyOverlap {
+			w.WriteHeader(http.StatusBadRequest)
+			encoder.Encode(response{Message: "The overlap must be between 0 and " + strconv.Itoa(int(maxKeyOverlap.Seconds())) + " seconds."})
+			return
+		}
+		overlap = time.Duration(seconds) * time.Second
+	}
+
+	old, err := loadAPIKey(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "API key not found."})
+		return
+	}
+	now := bson.Now()
+	if old.expired(now) || old.RotatedTo != "" {
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "The API key expired or was already rotated."})
+		return
+	}
+	if a := requestActor(req); a.Scoped && !scopesWithin(old.Scopes, a.Scopes) {
+		w.WriteHeader(http.StatusForbidden)
+		encoder.Encode(response{Message: "The credentials can't rotate a key with more scopes than their own."})
+		return
+	}
+
+	k := &apiKey{
+		OrganizationID: old.OrganizationID,
+		UserID:         old.UserID,
+		Name:           old.Name,
+		Scopes:         old.Scopes,
+		AllowedIPs:     old.AllowedIPs,
+		ExpiresAt:      old.ExpiresAt,
+	}
+	if err = k.Create(); err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "Unable to rotate API key.", data: &data{Errors: k.Errors}})
+		return
+	}
+	until := now.Add(overlap)
+	if old.ExpiresAt != nil && old.ExpiresAt.Before(until) {
+		until = *old.ExpiresAt
+	}
+	err = config.apiKeysCollection.UpdateId(old.ID, bson.M{"$set": bson.M{"rotated_to": k.ID, "expires_at": until}})
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err = encoder.Encode(response{Message: "API key rotated. Keep the new key, it won't be shown again.", data: &data{apiKey: k}}); err != nil {
+		log.Println(err)
+	}
+}
+
+// loadAPIKey loads a key of the organization.
+func loadAPIKey(orgID bson.ObjectId, id string) (*apiKey, error) {
+	var k apiKey
+	if !bson.IsObjectIdHex(id) {
+		return &k, errors.New("Invalid API key id.")
+	}
+	err := config.apiKeysCollection.Find(bson.M{"_id": bson.ObjectIdHex(id), "organization_id": orgID}).One(&k)
+	return &k, err
+}
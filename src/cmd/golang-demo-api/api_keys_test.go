@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAPIKeyValid(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	k := &apiKey{
+		ID:         bson.NewObjectId(),
+		Scopes:     []string{scopeUsersRead, "users:admin"},
+		AllowedIPs: []string{"10.0.0.0/8", "::1", "localhost"},
+		ExpiresAt:  &past,
+	}
+	if k.Valid() {
+		t.Fatalf("expected the key to be invalid")
+	}
+	for _, field := range []string{"name", "scopes", "allowed_ips", "expires_at"} {
+		if len(k.Errors[field]) != 1 {
+			t.Errorf("expected an error on %s, but got %v", field, k.Errors)
+		}
+	}
+
+	future := time.Now().Add(time.Hour)
+	k = &apiKey{ID: bson.NewObjectId(), Name: "Sync", Scopes: apiScopes, AllowedIPs: []string{"10.0.0.0/8", "::1"}, ExpiresAt: &future}
+	if !k.Valid() {
+		t.Errorf("expected the key to be valid, but got %v", k.Errors)
+	}
+}
+
+func TestAPIKeyAllows(t *testing.T) {
+	k := &apiKey{}
+	if !k.allows("192.0.2.1") {
+		t.Errorf("expected keys without addresses to be allowed anywhere")
+	}
+	k.AllowedIPs = []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}
+	for ip, allowed := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.0.2.1":   true,
+		"192.0.2.2":   false,
+		"2001:db8::1": true,
+		"::1":         false,
+		"unknown":     false,
+	} {
+		if k.allows(ip) != allowed {
+			t.Errorf("expected %s allowed to be %v", ip, allowed)
+		}
+	}
+}
+
+func TestAPIKeyExpired(t *testing.T) {
+	now := time.Now()
+	k := &apiKey{}
+	if k.expired(now) {
+		t.Errorf("expected keys without expiry to never expire")
+	}
+	k.ExpiresAt = &now
+	if !k.expired(now) || k.expired(now.Add(-time.Second)) {
+		t.Errorf("expected the key to expire at %v", now)
+	}
+}
+
+// apiKeyRequest makes a request with key in the "X-API-Key" header.
+func apiKeyRequest(t *testing.T, method, url, key, body string) int {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	req.Header.Set("Accept", apiContentType)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func createAPIKey(t *testing.T, adminURL, body string) *apiKey {
+	status, r := doOrganizationRequest(t, "POST", adminURL+"/api/api_keys", body)
+	if status != http.StatusOK || r.apiKey == nil {
+		t.Fatalf("expected the key to be created, but got %d %v", status, r.Errors)
+	}
+	return r.apiKey
+}
+
+func TestAPIKeys(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	admin := actorServer(actor{Type: actorUser, Role: roleAdmin, OrganizationID: defaultOrganization.ID})
+	defer admin.Close()
+	u := setupUser(t)
+
+	status, r := doOrganizationRequest(t, "POST", admin.URL+"/api/api_keys", `{"api_key":{"name":"Sync","scopes":["users:admin"],"user_id":"`+bson.NewObjectId().Hex()+`"}}`)
+	if status != 422 || len(r.Errors["scopes"]) == 0 || len(r.Errors["user_id"]) == 0 {
+		t.Errorf("expected the key to be refused, but got %d %v", status, r.Errors)
+	}
+
+	k := createAPIKey(t, admin.URL, `{"api_key":{"name":"Sync","scopes":["users:read"],"allowed_ips":["127.0.0.1"]}}`)
+	if len(k.Key) <= len(apiKeyPrefix) || k.Key[:len(k.Prefix)] != k.Prefix {
+		t.Fatalf("expected the key, but got %+v", k)
+	}
+	status, r = doOrganizationRequest(t, "GET", admin.URL+"/api/api_keys/"+k.ID.Hex(), "")
+	if status != http.StatusOK || r.apiKey == nil || r.apiKey.Key != "" || r.apiKey.LastUsedAt != nil {
+		t.Errorf("expected the unused key without its secret, but got %d %+v", status, r.apiKey)
+	}
+
+	// the key only allows reading
+	if status = apiKeyRequest(t, "GET", ts.URL+"/api/users/"+u.ID.Hex(), k.Key, ""); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	if status, _ := bearerRequest(t, "GET", ts.URL+"/api/users", k.Key); status != http.StatusOK {
+		t.Errorf("expected the key to be accepted as a bearer token, but got %d", status)
+	}
+	if status = apiKeyRequest(t, "DELETE", ts.URL+"/api/users/"+u.ID.Hex(), k.Key, ""); status != http.StatusForbidden {
+		t.Errorf("expected the users:write scope to be required, but got %d", status)
+	}
+	if status = apiKeyRequest(t, "GET", ts.URL+"/api/api_keys", k.Key, ""); status != http.StatusForbidden {
+		t.Errorf("expected keys without the admin scope not to be admins, but got %d", status)
+	}
+	// the routes without scope are closed to the keys
+	mutation := `{"query":"mutation { createUser(input: {name: \"Key User\", username: \"key_user\", email: \"key@sample.com\"}) { user { id } } }"}`
+	if status = apiKeyRequest(t, "POST", ts.URL+"/graphql", k.Key, mutation); status != http.StatusForbidden {
+		t.Errorf("expected the GraphQL API to be refused, but got %d", status)
+	}
+	if n, _ := config.usersCollection.Find(bson.M{"username": "key_user"}).Count(); n != 0 {
+		t.Errorf("expected no user to be created, but got %d", n)
+	}
+	if status = apiKeyRequest(t, "POST", ts.URL+"/api/api_keys", k.Key, `{"api_key":{"name":"Escalated","scopes":["users:write"]}}`); status != http.StatusForbidden {
+		t.Errorf("expected the key not to create keys, but got %d", status)
+	}
+	status, r = doOrganizationRequest(t, "GET", admin.URL+"/api/api_keys/"+k.ID.Hex(), "")
+	if status != http.StatusOK || r.apiKey.LastUsedAt == nil || r.apiKey.LastUsedIP != "127.0.0.1" {
+		t.Errorf("expected the last use of the key, but got %d %+v", status, r.apiKey)
+	}
+
+	elsewhere := createAPIKey(t, admin.URL, `{"api_key":{"name":"Elsewhere","scopes":["users:read"],"allowed_ips":["10.0.0.0/8"]}}`)
+	if status = apiKeyRequest(t, "GET", ts.URL+"/api/users", elsewhere.Key, ""); status != http.StatusUnauthorized {
+		t.Errorf("expected the address to be refused, but got %d", status)
+	}
+	if status = apiKeyRequest(t, "GET", ts.URL+"/api/users", apiKeyPrefix+"wrong", ""); status != http.StatusUnauthorized {
+		t.Errorf("expected %d, but got %d", http.StatusUnauthorized, status)
+	}
+
+	// the rotated key works until the end of the overlap
+	status, r = doOrganizationRequest(t, "POST", admin.URL+"/api/api_keys/"+k.ID.Hex()+"/rotate", "")
+	if status != http.StatusOK || r.apiKey == nil || r.apiKey.Key == "" || r.apiKey.Name != k.Name {
+		t.Fatalf("expected a new key, but got %d %+v", status, r.apiKey)
+	}
+	rotated := r.apiKey
+	for _, key := range []string{k.Key, rotated.Key} {
+		if status = apiKeyRequest(t, "GET", ts.URL+"/api/users", key, ""); status != http.StatusOK {
+			t.Errorf("expected both keys to work during the overlap, but got %d", status)
+		}
+	}
+	status, r = doOrganizationRequest(t, "GET", admin.URL+"/api/api_keys/"+k.ID.Hex(), "")
+	if r.apiKey == nil || r.apiKey.RotatedTo != rotated.ID || r.apiKey.ExpiresAt == nil {
+		t.Errorf("expected the key to be rotated, but got %d %+v", status, r.apiKey)
+	}
+	if status, _ = doOrganizationRequest(t, "POST", admin.URL+"/api/api_keys/"+k.ID.Hex()+"/rotate", ""); status != 422 {
+		t.Errorf("expected a rotated key not to be rotated again, but got %d", status)
+	}
+	if status, _ = doOrganizationRequest(t, "POST", admin.URL+"/api/api_keys/"+rotated.ID.Hex()+"/rotate?overlap=-1", ""); status != http.StatusBadRequest {
+		t.Errorf("expected %d, but got %d", http.StatusBadRequest, status)
+	}
+	// without overlap the old key stops at once
+	status, r = doOrganizationRequest(t, "POST", admin.URL+"/api/api_keys/"+rotated.ID.Hex()+"/rotate?overlap=0", "")
+	if status != http.StatusOK || r.apiKey == nil {
+		t.Fatalf("expected a new key, but got %d", status)
+	}
+	if status = apiKeyRequest(t, "GET", ts.URL+"/api/users", rotated.Key, ""); status != http.StatusUnauthorized {
+		t.Errorf("expected the rotated key to be expired, but got %d", status)
+	}
+	if status = apiKeyRequest(t, "GET", ts.URL+"/api/users", r.apiKey.Key, ""); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+
+	// keys with the admin scope manage keys, without giving more scopes
+	manager := createAPIKey(t, admin.URL, `{"api_key":{"name":"Manager","scopes":["admin","users:read"]}}`)
+	if status = apiKeyRequest(t, "GET", ts.URL+"/api/api_keys", manager.Key, ""); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	if status = apiKeyRequest(t, "POST", ts.URL+"/api/api_keys", manager.Key, `{"api_key":{"name":"Escalated","scopes":["users:write"]}}`); status != http.StatusForbidden {
+		t.Errorf("expected wider scopes to be refused, but got %d", status)
+	}
+	if status = apiKeyRequest(t, "POST", ts.URL+"/api/api_keys", manager.Key, `{"api_key":{"name":"Reader","scopes":["users:read"]}}`); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	writer := createAPIKey(t, admin.URL, `{"api_key":{"name":"Writer","scopes":["users:write"]}}`)
+	if status = apiKeyRequest(t, "POST", ts.URL+"/api/api_keys/"+writer.ID.Hex()+"/rotate", manager.Key, ""); status != http.StatusForbidden {
+		t.Errorf("expected keys with wider scopes not to be rotated, but got %d", status)
+	}
+
+	// keys can be owned by a user
+	owned := createAPIKey(t, admin.URL, `{"api_key":{"name":"Owned","scopes":["users:read","users:write"],"user_id":"`+u.ID.Hex()+`"}}`)
+	if owned.UserID != u.ID {
+		t.Errorf("expected the key to be owned by %s, but got %s", u.ID.Hex(), owned.UserID.Hex())
+	}
+	status, r = doOrganizationRequest(t, "GET", admin.URL+"/api/api_keys?user_id="+u.ID.Hex(), "")
+	if status != http.StatusOK || len(r.APIKeys) != 1 {
+		t.Errorf("expected the keys of the user, but got %d %d", status, len(r.APIKeys))
+	}
+
+	if status, _ = doOrganizationRequest(t, "DELETE", admin.URL+"/api/api_keys/"+owned.ID.Hex(), ""); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	if status = apiKeyRequest(t, "GET", ts.URL+"/api/users", owned.Key, ""); status != http.StatusUnauthorized {
+		t.Errorf("expected the deleted key to be refused, but got %d", status)
+	}
+
+	dropAllCollections(t)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Actions recorded in the audit log.
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRestore = "restore"
+	auditLock    = "lock"
+	auditUnlock  = "unlock"
+)
+
+// auditEvent records a change of a user. Events are only ever inserted.
+type auditEvent struct {
+	ID              bson.ObjectId `bson:"_id" json:"id"`
+	Action          string        `bson:"action" json:"action"`
+	Resource        string        `bson:"resource" json:"resource"`
+	ResourceID      bson.ObjectId `bson:"resource_id" json:"resource_id"`
+	OrganizationID  bson.ObjectId `bson:"organization_id" json:"-"`
+	Actor           actor         `bson:"actor" json:"actor"`
+	RequestID       string        `bson:"request_id,omitempty" json:"request_id,omitempty"`
+	ClientIP        string        `bson:"client_ip,omitempty" json:"client_ip,omitempty"`
+	Changes         []fieldChange `bson:"changes,omitempty" json:"changes,omitempty"`
+	PasswordChanged bool          `bson:"password_changed,omitempty" json:"password_changed,omitempty"`
+	CreatedAt       time.Time     `bson:"created_at" json:"created_at"`
+}
+
+// fieldChange is the value of a field before and after a change.
+type fieldChange struct {
+	Field  string      `bson:"field" json:"field"`
+	Before interface{} `bson:"before,omitempty" json:"before,omitempty"`
+	After  interface{} `bson:"after,omitempty" json:"after,omitempty"`
+}
+
+// AuditEvents represents a list of audit events
+type AuditEvents []auditEvent
+
+// unauditedFields are the user fields left out of the changes.
+// The password digest is only recorded as PasswordChanged and the
+// organization, which doesn't change, as OrganizationID.
+var unauditedFields = map[string]bool{
+	"_id":                   true,
+	"organization_id":       true,
+	"password_digest":       true,
+	"updated_at":            true,
+	"failed_logins":         true,
+	"last_failed_login_at":  true,
+	"locked_until":          true,
+	"totp_secret":           true,
+	"totp_last_counter":     true,
+	"recovery_code_digests": true,
+}
+
+func init() {
+	router.Path("/api/users/{id}/audit").
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("GET").
+		HandlerFunc(requireAdmin(userAuditHandler))
+
+	router.Path("/api/users/{id}/restore").
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("POST").
+		HandlerFunc(requireAdmin(restoreUserHandler))
+
+	router.Path("/api/audit").
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("GET").
+		HandlerFunc(requireAdmin(auditHandler))
+
+	userID := pathParam("id", "ID of the user")
+	documentOperations(
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/users/{id}/audit",
+			OperationID: "userAudit",
+			Summary:     "Returns the audit events of a user, latest first.",
+			Tags:        []string{"audit"},
+			Parameters:  []*openAPIParameter{userID, pageParam},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/users/{id}/restore",
+			OperationID: "restoreUser",
+			Summary:     "Restores a deleted user from the audit log, as invited.",
+			Tags:        []string{"audit"},
+			Parameters:  []*openAPIParameter{userID},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/audit",
+			OperationID: "listAuditEvents",
+			Summary:     "Returns the audit events matching the filters, latest first.",
+			Tags:        []string{"audit"},
+			Parameters: []*openAPIParameter{
+				pageParam,
+				queryParam("action", "Action of the events", &openAPISchema{Type: "string", Enum: []string{auditCreate, auditUpdate, auditDelete, auditRestore, auditLock, auditUnlock}}),
+				queryParam("resource_id", "ID of the changed user", objectIDSchema),
+				queryParam("actor_id", "ID of who made the changes", &openAPISchema{Type: "string"}),
+				queryParam("request_id", "ID of the request that made the changes", &openAPISchema{Type: "string"}),
+				queryParam("from", "Only events at or after this time", dateTimeSchema),
+				queryParam("to", "Only events before this time", dateTimeSchema),
+			},
+			Responses: adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest)),
+		},
+	)
+}
+
+// ensureAuditIndexes creates the indexes used to list audit events.
+func ensureAuditIndexes() error {
+	indexes := [][]string{
+		{"organization_id", "-_id"},
+		{"resource", "resource_id", "-_id"},
+		{"actor.id", "-_id"},
+		{"request_id"},
+		{"created_at"},
+	}
+	for _, key := range indexes {
+		if err := config.auditCollection.EnsureIndexKey(key...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditUserChange records the change of a user made by the request.
+// before is nil for created users and after is nil for deleted users.
+func auditUserChange(req *http.Request, action string, before, after *user) {
+	event := newAuditEvent(req, action, before, after)
+	if err := config.auditCollection.Insert(event); err != nil {
+		log.Println(err)
+	}
+}
+
+// auditUsersCreated records the creation of many users at once.
+func auditUsersCreated(req *http.Request, users []*user) {
+	for start := 0; start < len(users); start += bulkBatchSize {
+		end := start + bulkBatchSize
+		if end > len(users) {
+			end = len(users)
+		}
+		bulk := config.auditCollection.Bulk()
+		for _, u := range users[start:end] {
+			bulk.Insert(newAuditEvent(req, auditCreate, nil, u))
+		}
+		if _, err := bulk.Run(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func newAuditEvent(req *http.Request, action string, before, after *user) *auditEvent {
+	event := &auditEvent{
+		ID:        bson.NewObjectId(),
+		Action:    action,
+		Resource:  "user",
+		Actor:     requestActor(req),
+		RequestID: requestID(req),
+		ClientIP:  clientIP(req),
+		CreatedAt: bson.Now(),
+	}
+	if before != nil {
+		event.ResourceID, event.OrganizationID = before.ID, before.OrganizationID
+	} else {
+		event.ResourceID, event.OrganizationID = after.ID, after.OrganizationID
+	}
+	event.Changes, event.PasswordChanged = diffUsers(before, after)
+	return event
+}
+
+// diffUsers returns the saved fields that differ between before and after,
+// by their bson names. Either user can be nil.
+func diffUsers(before, after *user) (changes []fieldChange, passwordChanged bool) {
+	var b, a reflect.Value
+	if before != nil {
+		b = reflect.ValueOf(before).Elem()
+	}
+	if after != nil {
+		a = reflect.ValueOf(after).Elem()
+	}
+
+	t := reflect.TypeOf(user{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("bson"), ",")[0]
+		if name == "-" || name == "" {
+			continue
+		}
+		if name == "password_digest" {
+			var old string
+			if before != nil {
+				old = before.PasswordDigest
+			}
+			passwordChanged = after != nil && after.PasswordDigest != old
+			continue
+		}
+		if unauditedFields[name] {
+			continue
+		}
+
+		var change = fieldChange{Field: name}
+		if b.IsValid() && !isZero(b.Field(i)) {
+			change.Before = b.Field(i).Interface()
+		}
+		if a.IsValid() && !isZero(a.Field(i)) {
+			change.After = a.Field(i).Interface()
+		}
+		if !reflect.DeepEqual(change.Before, change.After) {
+			changes = append(changes, change)
+		}
+	}
+	return
+}
+
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// userAuditHandler returns the audit events of a user, latest first.
+// URL: GET /api/users/:id/audit
+// HEADERS:
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the user
+//	"page": Current page number(per page 20 records)
+func userAuditHandler(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	if !bson.IsObjectIdHex(id) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(422)
+		json.NewEncoder(w).Encode(response{Message: "User not found."})
+		return
+	}
+	writeAuditEvents(w, req, bson.M{"resource": "user", "resource_id": bson.ObjectIdHex(id)})
+}
+
+// auditHandler returns the audit events matching the filters, latest first.
+// URL: GET /api/audit
+// HEADERS:
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"page": Current page number(per page 20 records)
+//	"action": One of create, update, delete, restore, lock and unlock
+//	"resource_id": ID of the changed user
+//	"actor_id": ID of who made the changes
+//	"request_id": ID of the request that made the changes
+//	"from", "to": Only events in this RFC 3339 time range
+func auditHandler(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	filter := bson.M{}
+	if action := params.Get("action"); action != "" {
+		filter["action"] = action
+	}
+	if id := params.Get("resource_id"); bson.IsObjectIdHex(id) {
+		filter["resource_id"] = bson.ObjectIdHex(id)
+	}
+	if id := params.Get("actor_id"); id != "" {
+		filter["actor.id"] = id
+	}
+	if id := params.Get("request_id"); id != "" {
+		filter["request_id"] = id
+	}
+
+	createdAt := bson.M{}
+	for param, op := range map[string]string{"from": "$gte", "to": "$lt"} {
+		if v := params.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(response{Message: "Invalid " + param + ", expected an RFC 3339 time."})
+				return
+			}
+			createdAt[op] = t
+		}
+	}
+	if len(createdAt) > 0 {
+		filter["created_at"] = createdAt
+	}
+	writeAuditEvents(w, req, filter)
+}
+
+// writeAuditEvents writes the page of the events of the organization of
+// the request matching filter.
+func writeAuditEvents(w http.ResponseWriter, req *http.Request, filter bson.M) {
+	w.Header().Set("Content-Type", "application/json")
+	filter["organization_id"] = requestOrganization(req).ID
+
+	var events AuditEvents
+	var offset int
+	page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+	if page != 0 {
+		offset = (page - 1) * perPage
+	}
+	err := config.auditCollection.Find(filter).Sort("-_id").Limit(perPage).Skip(offset).All(&events)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	total, err := config.auditCollection.Find(filter).Count()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := response{data: &data{Total: total, AuditEvents: events}}
+	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// restoreUserHandler brings back a deleted user from its audit log.
+// The password isn't in the log, so the user is restored as invited and
+// has to set a new password.
+// URL: POST /api/users/:id/restore
+// HEADERS:
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the deleted user
+func restoreUserHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	u, err := deletedUser(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "Deleted user not found."})
+		return
+	}
+
+	if !u.Valid() {
+		w.WriteHeader(422)
+		encoder.Encode(response{
+			Message: "Unable to restore user. Please correct the errors and try again.",
+			data:    &data{Errors: u.Errors},
+		})
+		return
+	}
+	if err = u.checkQuota(); err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{
+			Message: "Unable to restore user. Please correct the errors and try again.",
+			data:    &data{Errors: u.Errors},
+		})
+		return
+	}
+	u.UpdatedAt = bson.Now()
+	if err = config.usersCollection.Insert(u); err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "Unable to restore user."})
+		return
+	}
+	userChanged(req, auditRestore, nil, u)
+
+	w.WriteHeader(http.StatusOK)
+	if err = encoder.Encode(response{Message: "User restored successfully.", data: &data{User: u}}); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// deletedUser rebuilds a deleted user of the organization from the
+// changes of its last delete event.
+func deletedUser(orgID bson.ObjectId, id string) (*user, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, errors.New("Invalid user id.")
+	}
+	objectID := bson.ObjectIdHex(id)
+	if n, _ := config.usersCollection.FindId(objectID).Count(); n > 0 {
+		return nil, errors.New("User " + id + " isn't deleted.")
+	}
+
+	var event auditEvent
+	err := config.auditCollection.
+		Find(bson.M{"resource": "user", "resource_id": objectID, "organization_id": orgID, "action": auditDelete}).
+		Sort("-_id").One(&event)
+	if err != nil {
+		return nil, err
+	}
+
+	// rebuild the document from the old values and decode it as a user
+	doc := bson.M{"_id": objectID, "invited": true}
+	for _, change := range event.Changes {
+		doc[change.Field] = change.Before
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	u := &user{}
+	err = bson.Unmarshal(raw, u)
+	u.OrganizationID = orgID
+	// the secrets aren't audited, the user enrols again
+	u.TOTPEnabled = false
+	return u, err
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// adminServer serves the router with every request made by an admin.
+func adminServer() *httptest.Server {
+	admin := actor{Type: "user", ID: bson.NewObjectId().Hex(), Role: roleAdmin}
+	return httptest.NewServer(withContract(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		router.ServeHTTP(w, withActor(req, admin))
+	})))
+}
+
+func getAuditEvents(t *testing.T, url string) (int, AuditEvents) {
+	client := &http.Client{}
+	req, err := http.NewRequest("GET", url, nil)
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	actResp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer actResp.Body.Close()
+	resp := response{data: &data{}}
+	json.NewDecoder(actResp.Body).Decode(&resp)
+	return actResp.StatusCode, resp.AuditEvents
+}
+
+func TestUserAuditHandler(t *testing.T) {
+	ts := adminServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	before := u
+	name, password := "Changed", "changed123"
+	if err := u.Update(newUser{Name: &name, Password: &password, PasswordConfirmation: &password}); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("PUT", ts.URL, nil)
+	auditUserChange(req, auditUpdate, &before, &u)
+
+	status, events := getAuditEvents(t, ts.URL+"/api/users/"+u.ID.Hex()+"/audit")
+	if status != http.StatusOK {
+		t.Fatalf("expected %d, but got %d", http.StatusOK, status)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected %d events, but got %d", 1, len(events))
+	}
+	event := events[0]
+	if event.Action != auditUpdate || !event.PasswordChanged {
+		t.Errorf("expected an update changing the password, but got %+v", event)
+	}
+	if len(event.Changes) != 1 || event.Changes[0].Field != "name" ||
+		event.Changes[0].Before != "Test User" || event.Changes[0].After != "Changed" {
+		t.Errorf("expected only the name to change, but got %+v", event.Changes)
+	}
+	dropAllCollections(t)
+}
+
+func TestAuditHandlerRequiresAdmin(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	status, _ := getAuditEvents(t, ts.URL+"/api/audit")
+	if status != http.StatusUnauthorized {
+		t.Errorf("expected %d, but got %d", http.StatusUnauthorized, status)
+	}
+}
+
+func TestDeleteAndRestoreUser(t *testing.T) {
+	ts := adminServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	config.usersCollection.UpdateId(u.ID, bson.M{"$set": bson.M{
+		"totp_enabled": true, "totp_secret": "secret", "locked_until": time.Now().Add(time.Hour),
+	}})
+	client := &http.Client{}
+	req, err := http.NewRequest("DELETE", ts.URL+"/api/users/"+u.ID.Hex(), nil)
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	req.Header.Add("Content-Type", "application/json")
+	if _, err = client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	_, events := getAuditEvents(t, ts.URL+"/api/audit?action=delete&resource_id="+u.ID.Hex())
+	if len(events) != 1 {
+		t.Fatalf("expected %d events, but got %d", 1, len(events))
+	}
+	for _, change := range events[0].Changes {
+		if change.Field == "password_digest" {
+			t.Errorf("expected password digest not to be audited")
+		}
+	}
+
+	req, err = http.NewRequest("POST", ts.URL+"/api/users/"+u.ID.Hex()+"/restore", &bytes.Buffer{})
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	actResp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actResp.Body.Close()
+	if actResp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, but got %d", http.StatusOK, actResp.StatusCode)
+	}
+
+	var restored user
+	config.usersCollection.FindId(u.ID).One(&restored)
+	if restored.Username != u.Username || restored.Email != u.Email || !restored.Invited {
+		t.Errorf("expected %s to be restored as invited, but got %+v", u.Username, restored)
+	}
+	if !restored.CreatedAt.Equal(u.CreatedAt) {
+		t.Errorf("expected created_at to be %s, but got %s", u.CreatedAt, restored.CreatedAt)
+	}
+	if restored.TOTPEnabled || restored.TOTPSecret != "" {
+		t.Errorf("expected the two-factor authentication to be off, but got %+v", restored)
+	}
+	if restored.locked(time.Now()) {
+		t.Errorf("expected the user not to be locked, but got %s", restored.LockedUntil)
+	}
+	dropAllCollections(t)
+}
+
+// TestAuditWithSession checks the audit endpoints behind the real
+// authentication, with the access token of an admin's session, instead
+// of an actor set by the test server.
+func TestAuditWithSession(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	admin := setupUser(t)
+	config.usersCollection.UpdateId(admin.ID, bson.M{"$set": bson.M{"role": roleAdmin}})
+	status, r := doOrganizationRequest(t, "POST", ts.URL+"/api/login", `{"login":{"username":"test_user","password":"test123#"}}`)
+	if status != http.StatusOK || r.Tokens == nil {
+		t.Fatalf("expected the admin to log in, but got %d %s", status, r.Message)
+	}
+	token := r.Tokens.AccessToken
+
+	u := user{Name: "Other User", Username: "other_user", Email: "other@sample.com", Password: "test123#", PasswordConfirmation: "test123#"}
+	if err := u.Create(); err != nil {
+		t.Fatal("Unable to create user: ", err, u.Errors)
+	}
+	if status, _ = sessionRequest(t, "DELETE", ts.URL+"/api/users/"+u.ID.Hex(), token, ""); status != http.StatusOK {
+		t.Fatalf("expected %d, but got %d", http.StatusOK, status)
+	}
+
+	auditURL := ts.URL + "/api/audit?action=delete&resource_id=" + u.ID.Hex()
+	if status, _ = getAuditEvents(t, auditURL); status != http.StatusUnauthorized {
+		t.Errorf("expected %d without the token, but got %d", http.StatusUnauthorized, status)
+	}
+	status, r = sessionRequest(t, "GET", auditURL, token, "")
+	if status != http.StatusOK || len(r.AuditEvents) != 1 {
+		t.Fatalf("expected the delete event, but got %d %d", status, len(r.AuditEvents))
+	}
+	if a := r.AuditEvents[0].Actor; a.Type != actorUser || a.ID != admin.ID.Hex() {
+		t.Errorf("expected the admin to be the actor, but got %+v", a)
+	}
+
+	if status, _ = sessionRequest(t, "POST", ts.URL+"/api/users/"+u.ID.Hex()+"/restore", token, ""); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	status, r = sessionRequest(t, "GET", ts.URL+"/api/users/"+u.ID.Hex()+"/audit", token, "")
+	if status != http.StatusOK || len(r.AuditEvents) != 2 || r.AuditEvents[0].Action != auditRestore {
+		t.Fatalf("expected the restore event first, but got %d %+v", status, r.AuditEvents)
+	}
+	if a := r.AuditEvents[0].Actor; a.Type != actorUser || a.ID != admin.ID.Hex() {
+		t.Errorf("expected the admin to be the actor, but got %+v", a)
+	}
+
+	dropAllCollections(t)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// authMiddleware authenticates the requests with an OAuth access token or
+// an API key, sent as a bearer token in the "Authorization" header. API
+// keys can also be sent in the "X-API-Key" header. Requests without
+// credentials stay anonymous, those with invalid ones are refused and
+// charged to authFailures. Scoped actors are refused on the routes not
+// declaring a scope.
+func authMiddleware(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	credential := req.Header.Get("X-API-Key")
+	if h := req.Header.Get("Authorization"); credential == "" && len(h) >= 7 && strings.EqualFold(h[:7], "Bearer ") {
+		credential = strings.TrimSpace(h[7:])
+	}
+	if credential == "" {
+		next(w, req)
+		return
+	}
+	if authFailures != nil && !authFailures.allow(w, req) {
+		return
+	}
+
+	var a *actor
+	var err error
+	if strings.HasPrefix(credential, apiKeyPrefix) {
+		a, err = apiKeyActor(req, credential)
+	} else {
+		a, err = accessTokenActor(credential)
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if a == nil {
+		if authFailures != nil {
+			authFailures.failed(req)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		if err = json.NewEncoder(w).Encode(response{Message: "Invalid or expired credentials."}); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	// unknown routes are left to the router to refuse
+	var match mux.RouteMatch
+	if a.Scoped && router.Match(req, &match) {
+		if _, ok := match.Handler.(scopedHandler); !ok {
+			refuseScope(w, "")
+			return
+		}
+	}
+	next(w, withActor(req, *a))
+}
+
+// scopedHandler is a handler the scoped actors can only call with its
+// scope. Without scope, the handler checks the scopes itself.
+type scopedHandler struct {
+	scope   string
+	handler http.HandlerFunc
+}
+
+func (h scopedHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if a := requestActor(req); a.Scoped && h.scope != "" && !containsString(a.Scopes, h.scope) {
+		refuseScope(w, h.scope)
+		return
+	}
+	h.handler(w, req)
+}
+
+// requireScope only lets the actors with scope call the handler. Only
+// the actors authenticated with scoped credentials are checked, the
+// others are limited by their role. The routes not registered with it
+// are closed to the scoped actors.
+func requireScope(scope string, handler http.HandlerFunc) http.Handler {
+	return scopedHandler{scope: scope, handler: handler}
+}
+
+// checksScopes opens the route of a handler checking the scopes of the
+// actors itself to the scoped actors.
+func checksScopes(handler http.HandlerFunc) http.Handler {
+	return scopedHandler{handler: handler}
+}
+
+// refuseScope refuses the credentials missing scope, or any scope when it
+// is empty.
+func refuseScope(w http.ResponseWriter, scope string) {
+	message := "The credentials can't be used on this route."
+	challenge := `Bearer error="insufficient_scope"`
+	if scope != "" {
+		message = "The credentials don't have the " + scope + " scope."
+		challenge += `, scope="` + scope + `"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.WriteHeader(http.StatusForbidden)
+	if err := json.NewEncoder(w).Encode(response{Message: message}); err != nil {
+		log.Println(err)
+	}
+}
+
+// scopesWithin tells whether every scope is one of allowed.
+func scopesWithin(scopes, allowed []string) bool {
+	for _, s := range scopes {
+		if !containsString(allowed, s) {
+			return false
+		}
+	}
+	return true
+}
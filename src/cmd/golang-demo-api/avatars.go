@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"image"
+	"image/draw"
+	_ "image/gif" // registers the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// avatarMaxSize is the largest avatar accepted, in bytes.
+	avatarMaxSize = 5 << 20
+	// avatarMaxDimension is the largest width and height accepted, so
+	// small files can't decode to huge images.
+	avatarMaxDimension = 4096
+	// avatarDefaultSize is the size served without the "size" parameter.
+	avatarDefaultSize = 128
+	// avatarCacheControl lets caches keep avatars, but they must check the
+	// ETag first, as the URL stays the same when the avatar changes.
+	avatarCacheControl = "public, no-cache"
+)
+
+// avatarSizes are the sizes of the square thumbnails, largest first as
+// each is made from the previous one.
+var avatarSizes = []int{256, 128, 64, 32}
+
+// avatarContentTypes are the image types accepted, by media type.
+var avatarContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+// avatarRequestContentTypes is the pattern matched against the
+// "Content-Type" of uploads: a form or the image itself.
+const avatarRequestContentTypes = `^(multipart/form-data|image/(png|jpeg|gif))(;.*)?$`
+
+// avatarMeta is the metadata of the GridFS files of avatars. Every upload
+// is a version with the original image and its thumbnails.
+type avatarMeta struct {
+	UserID         bson.ObjectId `bson:"user_id"`
+	OrganizationID bson.ObjectId `bson:"organization_id"`
+	Version        bson.ObjectId `bson:"version"`
+	Size           string        `bson:"size"`
+}
+
+func init() {
+	router.Path("/api/users/{id}/avatar").
+		HeadersRegexp("Content-Type", avatarRequestContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("PUT").
+		HandlerFunc(requireSelfOrAdmin(updateAvatarHandler))
+	router.Path("/api/users/{id}/avatar").
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("DELETE").
+		HandlerFunc(requireSelfOrAdmin(deleteAvatarHandler))
+	// images are loaded by browsers, which don't send the API headers
+	router.Path("/api/users/{id}/avatar").
+		Methods("GET").
+		HandlerFunc(avatarHandler)
+
+	// the files go with the user
+	onUserEvent(func(e userEvent) {
+		if e.Type == userDeleted {
+			if err := removeAvatars(e.User.ID, ""); err != nil {
+				log.Println(err)
+			}
+		}
+	})
+
+	imageSchema := &openAPISchema{Type: "string", Format: "binary"}
+	upload := &openAPIRequestBody{
+		Description: "The image, at most 5 MB and 4096x4096 pixels.",
+		Required:    true,
+		Content: map[string]*openAPIMediaType{
+			"multipart/form-data": {Schema: &openAPISchema{
+				Type:       "object",
+				Properties: map[string]*openAPISchema{"avatar": imageSchema},
+				Required:   []string{"avatar"},
+			}},
+		},
+	}
+	images := make(map[string]*openAPIMediaType)
+	for mt := range avatarContentTypes {
+		upload.Content[mt] = &openAPIMediaType{Schema: imageSchema}
+		images[mt] = &openAPIMediaType{Schema: imageSchema}
+	}
+	images["image/svg+xml"] = &openAPIMediaType{Schema: &openAPISchema{Type: "string"}}
+	served := envelopeResponses(http.StatusBadRequest, 422)
+	served["200"] = &openAPIResponse{Description: "The avatar, or the initials of the user when there is none.", Content: images}
+	served["206"] = &openAPIResponse{Description: "The requested range of the avatar.", Content: images}
+	served["304"] = &openAPIResponse{Description: "The avatar didn't change."}
+	userID := pathParam("id", "ID of the user")
+
+	documentOperations(
+		&openAPIOperation{
+			Method:      "PUT",
+			Path:        "/api/users/{id}/avatar",
+			OperationID: "updateAvatar",
+			Summary:     "Sets the avatar of a user.",
+			Tags:        []string{"avatars"},
+			Parameters:  []*openAPIParameter{userID},
+			RequestBody: upload,
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/users/{id}/avatar",
+			OperationID: "showAvatar",
+			Summary:     "Returns the avatar of a user.",
+			Tags:        []string{"avatars"},
+			Parameters: []*openAPIParameter{userID, queryParam("size", "Width and height of the thumbnail, or original",
+				&openAPISchema{Type: "string", Enum: []string{"32", "64", "128", "256", "original"}})},
+			Responses: served,
+		},
+		&openAPIOperation{
+			Method:      "DELETE",
+			Path:        "/api/users/{id}/avatar",
+			OperationID: "deleteAvatar",
+			Summary:     "Removes the avatar of a user.",
+			Tags:        []string{"avatars"},
+			Parameters:  []*openAPIParameter{userID},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+	)
+}
+
+// ensureAvatarIndexes creates the indexes used to find the avatars.
+func ensureAvatarIndexes() error {
+	if err := config.avatarsFS.Files.EnsureIndexKey("filename", "-uploadDate"); err != nil {
+		return err
+	}
+	return config.avatarsFS.Files.EnsureIndexKey("metadata.user_id")
+}
+
+// updateAvatarHandler stores the avatar of a user with its thumbnails.
+// URL: PUT /api/users/:id/avatar
+// HEADERS:
+//	"Content-Type": "multipart/form-data", "image/png", "image/jpeg" or "image/gif"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the user
+// BODY:
+//	avatar: The image, at most 5 MB and 4096x4096 pixels (multipart/form-data)
+//	or the image itself
+func updateAvatarHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	u, err := loadUser(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "User not found."})
+		return
+	}
+
+	b, errs := readAvatar(w, req)
+	var img image.Image
+	var format string
+	if len(errs) == 0 {
+		img, format, errs = decodeAvatar(b)
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(422)
+		encoder.Encode(response{
+			Message: "Unable to save avatar. Please correct the errors and try again.",
+			data:    &data{Errors: errs},
+		})
+		return
+	}
+
+	if err = saveAvatar(u, b, img, format); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(response{Message: "Avatar updated successfully."})
+}
+
+// readAvatar returns the image sent as the body or as the "avatar" field
+// of a form.
+func readAvatar(w http.ResponseWriter, req *http.Request) ([]byte, ModelErrors) {
+	errs := make(ModelErrors)
+	body := req.Body
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		req.Body = http.MaxBytesReader(w, req.Body, avatarMaxSize+maxMultipartMemory)
+		file, _, err := req.FormFile("avatar")
+		if err == http.ErrMissingFile {
+			errs["avatar"] = append(errs["avatar"], "can't be blank")
+			return nil, errs
+		} else if err != nil {
+			errs["avatar"] = append(errs["avatar"], "can't be read")
+			return nil, errs
+		}
+		defer file.Close()
+		body = file
+	}
+
+	// one byte more tells that it is too large
+	b, err := ioutil.ReadAll(io.LimitReader(body, avatarMaxSize+1))
+	switch {
+	case err != nil:
+		errs["avatar"] = append(errs["avatar"], "can't be read")
+	case len(b) == 0:
+		errs["avatar"] = append(errs["avatar"], "can't be blank")
+	case len(b) > avatarMaxSize:
+		errs["avatar"] = append(errs["avatar"], "must be at most 5 MB")
+	}
+	return b, errs
+}
+
+// decodeAvatar checks the type and dimensions of the image before
+// decoding it. The type is found from the content, whatever the client
+// says it is.
+func decodeAvatar(b []byte) (image.Image, string, ModelErrors) {
+	errs := make(ModelErrors)
+	if !avatarContentTypes[http.DetectContentType(b)] {
+		errs["avatar"] = append(errs["avatar"], "must be a PNG, JPEG or GIF image")
+		return nil, "", errs
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		errs["avatar"] = append(errs["avatar"], "is not a valid image")
+		return nil, "", errs
+	}
+	if cfg.Width > avatarMaxDimension || cfg.Height > avatarMaxDimension {
+		errs["avatar"] = append(errs["avatar"], fmt.Sprintf("must be at most %dx%d pixels", avatarMaxDimension, avatarMaxDimension))
+		return nil, "", errs
+	}
+	img, format, err := image.Decode(bytes.NewReader(b))
+	// the first frame of a GIF can be empty, whatever its screen size
+	if err != nil || img.Bounds().Empty() {
+		errs["avatar"] = append(errs["avatar"], "is not a valid image")
+		return nil, "", errs
+	}
+	return img, format, errs
+}
+
+// saveAvatar stores the original image and its thumbnails as a new
+// version, then removes the previous versions.
+func saveAvatar(u *user, original []byte, img image.Image, format string) error {
+	version := bson.NewObjectId()
+	meta := avatarMeta{UserID: u.ID, OrganizationID: u.OrganizationID, Version: version}
+	if err := writeAvatarFile(meta, "original", "image/"+format, original); err != nil {
+		return err
+	}
+
+	// JPEG photos stay JPEG, the others keep their transparency in PNG
+	contentType, encode := "image/png", func(w io.Writer, m image.Image) error { return png.Encode(w, m) }
+	if format == "jpeg" {
+		contentType, encode = "image/jpeg", func(w io.Writer, m image.Image) error {
+			return jpeg.Encode(w, m, &jpeg.Options{Quality: 85})
+		}
+	}
+	thumb := squareCrop(img)
+	for _, size := range avatarSizes {
+		thumb = resizeSquare(thumb, size)
+		var buf bytes.Buffer
+		if err := encode(&buf, thumb); err != nil {
+			return err
+		}
+		if err := writeAvatarFile(meta, strconv.Itoa(size), contentType, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return removeAvatars(u.ID, version)
+}
+
+func writeAvatarFile(meta avatarMeta, size, contentType string, b []byte) error {
+	f, err := config.avatarsFS.Create(avatarFileName(meta.UserID, size))
+	if err != nil {
+		return err
+	}
+	f.SetContentType(contentType)
+	meta.Size = size
+	f.SetMeta(meta)
+	if _, err = f.Write(b); err != nil {
+		f.Abort()
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func avatarFileName(userID bson.ObjectId, size string) string {
+	return userID.Hex() + "/" + size
+}
+
+// removeAvatars removes the files of the avatars of a user, but those of
+// the version keep.
+func removeAvatars(userID, keep bson.ObjectId) error {
+	query := bson.M{"metadata.user_id": userID}
+	if keep != "" {
+		query["metadata.version"] = bson.M{"$ne": keep}
+	}
+	var files []struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	if err := config.avatarsFS.Find(query).Select(bson.M{"_id": 1}).All(&files); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := config.avatarsFS.RemoveId(f.ID); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// avatarHandler returns the avatar of a user, or an image of the initials
+// of the user when there is none. Ranges and conditional requests are
+// supported.
+// URL: GET /api/users/:id/avatar
+// PARAMETERS:
+//	"id": ID of the user
+//	"size": 32, 64, 128 (default) or 256 pixels, or original
+func avatarHandler(w http.ResponseWriter, req *http.Request) {
+	size := req.URL.Query().Get("size")
+	if size == "" {
+		size = strconv.Itoa(avatarDefaultSize)
+	}
+	px, _ := strconv.Atoi(size)
+	if size != "original" && !containsInt(avatarSizes, px) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response{Message: "Invalid size, expected 32, 64, 128, 256 or original."})
+		return
+	}
+
+	org := requestOrganization(req)
+	id := mux.Vars(req)["id"]
+	if bson.IsObjectIdHex(id) {
+		f, err := config.avatarsFS.Open(avatarFileName(bson.ObjectIdHex(id), size))
+		var meta avatarMeta
+		if err == nil && (f.GetMeta(&meta) != nil || meta.OrganizationID != org.ID) {
+			// the avatars of the other organizations aren't found
+			f.Close()
+			err = mgo.ErrNotFound
+		}
+		if err == nil {
+			defer f.Close()
+			w.Header().Set("Content-Type", f.ContentType())
+			w.Header().Set("ETag", `"`+f.MD5()+`"`)
+			w.Header().Set("Cache-Control", avatarCacheControl)
+			http.ServeContent(w, req, "", f.UploadDate(), f)
+			return
+		} else if err != mgo.ErrNotFound {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	u, err := loadUser(org.ID, id)
+	if err != nil {
+		log.Println(err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(422)
+		json.NewEncoder(w).Encode(response{Message: "User not found."})
+		return
+	}
+	if px == 0 {
+		px = avatarSizes[0]
+	}
+	svg := initialsAvatar(u, px)
+	sum := md5.Sum(svg)
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	w.Header().Set("Cache-Control", avatarCacheControl)
+	http.ServeContent(w, req, "", u.UpdatedAt, bytes.NewReader(svg))
+}
+
+// deleteAvatarHandler removes the avatar of a user, who gets the image of
+// the initials back.
+// URL: DELETE /api/users/:id/avatar
+// HEADERS:
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the user
+func deleteAvatarHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	u, err := loadUser(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "User not found."})
+		return
+	}
+	if err = removeAvatars(u.ID, ""); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	encoder.Encode(response{Message: "Avatar deleted successfully."})
+}
+
+func containsInt(list []int, n int) bool {
+	for _, item := range list {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
+
+// squareCrop returns the centered square of img, as RGBA so the pixels
+// can be read directly.
+func squareCrop(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	min := image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2)
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(dst, dst.Bounds(), img, min, draw.Src)
+	return dst
+}
+
+// resizeSquare scales the square src to size x size pixels. Every pixel
+// is the average of the pixels of src it covers, which keeps thin lines
+// when shrinking. Images smaller than size are enlarged without
+// smoothing.
+func resizeSquare(src *image.RGBA, size int) *image.RGBA {
+	side := src.Bounds().Dx()
+	if side == size {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0, y1 := y*side/size, (y+1)*side/size
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < size; x++ {
+			x0, x1 := x*side/size, (x+1)*side/size
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r, g, b, a = r+int(p[0]), g+int(p[1]), b+int(p[2]), a+int(p[3])
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// avatarColors are the backgrounds of the initials, white text is
+// readable on all of them.
+var avatarColors = []string{
+	"#1abc9c", "#2ecc71", "#3498db", "#9b59b6", "#34495e",
+	"#16a085", "#27ae60", "#2980b9", "#8e44ad", "#e67e22",
+	"#e74c3c", "#c0392b", "#d35400", "#7f8c8d", "#2c3e50",
+}
+
+// initialsAvatar returns an SVG image of the initials of the user on a
+// background picked from the id, so it doesn't change with the name.
+func initialsAvatar(u *user, size int) []byte {
+	h := fnv.New32a()
+	h.Write([]byte(u.ID))
+	color := avatarColors[h.Sum32()%uint32(len(avatarColors))]
+
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+
+		`<rect width="%d" height="%d" fill="%s"/>`+
+		`<text x="50%%" y="50%%" dy=".35em" text-anchor="middle" fill="#ffffff" font-family="Helvetica, Arial, sans-serif" font-size="%d">%s</text>`+
+		`</svg>`,
+		size, size, size, size, size, size, color, size*2/5, html.EscapeString(initials(u))))
+}
+
+// initials returns the first letters of the first and last words of the
+// name, or the first letter of the username.
+func initials(u *user) string {
+	words := strings.Fields(u.Name)
+	if len(words) == 0 {
+		words = strings.Fields(u.Username)
+	}
+	if len(words) == 0 {
+		return "?"
+	}
+	if len(words) > 2 {
+		words = []string{words[0], words[len(words)-1]}
+	}
+	var s string
+	for _, w := range words {
+		r, _ := utf8.DecodeRuneInString(w)
+		s += string(unicode.ToUpper(r))
+	}
+	return s
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"client"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// testImage returns a PNG of w x h pixels, the left half black and the
+// right half white.
+func testImage(t *testing.T, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{A: 255}
+			if x >= w/2 {
+				c = color.RGBA{255, 255, 255, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func putAvatar(t *testing.T, url, contentType string, body []byte) (int, response) {
+	req, _ := http.NewRequest("PUT", url, bytes.NewReader(body))
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	req.Header.Add("Content-Type", contentType)
+	actResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer actResp.Body.Close()
+	resp := response{data: &data{}}
+	json.NewDecoder(actResp.Body).Decode(&resp)
+	return actResp.StatusCode, resp
+}
+
+func getAvatar(t *testing.T, url string, headers map[string]string) (*http.Response, []byte) {
+	req, _ := http.NewRequest("GET", url, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, b
+}
+
+func TestResizeSquare(t *testing.T) {
+	img, _, _ := decodeAvatar(testImage(t, 6, 4))
+	thumb := resizeSquare(squareCrop(img), 2)
+	if thumb.Bounds().Dx() != 2 || thumb.Bounds().Dy() != 2 {
+		t.Fatalf("expected 2x2, but got %s", thumb.Bounds())
+	}
+	// the crop is the 4 middle columns, half black and half white
+	if r, _, _, _ := thumb.At(0, 0).RGBA(); r != 0 {
+		t.Errorf("expected the left to be black, but got %v", thumb.At(0, 0))
+	}
+	if r, _, _, _ := thumb.At(1, 1).RGBA(); r != 0xffff {
+		t.Errorf("expected the right to be white, but got %v", thumb.At(1, 1))
+	}
+
+	// shrinking averages the pixels
+	thumb = resizeSquare(squareCrop(img), 1)
+	if r, _, _, _ := thumb.At(0, 0).RGBA(); r>>8 != 127 {
+		t.Errorf("expected gray, but got %v", thumb.At(0, 0))
+	}
+}
+
+func TestDecodeAvatar(t *testing.T) {
+	cases := map[string][]byte{
+		"must be a PNG, JPEG or GIF image": []byte("<svg></svg>"),
+		"is not a valid image":             append([]byte("\x89PNG\r\n\x1a\n"), "broken"...),
+		"must be at most 4096x4096 pixels": testImage(t, 4097, 1),
+	}
+	for expected, b := range cases {
+		_, _, errs := decodeAvatar(b)
+		if len(errs["avatar"]) != 1 || errs["avatar"][0] != expected {
+			t.Errorf("expected %s, but got %v", expected, errs)
+		}
+	}
+}
+
+func TestDecodeAvatarEmptyFrame(t *testing.T) {
+	// a 1x1 screen whose only frame is empty
+	var b bytes.Buffer
+	frame := image.NewPaletted(image.Rect(0, 0, 0, 0), color.Palette{color.Black, color.White})
+	err := gif.EncodeAll(&b, &gif.GIF{
+		Image:  []*image.Paletted{frame},
+		Delay:  []int{0},
+		Config: image.Config{ColorModel: frame.Palette, Width: 1, Height: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, _, errs := decodeAvatar(b.Bytes())
+	if img != nil || len(errs["avatar"]) != 1 || errs["avatar"][0] != "is not a valid image" {
+		t.Errorf("expected the empty image to be invalid, but got %v", errs)
+	}
+}
+
+func TestInitials(t *testing.T) {
+	cases := map[string]user{
+		"AS": {Name: "aditya shedge"},
+		"AV": {Name: "Aditya Kumar Verma"},
+		"É":  {Name: "élodie"},
+		"T":  {Username: "test_user"},
+		"?":  {},
+	}
+	for expected, u := range cases {
+		if actual := initials(&u); actual != expected {
+			t.Errorf("expected %s, but got %s", expected, actual)
+		}
+	}
+}
+
+func TestAvatarHandlers(t *testing.T) {
+	u := setupUser(t)
+	ts := actorServer(actor{Type: actorUser, ID: u.ID.Hex(), OrganizationID: defaultOrganization.ID})
+	defer ts.Close()
+	url := ts.URL + "/api/users/" + u.ID.Hex() + "/avatar"
+
+	// the initials until there is an avatar
+	resp, b := getAvatar(t, url, nil)
+	if resp.Header.Get("Content-Type") != "image/svg+xml" || !strings.Contains(string(b), ">TU</text>") {
+		t.Errorf("expected the initials, but got %s: %s", resp.Header.Get("Content-Type"), b)
+	}
+
+	status, r := putAvatar(t, url, "image/png", []byte("not an image"))
+	if status != 422 || len(r.Errors["avatar"]) == 0 {
+		t.Errorf("expected the avatar to be refused, but got %d %v", status, r.Errors)
+	}
+
+	// as a form
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	fw, _ := mw.CreateFormFile("avatar", "avatar.png")
+	fw.Write(testImage(t, 300, 200))
+	mw.Close()
+	status, r = putAvatar(t, url, mw.FormDataContentType(), form.Bytes())
+	if status != http.StatusOK {
+		t.Fatalf("expected %d, but got %d: %s %v", http.StatusOK, status, r.Message, r.Errors)
+	}
+
+	resp, b = getAvatar(t, url+"?size=64", nil)
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 64 {
+		t.Errorf("expected 64x64, but got %s", img.Bounds())
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" || resp.Header.Get("Cache-Control") != avatarCacheControl {
+		t.Errorf("expected caching headers, but got %v", resp.Header)
+	}
+
+	resp, _ = getAvatar(t, url+"?size=64", map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected %d, but got %d", http.StatusNotModified, resp.StatusCode)
+	}
+	resp, b = getAvatar(t, url+"?size=original", map[string]string{"Range": "bytes=0-7"})
+	if resp.StatusCode != http.StatusPartialContent || string(b) != "\x89PNG\r\n\x1a\n" {
+		t.Errorf("expected the first 8 bytes, but got %d %q", resp.StatusCode, b)
+	}
+	resp, _ = getAvatar(t, url+"?size=100", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected %d, but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// replacing the avatar removes the previous files
+	status, _ = putAvatar(t, url, "image/png", testImage(t, 32, 32))
+	if status != http.StatusOK {
+		t.Fatalf("expected %d, but got %d", http.StatusOK, status)
+	}
+	files, _ := config.avatarsFS.Find(bson.M{"metadata.user_id": u.ID}).Count()
+	if files != 1+len(avatarSizes) {
+		t.Errorf("expected %d files, but got %d", 1+len(avatarSizes), files)
+	}
+
+	// and deleting the user removes them all
+	if err = client.New(ts.URL).DeleteUser(context.Background(), u.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	files, _ = config.avatarsFS.Find(bson.M{"metadata.user_id": u.ID}).Count()
+	if files != 0 {
+		t.Errorf("expected the files to be removed, but got %d", files)
+	}
+
+	dropAllCollections(t)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// eventBusSize and eventBusDocs bound the capped collection of the bus,
+	// the oldest events are overwritten first.
+	eventBusSize = 64 << 20
+	eventBusDocs = 100000
+	// eventBusPoll is how long a tailing cursor waits for new events
+	// before checking whether the bus was stopped.
+	eventBusPoll = time.Second
+)
+
+// busEvent is an event as stored in the bus. Seq is the position of the
+// event, it increases by one with every event.
+type busEvent struct {
+	Seq   int64     `bson:"_id"`
+	Event userEvent `bson:"event"`
+}
+
+// eventBus shares the user events between the instances of the API. The
+// events are written to a capped collection, every instance tails it and
+// passes the events to its listeners in the same order.
+type eventBus struct {
+	sync.RWMutex
+	listeners []func(int64, userEvent)
+}
+
+var userEventBus = &eventBus{}
+
+// ensureEventBus creates the capped collection of the bus.
+func ensureEventBus() error {
+	err := config.eventsCollection.Create(&mgo.CollectionInfo{
+		Capped:   true,
+		MaxBytes: eventBusSize,
+		MaxDocs:  eventBusDocs,
+	})
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == 48 {
+		// NamespaceExists
+		return nil
+	}
+	return err
+}
+
+// onClusterUserEvent registers f to be called with the position of every
+// event published by any instance. Listeners run on the goroutine of the
+// bus, one at a time, slow work must be queued.
+func onClusterUserEvent(f func(seq int64, e userEvent)) {
+	userEventBus.Lock()
+	defer userEventBus.Unlock()
+	userEventBus.listeners = append(userEventBus.listeners, f)
+}
+
+// publish appends e to the bus and returns its position. The position is
+// the one after the last event, the unique _id makes concurrent writers
+// retry, so the natural order of the collection is the order of positions.
+func (b *eventBus) publish(e userEvent) (int64, error) {
+	for {
+		head, err := b.head()
+		if err != nil {
+			return 0, err
+		}
+		be := busEvent{Seq: head + 1, Event: e}
+		err = config.eventsCollection.Insert(be)
+		if mgo.IsDup(err) {
+			continue
+		}
+		return be.Seq, err
+	}
+}
+
+// head returns the position of the last event, 0 when there are none.
+func (b *eventBus) head() (int64, error) {
+	var last busEvent
+	err := config.eventsCollection.Find(nil).Sort("-$natural").Select(bson.M{"_id": 1}).One(&last)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	return last.Seq, err
+}
+
+// since returns the events after the position seq, up to limit. complete
+// is false when some of them were already overwritten.
+func (b *eventBus) since(seq int64, limit int) (events []busEvent, complete bool, err error) {
+	var first busEvent
+	err = config.eventsCollection.Find(nil).Sort("$natural").Select(bson.M{"_id": 1}).One(&first)
+	if err == mgo.ErrNotFound {
+		return nil, true, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	complete = first.Seq <= seq+1
+	err = config.eventsCollection.Find(bson.M{"_id": bson.M{"$gt": seq}}).Sort("$natural").Limit(limit).All(&events)
+	return
+}
+
+// run tails the bus from the position seq and passes the events to the
+// listeners until stop is closed.
+func (b *eventBus) run(seq int64, stop <-chan struct{}) {
+	session := config.session.Copy()
+	defer session.Close()
+	c := config.eventsCollection.With(session)
+
+	for {
+		iter := c.Find(bson.M{"_id": bson.M{"$gt": seq}}).Sort("$natural").Tail(eventBusPoll)
+		var be busEvent
+		for {
+			for iter.Next(&be) {
+				b.dispatch(be)
+				seq = be.Seq
+			}
+			if iter.Err() != nil || !iter.Timeout() {
+				break
+			}
+			select {
+			case <-stop:
+				iter.Close()
+				return
+			default:
+			}
+		}
+		if err := iter.Close(); err != nil {
+			log.Println(err)
+			session.Refresh()
+		}
+
+		// the cursor is dead, which happens on an empty collection
+		select {
+		case <-stop:
+			return
+		case <-time.After(eventBusPoll):
+		}
+	}
+}
+
+func (b *eventBus) dispatch(be busEvent) {
+	b.RLock()
+	defer b.RUnlock()
+	for _, f := range b.listeners {
+		f(be.Seq, be.Event)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEventBusPublish(t *testing.T) {
+	head, err := userEventBus.head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := userEventBus.publish(userEvent{Type: userUpdated, User: &user{}}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	events, complete, err := userEventBus.since(head, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !complete {
+		t.Errorf("expected the events to be complete")
+	}
+	if len(events) != 10 {
+		t.Fatalf("expected %d events, but got %d", 10, len(events))
+	}
+	for i, be := range events {
+		if be.Seq != head+int64(i)+1 {
+			t.Errorf("expected event %d at position %d, but got %d", i, head+int64(i)+1, be.Seq)
+		}
+	}
+}
+
+func TestEventBusRun(t *testing.T) {
+	received := make(chan int64, 1)
+	onClusterUserEvent(func(seq int64, e userEvent) {
+		if e.Type != userRestored {
+			return
+		}
+		select {
+		case received <- seq:
+		default:
+		}
+	})
+
+	seq, err := userEventBus.publish(userEvent{Type: userRestored, User: &user{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if got != seq {
+			t.Errorf("expected position %d, but got %d", seq, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the event to be dispatched")
+	}
+}
+
+func TestUserEventWithoutSecrets(t *testing.T) {
+	u := &user{
+		ID:                  bson.NewObjectId(),
+		Username:            "secret_user",
+		PasswordDigest:      "digest",
+		TOTPSecret:          "secret",
+		TOTPLastCounter:     1,
+		RecoveryCodeDigests: []string{"code"},
+		FailedLogins:        1,
+	}
+	e := userEvent{ID: bson.NewObjectId(), Type: userUpdated, User: u, CreatedAt: bson.Now()}
+	publishUserEvent(e)
+
+	var be struct {
+		Event struct {
+			User bson.M `bson:"user"`
+		} `bson:"event"`
+	}
+	if err := config.eventsCollection.Find(bson.M{"event._id": e.ID}).One(&be); err != nil {
+		t.Fatal(err)
+	}
+	if be.Event.User["username"] != u.Username {
+		t.Errorf("expected the user in the event, but got %v", be.Event.User)
+	}
+	for _, key := range []string{"password_digest", "totp_secret", "totp_last_counter", "recovery_code_digests", "failed_logins"} {
+		if _, ok := be.Event.User[key]; ok {
+			t.Errorf("expected no %s in the event, but got %v", key, be.Event.User)
+		}
+	}
+	if u.PasswordDigest == "" {
+		t.Errorf("expected the published user to be left untouched")
+	}
+}
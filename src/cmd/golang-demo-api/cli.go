@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	osuser "os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"client"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const cliUsage = `Usage: golang-demo-api [flags] <command> [arguments]
+
+Without arguments, golang-demo-api serves the API.
+
+Commands:
+	users list [-page n | -all]
+	users count
+	users show <id>
+	users create -name name -username username -email email [-mobile mobile] [-role admin] [-password password]
+	users update [-name name] [-username username] [-email email] [-mobile mobile] [-role role] <id>
+	users set-password [-password password] <id>
+	users delete <id>...
+	seed [-seed n] [-users n] [-from time] [-to time] [-password password] [fixture]...
+
+Passwords which aren't given as flags are read from the first line of the
+standard input.
+
+Flags:
+`
+
+// cliOptions are the flags shared by all the commands.
+type cliOptions struct {
+	env   string
+	api   string
+	token string
+	org   string
+	json  bool
+}
+
+// runCLI runs the admin command of args and returns the exit status.
+func runCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var opts cliOptions
+	fs := flag.NewFlagSet("golang-demo-api", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&opts.env, "env", "development", "`environment` of the database, the database is golang_demo_api_<env>")
+	fs.StringVar(&opts.api, "api", "", "`URL` of the API to go through instead of the database, like http://localhost:3000")
+	fs.StringVar(&opts.token, "token", "", "`token` sent to the API")
+	fs.StringVar(&opts.org, "org", "", "`slug` of the organization of the users, the default organization by default")
+	fs.BoolVar(&opts.json, "json", false, "print JSON instead of tables")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, cliUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+	name, args := args[0], args[1:]
+	if name == "users" && len(args) > 0 {
+		name, args = name+" "+args[0], args[1:]
+	}
+	cmd, ok := cliCommands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n", name)
+		fs.Usage()
+		return 2
+	}
+
+	store, err := openUserStore(opts)
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return 1
+	}
+	c := &cliCommand{cliOptions: opts, store: store, stdin: stdin, stdout: stdout}
+	cmdFlags := flag.NewFlagSet(name, flag.ContinueOnError)
+	cmdFlags.SetOutput(stderr)
+	if err = cmd(c, cmdFlags, args); err != nil {
+		if err == flag.ErrHelp || err == errCLIUsage {
+			if err == errCLIUsage {
+				cmdFlags.Usage()
+			}
+			return 2
+		}
+		fmt.Fprintln(stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// errCLIUsage is returned by the commands called with wrong arguments.
+var errCLIUsage = errors.New("wrong arguments")
+
+// cliCommand is what the commands are run with.
+type cliCommand struct {
+	cliOptions
+	store  userStore
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+// cliCommands are the commands, by name. They parse their flags with fs.
+var cliCommands = map[string]func(c *cliCommand, fs *flag.FlagSet, args []string) error{
+	"users list":         listUsersCommand,
+	"users count":        countUsersCommand,
+	"users show":         showUserCommand,
+	"users create":       createUserCommand,
+	"users update":       updateUserCommand,
+	"users set-password": setPasswordCommand,
+	"users delete":       deleteUsersCommand,
+	"seed":               seedCommand,
+}
+
+func listUsersCommand(c *cliCommand, fs *flag.FlagSet, args []string) error {
+	page := fs.Int("page", 1, "`page` to list, per page 20 users")
+	all := fs.Bool("all", false, "list the users of all the pages")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errCLIUsage
+	}
+	opts := client.ListOptions{Page: *page}
+	if *all {
+		opts.Page = 0
+	}
+	users, _, err := c.store.list(opts)
+	if err != nil {
+		return err
+	}
+	return c.printUsers(users)
+}
+
+func countUsersCommand(c *cliCommand, fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errCLIUsage
+	}
+	_, total, err := c.store.list(client.ListOptions{Page: 1})
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(map[string]int{"total": total})
+	}
+	fmt.Fprintln(c.stdout, total)
+	return nil
+}
+
+func showUserCommand(c *cliCommand, fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errCLIUsage
+	}
+	u, err := c.store.get(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return c.printUser(u)
+}
+
+// userFlags adds the fields of a user to fs. The returned function gives
+// the fields set on the command line.
+func userFlags(fs *flag.FlagSet) func() (params client.UserParams, role *string) {
+	fields := map[string]*string{}
+	for _, name := range []string{"name", "username", "email", "mobile", "password"} {
+		fields[name] = fs.String(name, "", "`"+name+"` of the user")
+	}
+	fields["role"] = fs.String("role", "", "`role` of the user, admin or empty")
+	return func() (client.UserParams, *string) {
+		set := map[string]*string{}
+		fs.Visit(func(f *flag.Flag) {
+			if v, ok := fields[f.Name]; ok {
+				set[f.Name] = v
+			}
+		})
+		params := client.UserParams{
+			Name:     set["name"],
+			Username: set["username"],
+			Email:    set["email"],
+			Mobile:   set["mobile"],
+			Password: set["password"],
+		}
+		params.PasswordConfirmation = params.Password
+		return params, set["role"]
+	}
+}
+
+func createUserCommand(c *cliCommand, fs *flag.FlagSet, args []string) error {
+	fields := userFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errCLIUsage
+	}
+	params, role := fields()
+	if params.Password == nil {
+		password, err := c.readPassword()
+		if err != nil {
+			return err
+		}
+		params.Password, params.PasswordConfirmation = &password, &password
+	}
+	u, err := c.store.create(params, role)
+	if err != nil {
+		return err
+	}
+	return c.printUser(u)
+}
+
+func updateUserCommand(c *cliCommand, fs *flag.FlagSet, args []string) error {
+	fields := userFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errCLIUsage
+	}
+	params, role := fields()
+	u, err := c.store.update(fs.Arg(0), params, role)
+	if err != nil {
+		return err
+	}
+	return c.printUser(u)
+}
+
+func setPasswordCommand(c *cliCommand, fs *flag.FlagSet, args []string) error {
+	password := fs.String("password", "", "new `password` of the user")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errCLIUsage
+	}
+	if *password == "" {
+		p, err := c.readPassword()
+		if err != nil {
+			return err
+		}
+		password = &p
+	}
+	_, err := c.store.update(fs.Arg(0), client.UserParams{Password: password, PasswordConfirmation: password}, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, "Password updated.")
+	return nil
+}
+
+func deleteUsersCommand(c *cliCommand, fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errCLIUsage
+	}
+	for _, id := range fs.Args() {
+		if err := c.store.delete(id); err != nil {
+			return fmt.Errorf("%s: %s", id, err)
+		}
+		fmt.Fprintln(c.stdout, "Deleted", id)
+	}
+	return nil
+}
+
+// readPassword reads a password from the first line of the standard input.
+func (c *cliCommand) readPassword() (string, error) {
+	line, err := bufio.NewReader(c.stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *cliCommand) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (c *cliCommand) printUsers(users []client.User) error {
+	if c.json {
+		if users == nil {
+			users = []client.User{}
+		}
+		return c.printJSON(users)
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tUSERNAME\tEMAIL\tMOBILE\tROLE\tCREATED AT")
+	for _, u := range users {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			u.ID, u.Name, u.Username, u.Email, u.Mobile, u.Role, u.CreatedAt.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func (c *cliCommand) printUser(u *client.User) error {
+	if c.json {
+		return c.printJSON(u)
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\t%s\n", u.ID)
+	fmt.Fprintf(tw, "Name\t%s\n", u.Name)
+	fmt.Fprintf(tw, "Username\t%s\n", u.Username)
+	fmt.Fprintf(tw, "Email\t%s\n", u.Email)
+	fmt.Fprintf(tw, "Mobile\t%s\n", u.Mobile)
+	fmt.Fprintf(tw, "Role\t%s\n", u.Role)
+	fmt.Fprintf(tw, "Invited\t%t\n", u.Invited)
+	fmt.Fprintf(tw, "Created at\t%s\n", u.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(tw, "Updated at\t%s\n", u.UpdatedAt.Format(time.RFC3339))
+	return tw.Flush()
+}
+
+// userStore is where the commands manage the users: the database, or the
+// HTTP API with the -api flag.
+type userStore interface {
+	// list returns the users of opts.Page, or all of them when it is 0,
+	// and the total number of users.
+	list(opts client.ListOptions) ([]client.User, int, error)
+	get(id string) (*client.User, error)
+	create(params client.UserParams, role *string) (*client.User, error)
+	update(id string, params client.UserParams, role *string) (*client.User, error)
+	delete(id string) error
+}
+
+func openUserStore(opts cliOptions) (userStore, error) {
+	if opts.api != "" {
+		c := client.New(opts.api)
+		c.Token = opts.token
+		c.Organization = opts.org
+		return &apiUserStore{c}, nil
+	}
+
+	if config.session == nil {
+		if err := connect(opts.env); err != nil {
+			return nil, err
+		}
+	}
+	useEnv(opts.env)
+	// the changes are published like those of the API
+	if err := ensureEventBus(); err != nil {
+		return nil, err
+	}
+	if err := ensureOrganizations(); err != nil {
+		return nil, err
+	}
+	org := defaultOrganization
+	if opts.org != "" {
+		err := config.organizationsCollection.Find(bson.M{"slug": opts.org}).One(&org)
+		if err == mgo.ErrNotFound {
+			return nil, fmt.Errorf("unknown organization %q", opts.org)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return dbUserStore{org: org}, nil
+}
+
+// dbUserStore manages the users of an organization directly in the
+// database, with the validation, audit log and events of the API.
+type dbUserStore struct {
+	org organization
+}
+
+// cliRequest is the request the changes are recorded with, made by the
+// user running the command.
+func cliRequest() *http.Request {
+	a := actor{Type: "cli"}
+	if u, err := osuser.Current(); err == nil {
+		a.ID = u.Username
+	}
+	req, _ := http.NewRequest("", "", nil)
+	return withActor(req, a)
+}
+
+func (s dbUserStore) list(opts client.ListOptions) ([]client.User, int, error) {
+	filter := bson.M{"organization_id": s.org.ID}
+	q := config.usersCollection.Find(filter).Sort("-created_at")
+	if opts.Page > 0 {
+		q = q.Skip((opts.Page - 1) * perPage).Limit(perPage)
+	}
+	var users Users
+	if err := q.All(&users); err != nil {
+		return nil, 0, err
+	}
+	total, err := config.usersCollection.Find(filter).Count()
+	if err != nil {
+		return nil, 0, err
+	}
+	cus := make([]client.User, len(users))
+	for i := range users {
+		cus[i] = clientUser(&users[i])
+	}
+	return cus, total, nil
+}
+
+func (s dbUserStore) get(id string) (*client.User, error) {
+	u, err := loadCLIUser(s.org.ID, id)
+	if err != nil {
+		return nil, err
+	}
+	cu := clientUser(u)
+	return &cu, nil
+}
+
+func (s dbUserStore) create(params client.UserParams, role *string) (*client.User, error) {
+	u := &user{OrganizationID: s.org.ID}
+	u.copyFields(newUserFromParams(params))
+	if role != nil {
+		if err := checkRole(*role); err != nil {
+			return nil, err
+		}
+		u.Role = *role
+	}
+	if err := u.Create(); err != nil {
+		return nil, modelError("Unable to save user.", u.Errors, err)
+	}
+	userChanged(cliRequest(), auditCreate, nil, u)
+	cu := clientUser(u)
+	return &cu, nil
+}
+
+func (s dbUserStore) update(id string, params client.UserParams, role *string) (*client.User, error) {
+	u, err := loadCLIUser(s.org.ID, id)
+	if err != nil {
+		return nil, err
+	}
+	before := *u
+	if role != nil {
+		if err = checkRole(*role); err != nil {
+			return nil, err
+		}
+		u.Role = *role
+	}
+	if err = u.Update(newUserFromParams(params)); err != nil {
+		return nil, modelError("Unable to update user.", u.Errors, err)
+	}
+	userChanged(cliRequest(), auditUpdate, &before, u)
+	cu := clientUser(u)
+	return &cu, nil
+}
+
+func (s dbUserStore) delete(id string) error {
+	u, err := loadCLIUser(s.org.ID, id)
+	if err != nil {
+		return err
+	}
+	if err = config.usersCollection.RemoveId(u.ID); err != nil {
+		return err
+	}
+	userChanged(cliRequest(), auditDelete, u, nil)
+	return nil
+}
+
+// loadCLIUser is loadUser with an error for people.
+func loadCLIUser(orgID bson.ObjectId, id string) (*user, error) {
+	u, err := loadUser(orgID, id)
+	if err == mgo.ErrNotFound || !bson.IsObjectIdHex(id) {
+		return nil, errors.New("user not found")
+	}
+	return u, err
+}
+
+func checkRole(role string) error {
+	if role != "" && role != roleAdmin {
+		return fmt.Errorf("unknown role %q, the roles are %q or none", role, roleAdmin)
+	}
+	return nil
+}
+
+// modelError returns the errors of the fields like the client gets them
+// from the API, or err when the fields are valid.
+func modelError(message string, errs ModelErrors, err error) error {
+	for _, msgs := range errs {
+		if len(msgs) > 0 {
+			return &client.ValidationError{Message: message, Errors: client.ModelErrors(errs)}
+		}
+	}
+	return err
+}
+
+func newUserFromParams(p client.UserParams) newUser {
+	return newUser{
+		Name:                 p.Name,
+		Username:             p.Username,
+		Email:                p.Email,
+		Mobile:               p.Mobile,
+		Password:             p.Password,
+		PasswordConfirmation: p.PasswordConfirmation,
+	}
+}
+
+func clientUser(u *user) client.User {
+	return client.User{
+		ID:             u.ID.Hex(),
+		Name:           u.Name,
+		Username:       u.Username,
+		Email:          u.Email,
+		Mobile:         u.Mobile,
+		CreatedAt:      u.CreatedAt,
+		UpdatedAt:      u.UpdatedAt,
+		Role:           u.Role,
+		Invited:        u.Invited,
+		OrganizationID: u.OrganizationID.Hex(),
+	}
+}
+
+// apiUserStore manages the users through the HTTP API.
+type apiUserStore struct {
+	c *client.Client
+}
+
+// cliUserFields are the fields of the users the commands print.
+var cliUserFields = []string{"id", "name", "username", "email", "mobile", "created_at", "updated_at", "role", "invited", "organization_id"}
+
+func (s *apiUserStore) list(opts client.ListOptions) ([]client.User, int, error) {
+	opts.Fields = cliUserFields
+	if opts.Page > 0 {
+		page, err := s.c.ListUsers(context.Background(), opts)
+		if err != nil {
+			return nil, 0, err
+		}
+		return page.Users, page.Total, nil
+	}
+	var users []client.User
+	it := s.c.IterateUsers(context.Background(), opts)
+	for it.Next() {
+		users = append(users, it.User())
+	}
+	return users, len(users), it.Err()
+}
+
+func (s *apiUserStore) get(id string) (*client.User, error) {
+	return s.c.GetUser(context.Background(), id)
+}
+
+func (s *apiUserStore) create(params client.UserParams, role *string) (*client.User, error) {
+	if role != nil {
+		return nil, errors.New("the role can't be set through the API, use the database")
+	}
+	return s.c.CreateUser(context.Background(), params)
+}
+
+func (s *apiUserStore) update(id string, params client.UserParams, role *string) (*client.User, error) {
+	if role != nil {
+		return nil, errors.New("the role can't be set through the API, use the database")
+	}
+	return s.c.PatchUser(context.Background(), id, params)
+}
+
+func (s *apiUserStore) delete(id string) error {
+	return s.c.DeleteUser(context.Background(), id)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"client"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func runTestCLI(t *testing.T, stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	status := runCLI(args, strings.NewReader(stdin), &stdout, &stderr)
+	return status, stdout.String(), stderr.String()
+}
+
+func TestCLIUsage(t *testing.T) {
+	for _, args := range [][]string{nil, {"users"}, {"users", "rename"}, {"groups", "list"}} {
+		status, _, stderr := runTestCLI(t, "", args...)
+		if status != 2 {
+			t.Errorf("%v: expected status %d, but got %d", args, 2, status)
+		}
+		if !strings.Contains(stderr, "Usage: golang-demo-api") {
+			t.Errorf("%v: expected the usage, but got %s", args, stderr)
+		}
+	}
+}
+
+func TestCLICreateAdmin(t *testing.T) {
+	status, stdout, stderr := runTestCLI(t, "secret123\n", "-env", "test", "-json",
+		"users", "create", "-name", "Admin", "-username", "admin", "-email", "admin@test.com", "-role", "admin")
+	if status != 0 {
+		t.Fatalf("expected status %d, but got %d: %s", 0, status, stderr)
+	}
+	var cu client.User
+	if err := json.Unmarshal([]byte(stdout), &cu); err != nil {
+		t.Fatal(err)
+	}
+
+	var u user
+	config.usersCollection.FindId(bson.ObjectIdHex(cu.ID)).One(&u)
+	if u.Role != roleAdmin {
+		t.Errorf("expected role to be %s, but got %s", roleAdmin, u.Role)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordDigest), []byte("secret123")); err != nil {
+		t.Errorf("expected password to be %s, but got mismatch", "secret123")
+	}
+
+	var event auditEvent
+	config.auditCollection.Find(bson.M{"resource_id": u.ID}).One(&event)
+	if event.Action != auditCreate || event.Actor.Type != "cli" {
+		t.Errorf("expected a create by the cli, but got %s by %s", event.Action, event.Actor.Type)
+	}
+
+	// the same validation as the API
+	status, _, stderr = runTestCLI(t, "", "-env", "test",
+		"users", "create", "-username", "admin", "-email", "other@test.com", "-password", "secret123")
+	if status != 1 || !strings.Contains(stderr, "name can't be blank; username is already taken") {
+		t.Errorf("expected the errors of the fields, but got %d: %s", status, stderr)
+	}
+
+	dropAllCollections(t)
+}
+
+func TestCLISetPasswordAndDelete(t *testing.T) {
+	u := setupUser(t)
+
+	status, _, stderr := runTestCLI(t, "changed123\n", "-env", "test", "users", "set-password", u.ID.Hex())
+	if status != 0 {
+		t.Fatalf("expected status %d, but got %d: %s", 0, status, stderr)
+	}
+	var nu user
+	config.usersCollection.FindId(u.ID).One(&nu)
+	if err := bcrypt.CompareHashAndPassword([]byte(nu.PasswordDigest), []byte("changed123")); err != nil {
+		t.Errorf("expected password to be %s, but got mismatch", "changed123")
+	}
+
+	status, stdout, _ := runTestCLI(t, "", "-env", "test", "users", "count")
+	if status != 0 || strings.TrimSpace(stdout) != "1" {
+		t.Errorf("expected %d user, but got %s", 1, stdout)
+	}
+
+	status, _, stderr = runTestCLI(t, "", "-env", "test", "users", "delete", u.ID.Hex())
+	if status != 0 {
+		t.Fatalf("expected status %d, but got %d: %s", 0, status, stderr)
+	}
+	totalUsers, _ := config.usersCollection.Find(bson.M{}).Count()
+	if totalUsers != 0 {
+		t.Errorf("expected %d, but got %d", 0, totalUsers)
+	}
+
+	status, _, stderr = runTestCLI(t, "", "-env", "test", "users", "show", u.ID.Hex())
+	if status != 1 || !strings.Contains(stderr, "user not found") {
+		t.Errorf("expected the user not to be found, but got %d: %s", status, stderr)
+	}
+
+	dropAllCollections(t)
+}
+
+func TestCLIThroughAPI(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	status, stdout, stderr := runTestCLI(t, "", "-api", ts.URL, "users", "list")
+	if status != 0 {
+		t.Fatalf("expected status %d, but got %d: %s", 0, status, stderr)
+	}
+	if !strings.HasPrefix(stdout, "ID") || !strings.Contains(stdout, u.ID.Hex()) {
+		t.Errorf("expected a table with the user, but got %s", stdout)
+	}
+
+	status, _, stderr = runTestCLI(t, "", "-api", ts.URL, "users", "update", "-role", "admin", u.ID.Hex())
+	if status != 1 || !strings.Contains(stderr, "can't be set through the API") {
+		t.Errorf("expected the role to be refused, but got %d: %s", status, stderr)
+	}
+
+	dropAllCollections(t)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Modes of the contract validation.
+const (
+	// contractOff doesn't validate anything.
+	contractOff = "off"
+	// contractLog rejects invalid requests and logs invalid responses.
+	contractLog = "log"
+	// contractStrict also replaces invalid responses by a 500 error.
+	contractStrict = "strict"
+)
+
+// contractMode returns the validation mode set with the API_VALIDATION
+// environment variable. It is off in production and logs elsewhere by
+// default.
+func contractMode() string {
+	switch mode := os.Getenv("API_VALIDATION"); mode {
+	case contractOff, contractLog, contractStrict:
+		return mode
+	}
+	if config.env == "production" {
+		return contractOff
+	}
+	return contractLog
+}
+
+// contractRoute is a documented operation with the regexp matching its
+// paths, and the number of variables of its path.
+type contractRoute struct {
+	op   *openAPIOperation
+	path *regexp.Regexp
+	vars int
+}
+
+// contractValidator is a negroni middleware validating the requests and
+// the JSON responses against the OpenAPI document. Requests of paths or
+// methods which aren't documented are left to the router.
+type contractValidator struct {
+	mode   string
+	routes []contractRoute
+}
+
+func newContractValidator(doc *openAPIDocument, mode string) *contractValidator {
+	v := &contractValidator{mode: mode}
+	for path, methods := range doc.Paths {
+		pattern := "^"
+		vars := 0
+		for _, part := range strings.Split(path, "/")[1:] {
+			if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+				vars++
+				pattern += "/[^/]+"
+			} else {
+				pattern += "/" + regexp.QuoteMeta(part)
+			}
+		}
+		re := regexp.MustCompile(pattern + "$")
+		for _, op := range methods {
+			v.routes = append(v.routes, contractRoute{op: op, path: re, vars: vars})
+		}
+	}
+	// static paths win over variables, like "/api/users/export" over
+	// "/api/users/{id}"
+	sort.SliceStable(v.routes, func(i, j int) bool {
+		return v.routes[i].vars < v.routes[j].vars
+	})
+	return v
+}
+
+func (v *contractValidator) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	op := v.operation(req)
+	if op == nil || v.mode == contractOff {
+		next(w, req)
+		return
+	}
+
+	if errs := v.validateRequest(op, req); len(errs) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response{
+			Message: "The request doesn't match the API contract.",
+			data:    &data{Errors: errs},
+		})
+		return
+	}
+
+	cw := &contractResponseWriter{ResponseWriter: w, streamed: streamed(op)}
+	next(cw, req)
+	if !cw.buffered {
+		return
+	}
+
+	body := cw.body.Bytes()
+	if errs := validateResponse(op, cw.status, cw.Header().Get("Content-Type"), body); len(errs) > 0 {
+		log.Printf("%s %s: the response doesn't match the API contract: %s", req.Method, req.URL.Path, errs)
+		if v.mode == contractStrict {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(response{
+				Message: fmt.Sprintf("The response (%d) doesn't match the API contract.", cw.status),
+				data:    &data{Errors: errs},
+			})
+			return
+		}
+	}
+	w.WriteHeader(cw.status)
+	w.Write(body)
+}
+
+// operation returns the documented operation of the request.
+func (v *contractValidator) operation(req *http.Request) *openAPIOperation {
+	for _, r := range v.routes {
+		if r.op.Method == req.Method && r.path.MatchString(req.URL.Path) {
+			return r.op
+		}
+	}
+	return nil
+}
+
+// streamed tells whether the successful responses of op are streamed,
+// those aren't held back, whatever their media type.
+func streamed(op *openAPIOperation) bool {
+	if r := op.Responses["200"]; r != nil {
+		for mt := range r.Content {
+			if !isJSONMediaType(mt) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateRequest checks the query and header parameters and the JSON body
+// of a request. The body is read and put back for the handler. The ids of
+// the paths are left to the handlers, which refuse malformed ones with a
+// 422 whether the validation is on or not.
+func (v *contractValidator) validateRequest(op *openAPIOperation, req *http.Request) ModelErrors {
+	errs := make(ModelErrors)
+	query := req.URL.Query()
+	for _, p := range op.Parameters {
+		var raw string
+		switch p.In {
+		case "path":
+			continue
+		case "query":
+			raw = query.Get(p.Name)
+		case "header":
+			raw = req.Header.Get(p.Name)
+		}
+		if raw == "" {
+			if p.Required {
+				errs[p.In+"."+p.Name] = append(errs[p.In+"."+p.Name], "is required")
+			}
+			continue
+		}
+		validateParam(p.Schema, raw, p.In+"."+p.Name, errs)
+	}
+
+	if op.RequestBody == nil || req.Body == nil {
+		return errs
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	content := op.RequestBody.Content[mediaType]
+	if content == nil || !isJSONMediaType(mediaType) {
+		// forms and files are checked by the handlers
+		return errs
+	}
+	b, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		errs["body"] = append(errs["body"], "can't be read")
+		return errs
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		if op.RequestBody.Required {
+			errs["body"] = append(errs["body"], "is required")
+		}
+		return errs
+	}
+	var body interface{}
+	if err = json.Unmarshal(b, &body); err != nil {
+		errs["body"] = append(errs["body"], "is not valid JSON")
+		return errs
+	}
+	content.Schema.validate(body, "body", errs)
+	return errs
+}
+
+// validateResponse checks a JSON response body. Empty bodies and server
+// errors which aren't documented are accepted.
+func validateResponse(op *openAPIOperation, status int, contentType string, body []byte) ModelErrors {
+	errs := make(ModelErrors)
+	r := op.Responses[strconv.Itoa(status)]
+	if r == nil {
+		if status < 500 {
+			errs["status"] = append(errs["status"], strconv.Itoa(status)+" is not documented")
+		}
+		return errs
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return errs
+	}
+
+	// the envelope is documented under the media type clients accept
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	content := r.Content[mediaType]
+	for mt, c := range r.Content {
+		if content == nil && isJSONMediaType(mt) {
+			content = c
+		}
+	}
+	if content == nil {
+		errs["content_type"] = append(errs["content_type"], mediaType+" is not documented")
+		return errs
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		errs["body"] = append(errs["body"], "is not valid JSON")
+		return errs
+	}
+	content.Schema.validate(v, "body", errs)
+	return errs
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// validateParam checks a parameter, converting it to the type of its
+// schema first.
+func validateParam(s *openAPISchema, raw, field string, errs ModelErrors) {
+	var v interface{} = raw
+	switch s.Type {
+	case "integer", "number":
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			errs[field] = append(errs[field], "must be a number")
+			return
+		}
+		v = f
+	case "boolean":
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			errs[field] = append(errs[field], "must be true or false")
+			return
+		}
+		v = b
+	}
+	s.validate(v, field, errs)
+}
+
+// validate checks v, a decoded JSON value, against the schema. The errors
+// are added to errs under field, with the path to the invalid value.
+func (s *openAPISchema) validate(v interface{}, field string, errs ModelErrors) {
+	if s.Ref != "" {
+		apiSchemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")].validate(v, field, errs)
+		return
+	}
+	if v == nil {
+		if !s.Nullable && (s.Type != "" || len(s.AllOf) > 0) {
+			errs[field] = append(errs[field], "can't be null")
+		}
+		return
+	}
+	for _, sub := range s.AllOf {
+		sub.validate(v, field, errs)
+	}
+
+	switch s.Type {
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			errs[field] = append(errs[field], "must be a string")
+			return
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				errs[field] = append(errs[field], "must be an RFC 3339 time")
+			}
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			errs[field] = append(errs[field], "must match "+s.Pattern)
+		}
+		if len(s.Enum) > 0 && !containsString(s.Enum, str) {
+			errs[field] = append(errs[field], "must be one of "+strings.Join(s.Enum, ", "))
+		}
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok {
+			errs[field] = append(errs[field], "must be a number")
+			return
+		}
+		if s.Type == "integer" && n != math.Trunc(n) {
+			errs[field] = append(errs[field], "must be an integer")
+		}
+		if s.Minimum != nil && n < *s.Minimum {
+			errs[field] = append(errs[field], fmt.Sprintf("must be at least %v", *s.Minimum))
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			errs[field] = append(errs[field], "must be true or false")
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			errs[field] = append(errs[field], "must be an array")
+			return
+		}
+		if s.Items != nil {
+			for i, item := range items {
+				s.Items.validate(item, fmt.Sprintf("%s[%d]", field, i), errs)
+			}
+		}
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			errs[field] = append(errs[field], "must be an object")
+			return
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				errs[field+"."+name] = append(errs[field+"."+name], "is required")
+			}
+		}
+		for name, value := range obj {
+			if ps := s.Properties[name]; ps != nil {
+				ps.validate(value, field+"."+name, errs)
+			} else if s.AdditionalProperties != nil {
+				s.AdditionalProperties.validate(value, field+"."+name, errs)
+			}
+		}
+	}
+}
+
+// contractResponseWriter holds back JSON responses until they are
+// validated. Other responses and streams are passed through.
+type contractResponseWriter struct {
+	http.ResponseWriter
+	streamed    bool
+	status      int
+	wroteHeader bool
+	buffered    bool
+	body        bytes.Buffer
+}
+
+func (w *contractResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.status = status
+	w.wroteHeader = true
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if isJSONMediaType(mediaType) && !(w.streamed && status < 300) {
+		w.buffered = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *contractResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffered {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *contractResponseWriter) Flush() {
+	if w.buffered {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
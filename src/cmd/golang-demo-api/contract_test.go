@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestContractValidatorRejectsRequests(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	cases := []struct {
+		method, path, body, field string
+	}{
+		{"GET", "/api/users?page=first", "", "query.page"},
+		{"POST", "/api/users", `{"user": {"name": 5}}`, "body.user.name"},
+		{"POST", "/api/users", `{"name": "Test"}`, "body.user"},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, ts.URL+c.path, strings.NewReader(c.body))
+		req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+		req.Header.Add("Content-Type", "application/json")
+		actResp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := response{data: &data{}}
+		err = json.NewDecoder(actResp.Body).Decode(&resp)
+		actResp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actResp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s %s: expected status %d, but got %d", c.method, c.path, http.StatusBadRequest, actResp.StatusCode)
+		}
+		if len(resp.Errors[c.field]) == 0 {
+			t.Errorf("%s %s: expected an error on %s, but got %v", c.method, c.path, c.field, resp.Errors)
+		}
+	}
+}
+
+func TestContractValidatorLeavesIdsToHandlers(t *testing.T) {
+	ts := httptest.NewServer(withContract(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(422)
+		w.Write([]byte(`{"message": "Invalid user id."}`))
+	})))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/api/users/x", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 422 {
+		t.Errorf("expected the handler status %d, but got %d", 422, resp.StatusCode)
+	}
+}
+
+func TestContractValidatorFailsResponses(t *testing.T) {
+	responses := map[string]int{
+		`{"data": {"user": {"id": "` + bson.NewObjectId().Hex() + `", "created_at": "2016-01-02T15:04:05Z"}}}`: http.StatusOK,
+		`{"data": {"user": {"id": 42}}}`:                       http.StatusInternalServerError,
+		`{"data": {"user": {"name": "Test"}}}`:                 http.StatusInternalServerError,
+		`{"data": {"user": {"id": "x", "created_at": "now"}}}`: http.StatusInternalServerError,
+	}
+	for body, status := range responses {
+		ts := httptest.NewServer(withContract(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(body))
+		})))
+
+		req, _ := http.NewRequest("GET", ts.URL+"/api/users/"+bson.NewObjectId().Hex(), nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%s: expected status %d, but got %d", body, status, resp.StatusCode)
+		}
+		ts.Close()
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsOptions configures which cross-origin requests are allowed.
+type corsOptions struct {
+	// AllowedOrigins can hold "*" for any origin or patterns with one
+	// wildcard like "https://*.example.com".
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// defaultCORSOptions are used by main. The allowed origins can be set with
+// the CORS_ALLOWED_ORIGINS environment variable as a comma separated list.
+var defaultCORSOptions = corsOptions{
+	AllowedOrigins: []string{"*"},
+	AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+	AllowedHeaders: []string{"Accept", "Content-Type", "Authorization", "X-API-Key"},
+	ExposedHeaders: []string{
+		"ETag", "Link", "Retry-After",
+		"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset",
+	},
+	MaxAge: 10 * time.Minute,
+}
+
+func init() {
+	if origins := os.Getenv("CORS_ALLOWED_ORIGINS"); origins != "" {
+		defaultCORSOptions.AllowedOrigins = strings.Split(origins, ",")
+	}
+}
+
+// cors is a negroni middleware adding the CORS headers to the responses of
+// allowed origins. Preflight requests are answered here, because the
+// routers only match the methods and headers of the API itself.
+type cors struct {
+	corsOptions
+}
+
+func newCORS(opts corsOptions) *cors {
+	return &cors{opts}
+}
+
+func (c *cors) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		next(w, req)
+		return
+	}
+
+	h := w.Header()
+	preflight := req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != ""
+	if preflight {
+		h.Add("Vary", "Origin")
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+
+		method := req.Header.Get("Access-Control-Request-Method")
+		if !c.originAllowed(origin) || !containsFold(c.AllowedMethods, method) || !c.headersAllowed(req) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		c.setOrigin(h, origin)
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+		if len(c.AllowedHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		}
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	h.Add("Vary", "Origin")
+	if c.originAllowed(origin) {
+		c.setOrigin(h, origin)
+		if len(c.ExposedHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+		}
+	}
+	next(w, req)
+}
+
+func (c *cors) setOrigin(h http.Header, origin string) {
+	// browsers reject "*" on requests with credentials
+	if containsFold(c.AllowedOrigins, "*") && !c.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (c *cors) originAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range c.AllowedOrigins {
+		if matchOrigin(strings.ToLower(strings.TrimSpace(pattern)), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cors) headersAllowed(req *http.Request) bool {
+	requested := req.Header.Get("Access-Control-Request-Headers")
+	if requested == "" {
+		return true
+	}
+	for _, header := range strings.Split(requested, ",") {
+		if !containsFold(c.AllowedHeaders, strings.TrimSpace(header)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchOrigin reports whether origin matches pattern, where a "*" in the
+// pattern stands for at least one character.
+func matchOrigin(pattern, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return pattern == origin
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	return len(origin) > len(prefix)+len(suffix) &&
+		strings.HasPrefix(origin, prefix) &&
+		strings.HasSuffix(origin, suffix)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
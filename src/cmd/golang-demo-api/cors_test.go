@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/negroni"
+)
+
+func corsServer() *httptest.Server {
+	n := negroni.New()
+	n.Use(newCORS(corsOptions{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.example.org"},
+		AllowedMethods:   []string{"GET", "POST"},
+		AllowedHeaders:   []string{"Accept", "Content-Type"},
+		ExposedHeaders:   []string{"ETag", "Link"},
+		AllowCredentials: true,
+		MaxAge:           time.Minute,
+	}))
+	n.UseHandler(router)
+	return httptest.NewServer(n)
+}
+
+func TestCORSPreflight(t *testing.T) {
+	ts := corsServer()
+	defer ts.Close()
+
+	client := &http.Client{}
+	req, err := http.NewRequest("OPTIONS", ts.URL+"/api/users", nil)
+	req.Header.Add("Origin", "https://admin.example.org")
+	req.Header.Add("Access-Control-Request-Method", "POST")
+	req.Header.Add("Access-Control-Request-Headers", "Content-Type, Accept")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected %d, but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      "https://admin.example.org",
+		"Access-Control-Allow-Methods":     "GET, POST",
+		"Access-Control-Allow-Headers":     "Accept, Content-Type",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "60",
+	}
+	for header, value := range expected {
+		if resp.Header.Get(header) != value {
+			t.Errorf("expected %s to be %s, but got %s", header, value, resp.Header.Get(header))
+		}
+	}
+}
+
+func TestCORSPreflightRejected(t *testing.T) {
+	ts := corsServer()
+	defer ts.Close()
+
+	origins := []string{"https://example.org", "https://evil.com", "https://app.example.com.evil.com"}
+	for _, origin := range origins {
+		client := &http.Client{}
+		req, err := http.NewRequest("OPTIONS", ts.URL+"/api/users", nil)
+		req.Header.Add("Origin", origin)
+		req.Header.Add("Access-Control-Request-Method", "GET")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected %d for %s, but got %d", http.StatusForbidden, origin, resp.StatusCode)
+		}
+		if v := resp.Header.Get("Access-Control-Allow-Origin"); v != "" {
+			t.Errorf("expected no Access-Control-Allow-Origin for %s, but got %s", origin, v)
+		}
+	}
+}
+
+func TestCORSActualRequest(t *testing.T) {
+	ts := corsServer()
+	defer ts.Close()
+
+	client := &http.Client{}
+	req, err := http.NewRequest("GET", ts.URL+"/api/users", nil)
+	req.Header.Add("Origin", "https://app.example.com")
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if v := resp.Header.Get("Access-Control-Allow-Origin"); v != "https://app.example.com" {
+		t.Errorf("expected Access-Control-Allow-Origin to be %s, but got %s", "https://app.example.com", v)
+	}
+	if v := resp.Header.Get("Access-Control-Expose-Headers"); v != "ETag, Link" {
+		t.Errorf("expected Access-Control-Expose-Headers to be %s, but got %s", "ETag, Link", v)
+	}
+	dropAllCollections(t)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Types of the user events.
+const (
+	userCreated  = "user.created"
+	userUpdated  = "user.updated"
+	userDeleted  = "user.deleted"
+	userRestored = "user.restored"
+)
+
+// userEventTypes are the event types by audit action.
+var userEventTypes = map[string]string{
+	auditCreate:  userCreated,
+	auditUpdate:  userUpdated,
+	auditDelete:  userDeleted,
+	auditRestore: userRestored,
+}
+
+// userEvent tells the listeners that a user changed. User is the state
+// after the change, or the last state for deleted users, without its
+// secrets.
+type userEvent struct {
+	ID        bson.ObjectId `bson:"_id" json:"id"`
+	Type      string        `bson:"type" json:"type"`
+	User      *user         `bson:"user" json:"user"`
+	CreatedAt time.Time     `bson:"created_at" json:"created_at"`
+}
+
+var userEventListeners struct {
+	sync.RWMutex
+	list []func(userEvent)
+}
+
+// onUserEvent registers f to be called after every change of a user made
+// by this instance. Listeners are called synchronously, slow work must be
+// queued. Use onClusterUserEvent to hear about the changes of all the
+// instances.
+func onUserEvent(f func(userEvent)) {
+	userEventListeners.Lock()
+	defer userEventListeners.Unlock()
+	userEventListeners.list = append(userEventListeners.list, f)
+}
+
+func publishUserEvent(e userEvent) {
+	if e.User != nil {
+		e.User = e.User.withoutSecrets()
+	}
+	if _, err := userEventBus.publish(e); err != nil {
+		log.Println(err)
+	}
+
+	userEventListeners.RLock()
+	defer userEventListeners.RUnlock()
+	for _, f := range userEventListeners.list {
+		f(e)
+	}
+}
+
+// userChanged records the change of a user made by the request in the
+// audit log and tells the listeners about it. before is nil for created
+// users and after is nil for deleted users.
+func userChanged(req *http.Request, action string, before, after *user) {
+	auditUserChange(req, action, before, after)
+
+	u := after
+	if u == nil {
+		u = before
+	}
+	publishUserEvent(userEvent{
+		ID:        bson.NewObjectId(),
+		Type:      userEventTypes[action],
+		User:      u,
+		CreatedAt: bson.Now(),
+	})
+}
+
+// usersCreated is userChanged for many created users.
+func usersCreated(req *http.Request, users []*user) {
+	auditUsersCreated(req, users)
+	for _, u := range users {
+		publishUserEvent(userEvent{
+			ID:        bson.NewObjectId(),
+			Type:      userCreated,
+			User:      u,
+			CreatedAt: bson.Now(),
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// userFields maps the fields of the users that can be requested with the
+// fields parameter to their key in the database.
+var userFields = map[string]string{
+	"id":              "_id",
+	"name":            "name",
+	"username":        "username",
+	"email":           "email",
+	"mobile":          "mobile",
+	"role":            "role",
+	"invited":         "invited",
+	"totp_enabled":    "totp_enabled",
+	"organization_id": "organization_id",
+	"created_at":      "created_at",
+	"updated_at":      "updated_at",
+}
+
+// defaultUsersFields are the fields of the index when none are requested.
+var defaultUsersFields = []string{"id", "name", "username", "email", "created_at"}
+
+var fieldsParam = queryParam("fields", "Comma separated fields to return, like name,email. The id is always returned.", &openAPISchema{Type: "string"})
+
+// parseFields returns the fields of the fields parameter, which must be
+// keys of allowed, or defaults when there is no parameter. The id is
+// always returned, first.
+func parseFields(q url.Values, allowed map[string]string, defaults []string) ([]string, error) {
+	param := strings.TrimSpace(q.Get("fields"))
+	if param == "" {
+		return defaults, nil
+	}
+	fields := []string{"id"}
+	seen := map[string]bool{"id": true}
+	for _, field := range strings.Split(param, ",") {
+		field = strings.TrimSpace(field)
+		if _, ok := allowed[field]; !ok {
+			return nil, errors.New("Unknown field: " + field + ".")
+		}
+		if !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+// projection returns the mgo projection of the fields, nil for all of
+// them.
+func projection(fields []string, allowed map[string]string) bson.M {
+	if fields == nil {
+		return nil
+	}
+	p := bson.M{}
+	for _, field := range fields {
+		p[allowed[field]] = 1
+	}
+	return p
+}
+
+// onlyFields returns the JSON object b with only the fields, in their
+// order.
+func onlyFields(b []byte, fields []string) ([]byte, error) {
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, field := range fields {
+		v, ok := all[field]
+		if !ok {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(field)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseFields(t *testing.T) {
+	cases := map[string][]string{
+		"":                     defaultUsersFields,
+		"id,name":              {"id", "name"},
+		" email , id ,email ":  {"id", "email"},
+		"created_at,mobile,id": {"id", "created_at", "mobile"},
+	}
+	for param, expected := range cases {
+		actual, err := parseFields(url.Values{"fields": {param}}, userFields, defaultUsersFields)
+		if err != nil || !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%q: expected %v, but got %v %v", param, expected, actual, err)
+		}
+	}
+	for _, param := range []string{"password_digest", "id,", "name,errors"} {
+		if _, err := parseFields(url.Values{"fields": {param}}, userFields, nil); err == nil {
+			t.Errorf("%q: expected an unknown field", param)
+		}
+	}
+
+	p := projection([]string{"id", "email"}, userFields)
+	if !reflect.DeepEqual(p, bson.M{"_id": 1, "email": 1}) {
+		t.Errorf("expected the keys of the database, but got %v", p)
+	}
+}
+
+func TestUserJSONFields(t *testing.T) {
+	u := user{ID: bson.NewObjectId(), Name: "Test User", Email: "test@sample.com", fields: []string{"email", "id", "created_at"}}
+	b, err := json.Marshal(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"email":"test@sample.com","id":"` + u.ID.Hex() + `","created_at":"0001-01-01T00:00:00Z"}`
+	if string(b) != expected {
+		t.Errorf("expected %s, but got %s", expected, b)
+	}
+
+	// all the fields without a selection
+	u.fields = nil
+	var all map[string]interface{}
+	b, _ = json.Marshal(u)
+	json.Unmarshal(b, &all)
+	if all["name"] != u.Name || all["updated_at"] == nil {
+		t.Errorf("expected every field, but got %s", b)
+	}
+}
+
+func getUsersJSON(t *testing.T, url string) (int, map[string]json.RawMessage) {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body.Data
+}
+
+func TestUsersHandlerFields(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	keys := func(b json.RawMessage) map[string]bool {
+		var m map[string]interface{}
+		json.Unmarshal(b, &m)
+		k := make(map[string]bool)
+		for key := range m {
+			k[key] = true
+		}
+		return k
+	}
+
+	// the index has a compact default
+	status, d := getUsersJSON(t, ts.URL+"/api/users")
+	var users []json.RawMessage
+	json.Unmarshal(d["users"], &users)
+	if status != http.StatusOK || len(users) != 1 {
+		t.Fatalf("expected a user, but got %d %v", status, d)
+	}
+	expected := map[string]bool{"id": true, "name": true, "username": true, "email": true, "created_at": true}
+	if k := keys(users[0]); !reflect.DeepEqual(k, expected) {
+		t.Errorf("expected %v, but got %v", expected, k)
+	}
+
+	status, d = getUsersJSON(t, ts.URL+"/api/users?fields=mobile")
+	json.Unmarshal(d["users"], &users)
+	expected = map[string]bool{"id": true, "mobile": true}
+	if k := keys(users[0]); status != http.StatusOK || !reflect.DeepEqual(k, expected) {
+		t.Errorf("expected %v, but got %d %v", expected, status, k)
+	}
+
+	url := ts.URL + "/api/users/" + u.ID.Hex()
+	status, d = getUsersJSON(t, url)
+	if k := keys(d["user"]); status != http.StatusOK || !k["mobile"] || !k["updated_at"] || !k["organization_id"] {
+		t.Errorf("expected every field, but got %d %v", status, k)
+	}
+	status, d = getUsersJSON(t, url+"?fields=email")
+	expected = map[string]bool{"id": true, "email": true}
+	if k := keys(d["user"]); status != http.StatusOK || !reflect.DeepEqual(k, expected) {
+		t.Errorf("expected %v, but got %d %v", expected, status, k)
+	}
+
+	for _, u := range []string{ts.URL + "/api/users?fields=password_digest", url + "?fields=name,errors"} {
+		if status, _ = getUsersJSON(t, u); status != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, but got %d", u, http.StatusBadRequest, status)
+		}
+	}
+
+	dropAllCollections(t)
+}
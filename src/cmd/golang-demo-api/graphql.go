@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxGraphQLPage is the largest page of a connection.
+const maxGraphQLPage = 100
+
+// fieldError is a ModelErrors entry as returned by the mutations.
+type fieldError struct {
+	Field    string   `json:"field"`
+	Messages []string `json:"messages"`
+}
+
+func fieldErrors(errs ModelErrors) []fieldError {
+	fields := make([]string, 0, len(errs))
+	for field := range errs {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	list := make([]fieldError, 0, len(fields))
+	for _, field := range fields {
+		list = append(list, fieldError{Field: field, Messages: errs[field]})
+	}
+	return list
+}
+
+var graphqlSchema graphql.Schema
+
+func init() {
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.ID),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*user).ID.Hex(), nil
+				},
+			},
+			"name":      &graphql.Field{Type: graphql.String},
+			"username":  &graphql.Field{Type: graphql.String},
+			"email":     &graphql.Field{Type: graphql.String},
+			"mobile":    &graphql.Field{Type: graphql.String},
+			"role":      &graphql.Field{Type: graphql.String},
+			"invited":   &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"createdAt": &graphql.Field{Type: graphql.DateTime},
+			"updatedAt": &graphql.Field{Type: graphql.DateTime},
+		},
+	})
+
+	userEdgeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UserEdge",
+		Fields: graphql.Fields{
+			"cursor": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"node":   &graphql.Field{Type: graphql.NewNonNull(userType)},
+		},
+	})
+
+	pageInfoType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PageInfo",
+		Fields: graphql.Fields{
+			"hasNextPage":     &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"hasPreviousPage": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"startCursor":     &graphql.Field{Type: graphql.String},
+			"endCursor":       &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	userConnectionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UserConnection",
+		Fields: graphql.Fields{
+			"edges":      &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userEdgeType)))},
+			"pageInfo":   &graphql.Field{Type: graphql.NewNonNull(pageInfoType)},
+			"totalCount": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	fieldErrorType := graphql.NewObject(graphql.ObjectConfig{
+		Name:        "FieldError",
+		Description: "Validation errors of an input field.",
+		Fields: graphql.Fields{
+			"field":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"messages": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+		},
+	})
+
+	userPayloadType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UserPayload",
+		Fields: graphql.Fields{
+			"user":   &graphql.Field{Type: userType},
+			"errors": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(fieldErrorType)))},
+		},
+	})
+
+	deleteUserPayloadType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "DeleteUserPayload",
+		Fields: graphql.Fields{
+			"deletedUserId": &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+		},
+	})
+
+	userInputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UserInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name":                 &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"username":             &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"email":                &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"mobile":               &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"password":             &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"passwordConfirmation": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"currentPassword":      &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "Asked to the users changing their own password."},
+		},
+	})
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"user": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: resolveUser,
+			},
+			"users": &graphql.Field{
+				Type: graphql.NewNonNull(userConnectionType),
+				Args: graphql.FieldConfigArgument{
+					"first": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: perPage},
+					"after": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: resolveUsers,
+			},
+		},
+	})
+
+	mutationType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createUser": &graphql.Field{
+				Type: graphql.NewNonNull(userPayloadType),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(userInputType)},
+				},
+				Resolve: resolveCreateUser,
+			},
+			"updateUser": &graphql.Field{
+				Type: graphql.NewNonNull(userPayloadType),
+				Args: graphql.FieldConfigArgument{
+					"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(userInputType)},
+				},
+				Resolve: resolveUpdateUser,
+			},
+			"deleteUser": &graphql.Field{
+				Type: graphql.NewNonNull(deleteUserPayloadType),
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: resolveDeleteUser,
+			},
+		},
+	})
+
+	var err error
+	graphqlSchema, err = graphql.NewSchema(graphql.SchemaConfig{
+		Query:    queryType,
+		Mutation: mutationType,
+	})
+	if err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
+
+	router.Path("/graphql").
+		HeadersRegexp("Content-Type", "^application/json").
+		Methods("POST").
+		HandlerFunc(graphqlHandler)
+
+	documentOperations(&openAPIOperation{
+		Method:      "POST",
+		Path:        "/graphql",
+		OperationID: "graphql",
+		Summary:     "Runs GraphQL queries and mutations over the users.",
+		Description: "The schema can be read with an introspection query.",
+		Tags:        []string{"graphql"},
+		RequestBody: jsonBody(struct {
+			Query         string                 `json:"query"`
+			Variables     map[string]interface{} `json:"variables,omitempty"`
+			OperationName string                 `json:"operationName,omitempty"`
+		}{}),
+		Responses: map[string]*openAPIResponse{
+			"200": {
+				Description: "The result, errors included.",
+				Content: map[string]*openAPIMediaType{"application/json": {Schema: &openAPISchema{
+					Type: "object",
+					Properties: map[string]*openAPISchema{
+						"data":   {Type: "object", Nullable: true},
+						"errors": {Type: "array", Items: &openAPISchema{Type: "object"}},
+					},
+				}}},
+			},
+			"400": {
+				Description: "Invalid request.",
+				Content:     map[string]*openAPIMediaType{"application/json": {Schema: schemaFor(response{})}},
+			},
+			"429": {
+				Description: "Too many mutations.",
+				Content:     map[string]*openAPIMediaType{"application/json": {Schema: schemaFor(response{})}},
+			},
+		},
+	})
+}
+
+// graphqlHandler runs GraphQL queries and mutations over the users. The
+// schema can be read with an introspection query. Errors are returned in
+// the "errors" member of the result, with a 200 status. A request runs at
+// most 5 mutations, each rate limited like its REST route, and queries
+// are refused when too deep or selecting too many fields.
+// URL: POST /graphql
+// HEADERS:
+//	"Content-Type": "application/json"
+// BODY:
+//	query: The GraphQL document. (required)
+//	variables: Values of the variables of the operation.
+//	operationName: Operation to run when the document has several.
+// EXAMPLE:
+//	{
+//		"query": "query($first: Int) { users(first: $first) { totalCount edges { cursor node { id name } } } }",
+//		"variables": {"first": 10}
+//	}
+func graphqlHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var params struct {
+		Query         string                 `json:"query"`
+		Variables     map[string]interface{} `json:"variables"`
+		OperationName string                 `json:"operationName"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&params); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response{Message: "Invalid GraphQL request."})
+		return
+	}
+
+	if op := parseGraphQLOperation(params.Query, params.OperationName, params.Variables); op != nil {
+		if err := op.check(); err != nil {
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(graphql.Result{
+				Errors: []gqlerrors.FormattedError{gqlerrors.NewFormattedError(err.Error())},
+			})
+			return
+		}
+		if !op.chargeMutations(w, req) {
+			return
+		}
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         graphqlSchema,
+		RequestString:  params.Query,
+		VariableValues: params.Variables,
+		OperationName:  params.OperationName,
+		RootObject:     map[string]interface{}{"request": req},
+		Context:        req.Context(),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// graphqlRequest returns the HTTP request of a resolver.
+func graphqlRequest(p graphql.ResolveParams) *http.Request {
+	return p.Info.RootValue.(map[string]interface{})["request"].(*http.Request)
+}
+
+// graphqlOrganization returns the id of the organization of a resolver.
+func graphqlOrganization(p graphql.ResolveParams) bson.ObjectId {
+	return requestOrganization(graphqlRequest(p)).ID
+}
+
+func resolveUser(p graphql.ResolveParams) (interface{}, error) {
+	u, err := loadUser(graphqlOrganization(p), p.Args["id"].(string))
+	if err != nil {
+		return nil, nil
+	}
+	return u, nil
+}
+
+func resolveUsers(p graphql.ResolveParams) (interface{}, error) {
+	filter := bson.M{"organization_id": graphqlOrganization(p)}
+	first, _ := p.Args["first"].(int)
+	if first < 1 || first > maxGraphQLPage {
+		return nil, errors.New("first must be between 1 and 100.")
+	}
+
+	totalCount, err := config.usersCollection.Find(filter).Count()
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	after, _ := p.Args["after"].(string)
+	if after != "" {
+		id, err := decodeUserCursor(after)
+		if err != nil {
+			return nil, err
+		}
+		filter["_id"] = bson.M{"$lt": id}
+	}
+
+	// newest first, one more than asked tells whether there is a next page
+	var users Users
+	if err = config.usersCollection.Find(filter).Sort("-_id").Limit(first + 1).All(&users); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	hasNextPage := len(users) > first
+	if hasNextPage {
+		users = users[:first]
+	}
+
+	edges := make([]map[string]interface{}, len(users))
+	for i := range users {
+		edges[i] = map[string]interface{}{"cursor": encodeUserCursor(users[i].ID), "node": &users[i]}
+	}
+	pageInfo := map[string]interface{}{"hasNextPage": hasNextPage, "hasPreviousPage": after != ""}
+	if len(edges) > 0 {
+		pageInfo["startCursor"] = edges[0]["cursor"]
+		pageInfo["endCursor"] = edges[len(edges)-1]["cursor"]
+	}
+
+	return map[string]interface{}{
+		"edges":      edges,
+		"pageInfo":   pageInfo,
+		"totalCount": totalCount,
+	}, nil
+}
+
+func resolveCreateUser(p graphql.ResolveParams) (interface{}, error) {
+	u := &user{OrganizationID: graphqlOrganization(p)}
+	u.copyFields(graphqlUserInput(p.Args["input"]))
+	if err := u.Create(); err != nil {
+		log.Println(err)
+		return map[string]interface{}{"errors": fieldErrors(u.Errors)}, nil
+	}
+	userChanged(graphqlRequest(p), auditCreate, nil, u)
+	return map[string]interface{}{"user": u, "errors": []fieldError{}}, nil
+}
+
+func resolveUpdateUser(p graphql.ResolveParams) (interface{}, error) {
+	a := requestActor(graphqlRequest(p))
+	if !a.selfOrAdmin(p.Args["id"].(string)) {
+		return nil, errors.New(errSelfOrAdmin)
+	}
+	u, err := loadUser(graphqlOrganization(p), p.Args["id"].(string))
+	if err != nil {
+		log.Println(err)
+		return nil, errors.New("User not found.")
+	}
+
+	before := *u
+	nu := graphqlUserInput(p.Args["input"])
+	if !checkCurrentPassword(a, u, nu) {
+		return map[string]interface{}{"errors": fieldErrors(u.Errors)}, nil
+	}
+	if err = u.Update(nu); err != nil {
+		log.Println(err)
+		return map[string]interface{}{"errors": fieldErrors(u.Errors)}, nil
+	}
+	userChanged(graphqlRequest(p), auditUpdate, &before, u)
+	return map[string]interface{}{"user": u, "errors": []fieldError{}}, nil
+}
+
+func resolveDeleteUser(p graphql.ResolveParams) (interface{}, error) {
+	if !requestActor(graphqlRequest(p)).selfOrAdmin(p.Args["id"].(string)) {
+		return nil, errors.New(errSelfOrAdmin)
+	}
+	u, err := loadUser(graphqlOrganization(p), p.Args["id"].(string))
+	if err != nil {
+		log.Println(err)
+		return nil, errors.New("User not found.")
+	}
+	if err = config.usersCollection.RemoveId(u.ID); err != nil {
+		log.Println(err)
+		return nil, errors.New("Unable to delete user.")
+	}
+	userChanged(graphqlRequest(p), auditDelete, u, nil)
+	return map[string]interface{}{"deletedUserId": u.ID.Hex()}, nil
+}
+
+// graphqlUserInput converts a UserInput argument, fields left out are nil.
+func graphqlUserInput(arg interface{}) newUser {
+	var nu newUser
+	input, _ := arg.(map[string]interface{})
+	fields := map[string]**string{
+		"name":                 &nu.Name,
+		"username":             &nu.Username,
+		"email":                &nu.Email,
+		"mobile":               &nu.Mobile,
+		"password":             &nu.Password,
+		"passwordConfirmation": &nu.PasswordConfirmation,
+		"currentPassword":      &nu.CurrentPassword,
+	}
+	for name, field := range fields {
+		if v, ok := input[name].(string); ok {
+			*field = &v
+		}
+	}
+	return nu
+}
+
+// encodeUserCursor returns the opaque cursor of a user in a connection.
+func encodeUserCursor(id bson.ObjectId) string {
+	return base64.URLEncoding.EncodeToString([]byte("user:" + id.Hex()))
+}
+
+func decodeUserCursor(cursor string) (bson.ObjectId, error) {
+	b, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(b), "user:") || !bson.IsObjectIdHex(string(b[len("user:"):])) {
+		return "", errors.New("Invalid cursor.")
+	}
+	return bson.ObjectIdHex(string(b[len("user:"):])), nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+const (
+	// maxGraphQLMutations is the most mutations a request can run.
+	maxGraphQLMutations = 5
+	// maxGraphQLDepth is the deepest a query can select, enough for the
+	// introspection queries of the usual clients.
+	maxGraphQLDepth = 15
+	// maxGraphQLCost is the most fields a query can resolve, counting the
+	// fields of every node of a connection.
+	maxGraphQLCost = 5000
+)
+
+// graphqlMutationRoutes are the REST routes doing the work of the
+// mutations, so that each mutation is rate limited like its route.
+var graphqlMutationRoutes = map[string][2]string{
+	"createUser": {"POST", "/api/users"},
+	"updateUser": {"PATCH", "/api/users/id"},
+	"deleteUser": {"DELETE", "/api/users/id"},
+}
+
+// graphqlOperation is the operation a request runs, as checked against
+// the limits before it is run.
+type graphqlOperation struct {
+	def       *ast.OperationDefinition
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+}
+
+// parseGraphQLOperation returns the operation named name of the query, or
+// its only operation. It returns nil when the query is invalid, leaving
+// graphql.Do to report why.
+func parseGraphQLOperation(query, name string, variables map[string]interface{}) *graphqlOperation {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return nil
+	}
+
+	op := &graphqlOperation{fragments: map[string]*ast.FragmentDefinition{}, variables: variables}
+	var defs []*ast.OperationDefinition
+	for _, node := range doc.Definitions {
+		switch def := node.(type) {
+		case *ast.OperationDefinition:
+			if name == "" || (def.Name != nil && def.Name.Value == name) {
+				defs = append(defs, def)
+			}
+		case *ast.FragmentDefinition:
+			op.fragments[def.Name.Value] = def
+		}
+	}
+	if len(defs) != 1 {
+		return nil
+	}
+	op.def = defs[0]
+	return op
+}
+
+// mutations returns the names of the mutations of the operation, none for
+// queries.
+func (op *graphqlOperation) mutations() []string {
+	if op.def.Operation != ast.OperationTypeMutation {
+		return nil
+	}
+	var names []string
+	op.eachField(op.def.SelectionSet, map[string]bool{}, func(f *ast.Field) {
+		names = append(names, f.Name.Value)
+	})
+	return names
+}
+
+// check returns an error when the operation is over the limits.
+func (op *graphqlOperation) check() error {
+	if len(op.mutations()) > maxGraphQLMutations {
+		return errors.New("A request can run at most " + strconv.Itoa(maxGraphQLMutations) + " mutations.")
+	}
+	cost, err := op.cost(op.def.SelectionSet, 1, 1, map[string]bool{})
+	if err != nil {
+		return err
+	}
+	if cost > maxGraphQLCost {
+		return errors.New("The query is too expensive, it can select at most " + strconv.Itoa(maxGraphQLCost) + " fields.")
+	}
+	return nil
+}
+
+// chargeMutations charges the client of req for the route of each
+// mutation, and tells whether every charge was allowed. The requests over
+// the limit are refused.
+func (op *graphqlOperation) chargeMutations(w http.ResponseWriter, req *http.Request) bool {
+	if apiRateLimiter == nil {
+		return true
+	}
+	for _, name := range op.mutations() {
+		route, ok := graphqlMutationRoutes[name]
+		if !ok {
+			continue
+		}
+		res, err := apiRateLimiter.take(req, route[0], route[1])
+		if err != nil {
+			// don't lock everybody out when the store is unavailable
+			log.Println(err)
+			continue
+		}
+		if !res.Allowed {
+			refuseTooManyRequests(w, res)
+			return false
+		}
+	}
+	return true
+}
+
+// cost returns the number of fields the selection resolves, each field
+// being resolved for every node of the connections it is in.
+func (op *graphqlOperation) cost(set *ast.SelectionSet, depth, nodes int, spread map[string]bool) (int, error) {
+	if depth > maxGraphQLDepth {
+		return 0, errors.New("The query is too deep, it can nest at most " + strconv.Itoa(maxGraphQLDepth) + " selections.")
+	}
+	total := 0
+	var err error
+	op.eachField(set, spread, func(f *ast.Field) {
+		if err != nil {
+			return
+		}
+		total += nodes
+		if f.SelectionSet == nil {
+			return
+		}
+		// stop counting past the limit, the counts could overflow
+		children := nodes * op.pageSize(f)
+		if children > maxGraphQLCost {
+			children = maxGraphQLCost + 1
+		}
+		var c int
+		c, err = op.cost(f.SelectionSet, depth+1, children, map[string]bool{})
+		total += c
+		if total > maxGraphQLCost {
+			total = maxGraphQLCost + 1
+		}
+	})
+	return total, err
+}
+
+// pageSize is how many nodes the field returns per node of its parent: the
+// page size of the users connection, one for the other fields.
+func (op *graphqlOperation) pageSize(f *ast.Field) int {
+	if f.Name.Value != "users" {
+		return 1
+	}
+	first := perPage
+	for _, arg := range f.Arguments {
+		if arg.Name.Value != "first" {
+			continue
+		}
+		switch v := arg.Value.(type) {
+		case *ast.IntValue:
+			if n, err := strconv.Atoi(v.Value); err == nil {
+				first = n
+			}
+		case *ast.Variable:
+			if n, ok := op.variables[v.Name.Value].(float64); ok {
+				first = int(n)
+			}
+		}
+	}
+	// larger pages are refused by resolveUsers
+	if first < 1 || first > maxGraphQLPage {
+		return 1
+	}
+	return first
+}
+
+// eachField calls fn with the fields of the selection, the fields of its
+// fragments included. Fragments already in spread are skipped, so cyclic
+// fragments end.
+func (op *graphqlOperation) eachField(set *ast.SelectionSet, spread map[string]bool, fn func(*ast.Field)) {
+	if set == nil {
+		return
+	}
+	for _, sel := range set.Selections {
+		switch s := sel.(type) {
+		case *ast.Field:
+			fn(s)
+		case *ast.InlineFragment:
+			op.eachField(s.SelectionSet, spread, fn)
+		case *ast.FragmentSpread:
+			name := s.Name.Value
+			if frag, ok := op.fragments[name]; ok && !spread[name] {
+				spread[name] = true
+				op.eachField(frag.SelectionSet, spread, fn)
+			}
+		}
+	}
+}
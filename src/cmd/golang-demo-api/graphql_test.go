@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/graphql-go/graphql/testutil"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// graphqlResult is the result of a GraphQL request.
+type graphqlResult struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func postGraphQL(t *testing.T, url, query string, variables map[string]interface{}) graphqlResult {
+	body, err := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", url+"/graphql", bytes.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var result graphqlResult
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestGraphQLUsers(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	other := user{
+		Name:                 "Other User",
+		Username:             "other_user",
+		Email:                "other@sample.com",
+		Password:             "test123#",
+		PasswordConfirmation: "test123#",
+	}
+	if err := other.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	query := `query($after: String) {
+		users(first: 1, after: $after) {
+			totalCount
+			edges { cursor node { id username } }
+			pageInfo { hasNextPage endCursor }
+		}
+		user(id: "` + u.ID.Hex() + `") { email }
+	}`
+	var data struct {
+		Users struct {
+			TotalCount int
+			Edges      []struct {
+				Cursor string
+				Node   struct{ ID, Username string }
+			}
+			PageInfo struct {
+				HasNextPage bool
+				EndCursor   string
+			}
+		}
+		User struct{ Email string }
+	}
+
+	result := postGraphQL(t, ts.URL, query, nil)
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	json.Unmarshal(result.Data, &data)
+	if data.Users.TotalCount != 2 {
+		t.Errorf("expected %d users, but got %d", 2, data.Users.TotalCount)
+	}
+	if len(data.Users.Edges) != 1 || data.Users.Edges[0].Node.Username != other.Username {
+		t.Errorf("expected the newest user first, but got %v", data.Users.Edges)
+	}
+	if !data.Users.PageInfo.HasNextPage {
+		t.Errorf("expected a next page")
+	}
+	if data.User.Email != u.Email {
+		t.Errorf("expected %s, but got %s", u.Email, data.User.Email)
+	}
+
+	result = postGraphQL(t, ts.URL, query, map[string]interface{}{"after": data.Users.PageInfo.EndCursor})
+	json.Unmarshal(result.Data, &data)
+	if len(data.Users.Edges) != 1 || data.Users.Edges[0].Node.ID != u.ID.Hex() {
+		t.Errorf("expected %s on the second page, but got %v", u.ID.Hex(), data.Users.Edges)
+	}
+	if data.Users.PageInfo.HasNextPage {
+		t.Errorf("expected no next page")
+	}
+	dropAllCollections(t)
+}
+
+func TestGraphQLCreateUser(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	mutation := `mutation($input: UserInput!) {
+		createUser(input: $input) { user { id name } errors { field messages } }
+	}`
+	var data struct {
+		CreateUser struct {
+			User   *struct{ ID, Name string }
+			Errors []fieldError
+		}
+	}
+
+	result := postGraphQL(t, ts.URL, mutation, map[string]interface{}{"input": map[string]interface{}{
+		"name": "Test", "username": u.Username, "email": "test@test.com",
+		"password": "test123", "passwordConfirmation": "test123",
+	}})
+	json.Unmarshal(result.Data, &data)
+	if data.CreateUser.User != nil {
+		t.Errorf("expected no user, but got %v", data.CreateUser.User)
+	}
+	if len(data.CreateUser.Errors) != 1 || data.CreateUser.Errors[0].Field != "username" {
+		t.Errorf("expected an error on username, but got %v", data.CreateUser.Errors)
+	}
+
+	result = postGraphQL(t, ts.URL, mutation, map[string]interface{}{"input": map[string]interface{}{
+		"name": "Test", "username": "test", "email": "test@test.com",
+		"password": "test123", "passwordConfirmation": "test123",
+	}})
+	json.Unmarshal(result.Data, &data)
+	if data.CreateUser.User == nil || data.CreateUser.User.Name != "Test" {
+		t.Fatalf("expected the created user, but got %v", data.CreateUser.Errors)
+	}
+	if _, err := loadUser(defaultOrganization.ID, data.CreateUser.User.ID); err != nil {
+		t.Error(err)
+	}
+	dropAllCollections(t)
+}
+
+func TestGraphQLIntrospection(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	result := postGraphQL(t, ts.URL, `{ __type(name: "User") { fields { name } } }`, nil)
+	var data struct {
+		Type struct {
+			Fields []struct{ Name string }
+		} `json:"__type"`
+	}
+	json.Unmarshal(result.Data, &data)
+	if len(data.Type.Fields) == 0 {
+		t.Errorf("expected the fields of User, but got %s", result.Data)
+	}
+}
+
+func TestGraphQLOperationLimits(t *testing.T) {
+	createUser := `createUser(input: {name: "a", username: "a", email: "a@a.com"}) { user { id } }`
+	tests := []struct {
+		query     string
+		variables map[string]interface{}
+		allowed   bool
+	}{
+		{testutil.IntrospectionQuery, nil, true},
+		{`{ users(first: 100) { edges { node { id name email } } } }`, nil, true},
+		{`mutation { a: ` + createUser + ` b: ` + createUser + ` }`, nil, true},
+		{`mutation { ...M } fragment M on Mutation { a: ` + createUser + ` b: ` + createUser + ` c: ` + createUser + ` d: ` + createUser + ` e: ` + createUser + ` f: ` + createUser + ` }`, nil, false},
+		{`mutation { a: ` + createUser + ` b: ` + createUser + ` c: ` + createUser + ` d: ` + createUser + ` e: ` + createUser + ` f: ` + createUser + ` }`, nil, false},
+		{`{ a: users(first: 100) { edges { node { ` + strings.Repeat("id ", 60) + ` } } } }`, nil, false},
+		{`query($n: Int) { users(first: $n) { edges { node { ` + strings.Repeat("id ", 60) + ` } } } }`, map[string]interface{}{"n": 100.0}, false},
+		{`query($n: Int) { users(first: $n) { edges { node { ` + strings.Repeat("id ", 60) + ` } } } }`, map[string]interface{}{"n": 10.0}, true},
+		{`{ __schema { types { fields { type { ` + strings.Repeat("ofType { ", 12) + `name` + strings.Repeat(" }", 16) + ` }`, nil, false},
+		{`{ users { ...F } } fragment F on UserConnection { edges { node { id } } ...F }`, nil, true},
+	}
+
+	for _, test := range tests {
+		op := parseGraphQLOperation(test.query, "", test.variables)
+		if op == nil {
+			t.Errorf("expected %q to parse", test.query)
+			continue
+		}
+		if err := op.check(); (err == nil) != test.allowed {
+			t.Errorf("expected %q to be allowed: %v, but got %v", test.query, test.allowed, err)
+		}
+	}
+}
+
+func TestGraphQLMutationsRateLimited(t *testing.T) {
+	apiRateLimiter = newRateLimiter(newMemoryRateLimitStore(), defaultRateLimit, rateLimitRule{
+		Name:    "create_user",
+		Methods: []string{"POST"},
+		Path:    rateLimitRules[0].Path,
+		Limit:   rateLimit{Requests: 2, Per: time.Minute},
+	})
+	defer func() { apiRateLimiter = nil }()
+	ts := newTestServer()
+	defer ts.Close()
+
+	mutation := `mutation {
+		a: createUser(input: {name: "A", username: "a", email: "a@test.com", password: "test123", passwordConfirmation: "test123"}) { user { id } }
+		b: createUser(input: {name: "B", username: "b", email: "b@test.com", password: "test123", passwordConfirmation: "test123"}) { user { id } }
+	}`
+	postGraphQL(t, ts.URL, mutation, nil)
+
+	// the bucket of create_user is empty, nothing is run
+	body, _ := json.Marshal(map[string]interface{}{"query": strings.Replace(mutation, `"a`, `"c`, -1)})
+	req, _ := http.NewRequest("POST", ts.URL+"/graphql", bytes.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected %d, but got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	if n, _ := config.usersCollection.Find(bson.M{"username": "c"}).Count(); n != 0 {
+		t.Errorf("expected the refused mutations not to run, but got %d users", n)
+	}
+	dropAllCollections(t)
+}
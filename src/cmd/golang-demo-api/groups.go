@@ -0,0 +1,822 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Roles of the members of a group.
+const (
+	groupMember     = "member"
+	groupMaintainer = "maintainer"
+	groupOwner      = "owner"
+)
+
+var groupRoles = []string{groupMember, groupMaintainer, groupOwner}
+
+// group is a team of users of an organization.
+type group struct {
+	ID             bson.ObjectId `bson:"_id" json:"id"`
+	OrganizationID bson.ObjectId `bson:"organization_id" json:"-"`
+	Name           string        `bson:"name" json:"name"`
+	Description    string        `bson:"description,omitempty" json:"description,omitempty"`
+	CreatedAt      time.Time     `bson:"created_at" json:"created_at"`
+	UpdatedAt      time.Time     `bson:"updated_at" json:"updated_at"`
+	// Role is the role of the user the groups are listed for.
+	Role   string      `bson:"-" json:"role,omitempty"`
+	Errors ModelErrors `bson:"-" json:"errors,omitempty"`
+}
+
+type newGroup struct {
+	Name        *string `json:"name,omitempty"`
+	Description *string `json:"description,omitempty"`
+}
+
+// Groups represents a collection of group objects
+type Groups []group
+
+// membership is the membership of a user in a group.
+type membership struct {
+	ID        bson.ObjectId `bson:"_id" json:"id"`
+	GroupID   bson.ObjectId `bson:"group_id" json:"group_id"`
+	UserID    bson.ObjectId `bson:"user_id" json:"user_id"`
+	Role      string        `bson:"role" json:"role"`
+	CreatedAt time.Time     `bson:"created_at" json:"created_at"`
+	User      *user         `bson:"-" json:"user,omitempty"`
+	Errors    ModelErrors   `bson:"-" json:"errors,omitempty"`
+}
+
+type newMembership struct {
+	UserID *string `json:"user_id,omitempty"`
+	Role   *string `json:"role,omitempty"`
+}
+
+// Memberships represents a collection of membership objects
+type Memberships []membership
+
+func init() {
+	groupsRouter := router.Path("/api/groups").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Subrouter()
+
+	groupsRouter.Methods("GET").HandlerFunc(groupsHandler)
+	groupsRouter.Methods("POST").HandlerFunc(createGroupHandler)
+
+	groupRouter := router.Path("/api/groups/{id}").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Subrouter()
+
+	groupRouter.Methods("GET").HandlerFunc(showGroupHandler)
+	groupRouter.Methods("PUT", "PATCH").HandlerFunc(updateGroupHandler)
+	groupRouter.Methods("DELETE").HandlerFunc(deleteGroupHandler)
+
+	membersRouter := router.Path("/api/groups/{id}/members").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Subrouter()
+
+	membersRouter.Methods("GET").HandlerFunc(groupMembersHandler)
+	membersRouter.Methods("POST").HandlerFunc(addGroupMemberHandler)
+
+	memberRouter := router.Path("/api/groups/{id}/members/{user_id}").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Subrouter()
+
+	memberRouter.Methods("PUT", "PATCH").HandlerFunc(updateGroupMemberHandler)
+	memberRouter.Methods("DELETE").HandlerFunc(removeGroupMemberHandler)
+
+	router.Path("/api/users/{id}/groups").
+		HeadersRegexp("Content-Type", requestContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("GET").
+		HandlerFunc(userGroupsHandler)
+
+	// the memberships of deleted users are removed, whatever deleted them
+	onUserEvent(func(e userEvent) {
+		if e.Type == userDeleted {
+			if _, err := config.membershipsCollection.RemoveAll(bson.M{"user_id": e.User.ID}); err != nil {
+				log.Println(err)
+			}
+		}
+	})
+
+	groupBody := jsonBody(struct {
+		Group newGroup `json:"group"`
+	}{})
+	memberBody := jsonBody(struct {
+		Member newMembership `json:"member"`
+	}{})
+	groupID := pathParam("id", "ID of the group")
+	memberID := pathParam("user_id", "ID of the member")
+	documentOperations(
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/groups",
+			OperationID: "listGroups",
+			Summary:     "Returns paginated groups, newest first.",
+			Tags:        []string{"groups"},
+			Parameters: []*openAPIParameter{
+				pageParam,
+				queryParam("q", "Search text matched against the name", &openAPISchema{Type: "string"}),
+			},
+			Responses: envelopeResponses(http.StatusOK),
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/groups",
+			OperationID: "createGroup",
+			Summary:     "Creates a group.",
+			Tags:        []string{"groups"},
+			RequestBody: groupBody,
+			Responses:   envelopeResponses(http.StatusOK, http.StatusBadRequest, 422),
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/groups/{id}",
+			OperationID: "showGroup",
+			Summary:     "Returns a group.",
+			Tags:        []string{"groups"},
+			Parameters:  []*openAPIParameter{groupID},
+			Responses:   envelopeResponses(http.StatusOK, 422),
+		},
+		&openAPIOperation{
+			Method:      "PUT",
+			Path:        "/api/groups/{id}",
+			OperationID: "updateGroup",
+			Summary:     "Updates a group, fields left out are unchanged.",
+			Tags:        []string{"groups"},
+			Parameters:  []*openAPIParameter{groupID},
+			RequestBody: groupBody,
+			Responses:   envelopeResponses(http.StatusOK, http.StatusBadRequest, 422),
+		},
+		&openAPIOperation{
+			Method:      "PATCH",
+			Path:        "/api/groups/{id}",
+			OperationID: "patchGroup",
+			Summary:     "Same as updateGroup.",
+			Tags:        []string{"groups"},
+			Parameters:  []*openAPIParameter{groupID},
+			RequestBody: groupBody,
+			Responses:   envelopeResponses(http.StatusOK, http.StatusBadRequest, 422),
+		},
+		&openAPIOperation{
+			Method:      "DELETE",
+			Path:        "/api/groups/{id}",
+			OperationID: "deleteGroup",
+			Summary:     "Deletes a group and its memberships.",
+			Tags:        []string{"groups"},
+			Parameters:  []*openAPIParameter{groupID},
+			Responses:   envelopeResponses(http.StatusOK, 422),
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/groups/{id}/members",
+			OperationID: "listGroupMembers",
+			Summary:     "Returns the paginated members of a group with their user, oldest first.",
+			Tags:        []string{"groups"},
+			Parameters: []*openAPIParameter{
+				groupID,
+				pageParam,
+				queryParam("role", "Role of the members", &openAPISchema{Type: "string", Enum: groupRoles}),
+			},
+			Responses: envelopeResponses(http.StatusOK, 422),
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/groups/{id}/members",
+			OperationID: "addGroupMember",
+			Summary:     "Adds a user to a group, as a member unless another role is given.",
+			Tags:        []string{"groups"},
+			Parameters:  []*openAPIParameter{groupID},
+			RequestBody: memberBody,
+			Responses:   envelopeResponses(http.StatusOK, http.StatusBadRequest, 422),
+		},
+		&openAPIOperation{
+			Method:      "PUT",
+			Path:        "/api/groups/{id}/members/{user_id}",
+			OperationID: "updateGroupMember",
+			Summary:     "Changes the role of a member.",
+			Tags:        []string{"groups"},
+			Parameters:  []*openAPIParameter{groupID, memberID},
+			RequestBody: memberBody,
+			Responses:   envelopeResponses(http.StatusOK, http.StatusBadRequest, 422),
+		},
+		&openAPIOperation{
+			Method:      "PATCH",
+			Path:        "/api/groups/{id}/members/{user_id}",
+			OperationID: "patchGroupMember",
+			Summary:     "Same as updateGroupMember.",
+			Tags:        []string{"groups"},
+			Parameters:  []*openAPIParameter{groupID, memberID},
+			RequestBody: memberBody,
+			Responses:   envelopeResponses(http.StatusOK, http.StatusBadRequest, 422),
+		},
+		&openAPIOperation{
+			Method:      "DELETE",
+			Path:        "/api/groups/{id}/members/{user_id}",
+			OperationID: "removeGroupMember",
+			Summary:     "Removes a user from a group.",
+			Tags:        []string{"groups"},
+			Parameters:  []*openAPIParameter{groupID, memberID},
+			Responses:   envelopeResponses(http.StatusOK, 422),
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/users/{id}/groups",
+			OperationID: "userGroups",
+			Summary:     "Returns the paginated groups of a user with the role of the user, newest first.",
+			Tags:        []string{"groups"},
+			Parameters:  []*openAPIParameter{pathParam("id", "ID of the user"), pageParam},
+			Responses:   envelopeResponses(http.StatusOK, 422),
+		},
+	)
+}
+
+// ensureGroupIndexes creates the indexes of the groups and memberships.
+func ensureGroupIndexes() error {
+	if err := config.groupsCollection.EnsureIndexKey("organization_id", "-created_at"); err != nil {
+		return err
+	}
+	err := config.membershipsCollection.EnsureIndex(mgo.Index{Key: []string{"group_id", "user_id"}, Unique: true})
+	if err != nil {
+		return err
+	}
+	return config.membershipsCollection.EnsureIndexKey("user_id")
+}
+
+func (g *group) Create() error {
+	g.ID = bson.NewObjectId()
+	if !g.Valid() {
+		return errors.New("Group Invalid")
+	}
+	g.CreatedAt = g.ID.Time()
+	g.UpdatedAt = g.CreatedAt
+	return config.groupsCollection.Insert(g)
+}
+
+func (g *group) Update(ng newGroup) error {
+	g.copyFields(ng)
+	if !g.Valid() {
+		return errors.New("Group Invalid")
+	}
+	g.UpdatedAt = bson.Now()
+	return config.groupsCollection.UpdateId(g.ID, g)
+}
+
+// Valid checks the fields of the group. Names are unique in the
+// organization.
+func (g *group) Valid() bool {
+	g.Errors = make(ModelErrors)
+	if strings.TrimSpace(g.Name) == "" {
+		g.Errors["name"] = append(g.Errors["name"], "can't be blank")
+	} else if n, _ := config.groupsCollection.Find(bson.M{
+		"_id":             bson.M{"$ne": g.ID},
+		"organization_id": g.OrganizationID,
+		"name":            g.Name,
+	}).Count(); n > 0 {
+		g.Errors["name"] = append(g.Errors["name"], "is already taken")
+	}
+	return len(g.Errors) == 0
+}
+
+func (g *group) copyFields(ng newGroup) {
+	if ng.Name != nil {
+		g.Name = *ng.Name
+	}
+	if ng.Description != nil {
+		g.Description = *ng.Description
+	}
+}
+
+// validGroupRole adds an error to errs when role isn't a role of the members.
+func validGroupRole(role string, errs ModelErrors) {
+	for _, r := range groupRoles {
+		if role == r {
+			return
+		}
+	}
+	errs["role"] = append(errs["role"], "must be one of "+strings.Join(groupRoles, ", "))
+}
+
+// groupsHandler returns paginated groups of the organization.
+// URL: GET /api/groups
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"page": Current page number(per page 20 records)
+//	"q": Search text matched against the name
+func groupsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	filter := bson.M{"organization_id": requestOrganization(req).ID}
+	if q := req.URL.Query().Get("q"); q != "" {
+		filter["name"] = bson.RegEx{Pattern: regexp.QuoteMeta(q), Options: "i"}
+	}
+
+	var groups Groups
+	var offset int
+	page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+	if page != 0 {
+		offset = (page - 1) * perPage
+	}
+	config.groupsCollection.Find(filter).Sort("-created_at").Limit(perPage).Skip(offset).All(&groups)
+
+	total, err := config.groupsCollection.Find(filter).Count()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := response{data: &data{Total: total, Groups: groups}}
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// createGroupHandler can be used to add a group.
+// URL: POST /api/groups
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// BODY:
+//	group[name]: Name of the group, unique in the organization. (required)
+//	group[description]: What the group is for.
+// EXAMPLE:
+//	{
+//		"group": {
+//			"name": "Support",
+//			"description": "Answers the tickets of the customers"
+//		}
+//	}
+func createGroupHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var params struct {
+		Group newGroup `json:"group"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&params); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var resp *response
+	g := &group{OrganizationID: requestOrganization(req).ID}
+	g.copyFields(params.Group)
+	if err := g.Create(); err != nil {
+		log.Println(err)
+		resp = &response{
+			Message: "Unable to save group. Please correct the errors and try again.",
+			data:    &data{Errors: g.Errors},
+		}
+		w.WriteHeader(422)
+	} else {
+		resp = &response{Message: "Group successfully created.", data: &data{group: g}}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// showGroupHandler returns a group.
+// URL: GET /api/groups/:id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the group
+func showGroupHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var resp *response
+	if g, err := loadGroup(requestOrganization(req).ID, mux.Vars(req)["id"]); err != nil {
+		log.Println(err)
+		resp = &response{Message: "Group not found."}
+		w.WriteHeader(422)
+	} else {
+		resp = &response{data: &data{group: g}}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// updateGroupHandler can be used to update a group.
+// URL: PUT|PATCH /api/groups/:id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// BODY:
+//	Same as createGroupHandler, fields left out are unchanged.
+func updateGroupHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var params struct {
+		Group newGroup `json:"group"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&params); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	g, err := loadGroup(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		w.Write([]byte(`{"message": "Group not found."}`))
+		return
+	}
+
+	var resp *response
+	if err = g.Update(params.Group); err != nil {
+		log.Println(err)
+		resp = &response{
+			Message: "Unable to update group. Please correct the errors and try again.",
+			data:    &data{Errors: g.Errors},
+		}
+		w.WriteHeader(422)
+	} else {
+		resp = &response{Message: "Group updated successfully.", data: &data{group: g}}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// deleteGroupHandler deletes a group and its memberships.
+// URL: DELETE /api/groups/:id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the group
+func deleteGroupHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var resp *response
+	if g, err := loadGroup(requestOrganization(req).ID, mux.Vars(req)["id"]); err != nil {
+		log.Println(err)
+		resp = &response{Message: "Group not found."}
+		w.WriteHeader(422)
+	} else if err = config.groupsCollection.RemoveId(g.ID); err != nil {
+		log.Println(err)
+		resp = &response{Message: "Unable to delete group."}
+		w.WriteHeader(422)
+	} else {
+		if _, err = config.membershipsCollection.RemoveAll(bson.M{"group_id": g.ID}); err != nil {
+			log.Println(err)
+		}
+		resp = &response{Message: "Group deleted successfully."}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// groupMembersHandler returns the paginated members of a group, oldest
+// first, with their user.
+// URL: GET /api/groups/:id/members
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the group
+//	"page": Current page number(per page 20 records)
+//	"role": Only the members with this role
+func groupMembersHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	g, err := loadGroup(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		w.Write([]byte(`{"message": "Group not found."}`))
+		return
+	}
+
+	filter := bson.M{"group_id": g.ID}
+	if role := req.URL.Query().Get("role"); role != "" {
+		filter["role"] = role
+	}
+	var members Memberships
+	var offset int
+	page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+	if page != 0 {
+		offset = (page - 1) * perPage
+	}
+	config.membershipsCollection.Find(filter).Sort("_id").Limit(perPage).Skip(offset).All(&members)
+
+	total, err := config.membershipsCollection.Find(filter).Count()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err = loadMemberUsers(members); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := response{data: &data{Total: total, Memberships: members}}
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// addGroupMemberHandler adds a user of the organization to a group.
+// URL: POST /api/groups/:id/members
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the group
+// BODY:
+//	member[user_id]: ID of the user. (required)
+//	member[role]: One of member (default), maintainer and owner.
+// EXAMPLE:
+//	{
+//		"member": {
+//			"user_id": "5a1f0e2b9d1e8a3c4b6f7d20",
+//			"role": "maintainer"
+//		}
+//	}
+func addGroupMemberHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	var params struct {
+		Member newMembership `json:"member"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&params); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	orgID := requestOrganization(req).ID
+	g, err := loadGroup(orgID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "Group not found."})
+		return
+	}
+
+	m := &membership{ID: bson.NewObjectId(), GroupID: g.ID, Role: groupMember, Errors: make(ModelErrors)}
+	if params.Member.Role != nil {
+		m.Role = *params.Member.Role
+	}
+	validGroupRole(m.Role, m.Errors)
+	if params.Member.UserID == nil || *params.Member.UserID == "" {
+		m.Errors["user_id"] = append(m.Errors["user_id"], "can't be blank")
+	} else if u, err := loadUser(orgID, *params.Member.UserID); err != nil {
+		m.Errors["user_id"] = append(m.Errors["user_id"], "is not a user")
+	} else {
+		m.UserID, m.User = u.ID, u
+	}
+	if len(m.Errors) == 0 {
+		m.CreatedAt = m.ID.Time()
+		err = config.membershipsCollection.Insert(m)
+		if mgo.IsDup(err) {
+			m.Errors["user_id"] = append(m.Errors["user_id"], "is already a member")
+		} else if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if len(m.Errors) > 0 {
+		w.WriteHeader(422)
+		encoder.Encode(response{
+			Message: "Unable to add member. Please correct the errors and try again.",
+			data:    &data{Errors: m.Errors},
+		})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err = encoder.Encode(response{Message: "Member added successfully.", data: &data{membership: m}}); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// updateGroupMemberHandler changes the role of a member of a group.
+// URL: PUT|PATCH /api/groups/:id/members/:user_id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the group
+//	"user_id": ID of the member
+// BODY:
+//	member[role]: One of member, maintainer and owner. (required)
+func updateGroupMemberHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	var params struct {
+		Member newMembership `json:"member"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&params); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	m, err := loadMembership(requestOrganization(req).ID, mux.Vars(req)["id"], mux.Vars(req)["user_id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "Member not found."})
+		return
+	}
+
+	errs := make(ModelErrors)
+	if params.Member.Role == nil {
+		errs["role"] = append(errs["role"], "can't be blank")
+	} else {
+		validGroupRole(*params.Member.Role, errs)
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(422)
+		encoder.Encode(response{
+			Message: "Unable to update member. Please correct the errors and try again.",
+			data:    &data{Errors: errs},
+		})
+		return
+	}
+	m.Role = *params.Member.Role
+	if err = config.membershipsCollection.UpdateId(m.ID, bson.M{"$set": bson.M{"role": m.Role}}); err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "Unable to update member."})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err = encoder.Encode(response{Message: "Member updated successfully.", data: &data{membership: m}}); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// removeGroupMemberHandler removes a user from a group.
+// URL: DELETE /api/groups/:id/members/:user_id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the group
+//	"user_id": ID of the member
+func removeGroupMemberHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var resp *response
+	if m, err := loadMembership(requestOrganization(req).ID, mux.Vars(req)["id"], mux.Vars(req)["user_id"]); err != nil {
+		log.Println(err)
+		resp = &response{Message: "Member not found."}
+		w.WriteHeader(422)
+	} else if err = config.membershipsCollection.RemoveId(m.ID); err != nil {
+		log.Println(err)
+		resp = &response{Message: "Unable to remove member."}
+		w.WriteHeader(422)
+	} else {
+		resp = &response{Message: "Member removed successfully."}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// userGroupsHandler returns the paginated groups of a user, newest first,
+// with the role of the user in each.
+// URL: GET /api/users/:id/groups
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the user
+//	"page": Current page number(per page 20 records)
+func userGroupsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	u, err := loadUser(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		w.Write([]byte(`{"message": "User not found."}`))
+		return
+	}
+
+	var memberships Memberships
+	if err = config.membershipsCollection.Find(bson.M{"user_id": u.ID}).All(&memberships); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	roles := make(map[bson.ObjectId]string)
+	ids := make([]bson.ObjectId, len(memberships))
+	for i, m := range memberships {
+		roles[m.GroupID] = m.Role
+		ids[i] = m.GroupID
+	}
+
+	var groups Groups
+	var offset int
+	page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+	if page != 0 {
+		offset = (page - 1) * perPage
+	}
+	filter := bson.M{"_id": bson.M{"$in": ids}, "organization_id": u.OrganizationID}
+	config.groupsCollection.Find(filter).Sort("-created_at").Limit(perPage).Skip(offset).All(&groups)
+	for i := range groups {
+		groups[i].Role = roles[groups[i].ID]
+	}
+
+	total, err := config.groupsCollection.Find(filter).Count()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := response{data: &data{Total: total, Groups: groups}}
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// loadMemberUsers sets the user of the memberships with one query.
+func loadMemberUsers(members Memberships) error {
+	ids := make([]bson.ObjectId, len(members))
+	for i, m := range members {
+		ids[i] = m.UserID
+	}
+	var users Users
+	if err := config.usersCollection.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&users); err != nil {
+		return err
+	}
+	byID := make(map[bson.ObjectId]*user, len(users))
+	for i := range users {
+		byID[users[i].ID] = &users[i]
+	}
+	for i := range members {
+		members[i].User = byID[members[i].UserID]
+	}
+	return nil
+}
+
+// loadGroup loads a group of the organization.
+func loadGroup(orgID bson.ObjectId, id string) (*group, error) {
+	var g group
+	if !bson.IsObjectIdHex(id) {
+		return &g, errors.New("Invalid group id.")
+	}
+	err := config.groupsCollection.Find(bson.M{"_id": bson.ObjectIdHex(id), "organization_id": orgID}).One(&g)
+	return &g, err
+}
+
+// loadMembership loads the membership of a user in a group of the
+// organization.
+func loadMembership(orgID bson.ObjectId, groupID, userID string) (*membership, error) {
+	var m membership
+	g, err := loadGroup(orgID, groupID)
+	if err != nil {
+		return &m, err
+	}
+	if !bson.IsObjectIdHex(userID) {
+		return &m, errors.New("Invalid user id.")
+	}
+	err = config.membershipsCollection.Find(bson.M{"group_id": g.ID, "user_id": bson.ObjectIdHex(userID)}).One(&m)
+	return &m, err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"client"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestGroupHandlers(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	if err := ensureGroupIndexes(); err != nil {
+		t.Fatal(err)
+	}
+
+	status, r := doOrganizationRequest(t, "POST", ts.URL+"/api/groups", `{"group":{"name":""}}`)
+	if status != 422 || len(r.Errors["name"]) == 0 {
+		t.Errorf("expected the name to be required, but got %d %v", status, r.Errors)
+	}
+	status, r = doOrganizationRequest(t, "POST", ts.URL+"/api/groups", `{"group":{"name":"Support","description":"Tickets"}}`)
+	if status != http.StatusOK || r.group == nil {
+		t.Fatalf("expected %d, but got %d: %s %v", http.StatusOK, status, r.Message, r.Errors)
+	}
+	url := ts.URL + "/api/groups/" + r.group.ID.Hex()
+	status, r = doOrganizationRequest(t, "POST", ts.URL+"/api/groups", `{"group":{"name":"Support"}}`)
+	if status != 422 || len(r.Errors["name"]) == 0 {
+		t.Errorf("expected the name to be taken, but got %d %v", status, r.Errors)
+	}
+	status, r = doOrganizationRequest(t, "PATCH", url, `{"group":{"name":"Customer Support"}}`)
+	if status != http.StatusOK || r.group.Name != "Customer Support" || r.group.Description != "Tickets" {
+		t.Errorf("expected the name to change, but got %d %+v", status, r.group)
+	}
+	for i := 0; i < perPage; i++ {
+		g := &group{OrganizationID: defaultOrganization.ID, Name: "Group " + string('A'+rune(i))}
+		if err := g.Create(); err != nil {
+			t.Fatal(err, g.Errors)
+		}
+	}
+	status, r = doOrganizationRequest(t, "GET", ts.URL+"/api/groups?page=2", "")
+	if status != http.StatusOK || r.Total != perPage+1 || len(r.Groups) != 1 || r.Groups[0].Name != "Customer Support" {
+		t.Errorf("expected the oldest group on the second page, but got %d %d %v", status, r.Total, r.Groups)
+	}
+
+	// members
+	u := setupUser(t)
+	members := url + "/members"
+	status, r = doOrganizationRequest(t, "POST", members, `{"member":{"user_id":"`+u.ID.Hex()+`","role":"admin"}}`)
+	if status != 422 || len(r.Errors["role"]) == 0 {
+		t.Errorf("expected the role to be refused, but got %d %v", status, r.Errors)
+	}
+	status, r = doOrganizationRequest(t, "POST", members, `{"member":{"user_id":"`+bson.NewObjectId().Hex()+`"}}`)
+	if status != 422 || len(r.Errors["user_id"]) == 0 {
+		t.Errorf("expected the user to be refused, but got %d %v", status, r.Errors)
+	}
+	status, r = doOrganizationRequest(t, "POST", members, `{"member":{"user_id":"`+u.ID.Hex()+`"}}`)
+	if status != http.StatusOK || r.membership.Role != groupMember {
+		t.Fatalf("expected a member, but got %d: %s %v", status, r.Message, r.Errors)
+	}
+	status, r = doOrganizationRequest(t, "POST", members, `{"member":{"user_id":"`+u.ID.Hex()+`"}}`)
+	if status != 422 || len(r.Errors["user_id"]) == 0 {
+		t.Errorf("expected the user to be a member already, but got %d %v", status, r.Errors)
+	}
+	status, r = doOrganizationRequest(t, "PATCH", members+"/"+u.ID.Hex(), `{"member":{"role":"owner"}}`)
+	if status != http.StatusOK || r.membership.Role != groupOwner {
+		t.Errorf("expected an owner, but got %d %v", status, r.Errors)
+	}
+	status, r = doOrganizationRequest(t, "GET", members, "")
+	if status != http.StatusOK || r.Total != 1 || r.Memberships[0].User == nil || r.Memberships[0].User.ID != u.ID {
+		t.Errorf("expected the member with the user, but got %d %+v", status, r.Memberships)
+	}
+	status, r = doOrganizationRequest(t, "GET", ts.URL+"/api/users/"+u.ID.Hex()+"/groups", "")
+	if status != http.StatusOK || r.Total != 1 || r.Groups[0].Role != groupOwner {
+		t.Errorf("expected the group of the user, but got %d %+v", status, r.Groups)
+	}
+	if status, _ = doOrganizationRequest(t, "DELETE", members+"/"+u.ID.Hex(), ""); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	if status, _ = doOrganizationRequest(t, "DELETE", members+"/"+u.ID.Hex(), ""); status != 422 {
+		t.Errorf("expected %d, but got %d", 422, status)
+	}
+
+	// deleting the group removes its memberships
+	doOrganizationRequest(t, "POST", members, `{"member":{"user_id":"`+u.ID.Hex()+`"}}`)
+	if status, _ = doOrganizationRequest(t, "DELETE", url, ""); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	if n, _ := config.membershipsCollection.Find(bson.M{"user_id": u.ID}).Count(); n != 0 {
+		t.Errorf("expected no membership, but got %d", n)
+	}
+
+	dropAllCollections(t)
+}
+
+func TestGroupMembershipsOfDeletedUsers(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	g := &group{OrganizationID: defaultOrganization.ID, Name: "Support"}
+	if err := g.Create(); err != nil {
+		t.Fatal(err, g.Errors)
+	}
+	status, r := doOrganizationRequest(t, "POST", ts.URL+"/api/groups/"+g.ID.Hex()+"/members", `{"member":{"user_id":"`+u.ID.Hex()+`"}}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected %d, but got %d: %s %v", http.StatusOK, status, r.Message, r.Errors)
+	}
+
+	admin := adminServer()
+	defer admin.Close()
+	if err := client.New(admin.URL).DeleteUser(context.Background(), u.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := config.membershipsCollection.Find(bson.M{"user_id": u.ID}).Count(); n != 0 {
+		t.Errorf("expected the memberships to be removed, but got %d", n)
+	}
+
+	dropAllCollections(t)
+}
+
+func TestNoCrossTenantGroups(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	acme, acmeUser := setupOrganization(t, "acme", 0)
+	_, globexUser := setupOrganization(t, "globex", 0)
+	g := &group{OrganizationID: acme.ID, Name: "Support"}
+	if err := g.Create(); err != nil {
+		t.Fatal(err, g.Errors)
+	}
+
+	// the groups of acme aren't visible from the default organization
+	status, r := doOrganizationRequest(t, "GET", ts.URL+"/api/groups", "")
+	if status != http.StatusOK || r.Total != 0 {
+		t.Errorf("expected no group, but got %d %v", status, r.Groups)
+	}
+	if status, _ = doOrganizationRequest(t, "GET", ts.URL+"/api/groups/"+g.ID.Hex(), ""); status != 422 {
+		t.Errorf("expected %d, but got %d", 422, status)
+	}
+
+	// and only the users of acme can join them
+	acmeServer := actorServer(actor{Type: "user", ID: acmeUser.ID.Hex(), OrganizationID: acme.ID})
+	defer acmeServer.Close()
+	members := acmeServer.URL + "/api/groups/" + g.ID.Hex() + "/members"
+	status, r = doOrganizationRequest(t, "POST", members, `{"member":{"user_id":"`+globexUser.ID.Hex()+`"}}`)
+	if status != 422 || len(r.Errors["user_id"]) == 0 {
+		t.Errorf("expected the user of globex to be refused, but got %d %v", status, r.Errors)
+	}
+	if status, _ = doOrganizationRequest(t, "POST", members, `{"member":{"user_id":"`+acmeUser.ID.Hex()+`"}}`); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+
+	dropAllCollections(t)
+}
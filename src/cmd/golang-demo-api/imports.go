@@ -0,0 +1,524 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxImportSize is the largest CSV file accepted by an import.
+const maxImportSize int64 = 5 << 20
+
+// maxImportRows is the largest number of rows accepted by an import.
+const maxImportRows = maxBulkUsers
+
+var errTooManyRows = fmt.Errorf("An import can't have more than %d rows", maxImportRows)
+
+// importFields are the user fields CSV columns can be mapped to.
+var importFields = []string{"name", "username", "email", "mobile", "password", "password_confirmation"}
+
+// userImport is the report of a CSV import. The rejected rows are kept
+// in their own collection so they can be downloaded with their errors.
+// The generated passwords are only returned by the import.
+type userImport struct {
+	ID                bson.ObjectId      `bson:"_id" json:"id"`
+	OrganizationID    bson.ObjectId      `bson:"organization_id" json:"-"`
+	Filename          string             `bson:"filename" json:"filename"`
+	DryRun            bool               `bson:"dry_run" json:"dry_run"`
+	Invite            bool               `bson:"invite" json:"invite"`
+	GeneratePasswords bool               `bson:"generate_passwords" json:"generate_passwords"`
+	Mapping           []columnMapping    `bson:"mapping" json:"mapping"`
+	Total             int                `bson:"total" json:"total"`
+	Created           int                `bson:"created" json:"created"`
+	Rejected          int                `bson:"rejected" json:"rejected"`
+	Header            []string           `bson:"header" json:"-"`
+	Errors            []importError      `bson:"-" json:"errors,omitempty"`
+	Passwords         []importedPassword `bson:"-" json:"passwords,omitempty"`
+	CreatedAt         time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// columnMapping maps a column of the CSV file onto a user field.
+type columnMapping struct {
+	Column string `bson:"column" json:"column"`
+	Field  string `bson:"field" json:"field"`
+}
+
+// importError is a rejected row of an import. The passwords of the row
+// are blanked before it is saved.
+type importError struct {
+	ID             bson.ObjectId `bson:"_id" json:"-"`
+	ImportID       bson.ObjectId `bson:"import_id" json:"-"`
+	OrganizationID bson.ObjectId `bson:"organization_id" json:"-"`
+	Row            int           `bson:"row" json:"row"`
+	Values         []string      `bson:"values" json:"-"`
+	Errors         ModelErrors   `bson:"errors" json:"errors"`
+}
+
+// importedPassword is the password generated for the user of a row.
+type importedPassword struct {
+	Row      int    `json:"row"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func init() {
+	importsRouter := router.Path("/api/imports").
+		HeadersRegexp("Content-Type", `^multipart/form-data(;.*)?$`).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Subrouter()
+
+	importsRouter.Methods("POST").HandlerFunc(requireAdmin(createImportHandler))
+
+	router.Path("/api/imports/{id}").
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("GET").
+		HandlerFunc(requireAdmin(showImportHandler))
+
+	router.Path("/api/imports/{id}/errors").
+		Headers("Accept", "text/csv").
+		Methods("GET").
+		HandlerFunc(requireAdmin(importErrorsHandler))
+
+	importID := pathParam("id", "ID of the import")
+	documentOperations(
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/imports",
+			OperationID: "createImport",
+			Summary:     "Imports the users of a CSV file.",
+			Tags:        []string{"imports"},
+			Parameters: []*openAPIParameter{
+				queryParam("dry_run", "true to only validate the rows, nothing is saved", &openAPISchema{Type: "boolean"}),
+				queryParam("invite", "true to create rows without password as invited users", &openAPISchema{Type: "boolean"}),
+				queryParam("generate_passwords", "true to generate the passwords of rows without password", &openAPISchema{Type: "boolean"}),
+			},
+			RequestBody: &openAPIRequestBody{
+				Required: true,
+				Content: map[string]*openAPIMediaType{"multipart/form-data": {Schema: &openAPISchema{
+					Type:     "object",
+					Required: []string{"file"},
+					Properties: map[string]*openAPISchema{
+						"file": {Type: "string", Format: "binary", Description: "The CSV file, its first row must be the column names."},
+					},
+					AdditionalProperties: &openAPISchema{Type: "string", Description: "mapping[<column>]: User field of the column."},
+				}}},
+			},
+			Responses: adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422, http.StatusInternalServerError)),
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/imports/{id}",
+			OperationID: "showImport",
+			Summary:     "Returns the report of an import.",
+			Tags:        []string{"imports"},
+			Parameters:  []*openAPIParameter{importID},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, http.StatusNotFound)),
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/imports/{id}/errors",
+			OperationID: "importErrors",
+			Summary:     "Returns the rejected rows of an import with their errors.",
+			Tags:        []string{"imports"},
+			Parameters:  []*openAPIParameter{importID},
+			Responses: adminOnly(map[string]*openAPIResponse{
+				"200": {
+					Description: "The rejected rows, with the row number and the errors appended. The passwords are blank.",
+					Content:     map[string]*openAPIMediaType{"text/csv": {Schema: &openAPISchema{Type: "string"}}},
+				},
+				"404": {
+					Description: "Import not found.",
+					Content:     map[string]*openAPIMediaType{"application/json": {Schema: schemaFor(response{})}},
+				},
+			}),
+		},
+	)
+}
+
+// createImportHandler imports the users of a CSV file. Every row goes
+// through the same validation as createUserHandler. The passwords
+// generated for the rows are returned once, with the report.
+// URL: POST /api/imports
+// HEADERS:
+//	"Content-Type": "multipart/form-data"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"dry_run": "true" to only validate the rows, nothing is saved.
+//	"invite": "true" to create rows without password as invited users.
+//	"generate_passwords": "true" to generate the passwords of rows without
+//	password, unless they are invited.
+// BODY:
+//	file: The CSV file, its first row must be the column names, and at
+//	most 10000 rows. (required)
+//	mapping[<column>]: User field of the column, one of name, username,
+//	email, mobile, password and password_confirmation. Columns named like
+//	a field are mapped to it when no mapping is given.
+// EXAMPLE:
+//	file=@users.csv&mapping[Full Name]=name&mapping[E-mail]=email&mapping[Login]=username
+func createImportHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	req.Body = http.MaxBytesReader(w, req.Body, maxImportSize)
+	if err := req.ParseMultipartForm(maxMultipartMemory); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	file, fh, err := req.FormFile("file")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response{Message: "A CSV file is required."})
+		return
+	}
+	defer file.Close()
+
+	imp := &userImport{
+		ID:                bson.NewObjectId(),
+		OrganizationID:    requestOrganization(req).ID,
+		Filename:          fh.Filename,
+		DryRun:            req.FormValue("dry_run") == "true",
+		Invite:            req.FormValue("invite") == "true",
+		GeneratePasswords: req.FormValue("generate_passwords") == "true",
+		CreatedAt:         bson.Now(),
+	}
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	imp.Header, err = reader.Read()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response{Message: "Unable to read the CSV file."})
+		return
+	}
+	// spreadsheets often save the file with a byte order mark
+	imp.Header[0] = strings.TrimPrefix(imp.Header[0], "\ufeff")
+
+	imp.Mapping, err = importMapping(imp.Header, req.PostForm)
+	if err != nil {
+		w.WriteHeader(422)
+		json.NewEncoder(w).Encode(response{Message: err.Error()})
+		return
+	}
+
+	created, err := imp.run(reader)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response{Message: "Unable to import the CSV file: " + err.Error()})
+		return
+	}
+	usersCreated(req, created)
+	if err = imp.save(); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response{Message: "Users imported, but unable to save the report of the import."})
+		return
+	}
+
+	resp := &response{Message: "Users imported.", data: &data{Import: imp}}
+	if imp.DryRun {
+		resp.Message = "Dry run, no user was saved."
+	}
+	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// showImportHandler returns the report of an import.
+// URL: GET /api/imports/:id
+// HEADERS:
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the import
+func showImportHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var resp *response
+	if imp, err := loadImport(requestOrganization(req).ID, mux.Vars(req)["id"]); err != nil {
+		log.Println(err)
+		resp = &response{Message: "Import not found."}
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		resp = &response{data: &data{Import: imp}}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// importErrorsHandler returns the rejected rows of an import as CSV, with
+// the row number and the errors of each row appended as two columns.
+// The file can be corrected and imported again.
+// URL: GET /api/imports/:id/errors
+// HEADERS:
+//	"Accept": "text/csv"
+// PARAMETERS:
+//	"id": ID of the import
+func importErrorsHandler(w http.ResponseWriter, req *http.Request) {
+	imp, err := loadImport(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response{Message: "Import not found."})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="import-`+imp.ID.Hex()+`-errors.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	cw.Write(append(append([]string{}, imp.Header...), "row", "errors"))
+	iter := config.importErrorsCollection.Find(bson.M{"import_id": imp.ID}).Sort("row").Iter()
+	var e importError
+	for iter.Next(&e) {
+		values := make([]string, len(imp.Header))
+		copy(values, e.Values)
+		cw.Write(append(values, strconv.Itoa(e.Row), e.Errors.String()))
+	}
+	if err = iter.Close(); err != nil {
+		log.Println(err)
+	}
+	cw.Flush()
+	if err = cw.Error(); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// run reads and validates every row, then saves the valid users unless
+// the import is a dry run, and returns the users saved. A username or email
+// can only be used once in the file, later rows using it are rejected, as
+// are the rows over the user quota of the organization. Only the passwords
+// of the valid users are hashed.
+func (imp *userImport) run(reader *csv.Reader) ([]*user, error) {
+	var users []*user
+	taken := map[string]map[string]bool{
+		"username": make(map[string]bool),
+		"email":    make(map[string]bool),
+	}
+	left, err := usersLeft(imp.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+
+	for row := 2; ; row++ {
+		values, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if imp.Total == maxImportRows {
+			return nil, errTooManyRows
+		}
+		imp.Total++
+
+		u := &user{ID: bson.NewObjectId(), OrganizationID: imp.OrganizationID}
+		u.copyFields(imp.newUser(values))
+		generate := false
+		if u.Password == "" && u.PasswordConfirmation == "" {
+			u.Invited = imp.Invite
+			generate = !imp.Invite && imp.GeneratePasswords
+		}
+		if !u.Invited && !generate {
+			// validate the password without paying for bcrypt
+			u.checkPassword()
+		}
+		u.CreatedAt = u.ID.Time()
+		u.UpdatedAt = u.CreatedAt
+
+		valid := u.validate(func(field, value string) bool {
+			return taken[field][value] || u.takenInCollection(field, value)
+		})
+		if valid && left == 0 {
+			u.Errors["organization"] = append(u.Errors["organization"], errQuotaReached)
+			valid = false
+		}
+		if !valid {
+			imp.Errors = append(imp.Errors, importError{Row: row, Values: imp.withoutPasswords(values), Errors: u.Errors})
+			continue
+		}
+		if generate && !imp.DryRun {
+			if u.Password, err = randomToken(12); err != nil {
+				return nil, err
+			}
+			u.PasswordConfirmation = u.Password
+			imp.Passwords = append(imp.Passwords, importedPassword{Row: row, Username: u.Username, Password: u.Password})
+		}
+		taken["username"][u.Username] = true
+		taken["email"][u.Email] = true
+		users = append(users, u)
+		left--
+	}
+
+	imp.Rejected = len(imp.Errors)
+	if imp.DryRun || len(users) == 0 {
+		return nil, nil
+	}
+
+	var withPasswords []*user
+	for _, u := range users {
+		if !u.Invited {
+			withPasswords = append(withPasswords, u)
+		}
+	}
+	generatePasswordDigests(withPasswords)
+
+	created, err := insertBulkUsers(users, false)
+	if err != nil {
+		log.Println(err)
+	}
+	var saved []*user
+	savedUsernames := make(map[string]bool)
+	for _, u := range users {
+		if created[u.ID] {
+			saved = append(saved, u)
+			savedUsernames[u.Username] = true
+		}
+	}
+	// only the passwords of the saved users are returned
+	var passwords []importedPassword
+	for _, p := range imp.Passwords {
+		if savedUsernames[p.Username] {
+			passwords = append(passwords, p)
+		}
+	}
+	imp.Passwords = passwords
+	imp.Created = len(saved)
+	return saved, nil
+}
+
+// save inserts the report of the import, then its rejected rows.
+func (imp *userImport) save() error {
+	if err := config.importsCollection.Insert(imp); err != nil {
+		return err
+	}
+	for start := 0; start < len(imp.Errors); start += bulkBatchSize {
+		end := start + bulkBatchSize
+		if end > len(imp.Errors) {
+			end = len(imp.Errors)
+		}
+		bulk := config.importErrorsCollection.Bulk()
+		for i := range imp.Errors[start:end] {
+			e := &imp.Errors[start+i]
+			e.ID, e.ImportID, e.OrganizationID = bson.NewObjectId(), imp.ID, imp.OrganizationID
+			bulk.Insert(e)
+		}
+		if _, err := bulk.Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ensureImportIndexes() error {
+	return config.importErrorsCollection.EnsureIndex(mgo.Index{Key: []string{"import_id", "row"}})
+}
+
+// withoutPasswords returns a copy of the values of a row, with the
+// columns mapped to the password fields blank.
+func (imp *userImport) withoutPasswords(values []string) []string {
+	clean := append([]string{}, values...)
+	for _, m := range imp.Mapping {
+		if m.Field != "password" && m.Field != "password_confirmation" {
+			continue
+		}
+		for i, column := range imp.Header {
+			if column == m.Column && i < len(clean) {
+				clean[i] = ""
+			}
+		}
+	}
+	return clean
+}
+
+// newUser builds the fields of a user from the mapped columns of a row.
+func (imp *userImport) newUser(values []string) newUser {
+	form := make(map[string][]string)
+	for _, m := range imp.Mapping {
+		for i, column := range imp.Header {
+			if column == m.Column && i < len(values) {
+				form["user["+m.Field+"]"] = []string{strings.TrimSpace(values[i])}
+			}
+		}
+	}
+	// a single password column is enough
+	if _, ok := form["user[password_confirmation]"]; !ok {
+		form["user[password_confirmation]"] = form["user[password]"]
+	}
+
+	var nu newUser
+	decodeForm(form, "user", &nu)
+	return nu
+}
+
+// importMapping reads the "mapping[<column>]" parameters. Without any,
+// the columns having the name of a user field are mapped to it.
+func importMapping(header []string, form map[string][]string) ([]columnMapping, error) {
+	columns := make(map[string]bool)
+	for _, column := range header {
+		columns[column] = true
+	}
+	fields := make(map[string]bool)
+	for _, field := range importFields {
+		fields[field] = true
+	}
+
+	var mapping []columnMapping
+	for key, values := range form {
+		if !strings.HasPrefix(key, "mapping[") || !strings.HasSuffix(key, "]") || len(values) == 0 {
+			continue
+		}
+		column := key[len("mapping[") : len(key)-1]
+		field := values[0]
+		if !columns[column] {
+			return nil, errors.New("Unknown column " + column + ".")
+		}
+		if !fields[field] {
+			return nil, errors.New("Unknown field " + field + ".")
+		}
+		mapping = append(mapping, columnMapping{Column: column, Field: field})
+	}
+
+	if len(mapping) == 0 {
+		for _, column := range header {
+			field := strings.ToLower(strings.TrimSpace(column))
+			if fields[field] {
+				mapping = append(mapping, columnMapping{Column: column, Field: field})
+			}
+		}
+	}
+	if len(mapping) == 0 {
+		return nil, errors.New("No column is mapped to a user field.")
+	}
+	sort.Slice(mapping, func(i, j int) bool { return mapping[i].Column < mapping[j].Column })
+	return mapping, nil
+}
+
+func loadImport(orgID bson.ObjectId, id string) (*userImport, error) {
+	var imp userImport
+	if !bson.IsObjectIdHex(id) {
+		return &imp, errors.New("Invalid import id.")
+	}
+	err := config.importsCollection.Find(bson.M{"_id": bson.ObjectIdHex(id), "organization_id": orgID}).One(&imp)
+	return &imp, err
+}
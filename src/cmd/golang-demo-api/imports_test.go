@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const importCSV = "Full Name,Login,E-mail,Secret\n" +
+	"One,one,one@test.com,test123\n" +
+	"Two,one,two@test.com,test123\n" +
+	"Three,three,three@test.com,\n"
+
+func postImport(t *testing.T, url string, fields map[string]string) (int, *userImport) {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fw, err := mw.CreateFormFile("file", "users.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(importCSV))
+	mw.WriteField("mapping[Full Name]", "name")
+	mw.WriteField("mapping[Login]", "username")
+	mw.WriteField("mapping[E-mail]", "email")
+	mw.WriteField("mapping[Secret]", "password")
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	mw.Close()
+
+	client := &http.Client{}
+	req, err := http.NewRequest("POST", url, &b)
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	req.Header.Add("Content-Type", mw.FormDataContentType())
+	actResp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer actResp.Body.Close()
+	resp := response{data: &data{}}
+	if err = json.NewDecoder(actResp.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Import == nil {
+		t.Fatalf("expected an import report, got message %s", resp.Message)
+	}
+	return actResp.StatusCode, resp.Import
+}
+
+func TestCreateImportHandler(t *testing.T) {
+	ts := actorServer(actor{Type: actorUser, Role: roleAdmin, OrganizationID: defaultOrganization.ID})
+	defer ts.Close()
+
+	status, imp := postImport(t, ts.URL+"/api/imports", nil)
+	if status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	if imp.Total != 3 || imp.Created != 1 || imp.Rejected != 2 {
+		t.Errorf("expected 3 total, 1 created and 2 rejected, but got %d, %d and %d", imp.Total, imp.Created, imp.Rejected)
+	}
+	if len(imp.Errors) != 2 || imp.Errors[0].Row != 3 || imp.Errors[1].Row != 4 {
+		t.Errorf("expected rows 3 and 4 to be rejected, but got %+v", imp.Errors)
+	}
+
+	var u user
+	config.usersCollection.Find(bson.M{"username": "one"}).One(&u)
+	if u.Name != "One" {
+		t.Errorf("expected name to be %s, but got %s", "One", u.Name)
+	}
+
+	// download the rejected rows
+	client := &http.Client{}
+	req, err := http.NewRequest("GET", ts.URL+"/api/imports/"+imp.ID.Hex()+"/errors", nil)
+	req.Header.Add("Accept", "text/csv")
+	actResp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer actResp.Body.Close()
+	records, err := csv.NewReader(actResp.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected %d records, but got %d", 3, len(records))
+	}
+	if records[1][0] != "Two" || records[1][4] != "3" || records[1][5] != "username is already taken" {
+		t.Errorf("unexpected error row %v", records[1])
+	}
+	// the passwords are never kept
+	var saved []importError
+	config.importErrorsCollection.Find(bson.M{"import_id": imp.ID}).All(&saved)
+	if len(saved) != 2 {
+		t.Errorf("expected %d rejected rows to be saved, but got %d", 2, len(saved))
+	}
+	for _, e := range saved {
+		if e.Values[3] != "" {
+			t.Errorf("expected the password of row %d to be blank, but got %q", e.Row, e.Values[3])
+		}
+	}
+	if records[1][3] != "" {
+		t.Errorf("expected the password to be blank, but got %q", records[1][3])
+	}
+
+	// only admins import users
+	anonymous := newTestServer()
+	defer anonymous.Close()
+	req, _ = http.NewRequest("GET", anonymous.URL+"/api/imports/"+imp.ID.Hex()+"/errors", nil)
+	req.Header.Add("Accept", "text/csv")
+	if actResp, err = client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	actResp.Body.Close()
+	if actResp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected %d, but got %d", http.StatusUnauthorized, actResp.StatusCode)
+	}
+
+	dropAllCollections(t)
+}
+
+func TestCreateImportHandlerDryRunWithInvites(t *testing.T) {
+	ts := actorServer(actor{Type: actorUser, Role: roleAdmin, OrganizationID: defaultOrganization.ID})
+	defer ts.Close()
+
+	_, imp := postImport(t, ts.URL+"/api/imports?dry_run=true", map[string]string{"invite": "true"})
+	if imp.Total != 3 || imp.Created != 0 || imp.Rejected != 1 {
+		t.Errorf("expected 3 total, 0 created and 1 rejected, but got %d, %d and %d", imp.Total, imp.Created, imp.Rejected)
+	}
+
+	totalUsers, _ := config.usersCollection.Find(bson.M{}).Count()
+	if totalUsers != 0 {
+		t.Errorf("expected %d, but got %d", 0, totalUsers)
+	}
+
+	dropAllCollections(t)
+}
+
+func TestCreateImportHandlerGeneratePasswords(t *testing.T) {
+	ts := actorServer(actor{Type: actorUser, Role: roleAdmin, OrganizationID: defaultOrganization.ID})
+	defer ts.Close()
+
+	_, imp := postImport(t, ts.URL+"/api/imports", map[string]string{"generate_passwords": "true"})
+	if imp.Total != 3 || imp.Created != 2 || imp.Rejected != 1 {
+		t.Errorf("expected 3 total, 2 created and 1 rejected, but got %d, %d and %d", imp.Total, imp.Created, imp.Rejected)
+	}
+	if len(imp.Passwords) != 1 || imp.Passwords[0].Row != 4 || imp.Passwords[0].Username != "three" {
+		t.Fatalf("expected the password of row 4, but got %+v", imp.Passwords)
+	}
+
+	var u user
+	if err := config.usersCollection.Find(bson.M{"username": "three"}).One(&u); err != nil {
+		t.Fatal(err)
+	}
+	if !u.passwordMatches(imp.Passwords[0].Password) {
+		t.Errorf("expected the generated password to be the password of the user")
+	}
+
+	// the generated passwords are only returned once
+	saved, err := loadImport(defaultOrganization.ID, imp.ID.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Passwords) != 0 {
+		t.Errorf("expected the passwords not to be saved, but got %+v", saved.Passwords)
+	}
+
+	dropAllCollections(t)
+}
+
+func TestCreateImportHandlerTooManyRows(t *testing.T) {
+	ts := actorServer(actor{Type: actorUser, Role: roleAdmin, OrganizationID: defaultOrganization.ID})
+	defer ts.Close()
+
+	file := "Full Name,Login,E-mail,Secret\n" + strings.Repeat("One,one,one@test.com,\n", maxImportRows+1)
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fw, _ := mw.CreateFormFile("file", "users.csv")
+	fw.Write([]byte(file))
+	mw.Close()
+
+	req, _ := http.NewRequest("POST", ts.URL+"/api/imports", &b)
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	req.Header.Add("Content-Type", mw.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected %d, but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	totalUsers, _ := config.usersCollection.Find(bson.M{}).Count()
+	if totalUsers != 0 {
+		t.Errorf("expected %d, but got %d", 0, totalUsers)
+	}
+	dropAllCollections(t)
+}
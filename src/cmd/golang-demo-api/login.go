@@ -0,0 +1,505 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// loginPolicy are the thresholds of the protection against guessed
+// passwords. Failed logins are counted per user and reset by a successful
+// one.
+type loginPolicy struct {
+	// After DelayAfter failed logins in a row, the user is locked for
+	// Delay, doubled at every further failure.
+	DelayAfter int
+	Delay      time.Duration
+	// After LockAfter failed logins in a row, the user is locked for
+	// Lockout or until an admin unlocks it.
+	LockAfter int
+	Lockout   time.Duration
+}
+
+var defaultLoginPolicy = loginPolicy{
+	DelayAfter: 3,
+	Delay:      time.Second,
+	LockAfter:  10,
+	Lockout:    15 * time.Minute,
+}
+
+// loginThresholds is the policy of the logins, set from the environment.
+var loginThresholds = loginPolicyFromEnv()
+
+// loginPolicyFromEnv returns defaultLoginPolicy with the thresholds set in
+// LOGIN_DELAY_AFTER, LOGIN_LOCK_AFTER and LOGIN_LOCKOUT (like "30m").
+func loginPolicyFromEnv() loginPolicy {
+	p := defaultLoginPolicy
+	if n, err := strconv.Atoi(os.Getenv("LOGIN_DELAY_AFTER")); err == nil && n > 0 {
+		p.DelayAfter = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("LOGIN_LOCK_AFTER")); err == nil && n > 0 {
+		p.LockAfter = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("LOGIN_LOCKOUT")); err == nil && d > 0 {
+		p.Lockout = d
+	}
+	return p
+}
+
+// lockedUntil returns until when a user is locked after failures failed
+// logins in a row, the zero time when it isn't.
+func (p loginPolicy) lockedUntil(failures int, now time.Time) time.Time {
+	switch {
+	case failures >= p.LockAfter:
+		return now.Add(p.Lockout)
+	case failures >= p.DelayAfter:
+		d := math.Min(float64(p.Delay)*math.Pow(2, float64(failures-p.DelayAfter)), float64(p.Lockout))
+		return now.Add(time.Duration(d))
+	}
+	return time.Time{}
+}
+
+// errInvalidLogin is the only error of the logins, whatever failed, so
+// they don't tell whether a user exists or is locked.
+const errInvalidLogin = "Invalid username or password, or the account is temporarily locked."
+
+// dummyPasswordDigest is compared to the passwords of the logins of
+// unknown or locked users, so they take as long as the others.
+var dummyPasswordDigest, _ = bcrypt.GenerateFromPassword([]byte("not a password"), 0)
+
+type loginParams struct {
+	// Username is the username or the email of the user.
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type totpLoginParams struct {
+	// MFAToken is the token returned by the login with the password.
+	MFAToken string `json:"mfa_token"`
+	// Code is a code of the authenticator app, or a recovery code.
+	Code string `json:"code"`
+}
+
+// loginChallenge is a login whose password was checked, waiting for the
+// code of the second factor.
+type loginChallenge struct {
+	// ID is the hash of the token given to the client.
+	ID        string        `bson:"_id"`
+	UserID    bson.ObjectId `bson:"user_id"`
+	Attempts  int           `bson:"attempts"`
+	ExpiresAt time.Time     `bson:"expires_at"`
+}
+
+const (
+	// loginChallengeTTL is the time to enter the code after the password.
+	loginChallengeTTL = 5 * time.Minute
+	// loginChallengeAttempts are the codes tried before the password must
+	// be entered again.
+	loginChallengeAttempts = 5
+)
+
+// errInvalidCode is the error of the second step of the logins.
+const errInvalidCode = "Invalid two-factor code, or the login expired."
+
+func init() {
+	router.Path("/api/login").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("POST").
+		HandlerFunc(loginHandler)
+	router.Path("/api/login/totp").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("POST").
+		HandlerFunc(loginTOTPHandler)
+
+	router.Path("/api/users/{id}/unlock").
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("POST").
+		HandlerFunc(requireAdmin(unlockUserHandler))
+
+	documentOperations(
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/login",
+			OperationID: "login",
+			Summary:     "Checks the password of a user and starts a session, or returns an mfa_token for loginTOTP when it uses two-factor authentication. Failed logins lock the user for a while.",
+			Tags:        []string{"login"},
+			RequestBody: jsonBody(struct {
+				Login loginParams `json:"login"`
+			}{}),
+			Responses: envelopeResponses(http.StatusOK, http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden),
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/login/totp",
+			OperationID: "loginTOTP",
+			Summary:     "Completes the login of a user using two-factor authentication with a code, and starts a session.",
+			Tags:        []string{"login"},
+			RequestBody: jsonBody(struct {
+				Login totpLoginParams `json:"login"`
+			}{}),
+			Responses: envelopeResponses(http.StatusOK, http.StatusBadRequest, http.StatusUnauthorized),
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/users/{id}/unlock",
+			OperationID: "unlockUser",
+			Summary:     "Unlocks a user locked by failed logins.",
+			Tags:        []string{"login"},
+			Parameters:  []*openAPIParameter{pathParam("id", "ID of the user")},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+	)
+}
+
+// ensureLoginIndexes creates the index removing the expired login
+// challenges.
+func ensureLoginIndexes() error {
+	return config.loginChallenges.EnsureIndex(mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second})
+}
+
+// randomToken returns n random bytes in hex.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the hash of a token as saved, so tokens can't be
+// taken from the database.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// locked tells whether failed logins lock the user at now.
+func (u *user) locked(now time.Time) bool {
+	return now.Before(u.LockedUntil)
+}
+
+// loginFailed counts a failed login of the user and locks it when the
+// policy says so. It returns the user as saved.
+func (u *user) loginFailed(p loginPolicy, now time.Time) (*user, error) {
+	var after user
+	_, err := config.usersCollection.FindId(u.ID).Apply(mgo.Change{
+		Update: bson.M{
+			"$inc": bson.M{"failed_logins": 1},
+			"$set": bson.M{"last_failed_login_at": now},
+		},
+		ReturnNew: true,
+	}, &after)
+	if err != nil {
+		return nil, err
+	}
+	if until := p.lockedUntil(after.FailedLogins, now); !until.IsZero() {
+		after.LockedUntil = until
+		err = config.usersCollection.UpdateId(u.ID, bson.M{"$set": bson.M{"locked_until": until}})
+	}
+	return &after, err
+}
+
+// loginSucceeded forgets the failed logins of the user, if any.
+func (u *user) loginSucceeded() {
+	if u.FailedLogins > 0 || !u.LockedUntil.IsZero() {
+		if err := u.resetFailedLogins(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// resetFailedLogins forgets the failed logins of the user.
+func (u *user) resetFailedLogins() error {
+	u.FailedLogins, u.LastFailedLoginAt, u.LockedUntil = 0, time.Time{}, time.Time{}
+	return config.usersCollection.UpdateId(u.ID, bson.M{"$unset": bson.M{
+		"failed_logins":        "",
+		"last_failed_login_at": "",
+		"locked_until":         "",
+	}})
+}
+
+// loginHandler checks the password of a user of the organization. After
+// too many failed logins in a row the user is locked, and the logins fail
+// until the lock expires or an admin unlocks it. Failed logins all get
+// the same response after the same time.
+// Users with two-factor authentication get an mfa_token to send with a
+// code to loginTOTPHandler. Users whose role must use it and don't are
+// refused.
+// URL: POST /api/login
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// BODY:
+//	login[username]: Username or email of the user. (required)
+//	login[password]: Password of the user. (required)
+// EXAMPLE:
+//	{
+//		"login": {
+//			"username": "aditya",
+//			"password": "test123#"
+//		}
+//	}
+func loginHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	var params struct {
+		Login loginParams `json:"login"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&params); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	u, err := authenticate(req, requestOrganization(req).ID, params.Login.Username, params.Login.Password)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if u == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		encoder.Encode(response{Message: errInvalidLogin})
+		return
+	}
+
+	if u.TOTPEnabled {
+		token, err := newLoginChallenge(u)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		encoder.Encode(response{Message: "Two-factor code required.", data: &data{MFAToken: token}})
+		return
+	}
+	if required, err := u.requiresTOTP(); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if required {
+		w.WriteHeader(http.StatusForbidden)
+		encoder.Encode(response{Message: "Two-factor authentication is required for this user, enable it to log in."})
+		return
+	}
+	loggedIn(w, req, u)
+}
+
+// authenticate checks the password of the user of the organization with
+// the username or email. It returns nil when the login fails, whatever
+// the reason, after the same time. The failure is counted once the
+// response is on its way, so its writes don't tell known users apart.
+func authenticate(req *http.Request, orgID bson.ObjectId, username, password string) (*user, error) {
+	now := bson.Now()
+	var u user
+	err := config.usersCollection.Find(bson.M{
+		"organization_id": orgID,
+		"$or": []bson.M{
+			{"username": username},
+			{"email": username},
+		},
+	}).One(&u)
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+
+	digest := dummyPasswordDigest
+	canLogin := err == nil && u.PasswordDigest != "" && !u.locked(now)
+	if canLogin {
+		digest = []byte(u.PasswordDigest)
+	}
+	// always compared, so the logins of unknown users aren't faster
+	if bcrypt.CompareHashAndPassword(digest, []byte(password)) != nil {
+		canLogin = false
+	}
+
+	if !canLogin {
+		if err == nil && !u.locked(now) {
+			loginRefusedLater(req, &u, now)
+		}
+		return nil, nil
+	}
+	return &u, nil
+}
+
+// newLoginChallenge saves the login of u waiting for a code, and returns
+// its token.
+func newLoginChallenge(u *user) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	return token, config.loginChallenges.Insert(loginChallenge{
+		ID:        hashToken(token),
+		UserID:    u.ID,
+		ExpiresAt: bson.Now().Add(loginChallengeTTL),
+	})
+}
+
+// loggedIn answers the successful login of u with the tokens of a new
+// session.
+func loggedIn(w http.ResponseWriter, req *http.Request, u *user) {
+	u.loginSucceeded()
+	s, tokens, err := startSession(req, u)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(response{Message: "Logged in successfully.", data: &data{User: u, session: s, Tokens: tokens}}); err != nil {
+		log.Println(err)
+	}
+}
+
+// loginTOTPHandler completes the login of a user using two-factor
+// authentication with a code of its app or a recovery code. Wrong codes
+// count as failed logins.
+// URL: POST /api/login/totp
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// BODY:
+//	login[mfa_token]: Token returned by the login with the password. (required)
+//	login[code]: Code of the authenticator app, or a recovery code. (required)
+// EXAMPLE:
+//	{
+//		"login": {
+//			"mfa_token": "8c0e0b8e1d7c4f6a9b2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b",
+//			"code": "123456"
+//		}
+//	}
+func loginTOTPHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	var params struct {
+		Login totpLoginParams `json:"login"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&params); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	now := bson.Now()
+	var c loginChallenge
+	err := config.loginChallenges.Find(bson.M{
+		"_id":        hashToken(params.Login.MFAToken),
+		"expires_at": bson.M{"$gt": now},
+	}).One(&c)
+	var u *user
+	if err == nil {
+		u, err = loadUser(requestOrganization(req).ID, c.UserID.Hex())
+	}
+	if err != nil || u.locked(now) || !u.TOTPEnabled {
+		w.WriteHeader(http.StatusUnauthorized)
+		encoder.Encode(response{Message: errInvalidCode})
+		return
+	}
+
+	ok, err := u.checkSecondFactor(params.Login.Code, now)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		loginRefused(req, u, now)
+		if c.Attempts+1 >= loginChallengeAttempts {
+			err = config.loginChallenges.RemoveId(c.ID)
+		} else {
+			err = config.loginChallenges.UpdateId(c.ID, bson.M{"$inc": bson.M{"attempts": 1}})
+		}
+		if err != nil {
+			log.Println(err)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		encoder.Encode(response{Message: errInvalidCode})
+		return
+	}
+
+	if err = config.loginChallenges.RemoveId(c.ID); err != nil {
+		log.Println(err)
+	}
+	loggedIn(w, req, u)
+}
+
+// loginRefused counts the failed login of u and records in the audit log
+// when it locks u out.
+func loginRefused(req *http.Request, u *user, now time.Time) {
+	after, err := u.loginFailed(loginThresholds, now)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if after.FailedLogins >= loginThresholds.LockAfter {
+		auditUserChange(req, auditLock, u, after)
+	}
+}
+
+// pendingLoginFailures are the failed logins of loginRefusedLater not yet
+// counted.
+var pendingLoginFailures sync.WaitGroup
+
+// loginRefusedLater counts the failed login of u in the background, while
+// the response is sent.
+func loginRefusedLater(req *http.Request, u *user, now time.Time) {
+	pendingLoginFailures.Add(1)
+	go func() {
+		defer pendingLoginFailures.Done()
+		loginRefused(req, u, now)
+	}()
+}
+
+// unlockUserHandler unlocks a user locked by failed logins, and forgets
+// them.
+// URL: POST /api/users/:id/unlock
+// HEADERS:
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the user
+func unlockUserHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	u, err := loadUser(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "User not found."})
+		return
+	}
+	before := *u
+	if err = u.resetFailedLogins(); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if before.locked(bson.Now()) {
+		auditUserChange(req, auditUnlock, &before, u)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err = encoder.Encode(response{Message: "User unlocked successfully.", data: &data{User: u}}); err != nil {
+		log.Println(err)
+	}
+}
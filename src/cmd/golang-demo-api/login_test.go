@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestLoginPolicy(t *testing.T) {
+	p := loginPolicy{DelayAfter: 2, Delay: time.Second, LockAfter: 5, Lockout: time.Minute}
+	now := time.Now()
+	cases := map[int]time.Duration{
+		1: 0,
+		2: time.Second,
+		3: 2 * time.Second,
+		4: 4 * time.Second,
+		5: time.Minute,
+		9: time.Minute,
+	}
+	for failures, expected := range cases {
+		until := p.lockedUntil(failures, now)
+		if expected == 0 && !until.IsZero() || expected != 0 && until.Sub(now) != expected {
+			t.Errorf("%d failures: expected a lock of %s, but got until %s", failures, expected, until)
+		}
+	}
+
+	// the delays never exceed the lockout
+	p.LockAfter = 50
+	if d := p.lockedUntil(40, now).Sub(now); d != p.Lockout {
+		t.Errorf("expected %s, but got %s", p.Lockout, d)
+	}
+}
+
+func TestLoginHandler(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	defer func(p loginPolicy) { loginThresholds = p }(loginThresholds)
+	loginThresholds = loginPolicy{DelayAfter: 2, Delay: time.Millisecond, LockAfter: 3, Lockout: time.Hour}
+
+	u := setupUser(t)
+	login := func(username, password string) (int, response) {
+		status, r := doOrganizationRequest(t, "POST", ts.URL+"/api/login",
+			`{"login":{"username":"`+username+`","password":"`+password+`"}}`)
+		// the failures are counted after the response
+		pendingLoginFailures.Wait()
+		return status, r
+	}
+
+	status, r := login("test@sample.com", "test123#")
+	if status != http.StatusOK || r.User == nil || r.User.ID != u.ID {
+		t.Fatalf("expected the user to log in, but got %d %s", status, r.Message)
+	}
+	if r.session == nil || r.Tokens == nil || r.Tokens.AccessToken == "" {
+		t.Errorf("expected the tokens of a session")
+	}
+
+	// unknown users and wrong passwords get the same response
+	_, unknown := login("unknown", "test123#")
+	status, r = login("test_user", "wrong")
+	if status != http.StatusUnauthorized || r.Message != unknown.Message {
+		t.Errorf("expected %d %q, but got %d %q", http.StatusUnauthorized, unknown.Message, status, r.Message)
+	}
+	time.Sleep(10 * time.Millisecond)
+	login("test_user", "wrong")
+	time.Sleep(10 * time.Millisecond)
+	login("test_user", "wrong")
+
+	// locked, even with the right password
+	status, r = login("test_user", "test123#")
+	if status != http.StatusUnauthorized || r.Message != unknown.Message {
+		t.Errorf("expected the user to be locked, but got %d %q", status, r.Message)
+	}
+	var saved user
+	config.usersCollection.FindId(u.ID).One(&saved)
+	if saved.FailedLogins != 3 || !saved.locked(time.Now().Add(time.Minute)) {
+		t.Errorf("expected 3 failed logins and a lock, but got %d until %s", saved.FailedLogins, saved.LockedUntil)
+	}
+	if n, _ := config.auditCollection.Find(bson.M{"resource_id": u.ID, "action": auditLock}).Count(); n != 1 {
+		t.Errorf("expected a lock in the audit log, but got %d", n)
+	}
+
+	// unlocked by an admin
+	admin := actorServer(actor{Type: "user", ID: bson.NewObjectId().Hex(), Role: roleAdmin})
+	defer admin.Close()
+	if status, _ = doOrganizationRequest(t, "POST", ts.URL+"/api/users/"+u.ID.Hex()+"/unlock", ""); status != http.StatusUnauthorized {
+		t.Errorf("expected %d, but got %d", http.StatusUnauthorized, status)
+	}
+	if status, _ = doOrganizationRequest(t, "POST", admin.URL+"/api/users/"+u.ID.Hex()+"/unlock", ""); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	if n, _ := config.auditCollection.Find(bson.M{"resource_id": u.ID, "action": auditUnlock}).Count(); n != 1 {
+		t.Errorf("expected an unlock in the audit log, but got %d", n)
+	}
+	if status, _ = login("test_user", "test123#"); status != http.StatusOK {
+		t.Errorf("expected the user to log in, but got %d", status)
+	}
+	config.usersCollection.FindId(u.ID).One(&saved)
+	if saved.FailedLogins != 0 || !saved.LockedUntil.IsZero() {
+		t.Errorf("expected the failed logins to be forgotten, but got %d until %s", saved.FailedLogins, saved.LockedUntil)
+	}
+
+	dropAllCollections(t)
+}
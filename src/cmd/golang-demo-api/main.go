@@ -3,6 +3,10 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/codegangsta/negroni"
 	"github.com/gorilla/mux"
@@ -13,54 +17,239 @@ import (
 const perPage int = 20
 
 var config struct {
-	env             string
-	session         *mgo.Session
-	db              *mgo.Database
-	usersCollection *mgo.Collection
+	env                    string
+	session                *mgo.Session
+	db                     *mgo.Database
+	usersCollection        *mgo.Collection
+	importsCollection      *mgo.Collection
+	importErrorsCollection *mgo.Collection
+	auditCollection        *mgo.Collection
+	eventsCollection       *mgo.Collection
+	avatarsFS              *mgo.GridFS
+
+	organizationsCollection *mgo.Collection
+	groupsCollection        *mgo.Collection
+	membershipsCollection   *mgo.Collection
+	loginChallenges         *mgo.Collection
+	oauthClientsCollection  *mgo.Collection
+	oauthCodesCollection    *mgo.Collection
+	oauthTokensCollection   *mgo.Collection
+	apiKeysCollection       *mgo.Collection
+	sessionsCollection      *mgo.Collection
+	signingKeysCollection   *mgo.Collection
+	seedSequencesCollection *mgo.Collection
+
+	webhooksCollection          *mgo.Collection
+	webhookDeliveriesCollection *mgo.Collection
 }
 
-func init() {
-	config.env = "development"
+// connect opens the session to MongoDB and points the config to the
+// database of env.
+func connect(env string) error {
 	session, err := mgo.Dial("127.0.0.1")
 	if err != nil {
-		log.Fatalln(err)
-		panic(err)
+		return err
 	}
 	config.session = session
+	useEnv(env)
+	return nil
+}
+
+// serverEnv returns the environment the API is served in, APP_ENV or
+// development by default.
+func serverEnv() string {
+	if env := os.Getenv("APP_ENV"); env != "" {
+		return env
+	}
+	return "development"
+}
+
+// useEnv points the config to the database of the environment.
+func useEnv(env string) {
+	config.env = env
 	config.db = config.session.DB("golang_demo_api_" + config.env)
 	config.usersCollection = config.db.C("users")
+	config.importsCollection = config.db.C("imports")
+	config.importErrorsCollection = config.db.C("import_errors")
+	config.auditCollection = config.db.C("audit_events")
+	config.eventsCollection = config.db.C("events")
+	config.avatarsFS = config.db.GridFS("avatars")
+	config.organizationsCollection = config.db.C("organizations")
+	config.groupsCollection = config.db.C("groups")
+	config.membershipsCollection = config.db.C("group_memberships")
+	config.loginChallenges = config.db.C("login_challenges")
+	config.oauthClientsCollection = config.db.C("oauth_clients")
+	config.oauthCodesCollection = config.db.C("oauth_codes")
+	config.oauthTokensCollection = config.db.C("oauth_tokens")
+	config.apiKeysCollection = config.db.C("api_keys")
+	config.sessionsCollection = config.db.C("sessions")
+	config.signingKeysCollection = config.db.C("signing_keys")
+	config.seedSequencesCollection = config.db.C("seed_sequences")
+	config.webhooksCollection = config.db.C("webhooks")
+	config.webhookDeliveriesCollection = config.db.C("webhook_deliveries")
 }
 
 // ModelErrors is used to store errors associated with model fields
 type ModelErrors map[string][]string
 
+// String returns the errors on one line, like "email is already taken; name can't be blank".
+func (e ModelErrors) String() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var msgs []string
+	for _, field := range fields {
+		for _, msg := range e[field] {
+			msgs = append(msgs, field+" "+msg)
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
 type response struct {
 	Message string `json:"message,omitempty"`
 	*data   `json:"data,omitempty"`
 }
 
 type data struct {
-	Total  int `json:"total,omitempty"`
-	Users  `json:"users,omitempty"`
-	*user  `json:"user,omitempty"`
-	Errors ModelErrors `json:"errors,omitempty"`
+	Total             int `json:"total,omitempty"`
+	Users             `json:"users,omitempty"`
+	User              *user        `json:"user,omitempty"`
+	Errors            ModelErrors  `json:"errors,omitempty"`
+	Results           []bulkResult `json:"results,omitempty"`
+	Import            *userImport  `json:"import,omitempty"`
+	AuditEvents       `json:"audit_events,omitempty"`
+	Webhooks          `json:"webhooks,omitempty"`
+	*webhook          `json:"webhook,omitempty"`
+	WebhookDeliveries `json:"deliveries,omitempty"`
+	Organizations     `json:"organizations,omitempty"`
+	*organization     `json:"organization,omitempty"`
+	Groups            `json:"groups,omitempty"`
+	*group            `json:"group,omitempty"`
+	Memberships       `json:"members,omitempty"`
+	*membership       `json:"member,omitempty"`
+	MFAToken          string          `json:"mfa_token,omitempty"`
+	TOTP              *totpEnrollment `json:"totp,omitempty"`
+	RecoveryCodes     []string        `json:"recovery_codes,omitempty"`
+	OAuthClients      `json:"oauth_clients,omitempty"`
+	*oauthClient      `json:"oauth_client,omitempty"`
+	APIKeys           `json:"api_keys,omitempty"`
+	*apiKey           `json:"api_key,omitempty"`
+	Sessions          `json:"sessions,omitempty"`
+	*session          `json:"session,omitempty"`
+	Tokens            *tokenResponse `json:"tokens,omitempty"`
 }
 
 var router = mux.NewRouter().StrictSlash(false)
 
 func main() {
+	// with arguments, the binary runs the admin commands
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
+
+	if err := connect(serverEnv()); err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
 	defer config.session.Close()
+	// the two-factor secrets can't be stored without their key
+	if _, err := totpKey(); err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
 
 	// Negroni Classic has Recovery, Logger and Static.
 	// We don't need static file serving in API.
 	n := negroni.New()
 	n.Use(negroni.NewRecovery())
+	n.UseFunc(requestIDMiddleware)
 	n.Use(negroni.NewLogger())
+	n.Use(newCORS(defaultCORSOptions))
+
+	if err := ensureOrganizations(); err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
+	if err := ensureAuditIndexes(); err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
+	if err := ensureImportIndexes(); err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
+	if err := ensureAvatarIndexes(); err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
+	if err := ensureGroupIndexes(); err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
+	if err := ensureLoginIndexes(); err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
+	if err := ensureOAuthIndexes(); err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
+	if _, err := signingKey(); err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
+	if err := ensureAPIKeyIndexes(); err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
+	if err := ensureSessionIndexes(); err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
+
+	// Events written from now on reach the listeners of this instance.
+	if err := ensureEventBus(); err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
+	head, err := userEventBus.head()
+	if err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
+	go userEventBus.run(head, nil)
+
+	if err := ensureWebhookIndexes(); err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
+	go runWebhookWorker(time.Second)
+
+	// Limits are kept in the database so they hold across instances.
+	rateLimitStore, err := newMongoRateLimitStore(config.db.C("rate_limits"))
+	if err != nil {
+		log.Fatalln(err)
+		panic(err)
+	}
+	// invalid credentials are limited by address, before authentication
+	authFailures = newAuthFailureLimiter(rateLimitStore, failedAuthLimit)
+	n.UseFunc(authMiddleware)
+	// after authentication, to limit the clients by actor
+	apiRateLimiter = newRateLimiter(rateLimitStore, defaultRateLimit, rateLimitRules...)
+	n.Use(apiRateLimiter)
+	n.UseFunc(tenantMiddleware)
+	if mode := contractMode(); mode != contractOff {
+		n.Use(newContractValidator(openAPISpec(), mode))
+	}
 	n.UseHandler(router)
 
 	log.Println("App initialized...")
 
-	err := http.ListenAndServe(":3000", n)
+	err = http.ListenAndServe(":3000", n)
 	if err != nil {
 		log.Fatalln(err)
 		panic(err)
@@ -0,0 +1,944 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	accessTokenTTL       = time.Hour
+	refreshTokenTTL      = 30 * 24 * time.Hour
+	authorizationCodeTTL = 5 * time.Minute
+)
+
+// Types of the OAuth tokens.
+const (
+	tokenAccess  = "access"
+	tokenRefresh = "refresh"
+)
+
+// authorizationCode is a code sent to the redirect URI of a client after
+// the login of a user, to exchange for tokens once.
+type authorizationCode struct {
+	// ID is the hash of the code.
+	ID             string        `bson:"_id"`
+	ClientID       bson.ObjectId `bson:"client_id"`
+	UserID         bson.ObjectId `bson:"user_id"`
+	OrganizationID bson.ObjectId `bson:"organization_id"`
+	// RedirectURI is the redirect_uri of the authorization request, which
+	// must be sent again with the code when it was given.
+	RedirectURI   string    `bson:"redirect_uri,omitempty"`
+	Scopes        []string  `bson:"scopes"`
+	Nonce         string    `bson:"nonce,omitempty"`
+	CodeChallenge string    `bson:"code_challenge,omitempty"`
+	AuthTime      time.Time `bson:"auth_time"`
+	ExpiresAt     time.Time `bson:"expires_at"`
+}
+
+// oauthToken is an access or refresh token. The tokens issued from one
+// authorization, refreshed or not, share their FamilyID. The tokens of the
+// sessions have no client, and their session as FamilyID.
+type oauthToken struct {
+	// ID is the hash of the token.
+	ID             string        `bson:"_id"`
+	Type           string        `bson:"type"`
+	ClientID       bson.ObjectId `bson:"client_id,omitempty"`
+	UserID         bson.ObjectId `bson:"user_id,omitempty"`
+	OrganizationID bson.ObjectId `bson:"organization_id"`
+	Scopes         []string      `bson:"scopes"`
+	FamilyID       bson.ObjectId `bson:"family_id"`
+	AuthTime       time.Time     `bson:"auth_time,omitempty"`
+	CreatedAt      time.Time     `bson:"created_at"`
+	ExpiresAt      time.Time     `bson:"expires_at"`
+	RevokedAt      time.Time     `bson:"revoked_at,omitempty"`
+}
+
+// tokenResponse is the successful response of the token endpoint.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// oauthError is the error response of the OAuth endpoints.
+type oauthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// tokenIntrospection is the response of the introspection endpoint, only
+// active tokens have the other members.
+type tokenIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Expiry    int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+}
+
+// authorizationRequest are the parameters of the authorization endpoint.
+type authorizationRequest struct {
+	client *oauthClient
+	scopes []string
+	// redirectTo is RedirectURI, or the only URI of the client when it
+	// isn't given.
+	redirectTo string
+
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// authorizePage is the login form of the authorization endpoint.
+type authorizePage struct {
+	Client   *oauthClient
+	Params   url.Values
+	Username string
+	// AskCode is set for the users with two-factor authentication.
+	AskCode bool
+	Error   string
+}
+
+var authorizeTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Sign in to {{.Client.Name}}</title>
+</head>
+<body>
+<h1>Sign in to {{.Client.Name}}</h1>
+{{with .Error}}<p role="alert">{{.}}</p>{{end}}
+<form method="post" action="/oauth/authorize">
+{{range $name, $values := .Params}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<p><label>Username or email <input name="username" value="{{.Username}}" autocomplete="username" required></label></p>
+<p><label>Password <input type="password" name="password" autocomplete="current-password" required></label></p>
+{{if .AskCode}}<p><label>Two-factor code <input name="code" autocomplete="one-time-code" required></label></p>
+{{end}}<p><button type="submit">Sign in</button></p>
+</form>
+</body>
+</html>
+`))
+
+func init() {
+	router.Path("/oauth/authorize").
+		Methods("GET", "POST").
+		HandlerFunc(authorizeHandler)
+	router.Path("/oauth/token").
+		Methods("POST").
+		HandlerFunc(tokenHandler)
+	router.Path("/oauth/revoke").
+		Methods("POST").
+		HandlerFunc(revokeTokenHandler)
+	router.Path("/oauth/introspect").
+		Methods("POST").
+		HandlerFunc(introspectTokenHandler)
+
+	// the tokens of deleted users are revoked, whatever deleted them
+	onUserEvent(func(e userEvent) {
+		if e.Type == userDeleted {
+			for _, c := range []*mgo.Collection{config.oauthCodesCollection, config.oauthTokensCollection} {
+				if _, err := c.RemoveAll(bson.M{"user_id": e.User.ID}); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	})
+
+	oauthErrorContent := map[string]*openAPIMediaType{"application/json": {Schema: schemaFor(oauthError{})}}
+	authorizeParams := []*openAPIParameter{
+		queryParam("response_type", "Must be code", &openAPISchema{Type: "string", Enum: []string{"code"}}),
+		queryParam("client_id", "ID of the client", objectIDSchema),
+		queryParam("redirect_uri", "One of the redirect URIs of the client, required when it has several", &openAPISchema{Type: "string"}),
+		queryParam("scope", "Scopes separated by spaces, those of the client by default", &openAPISchema{Type: "string"}),
+		queryParam("state", "Value sent back to the client with the code", &openAPISchema{Type: "string"}),
+		queryParam("nonce", "Value put in the ID token", &openAPISchema{Type: "string"}),
+		queryParam("code_challenge", "PKCE challenge, required for public clients", &openAPISchema{Type: "string"}),
+		queryParam("code_challenge_method", "Must be S256", &openAPISchema{Type: "string", Enum: []string{"S256"}}),
+	}
+	authorizeResponses := map[string]*openAPIResponse{
+		"200": {
+			Description: "The login form.",
+			Content:     map[string]*openAPIMediaType{"text/html": {Schema: &openAPISchema{Type: "string"}}},
+		},
+		"302": {Description: "Redirects to the client with a code, or an error."},
+		"400": {Description: "The client or the redirect URI is invalid.", Content: oauthErrorContent},
+	}
+	clientErrors := func(responses map[string]*openAPIResponse) map[string]*openAPIResponse {
+		responses["400"] = &openAPIResponse{Description: "Invalid request.", Content: oauthErrorContent}
+		responses["401"] = &openAPIResponse{Description: "The client is unknown or its secret is wrong.", Content: oauthErrorContent}
+		return responses
+	}
+	documentOperations(
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/oauth/authorize",
+			OperationID: "authorize",
+			Summary:     "Shows the login form of an authorization request.",
+			Tags:        []string{"oauth"},
+			Parameters:  authorizeParams,
+			Responses:   authorizeResponses,
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/oauth/authorize",
+			OperationID: "postAuthorize",
+			Summary:     "Logs the user in and redirects to the client with an authorization code.",
+			Tags:        []string{"oauth"},
+			RequestBody: formBody("response_type", "client_id", "redirect_uri", "scope", "state", "nonce",
+				"code_challenge", "code_challenge_method", "username", "password", "code"),
+			Responses: authorizeResponses,
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/oauth/token",
+			OperationID: "token",
+			Summary:     "Issues tokens for an authorization code, the credentials of a client or a refresh token.",
+			Tags:        []string{"oauth"},
+			RequestBody: formBody("grant_type", "code", "redirect_uri", "code_verifier", "refresh_token", "scope",
+				"client_id", "client_secret"),
+			Responses: clientErrors(map[string]*openAPIResponse{
+				"200": {
+					Description: "The tokens.",
+					Content:     map[string]*openAPIMediaType{"application/json": {Schema: schemaFor(tokenResponse{})}},
+				},
+			}),
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/oauth/revoke",
+			OperationID: "revokeToken",
+			Summary:     "Revokes a token of the client, and the tokens refreshed with it.",
+			Tags:        []string{"oauth"},
+			RequestBody: formBody("token", "token_type_hint", "client_id", "client_secret"),
+			Responses: clientErrors(map[string]*openAPIResponse{
+				"200": {Description: "The token is revoked, or was invalid."},
+			}),
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/oauth/introspect",
+			OperationID: "introspectToken",
+			Summary:     "Tells whether a token of the organization is active, for confidential clients.",
+			Tags:        []string{"oauth"},
+			RequestBody: formBody("token", "token_type_hint", "client_id", "client_secret"),
+			Responses: clientErrors(map[string]*openAPIResponse{
+				"200": {
+					Description: "The state of the token.",
+					Content:     map[string]*openAPIMediaType{"application/json": {Schema: schemaFor(tokenIntrospection{})}},
+				},
+			}),
+		},
+	)
+}
+
+// ensureOAuthIndexes creates the indexes of the clients and tokens, and
+// those removing the expired codes and tokens.
+func ensureOAuthIndexes() error {
+	if err := config.oauthClientsCollection.EnsureIndexKey("organization_id"); err != nil {
+		return err
+	}
+	if err := config.oauthCodesCollection.EnsureIndex(mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second}); err != nil {
+		return err
+	}
+	if err := config.oauthTokensCollection.EnsureIndex(mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second}); err != nil {
+		return err
+	}
+	for _, key := range []string{"family_id", "user_id", "client_id"} {
+		if err := config.oauthTokensCollection.EnsureIndexKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findOAuthClient loads a client of any organization by its client_id.
+func findOAuthClient(id string) (*oauthClient, error) {
+	var c oauthClient
+	if !bson.IsObjectIdHex(id) {
+		return &c, mgo.ErrNotFound
+	}
+	err := config.oauthClientsCollection.FindId(bson.ObjectIdHex(id)).One(&c)
+	return &c, err
+}
+
+// requestedScopes returns the scopes of the scope parameter, all those
+// allowed when it is empty.
+func requestedScopes(scope string, allowed []string) ([]string, *oauthError) {
+	if strings.TrimSpace(scope) == "" {
+		return allowed, nil
+	}
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if !containsString(allowed, s) {
+			return nil, &oauthError{Error: "invalid_scope", ErrorDescription: "The scope " + s + " isn't allowed."}
+		}
+		if !containsString(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes, nil
+}
+
+// parseAuthorizationRequest checks the parameters of the authorization
+// endpoint. Errors are only sent to the redirect URI once both the client
+// and the URI are known, redirect tells whether they are.
+func parseAuthorizationRequest(v url.Values) (ar *authorizationRequest, oerr *oauthError, redirect bool) {
+	ar = &authorizationRequest{
+		ResponseType:        v.Get("response_type"),
+		ClientID:            v.Get("client_id"),
+		RedirectURI:         v.Get("redirect_uri"),
+		Scope:               v.Get("scope"),
+		State:               v.Get("state"),
+		Nonce:               v.Get("nonce"),
+		CodeChallenge:       v.Get("code_challenge"),
+		CodeChallengeMethod: v.Get("code_challenge_method"),
+	}
+	c, err := findOAuthClient(ar.ClientID)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			log.Println(err)
+		}
+		return ar, &oauthError{Error: "invalid_request", ErrorDescription: "Unknown client."}, false
+	}
+	ar.client = c
+	switch {
+	case containsString(c.RedirectURIs, ar.RedirectURI):
+		ar.redirectTo = ar.RedirectURI
+	case ar.RedirectURI == "" && len(c.RedirectURIs) == 1:
+		ar.redirectTo = c.RedirectURIs[0]
+	default:
+		return ar, &oauthError{Error: "invalid_request", ErrorDescription: "The redirect_uri isn't registered for the client."}, false
+	}
+
+	if !containsString(c.GrantTypes, grantAuthorizationCode) {
+		return ar, &oauthError{Error: "unauthorized_client", ErrorDescription: "The client can't use authorization codes."}, true
+	}
+	if ar.ResponseType != "code" {
+		return ar, &oauthError{Error: "unsupported_response_type", ErrorDescription: "The response_type must be code."}, true
+	}
+	if ar.scopes, oerr = requestedScopes(ar.Scope, c.Scopes); oerr != nil {
+		return ar, oerr, true
+	}
+	if ar.CodeChallenge == "" && !c.Confidential {
+		return ar, &oauthError{Error: "invalid_request", ErrorDescription: "Public clients must send a code_challenge."}, true
+	}
+	if ar.CodeChallenge != "" && ar.CodeChallengeMethod != "S256" {
+		return ar, &oauthError{Error: "invalid_request", ErrorDescription: "The code_challenge_method must be S256."}, true
+	}
+	return ar, nil, false
+}
+
+// values returns the parameters of the request, to send them again with
+// the login form.
+func (ar *authorizationRequest) values() url.Values {
+	v := make(url.Values)
+	for name, value := range map[string]string{
+		"response_type":         ar.ResponseType,
+		"client_id":             ar.ClientID,
+		"redirect_uri":          ar.RedirectURI,
+		"scope":                 ar.Scope,
+		"state":                 ar.State,
+		"nonce":                 ar.Nonce,
+		"code_challenge":        ar.CodeChallenge,
+		"code_challenge_method": ar.CodeChallengeMethod,
+	} {
+		if value != "" {
+			v.Set(name, value)
+		}
+	}
+	return v
+}
+
+// redirectAuthorization sends the user back to the client with params
+// and the state of the request.
+func redirectAuthorization(w http.ResponseWriter, ar *authorizationRequest, params url.Values) {
+	u, err := url.Parse(ar.redirectTo)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	q := u.Query()
+	for name := range params {
+		q.Set(name, params.Get(name))
+	}
+	if ar.State != "" {
+		q.Set("state", ar.State)
+	}
+	u.RawQuery = q.Encode()
+	w.Header().Set("Location", u.String())
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusFound)
+}
+
+func renderAuthorizePage(w http.ResponseWriter, page authorizePage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// the form must not be framed by other sites
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(http.StatusOK)
+	if err := authorizeTemplate.Execute(w, page); err != nil {
+		log.Println(err)
+	}
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, oerr *oauthError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(oerr); err != nil {
+		log.Println(err)
+	}
+}
+
+// authorizeHandler is the authorization endpoint of OAuth 2.0 with the
+// authorization code. GET shows a login form to the user, whose password
+// and code are checked like by loginHandler when it is posted. The user
+// is then redirected to the client with a code for tokenHandler. The
+// clients are apps of the organization, so no consent is asked.
+// URL: GET|POST /oauth/authorize
+// PARAMETERS:
+//	"response_type": Must be code (required)
+//	"client_id": ID of the client (required)
+//	"redirect_uri": One of the redirect URIs of the client, required when
+//	it has several
+//	"scope": Scopes separated by spaces, those of the client by default
+//	"state": Value sent back to the client with the code
+//	"nonce": Value put in the ID token
+//	"code_challenge": base64url of the SHA-256 of the code_verifier,
+//	required for public clients
+//	"code_challenge_method": Must be S256
+// BODY:
+//	The parameters, with username, password and code when it is asked.
+func authorizeHandler(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		log.Println(err)
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Error: "invalid_request"})
+		return
+	}
+	ar, oerr, redirect := parseAuthorizationRequest(req.Form)
+	if oerr != nil {
+		if redirect {
+			redirectAuthorization(w, ar, url.Values{"error": {oerr.Error}, "error_description": {oerr.ErrorDescription}})
+		} else {
+			writeOAuthError(w, http.StatusBadRequest, oerr)
+		}
+		return
+	}
+
+	page := authorizePage{Client: ar.client, Params: ar.values()}
+	if req.Method != "POST" {
+		renderAuthorizePage(w, page)
+		return
+	}
+
+	page.Username = req.PostForm.Get("username")
+	u, err := authenticate(req, ar.client.OrganizationID, page.Username, req.PostForm.Get("password"))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if u == nil {
+		page.Error = errInvalidLogin
+		renderAuthorizePage(w, page)
+		return
+	}
+
+	now := bson.Now()
+	if u.TOTPEnabled {
+		page.AskCode = true
+		code := req.PostForm.Get("code")
+		if code == "" {
+			page.Error = "Enter the code of your authenticator app, or a recovery code."
+			renderAuthorizePage(w, page)
+			return
+		}
+		ok, err := u.checkSecondFactor(code, now)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			loginRefused(req, u, now)
+			page.Error = errInvalidCode
+			renderAuthorizePage(w, page)
+			return
+		}
+	} else if required, err := u.requiresTOTP(); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if required {
+		page.Error = "Two-factor authentication is required for this user, enable it to log in."
+		renderAuthorizePage(w, page)
+		return
+	}
+	u.loginSucceeded()
+
+	token, err := randomToken(32)
+	if err == nil {
+		err = config.oauthCodesCollection.Insert(authorizationCode{
+			ID:             hashToken(token),
+			ClientID:       ar.client.ID,
+			UserID:         u.ID,
+			OrganizationID: u.OrganizationID,
+			RedirectURI:    ar.RedirectURI,
+			Scopes:         ar.scopes,
+			Nonce:          ar.Nonce,
+			CodeChallenge:  ar.CodeChallenge,
+			AuthTime:       now,
+			ExpiresAt:      now.Add(authorizationCodeTTL),
+		})
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	redirectAuthorization(w, ar, url.Values{"code": {token}})
+}
+
+// authenticateClient returns the client of a request to the token
+// endpoints, authenticated with HTTP Basic or the client_id and
+// client_secret of the form. Public clients only send their client_id.
+// It returns nil when the client is unknown or its secret is wrong.
+func authenticateClient(req *http.Request) *oauthClient {
+	id, secret, basic := req.BasicAuth()
+	if basic {
+		// the credentials are form encoded before being put in the header
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = req.PostForm.Get("client_id"), req.PostForm.Get("client_secret")
+	}
+	c, err := findOAuthClient(id)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			log.Println(err)
+		}
+		return nil
+	}
+	if c.Confidential != (secret != "") {
+		return nil
+	}
+	if c.Confidential && subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(c.SecretDigest)) != 1 {
+		return nil
+	}
+	return c
+}
+
+// verifyCodeChallenge tells whether verifier is the PKCE code_verifier of
+// the S256 challenge.
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// save saves a copy of t with the type and lifetime given, and returns
+// its token.
+func (t oauthToken) save(typ string, ttl time.Duration) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	t.ID, t.Type, t.ExpiresAt = hashToken(token), typ, t.CreatedAt.Add(ttl)
+	return token, config.oauthTokensCollection.Insert(t)
+}
+
+// active tells whether the token can be used at now.
+func (t *oauthToken) active(now time.Time) bool {
+	return t.RevokedAt.IsZero() && now.Before(t.ExpiresAt)
+}
+
+// revokeTokenFamily revokes the tokens issued from one authorization.
+func revokeTokenFamily(familyID bson.ObjectId) error {
+	_, err := config.oauthTokensCollection.UpdateAll(
+		bson.M{"family_id": familyID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": bson.Now()}},
+	)
+	return err
+}
+
+// revokeUserTokens revokes the tokens of every client of the user.
+func revokeUserTokens(userID bson.ObjectId) error {
+	_, err := config.oauthTokensCollection.UpdateAll(
+		bson.M{"user_id": userID, "client_id": bson.M{"$exists": true}, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": bson.Now()}},
+	)
+	return err
+}
+
+// issueTokens issues an access token to the client for u, or for itself
+// when u is nil. Users also get a refresh token when the client can use
+// them, and an ID token with the openid scope. familyID is the family of
+// a refreshed token, a new one is started when it is empty.
+func issueTokens(req *http.Request, c *oauthClient, u *user, scopes []string, nonce string, authTime time.Time, familyID bson.ObjectId) (*tokenResponse, error) {
+	if familyID == "" {
+		familyID = bson.NewObjectId()
+	}
+	t := oauthToken{
+		ClientID:       c.ID,
+		OrganizationID: c.OrganizationID,
+		Scopes:         scopes,
+		FamilyID:       familyID,
+		AuthTime:       authTime,
+		CreatedAt:      bson.Now(),
+	}
+	if u != nil {
+		t.UserID = u.ID
+	}
+
+	access, err := t.save(tokenAccess, accessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	resp := &tokenResponse{
+		AccessToken: access,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(accessTokenTTL.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	}
+	if u == nil {
+		return resp, nil
+	}
+	if containsString(c.GrantTypes, grantRefreshToken) {
+		if resp.RefreshToken, err = t.save(tokenRefresh, refreshTokenTTL); err != nil {
+			return nil, err
+		}
+	}
+	if containsString(scopes, scopeOpenID) {
+		if resp.IDToken, err = newIDToken(req, u, c.ID.Hex(), scopes, nonce, authTime); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func invalidGrant(description string) *oauthError {
+	return &oauthError{Error: "invalid_grant", ErrorDescription: description}
+}
+
+// exchangeAuthorizationCode issues the tokens of an authorization code,
+// which can only be exchanged once by its client.
+func exchangeAuthorizationCode(req *http.Request, c *oauthClient) (*tokenResponse, *oauthError, error) {
+	form := req.PostForm
+	var code authorizationCode
+	_, err := config.oauthCodesCollection.Find(bson.M{
+		"_id":        hashToken(form.Get("code")),
+		"expires_at": bson.M{"$gt": bson.Now()},
+	}).Apply(mgo.Change{Remove: true}, &code)
+	if err == mgo.ErrNotFound {
+		return nil, invalidGrant("The code is invalid, expired or already used."), nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	if code.ClientID != c.ID {
+		return nil, invalidGrant("The code was issued to another client."), nil
+	}
+	if code.RedirectURI != "" && code.RedirectURI != form.Get("redirect_uri") {
+		return nil, invalidGrant("The redirect_uri doesn't match the authorization request."), nil
+	}
+	verifier := form.Get("code_verifier")
+	if code.CodeChallenge == "" && verifier != "" {
+		return nil, invalidGrant("The authorization request had no code_challenge."), nil
+	}
+	if code.CodeChallenge != "" && !verifyCodeChallenge(code.CodeChallenge, verifier) {
+		return nil, invalidGrant("The code_verifier doesn't match the code_challenge."), nil
+	}
+
+	u, err := loadUser(code.OrganizationID, code.UserID.Hex())
+	if err == mgo.ErrNotFound {
+		return nil, invalidGrant("The user doesn't exist anymore."), nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	resp, err := issueTokens(req, c, u, code.Scopes, code.Nonce, code.AuthTime, "")
+	return resp, nil, err
+}
+
+// clientCredentialsGrant issues an access token to a confidential client
+// for itself. The scopes of OpenID Connect are about users, they can't be
+// given to the clients.
+func clientCredentialsGrant(req *http.Request, c *oauthClient) (*tokenResponse, *oauthError, error) {
+	var allowed []string
+	for _, s := range c.Scopes {
+		if s != scopeOpenID && s != scopeProfile && s != scopeEmail {
+			allowed = append(allowed, s)
+		}
+	}
+	scopes, oerr := requestedScopes(req.PostForm.Get("scope"), allowed)
+	if oerr != nil {
+		return nil, oerr, nil
+	}
+	resp, err := issueTokens(req, c, nil, scopes, "", time.Time{}, "")
+	return resp, nil, err
+}
+
+// refreshTokenGrant exchanges a refresh token for new tokens. Refresh
+// tokens are rotated: each is used once, and using one again revokes all
+// the tokens of its family, since one of its users stole it.
+func refreshTokenGrant(req *http.Request, c *oauthClient) (*tokenResponse, *oauthError, error) {
+	now := bson.Now()
+	var old oauthToken
+	_, err := config.oauthTokensCollection.Find(bson.M{
+		"_id":       hashToken(req.PostForm.Get("refresh_token")),
+		"type":      tokenRefresh,
+		"client_id": c.ID,
+	}).Apply(mgo.Change{Update: bson.M{"$set": bson.M{"revoked_at": now}}}, &old)
+	if err == mgo.ErrNotFound {
+		return nil, invalidGrant("The refresh token is invalid."), nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	if !old.RevokedAt.IsZero() {
+		if err = revokeTokenFamily(old.FamilyID); err != nil {
+			return nil, nil, err
+		}
+		return nil, invalidGrant("The refresh token was already used, the tokens issued with it are revoked."), nil
+	}
+	if !now.Before(old.ExpiresAt) {
+		return nil, invalidGrant("The refresh token expired."), nil
+	}
+	scopes, oerr := requestedScopes(req.PostForm.Get("scope"), old.Scopes)
+	if oerr != nil {
+		return nil, oerr, nil
+	}
+	u, err := loadUser(old.OrganizationID, old.UserID.Hex())
+	if err == mgo.ErrNotFound {
+		return nil, invalidGrant("The user doesn't exist anymore."), nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	resp, err := issueTokens(req, c, u, scopes, "", old.AuthTime, old.FamilyID)
+	return resp, nil, err
+}
+
+// tokenHandler is the token endpoint of OAuth 2.0. Confidential clients
+// authenticate with HTTP Basic or client_id and client_secret, public
+// clients send their client_id.
+// URL: POST /oauth/token
+// HEADERS:
+//	"Content-Type": "application/x-www-form-urlencoded"
+//	"Authorization": "Basic <client_id:client_secret>"
+// BODY:
+//	grant_type: authorization_code, client_credentials or refresh_token
+//	(required)
+//	code: Code of the authorization_code grant.
+//	redirect_uri: The redirect_uri of the authorization request, when it
+//	was given.
+//	code_verifier: The PKCE verifier of the code_challenge.
+//	refresh_token: Token of the refresh_token grant.
+//	scope: Scopes separated by spaces, to ask for fewer.
+// EXAMPLE:
+//	grant_type=authorization_code&code=2c4b...&client_id=5a1b...&code_verifier=dBjftJeZ4CVP...
+func tokenHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if err := req.ParseForm(); err != nil {
+		log.Println(err)
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Error: "invalid_request"})
+		return
+	}
+	c := authenticateClient(req)
+	if c == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		writeOAuthError(w, http.StatusUnauthorized, &oauthError{Error: "invalid_client", ErrorDescription: "Unknown client or wrong secret."})
+		return
+	}
+
+	grant := req.PostForm.Get("grant_type")
+	if !containsString(oauthGrantTypes, grant) {
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Error: "unsupported_grant_type"})
+		return
+	}
+	if !containsString(c.GrantTypes, grant) {
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Error: "unauthorized_client", ErrorDescription: "The client can't use the " + grant + " grant."})
+		return
+	}
+
+	var resp *tokenResponse
+	var oerr *oauthError
+	var err error
+	switch grant {
+	case grantAuthorizationCode:
+		resp, oerr, err = exchangeAuthorizationCode(req, c)
+	case grantClientCredentials:
+		resp, oerr, err = clientCredentialsGrant(req, c)
+	case grantRefreshToken:
+		resp, oerr, err = refreshTokenGrant(req, c)
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if oerr != nil {
+		writeOAuthError(w, http.StatusBadRequest, oerr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+}
+
+// revokeTokenHandler revokes a token of the client. Revoking a refresh
+// token also revokes the tokens of its family. Unknown tokens get the
+// same response.
+// URL: POST /oauth/revoke
+// HEADERS:
+//	"Content-Type": "application/x-www-form-urlencoded"
+//	"Authorization": "Basic <client_id:client_secret>"
+// BODY:
+//	token: The access or refresh token. (required)
+//	token_type_hint: Ignored, tokens of both types are looked for.
+func revokeTokenHandler(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		log.Println(err)
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Error: "invalid_request"})
+		return
+	}
+	c := authenticateClient(req)
+	if c == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		writeOAuthError(w, http.StatusUnauthorized, &oauthError{Error: "invalid_client", ErrorDescription: "Unknown client or wrong secret."})
+		return
+	}
+
+	var t oauthToken
+	err := config.oauthTokensCollection.Find(bson.M{"_id": hashToken(req.PostForm.Get("token")), "client_id": c.ID}).One(&t)
+	if err == nil {
+		if t.Type == tokenRefresh {
+			err = revokeTokenFamily(t.FamilyID)
+		} else if t.RevokedAt.IsZero() {
+			err = config.oauthTokensCollection.UpdateId(t.ID, bson.M{"$set": bson.M{"revoked_at": bson.Now()}})
+		}
+	}
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// introspectTokenHandler tells a confidential client, like an API using
+// the tokens, whether a token of its organization is active, and what
+// for.
+// URL: POST /oauth/introspect
+// HEADERS:
+//	"Content-Type": "application/x-www-form-urlencoded"
+//	"Authorization": "Basic <client_id:client_secret>"
+// BODY:
+//	token: The access or refresh token. (required)
+//	token_type_hint: Ignored, tokens of both types are looked for.
+func introspectTokenHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err := req.ParseForm(); err != nil {
+		log.Println(err)
+		writeOAuthError(w, http.StatusBadRequest, &oauthError{Error: "invalid_request"})
+		return
+	}
+	c := authenticateClient(req)
+	if c == nil || !c.Confidential {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		writeOAuthError(w, http.StatusUnauthorized, &oauthError{Error: "invalid_client", ErrorDescription: "Only confidential clients can introspect tokens."})
+		return
+	}
+
+	var t oauthToken
+	err := config.oauthTokensCollection.Find(bson.M{
+		"_id":             hashToken(req.PostForm.Get("token")),
+		"organization_id": c.OrganizationID,
+		"client_id":       bson.M{"$exists": true},
+	}).One(&t)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var resp tokenIntrospection
+	if err == nil && t.active(bson.Now()) {
+		resp = tokenIntrospection{
+			Active:   true,
+			Scope:    strings.Join(t.Scopes, " "),
+			ClientID: t.ClientID.Hex(),
+			Expiry:   t.ExpiresAt.Unix(),
+			IssuedAt: t.CreatedAt.Unix(),
+			Issuer:   oauthIssuer(req),
+		}
+		if t.UserID != "" {
+			resp.Subject = t.UserID.Hex()
+		}
+		if t.Type == tokenAccess {
+			resp.TokenType = "Bearer"
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+}
+
+// accessTokenActor returns who an access token was issued to, nil when
+// the token isn't active.
+func accessTokenActor(token string) (*actor, error) {
+	var t oauthToken
+	err := config.oauthTokensCollection.Find(bson.M{"_id": hashToken(token), "type": tokenAccess}).One(&t)
+	if err == mgo.ErrNotFound || (err == nil && !t.active(bson.Now())) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if t.UserID == "" {
+		return &actor{Type: actorClient, ID: t.ClientID.Hex(), OrganizationID: t.OrganizationID, Scopes: t.Scopes, Scoped: true}, nil
+	}
+	var u user
+	err = config.usersCollection.FindId(t.UserID).Select(bson.M{"role": 1}).One(&u)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	a := &actor{Type: actorUser, ID: u.ID.Hex(), Role: u.Role, OrganizationID: t.OrganizationID, Scopes: t.Scopes, Scoped: true}
+	if t.ClientID == "" {
+		// the tokens of the sessions have the rights of their user
+		a.Scoped, a.SessionID = false, t.FamilyID.Hex()
+	}
+	return a, nil
+}
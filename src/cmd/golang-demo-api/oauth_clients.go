@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Grants the OAuth clients can use at the token endpoint.
+const (
+	grantAuthorizationCode = "authorization_code"
+	grantClientCredentials = "client_credentials"
+	grantRefreshToken      = "refresh_token"
+)
+
+var oauthGrantTypes = []string{grantAuthorizationCode, grantClientCredentials, grantRefreshToken}
+
+// oauthScopes are the scopes the OAuth clients can be given.
+var oauthScopes = []string{scopeOpenID, scopeProfile, scopeEmail, scopeUsersRead, scopeUsersWrite}
+
+var (
+	defaultOAuthGrantTypes = []string{grantAuthorizationCode, grantRefreshToken}
+	defaultOAuthScopes     = []string{scopeOpenID, scopeProfile, scopeEmail}
+)
+
+// oauthClient is an application of an organization using the API with
+// OAuth 2.0. Its ID is the client_id.
+type oauthClient struct {
+	ID             bson.ObjectId `bson:"_id" json:"client_id"`
+	OrganizationID bson.ObjectId `bson:"organization_id" json:"-"`
+	Name           string        `bson:"name" json:"name"`
+	RedirectURIs   []string      `bson:"redirect_uris,omitempty" json:"redirect_uris,omitempty"`
+	GrantTypes     []string      `bson:"grant_types" json:"grant_types"`
+	Scopes         []string      `bson:"scopes" json:"scopes"`
+	// Confidential clients authenticate with their secret. Public ones,
+	// like mobile and single page apps, can't keep one and must use PKCE.
+	Confidential bool   `bson:"confidential" json:"confidential"`
+	SecretDigest string `bson:"secret_digest,omitempty" json:"-"`
+	// Secret is only returned on creation.
+	Secret    string      `bson:"-" json:"client_secret,omitempty"`
+	CreatedAt time.Time   `bson:"created_at" json:"created_at"`
+	Errors    ModelErrors `bson:"-" json:"errors,omitempty"`
+}
+
+type newOAuthClient struct {
+	Name         *string   `json:"name,omitempty"`
+	RedirectURIs *[]string `json:"redirect_uris,omitempty"`
+	GrantTypes   *[]string `json:"grant_types,omitempty"`
+	Scopes       *[]string `json:"scopes,omitempty"`
+	Confidential *bool     `json:"confidential,omitempty"`
+}
+
+// OAuthClients represents a collection of oauthClient objects
+type OAuthClients []oauthClient
+
+func init() {
+	clientsRouter := router.Path("/api/oauth/clients").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Subrouter()
+
+	clientsRouter.Methods("GET").HandlerFunc(requireAdmin(oauthClientsHandler))
+	clientsRouter.Methods("POST").HandlerFunc(requireAdmin(createOAuthClientHandler))
+
+	clientRouter := router.Path("/api/oauth/clients/{id}").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Subrouter()
+
+	clientRouter.Methods("GET").HandlerFunc(requireAdmin(showOAuthClientHandler))
+	clientRouter.Methods("DELETE").HandlerFunc(requireAdmin(deleteOAuthClientHandler))
+
+	clientID := pathParam("id", "ID of the client")
+	documentOperations(
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/oauth/clients",
+			OperationID: "listOAuthClients",
+			Summary:     "Returns all the OAuth clients of the organization, newest first.",
+			Tags:        []string{"oauth"},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK)),
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/oauth/clients",
+			OperationID: "createOAuthClient",
+			Summary:     "Registers an OAuth client. The secret of confidential clients is only returned here.",
+			Tags:        []string{"oauth"},
+			RequestBody: jsonBody(struct {
+				Client newOAuthClient `json:"oauth_client"`
+			}{}),
+			Responses: adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422)),
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/oauth/clients/{id}",
+			OperationID: "showOAuthClient",
+			Summary:     "Returns an OAuth client.",
+			Tags:        []string{"oauth"},
+			Parameters:  []*openAPIParameter{clientID},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+		&openAPIOperation{
+			Method:      "DELETE",
+			Path:        "/api/oauth/clients/{id}",
+			OperationID: "deleteOAuthClient",
+			Summary:     "Deletes an OAuth client, revoking its tokens.",
+			Tags:        []string{"oauth"},
+			Parameters:  []*openAPIParameter{clientID},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+	)
+}
+
+// Create saves the client with a new secret when it is confidential.
+func (c *oauthClient) Create() error {
+	c.ID = bson.NewObjectId()
+	if c.GrantTypes == nil {
+		c.GrantTypes = defaultOAuthGrantTypes
+	}
+	if c.Scopes == nil {
+		c.Scopes = defaultOAuthScopes
+	}
+	if !c.Valid() {
+		return errors.New("OAuth Client Invalid")
+	}
+	if c.Confidential {
+		secret, err := randomToken(32)
+		if err != nil {
+			return err
+		}
+		c.Secret, c.SecretDigest = secret, hashToken(secret)
+	}
+	c.CreatedAt = c.ID.Time()
+	return config.oauthClientsCollection.Insert(c)
+}
+
+// Valid checks the fields of the client. Clients using the authorization
+// code need redirect URIs, and only confidential ones can use their own
+// credentials.
+func (c *oauthClient) Valid() bool {
+	c.Errors = make(ModelErrors)
+	if strings.TrimSpace(c.Name) == "" {
+		c.Errors["name"] = append(c.Errors["name"], "can't be blank")
+	}
+	if len(c.GrantTypes) == 0 {
+		c.Errors["grant_types"] = append(c.Errors["grant_types"], "can't be blank")
+	}
+	for _, g := range c.GrantTypes {
+		if !containsString(oauthGrantTypes, g) {
+			c.Errors["grant_types"] = append(c.Errors["grant_types"], "must be any of "+strings.Join(oauthGrantTypes, ", "))
+			break
+		}
+	}
+	if containsString(c.GrantTypes, grantClientCredentials) && !c.Confidential {
+		c.Errors["grant_types"] = append(c.Errors["grant_types"], "client_credentials needs a confidential client")
+	}
+	if containsString(c.GrantTypes, grantAuthorizationCode) && len(c.RedirectURIs) == 0 {
+		c.Errors["redirect_uris"] = append(c.Errors["redirect_uris"], "can't be blank")
+	}
+	for _, uri := range c.RedirectURIs {
+		if !validRedirectURI(uri) {
+			c.Errors["redirect_uris"] = append(c.Errors["redirect_uris"], uri+" must be an absolute URI without fragment, using https unless on localhost")
+		}
+	}
+	for _, s := range c.Scopes {
+		if !containsString(oauthScopes, s) {
+			c.Errors["scopes"] = append(c.Errors["scopes"], "must be any of "+strings.Join(oauthScopes, ", "))
+			break
+		}
+	}
+	return len(c.Errors) == 0
+}
+
+// validRedirectURI tells whether uri can receive authorization codes.
+// Native apps can use their own schemes, but codes are only sent over
+// plain HTTP to the machine of the user.
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Fragment != "" {
+		return false
+	}
+	if u.Scheme == "http" {
+		host := u.Hostname()
+		ip := net.ParseIP(host)
+		return host == "localhost" || (ip != nil && ip.IsLoopback())
+	}
+	return u.Scheme != "https" || u.Host != ""
+}
+
+func (c *oauthClient) copyFields(nc newOAuthClient) {
+	if nc.Name != nil {
+		c.Name = *nc.Name
+	}
+	if nc.RedirectURIs != nil {
+		c.RedirectURIs = *nc.RedirectURIs
+	}
+	if nc.GrantTypes != nil {
+		c.GrantTypes = *nc.GrantTypes
+	}
+	if nc.Scopes != nil {
+		c.Scopes = *nc.Scopes
+	}
+	if nc.Confidential != nil {
+		c.Confidential = *nc.Confidential
+	}
+}
+
+// oauthClientsHandler returns all the OAuth clients of the organization.
+// URL: GET /api/oauth/clients
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+func oauthClientsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var clients OAuthClients
+	if err := config.oauthClientsCollection.Find(bson.M{"organization_id": requestOrganization(req).ID}).Sort("-_id").All(&clients); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := response{data: &data{Total: len(clients), OAuthClients: clients}}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// createOAuthClientHandler registers an application using OAuth 2.0.
+// The response of confidential clients holds their client_secret, it
+// can't be read again afterwards.
+// URL: POST /api/oauth/clients
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// BODY:
+//	oauth_client[name]: Name shown to the users logging in. (required)
+//	oauth_client[redirect_uris]: URIs the authorization codes are sent to,
+//	required with the authorization_code grant.
+//	oauth_client[grant_types]: Any of authorization_code, refresh_token
+//	and client_credentials, the first two by default.
+//	oauth_client[scopes]: Any of openid, profile and email, all by default.
+//	oauth_client[confidential]: Whether the client can keep a secret.
+// EXAMPLE:
+//	{
+//		"oauth_client": {
+//			"name": "Dashboard",
+//			"redirect_uris": ["https://dashboard.example.com/callback"],
+//			"confidential": true
+//		}
+//	}
+func createOAuthClientHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var params struct {
+		Client newOAuthClient `json:"oauth_client"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&params); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var resp *response
+	c := &oauthClient{OrganizationID: requestOrganization(req).ID}
+	c.copyFields(params.Client)
+	if err := c.Create(); err != nil {
+		log.Println(err)
+		resp = &response{
+			Message: "Unable to save OAuth client. Please correct the errors and try again.",
+			data:    &data{Errors: c.Errors},
+		}
+		w.WriteHeader(422)
+	} else {
+		resp = &response{Message: "OAuth client successfully created.", data: &data{oauthClient: c}}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// showOAuthClientHandler returns an OAuth client, without its secret.
+// URL: GET /api/oauth/clients/:id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the client
+func showOAuthClientHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var resp *response
+	if c, err := loadOAuthClient(requestOrganization(req).ID, mux.Vars(req)["id"]); err != nil {
+		log.Println(err)
+		resp = &response{Message: "OAuth client not found."}
+		w.WriteHeader(422)
+	} else {
+		resp = &response{data: &data{oauthClient: c}}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// deleteOAuthClientHandler deletes an OAuth client with its codes and
+// tokens, which stop working at once.
+// URL: DELETE /api/oauth/clients/:id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the client
+func deleteOAuthClientHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var resp *response
+	if c, err := loadOAuthClient(requestOrganization(req).ID, mux.Vars(req)["id"]); err != nil {
+		log.Println(err)
+		resp = &response{Message: "OAuth client not found."}
+		w.WriteHeader(422)
+	} else if err = config.oauthClientsCollection.RemoveId(c.ID); err != nil {
+		log.Println(err)
+		resp = &response{Message: "Unable to delete OAuth client."}
+		w.WriteHeader(422)
+	} else {
+		for _, coll := range []*mgo.Collection{config.oauthCodesCollection, config.oauthTokensCollection} {
+			if _, err = coll.RemoveAll(bson.M{"client_id": c.ID}); err != nil {
+				log.Println(err)
+			}
+		}
+		resp = &response{Message: "OAuth client deleted successfully."}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// loadOAuthClient loads a client of the organization.
+func loadOAuthClient(orgID bson.ObjectId, id string) (*oauthClient, error) {
+	var c oauthClient
+	if !bson.IsObjectIdHex(id) {
+		return &c, errors.New("Invalid client id.")
+	}
+	err := config.oauthClientsCollection.Find(bson.M{"_id": bson.ObjectIdHex(id), "organization_id": orgID}).One(&c)
+	return &c, err
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// the example of RFC 7636
+const (
+	testCodeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	testCodeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	if !verifyCodeChallenge(testCodeChallenge, testCodeVerifier) {
+		t.Errorf("expected the verifier of RFC 7636 to match")
+	}
+	for _, verifier := range []string{"", testCodeVerifier[1:], testCodeVerifier[:42] + "A"} {
+		if verifyCodeChallenge(testCodeChallenge, verifier) {
+			t.Errorf("%q: expected the verifier not to match", verifier)
+		}
+	}
+}
+
+func TestValidRedirectURI(t *testing.T) {
+	cases := map[string]bool{
+		"https://app.example.com/callback": true,
+		"http://localhost:8080/callback":   true,
+		"http://127.0.0.1/callback":        true,
+		"com.example.app:/callback":        true,
+		"http://app.example.com/callback":  false,
+		"https://app.example.com/#token":   false,
+		"/callback":                        false,
+		"https:///callback":                false,
+	}
+	for uri, expected := range cases {
+		if actual := validRedirectURI(uri); actual != expected {
+			t.Errorf("%s: expected %v, but got %v", uri, expected, actual)
+		}
+	}
+}
+
+func TestRequestedScopes(t *testing.T) {
+	allowed := []string{scopeOpenID, scopeEmail}
+	if scopes, oerr := requestedScopes("", allowed); oerr != nil || len(scopes) != 2 {
+		t.Errorf("expected the allowed scopes, but got %v %v", scopes, oerr)
+	}
+	if scopes, oerr := requestedScopes(" email  email ", allowed); oerr != nil || len(scopes) != 1 || scopes[0] != scopeEmail {
+		t.Errorf("expected %v, but got %v %v", []string{scopeEmail}, scopes, oerr)
+	}
+	if _, oerr := requestedScopes("openid profile", allowed); oerr == nil || oerr.Error != "invalid_scope" {
+		t.Errorf("expected an invalid scope, but got %v", oerr)
+	}
+}
+
+// browser doesn't follow the redirects, so they can be checked.
+var browser = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// registerOAuthClient registers a client with the API of the admins.
+func registerOAuthClient(t *testing.T, adminURL, body string) *oauthClient {
+	status, r := doOrganizationRequest(t, "POST", adminURL+"/api/oauth/clients", body)
+	if status != http.StatusOK || r.oauthClient == nil {
+		t.Fatalf("expected a client, but got %d %s %v", status, r.Message, r.Errors)
+	}
+	return r.oauthClient
+}
+
+// oauthResult is any response of the token endpoints.
+type oauthResult struct {
+	tokenResponse
+	oauthError
+	// the members of the introspection not in tokenResponse
+	Active   bool   `json:"active"`
+	ClientID string `json:"client_id"`
+	Subject  string `json:"sub"`
+}
+
+// postOAuthForm posts form to an endpoint of the tokens, authenticated
+// with HTTP Basic when a secret is given.
+func postOAuthForm(t *testing.T, endpoint string, form url.Values, clientID, secret string) (int, oauthResult) {
+	if secret == "" {
+		form.Set("client_id", clientID)
+	}
+	req, _ := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if secret != "" {
+		req.SetBasicAuth(clientID, secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r oauthResult
+	json.NewDecoder(resp.Body).Decode(&r)
+	return resp.StatusCode, r
+}
+
+func bearerRequest(t *testing.T, method, url, token string) (int, []byte) {
+	req, _ := http.NewRequest(method, url, nil)
+	req.Header.Set("Accept", apiContentType)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, b
+}
+
+// fetchSigningKey reads the key of the ID tokens in the JWKS.
+func fetchSigningKey(t *testing.T, jwksURI string) *rsa.PublicKey {
+	resp, err := http.Get(jwksURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var set jsonWebKeySet
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil || len(set.Keys) != 1 {
+		t.Fatalf("expected a key, but got %+v %v", set, err)
+	}
+	n, _ := base64.RawURLEncoding.DecodeString(set.Keys[0].Modulus)
+	e, _ := base64.RawURLEncoding.DecodeString(set.Keys[0].Exponent)
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+}
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	admin := actorServer(actor{Type: actorUser, Role: roleAdmin, OrganizationID: defaultOrganization.ID})
+	defer admin.Close()
+
+	u := setupUser(t)
+	redirectURI := "com.example.app:/callback"
+	c := registerOAuthClient(t, admin.URL, `{"oauth_client":{"name":"Mobile","redirect_uris":["`+redirectURI+`"],"scopes":["openid","email","users:read"]}}`)
+	if c.Confidential || c.Secret != "" {
+		t.Errorf("expected a public client, but got %+v", c)
+	}
+
+	// the client discovers the endpoints
+	resp, err := http.Get(ts.URL + "/.well-known/openid-configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var discovery openIDConfiguration
+	json.NewDecoder(resp.Body).Decode(&discovery)
+	resp.Body.Close()
+	if discovery.Issuer != ts.URL || discovery.TokenEndpoint != ts.URL+"/oauth/token" {
+		t.Fatalf("expected the endpoints of %s, but got %+v", ts.URL, discovery)
+	}
+	key := fetchSigningKey(t, discovery.JWKSURI)
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.ID.Hex()},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {"openid email users:read"},
+		"state":                 {"af0ifjsldkj"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {testCodeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	resp, err = browser.Get(discovery.AuthorizationEndpoint + "?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), `name="code_challenge" value="`+testCodeChallenge+`"`) {
+		t.Fatalf("expected the login form, but got %d %s", resp.StatusCode, page)
+	}
+
+	// public clients must use PKCE
+	noPKCE := url.Values{"response_type": {"code"}, "client_id": {c.ID.Hex()}, "state": {"s"}}
+	resp, err = browser.Get(discovery.AuthorizationEndpoint + "?" + noPKCE.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if location, _ := resp.Location(); resp.StatusCode != http.StatusFound || location.Query().Get("error") != "invalid_request" || location.Query().Get("state") != "s" {
+		t.Errorf("expected an error sent to the client, but got %d %v", resp.StatusCode, location)
+	}
+	// unknown redirect URIs are never redirected to
+	params.Set("redirect_uri", "https://evil.example.com/callback")
+	resp, err = browser.Get(discovery.AuthorizationEndpoint + "?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected %d, but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	params.Set("redirect_uri", redirectURI)
+
+	login := func(password string) *http.Response {
+		form := url.Values{"username": {"test_user"}, "password": {password}}
+		for name := range params {
+			form.Set(name, params.Get(name))
+		}
+		resp, err := browser.PostForm(discovery.AuthorizationEndpoint, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	authorize := func() string {
+		resp := login("test123#")
+		location, err := resp.Location()
+		if resp.StatusCode != http.StatusFound || err != nil {
+			t.Fatalf("expected a redirect, but got %d %v", resp.StatusCode, err)
+		}
+		q := location.Query()
+		if location.Scheme != "com.example.app" || q.Get("state") != "af0ifjsldkj" || q.Get("code") == "" {
+			t.Fatalf("expected a code sent to %s, but got %s", redirectURI, location)
+		}
+		return q.Get("code")
+	}
+	if resp = login("wrong"); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the form again, but got %d", resp.StatusCode)
+	}
+
+	exchange := func(code, verifier string) (int, oauthResult) {
+		return postOAuthForm(t, discovery.TokenEndpoint, url.Values{
+			"grant_type":    {grantAuthorizationCode},
+			"code":          {code},
+			"redirect_uri":  {redirectURI},
+			"code_verifier": {verifier},
+		}, c.ID.Hex(), "")
+	}
+	status, r := exchange(authorize(), strings.Repeat("x", 43))
+	if status != http.StatusBadRequest || r.Error != "invalid_grant" {
+		t.Errorf("expected the verifier to be refused, but got %d %+v", status, r.oauthError)
+	}
+	code := authorize()
+	status, r = exchange(code, testCodeVerifier)
+	if status != http.StatusOK || r.AccessToken == "" || r.RefreshToken == "" || r.IDToken == "" {
+		t.Fatalf("expected the tokens, but got %d %+v", status, r.oauthError)
+	}
+	tokens := r.tokenResponse
+	if status, r = exchange(code, testCodeVerifier); status != http.StatusBadRequest || r.Error != "invalid_grant" {
+		t.Errorf("expected the code to be used once, but got %d %+v", status, r.oauthError)
+	}
+
+	var claims idTokenClaims
+	if err = verifyJWT(key, tokens.IDToken, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != ts.URL || claims.Audience != c.ID.Hex() || claims.Subject != u.ID.Hex() || claims.Nonce != "n-0S6_WzA2Mj" {
+		t.Errorf("expected the claims of the request, but got %+v", claims)
+	}
+	if claims.Email != u.Email || claims.Name != "" {
+		t.Errorf("expected the claims of the email scope, but got %+v", claims.userInfo)
+	}
+
+	status, b := bearerRequest(t, "GET", discovery.UserInfoEndpoint, tokens.AccessToken)
+	var info userInfo
+	json.Unmarshal(b, &info)
+	if status != http.StatusOK || info.Subject != u.ID.Hex() || info.Email != u.Email {
+		t.Errorf("expected the user info, but got %d %s", status, b)
+	}
+	// the access token is used with the API
+	if status, b = bearerRequest(t, "GET", ts.URL+"/api/users/"+u.ID.Hex(), tokens.AccessToken); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d %s", http.StatusOK, status, b)
+	}
+	if status, _ = bearerRequest(t, "DELETE", ts.URL+"/api/users/"+u.ID.Hex(), tokens.AccessToken); status != http.StatusForbidden {
+		t.Errorf("expected the users:write scope to be required, but got %d", status)
+	}
+	if status, _ = bearerRequest(t, "GET", ts.URL+"/api/users/"+u.ID.Hex(), "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("expected %d, but got %d", http.StatusUnauthorized, status)
+	}
+
+	refresh := func(token string) (int, oauthResult) {
+		return postOAuthForm(t, discovery.TokenEndpoint, url.Values{
+			"grant_type":    {grantRefreshToken},
+			"refresh_token": {token},
+		}, c.ID.Hex(), "")
+	}
+	status, r = refresh(tokens.RefreshToken)
+	if status != http.StatusOK || r.AccessToken == "" || r.RefreshToken == tokens.RefreshToken {
+		t.Fatalf("expected new tokens, but got %d %+v", status, r.oauthError)
+	}
+	refreshed := r.tokenResponse
+	// using a refresh token twice revokes its family
+	if status, r = refresh(tokens.RefreshToken); status != http.StatusBadRequest || r.Error != "invalid_grant" {
+		t.Errorf("expected the reuse to be refused, but got %d %+v", status, r.oauthError)
+	}
+	if status, _ = refresh(refreshed.RefreshToken); status != http.StatusBadRequest {
+		t.Errorf("expected the refreshed token to be revoked, but got %d", status)
+	}
+	if status, _ = bearerRequest(t, "GET", discovery.UserInfoEndpoint, refreshed.AccessToken); status != http.StatusUnauthorized {
+		t.Errorf("expected the access token to be revoked, but got %d", status)
+	}
+
+	dropAllCollections(t)
+}
+
+func TestOAuthClientCredentials(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	admin := actorServer(actor{Type: actorUser, Role: roleAdmin, OrganizationID: defaultOrganization.ID})
+	defer admin.Close()
+
+	status, r := doOrganizationRequest(t, "POST", admin.URL+"/api/oauth/clients", `{"oauth_client":{"name":"Worker","grant_types":["client_credentials"]}}`)
+	if status != 422 || len(r.Errors["grant_types"]) == 0 {
+		t.Errorf("expected public clients to be refused, but got %d %v", status, r.Errors)
+	}
+	c := registerOAuthClient(t, admin.URL, `{"oauth_client":{"name":"Worker","grant_types":["client_credentials"],"confidential":true,"scopes":["users:read"]}}`)
+	if c.Secret == "" {
+		t.Fatalf("expected the secret of the client")
+	}
+	status, r = doOrganizationRequest(t, "GET", admin.URL+"/api/oauth/clients/"+c.ID.Hex(), "")
+	if status != http.StatusOK || r.oauthClient == nil || r.oauthClient.Secret != "" {
+		t.Errorf("expected the client without its secret, but got %d %+v", status, r.oauthClient)
+	}
+
+	credentials := url.Values{"grant_type": {grantClientCredentials}}
+	if status, res := postOAuthForm(t, ts.URL+"/oauth/token", credentials, c.ID.Hex(), "wrong"); status != http.StatusUnauthorized || res.Error != "invalid_client" {
+		t.Errorf("expected the secret to be refused, but got %d %+v", status, res.oauthError)
+	}
+	status, res := postOAuthForm(t, ts.URL+"/oauth/token", credentials, c.ID.Hex(), c.Secret)
+	if status != http.StatusOK || res.AccessToken == "" || res.RefreshToken != "" || res.IDToken != "" {
+		t.Fatalf("expected an access token only, but got %d %+v", status, res)
+	}
+	token := res.AccessToken
+
+	introspect := func() (int, oauthResult) {
+		return postOAuthForm(t, ts.URL+"/oauth/introspect", url.Values{"token": {token}}, c.ID.Hex(), c.Secret)
+	}
+	status, res = introspect()
+	if status != http.StatusOK || !res.Active || res.ClientID != c.ID.Hex() || res.Subject != "" {
+		t.Errorf("expected an active token of the client, but got %d %+v", status, res)
+	}
+	if status, _ := bearerRequest(t, "GET", ts.URL+"/api/users", token); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	// clients aren't users
+	if status, _ := bearerRequest(t, "GET", ts.URL+"/oauth/userinfo", token); status != http.StatusUnauthorized {
+		t.Errorf("expected %d, but got %d", http.StatusUnauthorized, status)
+	}
+
+	if status, _ = postOAuthForm(t, ts.URL+"/oauth/revoke", url.Values{"token": {token}}, c.ID.Hex(), c.Secret); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	if status, res = introspect(); status != http.StatusOK || res.Active {
+		t.Errorf("expected the token to be revoked, but got %d %+v", status, res)
+	}
+
+	// deleting the client revokes its tokens
+	_, res = postOAuthForm(t, ts.URL+"/oauth/token", credentials, c.ID.Hex(), c.Secret)
+	if status, _ = doOrganizationRequest(t, "DELETE", admin.URL+"/api/oauth/clients/"+c.ID.Hex(), ""); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	if status, _ := bearerRequest(t, "GET", ts.URL+"/api/users", res.AccessToken); status != http.StatusUnauthorized {
+		t.Errorf("expected %d, but got %d", http.StatusUnauthorized, status)
+	}
+
+	dropAllCollections(t)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// idTokenTTL is how long the ID tokens are valid.
+const idTokenTTL = time.Hour
+
+// Scopes of OpenID Connect, which select the claims of the users.
+const (
+	scopeOpenID  = "openid"
+	scopeProfile = "profile"
+	scopeEmail   = "email"
+)
+
+// userInfo are the claims about a user, as returned by userInfoHandler
+// and in the ID tokens.
+type userInfo struct {
+	Subject           string `json:"sub"`
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
+	UpdatedAt         int64  `json:"updated_at,omitempty"`
+}
+
+// idTokenClaims are the claims of an ID token.
+type idTokenClaims struct {
+	Issuer   string `json:"iss"`
+	Audience string `json:"aud"`
+	Expiry   int64  `json:"exp"`
+	IssuedAt int64  `json:"iat"`
+	AuthTime int64  `json:"auth_time,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	userInfo
+}
+
+// jsonWebKey is the public part of the signing key, as published in the
+// JWKS.
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// openIDConfiguration is the discovery document of the provider.
+type openIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// signingKeyID is the id of the signing key in the database.
+const signingKeyID = "oidc"
+
+var (
+	oidcKey     *rsa.PrivateKey
+	oidcKeyErr  error
+	oidcKeyOnce sync.Once
+)
+
+func init() {
+	router.Path("/.well-known/openid-configuration").
+		Methods("GET").
+		HandlerFunc(openIDConfigurationHandler)
+	router.Path("/oauth/jwks").
+		Methods("GET").
+		HandlerFunc(jwksHandler)
+	router.Path("/oauth/userinfo").
+		Methods("GET", "POST").
+		Handler(checksScopes(userInfoHandler))
+
+	userInfoResponses := map[string]*openAPIResponse{
+		"200": {
+			Description: "The claims of the user allowed by the scopes of the token.",
+			Content:     map[string]*openAPIMediaType{"application/json": {Schema: schemaFor(userInfo{})}},
+		},
+		"401": {
+			Description: "The access token is missing, invalid or expired.",
+			Content:     map[string]*openAPIMediaType{"application/json": {Schema: schemaFor(oauthError{})}},
+		},
+		"403": {
+			Description: "The access token wasn't given the openid scope.",
+			Content:     map[string]*openAPIMediaType{"application/json": {Schema: schemaFor(oauthError{})}},
+		},
+	}
+	documentOperations(
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/.well-known/openid-configuration",
+			OperationID: "openIDConfiguration",
+			Summary:     "Returns the OpenID Connect discovery document.",
+			Tags:        []string{"oauth"},
+			Responses: map[string]*openAPIResponse{
+				"200": {
+					Description: "The endpoints and features of the provider.",
+					Content:     map[string]*openAPIMediaType{"application/json": {Schema: schemaFor(openIDConfiguration{})}},
+				},
+			},
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/oauth/jwks",
+			OperationID: "jwks",
+			Summary:     "Returns the public keys the ID tokens are signed with.",
+			Tags:        []string{"oauth"},
+			Responses: map[string]*openAPIResponse{
+				"200": {
+					Description: "The JSON Web Key Set.",
+					Content:     map[string]*openAPIMediaType{"application/json": {Schema: schemaFor(jsonWebKeySet{})}},
+				},
+			},
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/oauth/userinfo",
+			OperationID: "userInfo",
+			Summary:     "Returns the claims about the user of an access token with the openid scope.",
+			Tags:        []string{"oauth"},
+			Responses:   userInfoResponses,
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/oauth/userinfo",
+			OperationID: "postUserInfo",
+			Summary:     "Same as userInfo.",
+			Tags:        []string{"oauth"},
+			Responses:   userInfoResponses,
+		},
+	)
+}
+
+// signingKey returns the RSA key the ID tokens are signed with, read from
+// the PEM in OIDC_SIGNING_KEY. When none is set the key is the one stored
+// in the database, so that every instance of the API signs with it.
+func signingKey() (*rsa.PrivateKey, error) {
+	oidcKeyOnce.Do(func() {
+		s := os.Getenv("OIDC_SIGNING_KEY")
+		if s == "" {
+			s, oidcKeyErr = storedSigningKey()
+			if oidcKeyErr != nil {
+				return
+			}
+		}
+		oidcKey, oidcKeyErr = loadSigningKey(s)
+	})
+	return oidcKey, oidcKeyErr
+}
+
+// storedSigningKey returns the PEM of the signing key stored in the
+// database, generating it on the first start. The key is encrypted like the
+// TOTP secrets, and when instances start together the first to store its
+// key wins.
+func storedSigningKey() (string, error) {
+	var stored struct {
+		Key string `bson:"key"`
+	}
+	err := config.signingKeysCollection.FindId(signingKeyID).One(&stored)
+	if err == mgo.ErrNotFound {
+		var key *rsa.PrivateKey
+		if key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			return "", err
+		}
+		pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		var encrypted string
+		if encrypted, err = encryptSecret(pemKey); err != nil {
+			return "", err
+		}
+		err = config.signingKeysCollection.Insert(bson.M{"_id": signingKeyID, "key": encrypted, "created_at": bson.Now()})
+		if err != nil && !mgo.IsDup(err) {
+			return "", err
+		}
+		err = config.signingKeysCollection.FindId(signingKeyID).One(&stored)
+	}
+	if err != nil {
+		return "", err
+	}
+	pemKey, err := decryptSecret(stored.Key)
+	if err != nil {
+		return "", err
+	}
+	return string(pemKey), nil
+}
+
+func loadSigningKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("OIDC_SIGNING_KEY must be a PEM encoded RSA key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("OIDC_SIGNING_KEY must be a PEM encoded RSA key")
+	}
+	return rsaKey, nil
+}
+
+// publicJWK returns the public part of key, its id being a hash of it.
+func publicJWK(key *rsa.PublicKey) jsonWebKey {
+	n := key.N.Bytes()
+	e := big.NewInt(int64(key.E)).Bytes()
+	sum := sha256.Sum256(append(append([]byte{}, n...), e...))
+	return jsonWebKey{
+		KeyType:   "RSA",
+		Use:       "sig",
+		Algorithm: "RS256",
+		KeyID:     base64.RawURLEncoding.EncodeToString(sum[:8]),
+		Modulus:   base64.RawURLEncoding.EncodeToString(n),
+		Exponent:  base64.RawURLEncoding.EncodeToString(e),
+	}
+}
+
+// signJWT returns claims as a JWT signed with RS256.
+func signJWT(key *rsa.PrivateKey, claims interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": publicJWK(&key.PublicKey).KeyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// verifyJWT checks the RS256 signature of token and decodes its claims.
+func verifyJWT(key *rsa.PublicKey, token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(b, &header) != nil || header.Algorithm != "RS256" {
+		return errors.New("unsupported token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return err
+	}
+	if b, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, claims)
+}
+
+// oauthIssuer returns the issuer of the tokens, OAUTH_ISSUER or the
+// origin the request was made to.
+func oauthIssuer(req *http.Request) string {
+	if iss := os.Getenv("OAUTH_ISSUER"); iss != "" {
+		return strings.TrimSuffix(iss, "/")
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host
+}
+
+// userInfoFor returns the claims about u allowed by the scopes.
+func userInfoFor(u *user, scopes []string) userInfo {
+	info := userInfo{Subject: u.ID.Hex()}
+	if containsString(scopes, scopeProfile) {
+		info.Name = u.Name
+		info.PreferredUsername = u.Username
+		if !u.UpdatedAt.IsZero() {
+			info.UpdatedAt = u.UpdatedAt.Unix()
+		}
+	}
+	if containsString(scopes, scopeEmail) {
+		info.Email = u.Email
+	}
+	return info
+}
+
+// newIDToken returns the signed ID token of u for the client.
+func newIDToken(req *http.Request, u *user, clientID string, scopes []string, nonce string, authTime time.Time) (string, error) {
+	key, err := signingKey()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := idTokenClaims{
+		Issuer:   oauthIssuer(req),
+		Audience: clientID,
+		Expiry:   now.Add(idTokenTTL).Unix(),
+		IssuedAt: now.Unix(),
+		Nonce:    nonce,
+		userInfo: userInfoFor(u, scopes),
+	}
+	if !authTime.IsZero() {
+		claims.AuthTime = authTime.Unix()
+	}
+	return signJWT(key, claims)
+}
+
+// openIDConfigurationHandler returns the OpenID Connect discovery
+// document, with the endpoints under the issuer.
+// URL: GET /.well-known/openid-configuration
+func openIDConfigurationHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	iss := oauthIssuer(req)
+	doc := openIDConfiguration{
+		Issuer:                            iss,
+		AuthorizationEndpoint:             iss + "/oauth/authorize",
+		TokenEndpoint:                     iss + "/oauth/token",
+		UserInfoEndpoint:                  iss + "/oauth/userinfo",
+		JWKSURI:                           iss + "/oauth/jwks",
+		RevocationEndpoint:                iss + "/oauth/revoke",
+		IntrospectionEndpoint:             iss + "/oauth/introspect",
+		ScopesSupported:                   oauthScopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               oauthGrantTypes,
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "name", "preferred_username", "email", "updated_at"},
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(doc); err != nil {
+		log.Println(err)
+	}
+}
+
+// jwksHandler returns the public keys the ID tokens are signed with.
+// URL: GET /oauth/jwks
+func jwksHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	key, err := signingKey()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(jsonWebKeySet{Keys: []jsonWebKey{publicJWK(&key.PublicKey)}}); err != nil {
+		log.Println(err)
+	}
+}
+
+// userInfoHandler returns the claims about the user of the access token,
+// which must have the openid scope. The profile and email scopes add the
+// claims of the name and of the email.
+// URL: GET|POST /oauth/userinfo
+// HEADERS:
+//	"Authorization": "Bearer <access token>"
+func userInfoHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	a := requestActor(req)
+	if a.Type != actorUser {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		encoder.Encode(oauthError{Error: "invalid_token", ErrorDescription: "A user access token is required."})
+		return
+	}
+	if !containsString(a.Scopes, scopeOpenID) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		w.WriteHeader(http.StatusForbidden)
+		encoder.Encode(oauthError{Error: "insufficient_scope", ErrorDescription: "The openid scope is required."})
+		return
+	}
+	u, err := loadUser(a.OrganizationID, a.ID)
+	if err != nil {
+		log.Println(err)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		encoder.Encode(oauthError{Error: "invalid_token"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err = encoder.Encode(userInfoFor(u, a.Scopes)); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSignJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := signJWT(key, idTokenClaims{Issuer: "https://id.example.com", Nonce: "abc", userInfo: userInfo{Subject: "42"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var claims idTokenClaims
+	if err = verifyJWT(&key.PublicKey, token, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != "https://id.example.com" || claims.Nonce != "abc" || claims.Subject != "42" {
+		t.Errorf("expected the claims signed, but got %+v", claims)
+	}
+
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"https://evil.example.com"}`)) + "." + parts[2]
+	if err = verifyJWT(&key.PublicKey, tampered, &claims); err == nil {
+		t.Errorf("expected changed claims to be refused")
+	}
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if err = verifyJWT(&other.PublicKey, token, &claims); err == nil {
+		t.Errorf("expected the signature of another key to be refused")
+	}
+}
+
+func TestPublicJWK(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwk := publicJWK(&key.PublicKey)
+	if jwk.KeyType != "RSA" || jwk.Algorithm != "RS256" || jwk.Exponent != "AQAB" || jwk.KeyID == "" {
+		t.Errorf("expected the public key, but got %+v", jwk)
+	}
+	if again := publicJWK(&key.PublicKey); again.KeyID != jwk.KeyID {
+		t.Errorf("expected the id of the key to be stable")
+	}
+}
+
+func TestUserInfoFor(t *testing.T) {
+	u := &user{Name: "Test User", Username: "test_user", Email: "test@sample.com"}
+	if info := userInfoFor(u, []string{scopeOpenID}); info.Name != "" || info.Email != "" {
+		t.Errorf("expected the subject only, but got %+v", info)
+	}
+	info := userInfoFor(u, []string{scopeOpenID, scopeProfile, scopeEmail})
+	if info.Name != u.Name || info.PreferredUsername != u.Username || info.Email != u.Email {
+		t.Errorf("expected the claims of the scopes, but got %+v", info)
+	}
+}
+
+func TestStoredSigningKey(t *testing.T) {
+	first, err := storedSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := storedSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Errorf("expected every instance to share the stored key")
+	}
+	if _, err = loadSigningKey(first); err != nil {
+		t.Errorf("expected a PEM encoded RSA key, but got %v", err)
+	}
+
+	var stored bson.M
+	if err = config.signingKeysCollection.FindId(signingKeyID).One(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored["key"].(string), "PRIVATE KEY") {
+		t.Errorf("expected the stored key to be encrypted")
+	}
+
+	dropAllCollections(t)
+}
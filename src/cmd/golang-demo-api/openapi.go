@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// apiContentType is the media type clients must accept to get the
+// response envelope. The body itself is sent as "application/json".
+const apiContentType = "application/vnd.demo_app.v1+json"
+
+// openAPIDocument is an OpenAPI 3 document describing the API.
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]*openAPISchema `json:"schemas"`
+}
+
+// openAPIOperation documents a method of a route. Method and Path are
+// where it is registered in the router, Path being the route template.
+type openAPIOperation struct {
+	Method      string                      `json:"-"`
+	Path        string                      `json:"-"`
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary"`
+	Description string                      `json:"description,omitempty"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Parameters  []*openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Description string                       `json:"description,omitempty"`
+	Required    bool                         `json:"required,omitempty"`
+	Content     map[string]*openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                       `json:"description"`
+	Content     map[string]*openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+// openAPISchema is the subset of JSON schema used by the document.
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	AllOf                []*openAPISchema          `json:"allOf,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Pattern              string                    `json:"pattern,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty"`
+	Minimum              *float64                  `json:"minimum,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+	Description          string                    `json:"description,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+
+	// pattern is Pattern compiled, set when the document is built.
+	pattern *regexp.Regexp
+}
+
+var (
+	// apiOperations are the documented operations, in registration order.
+	apiOperations []*openAPIOperation
+	// apiSchemas are the components of the document, by Go type name.
+	apiSchemas = make(map[string]*openAPISchema)
+
+	apiDocument     *openAPIDocument
+	apiDocumentOnce sync.Once
+)
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	objectIDType = reflect.TypeOf(bson.ObjectId(""))
+)
+
+// Parameters and schemas shared by several operations.
+var (
+	objectIDSchema = &openAPISchema{Type: "string", Pattern: "^[0-9a-f]{24}$"}
+	dateTimeSchema = &openAPISchema{Type: "string", Format: "date-time"}
+
+	pageParam = queryParam("page", "Current page number(per page 20 records)", &openAPISchema{Type: "integer"})
+)
+
+func init() {
+	router.Path("/api/openapi.json").
+		Methods("GET").
+		HandlerFunc(openAPIHandler)
+
+	documentOperations(&openAPIOperation{
+		Method:      "GET",
+		Path:        "/api/openapi.json",
+		OperationID: "getOpenAPI",
+		Summary:     "Returns this document.",
+		Tags:        []string{"meta"},
+		Responses: map[string]*openAPIResponse{
+			"200": {
+				Description: "The OpenAPI document.",
+				Content:     map[string]*openAPIMediaType{"application/json": {Schema: &openAPISchema{Type: "object"}}},
+			},
+		},
+	})
+}
+
+// openAPIHandler returns the OpenAPI 3 document of the API.
+// URL: GET /api/openapi.json
+func openAPIHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(openAPISpec()); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// documentOperations adds operations to the OpenAPI document. Every route
+// registered in the router must be documented, which is checked by the
+// tests.
+func documentOperations(ops ...*openAPIOperation) {
+	apiOperations = append(apiOperations, ops...)
+}
+
+// openAPISpec returns the document of the operations.
+func openAPISpec() *openAPIDocument {
+	apiDocumentOnce.Do(func() {
+		doc := &openAPIDocument{
+			OpenAPI: "3.0.3",
+			Info: openAPIInfo{
+				Title: "golang-demo-api",
+				Description: "JSON API of users. Requests must accept \"" + apiContentType +
+					"\", the responses are sent as \"application/json\". Requests are made for the organization " +
+					"of the credentials, else the one whose slug is in the \"X-Organization\" header or the subdomain.",
+				Version: "1",
+			},
+			Paths:      make(map[string]map[string]*openAPIOperation),
+			Components: openAPIComponents{Schemas: apiSchemas},
+		}
+		for _, op := range apiOperations {
+			if doc.Paths[op.Path] == nil {
+				doc.Paths[op.Path] = make(map[string]*openAPIOperation)
+			}
+			doc.Paths[op.Path][strings.ToLower(op.Method)] = op
+			for _, p := range op.Parameters {
+				p.Schema.compilePatterns()
+			}
+			if op.RequestBody != nil {
+				for _, mt := range op.RequestBody.Content {
+					mt.Schema.compilePatterns()
+				}
+			}
+			for _, r := range op.Responses {
+				for _, mt := range r.Content {
+					mt.Schema.compilePatterns()
+				}
+			}
+		}
+		for _, schema := range apiSchemas {
+			schema.compilePatterns()
+		}
+		apiDocument = doc
+	})
+	return apiDocument
+}
+
+// compilePatterns compiles the patterns of the schema and of the schemas
+// it is made of, so that the validation doesn't compile them for each
+// value.
+func (s *openAPISchema) compilePatterns() {
+	if s == nil {
+		return
+	}
+	if s.Pattern != "" && s.pattern == nil {
+		s.pattern = regexp.MustCompile(s.Pattern)
+	}
+	for _, sub := range s.AllOf {
+		sub.compilePatterns()
+	}
+	for _, prop := range s.Properties {
+		prop.compilePatterns()
+	}
+	s.Items.compilePatterns()
+	s.AdditionalProperties.compilePatterns()
+}
+
+// pathParam documents a variable of the route template.
+func pathParam(name, description string) *openAPIParameter {
+	return &openAPIParameter{Name: name, In: "path", Description: description, Required: true, Schema: objectIDSchema}
+}
+
+func queryParam(name, description string, schema *openAPISchema) *openAPIParameter {
+	return &openAPIParameter{Name: name, In: "query", Description: description, Schema: schema}
+}
+
+// jsonBody documents a request body of the given media types with the
+// schema of v.
+func jsonBody(v interface{}, mediaTypes ...string) *openAPIRequestBody {
+	if len(mediaTypes) == 0 {
+		mediaTypes = []string{"application/json"}
+	}
+	body := &openAPIRequestBody{Required: true, Content: make(map[string]*openAPIMediaType)}
+	for _, mt := range mediaTypes {
+		body.Content[mt] = &openAPIMediaType{Schema: schemaFor(v)}
+	}
+	return body
+}
+
+// formBody documents a request body of a form with the fields given,
+// which are all strings.
+func formBody(fields ...string) *openAPIRequestBody {
+	s := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+	for _, f := range fields {
+		s.Properties[f] = &openAPISchema{Type: "string"}
+	}
+	return &openAPIRequestBody{
+		Required: true,
+		Content:  map[string]*openAPIMediaType{"application/x-www-form-urlencoded": {Schema: s}},
+	}
+}
+
+// envelopeResponses documents responses with the envelope of the API,
+// which is sent with all the statuses given.
+func envelopeResponses(statuses ...int) map[string]*openAPIResponse {
+	responses := make(map[string]*openAPIResponse)
+	for _, status := range statuses {
+		description := http.StatusText(status)
+		if status == 422 {
+			description = "Not found or invalid, the errors are in data.errors."
+		}
+		responses[strconv.Itoa(status)] = &openAPIResponse{
+			Description: description,
+			Content:     map[string]*openAPIMediaType{apiContentType: {Schema: schemaFor(response{})}},
+		}
+	}
+	return responses
+}
+
+// adminOnly adds the responses of requireAdmin to responses.
+func adminOnly(responses map[string]*openAPIResponse) map[string]*openAPIResponse {
+	for status, r := range envelopeResponses(http.StatusUnauthorized, http.StatusForbidden) {
+		responses[status] = r
+	}
+	return responses
+}
+
+// scoped adds the response of the credentials missing the scope of the
+// operation to responses.
+func scoped(responses map[string]*openAPIResponse) map[string]*openAPIResponse {
+	for status, r := range envelopeResponses(http.StatusForbidden) {
+		responses[status] = r
+	}
+	return responses
+}
+
+// schemaFor returns the schema of the JSON encoding of v. Named types
+// other than the basic ones are added to the components and referenced.
+func schemaFor(v interface{}) *openAPISchema {
+	return typeSchema(reflect.TypeOf(v))
+}
+
+func typeSchema(t reflect.Type) *openAPISchema {
+	switch t {
+	case timeType:
+		return dateTimeSchema
+	case objectIDType:
+		return objectIDSchema
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Struct, reflect.Slice, reflect.Map:
+		if t.Name() == "" {
+			return kindSchema(t)
+		}
+		if _, ok := apiSchemas[t.Name()]; !ok {
+			// registered first, so recursive types end
+			apiSchemas[t.Name()] = &openAPISchema{}
+			*apiSchemas[t.Name()] = *kindSchema(t)
+		}
+		return &openAPISchema{Ref: "#/components/schemas/" + t.Name()}
+	}
+	return kindSchema(t)
+}
+
+// kindSchema returns the schema of t, without referencing it.
+func kindSchema(t reflect.Type) *openAPISchema {
+	switch t.Kind() {
+	case reflect.Struct:
+		return structSchema(t)
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &openAPISchema{Type: "string", Format: "byte"}
+		}
+		// nil slices are encoded as null
+		return &openAPISchema{Type: "array", Items: typeSchema(t.Elem()), Nullable: t.Kind() == reflect.Slice}
+	case reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: typeSchema(t.Elem()), Nullable: true}
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &openAPISchema{Type: "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		min := 0.0
+		return &openAPISchema{Type: "integer", Minimum: &min}
+	case reflect.Float32, reflect.Float64:
+		return &openAPISchema{Type: "number"}
+	}
+	// interfaces can be anything
+	return &openAPISchema{}
+}
+
+// structSchema follows the rules of encoding/json: embedded structs
+// without a name have their fields promoted and fields without omitempty
+// are always present.
+func structSchema(t reflect.Type) *openAPISchema {
+	s := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.Index(tag, ","); i != -1 {
+			name, opts = tag[:i], tag[i:]
+		}
+
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			embedded := structSchema(ft)
+			for field, fs := range embedded.Properties {
+				s.Properties[field] = fs
+			}
+			s.Required = append(s.Required, embedded.Required...)
+			continue
+		}
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		fs := typeSchema(f.Type)
+		omitempty := strings.Contains(opts, ",omitempty")
+		if !omitempty {
+			s.Required = append(s.Required, name)
+			if f.Type.Kind() == reflect.Ptr {
+				fs = &openAPISchema{AllOf: []*openAPISchema{fs}, Nullable: true}
+			}
+		}
+		s.Properties[name] = fs
+	}
+	return s
+}
+
+// formSchema returns the schema of a form sending the fields of v, a
+// struct, as "prefix[field]" like decodeForm reads them.
+func formSchema(prefix string, v interface{}) *openAPISchema {
+	t := reflect.TypeOf(v)
+	s := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		s.Properties[prefix+"["+name+"]"] = typeSchema(t.Field(i).Type)
+	}
+	return s
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var routeMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+// documentedRequests returns the media types accepted by and sent to the
+// documented operations, which are all the header combinations the routes
+// can require.
+func documentedRequests() (accepts, contentTypes []string) {
+	seen := make(map[string]bool)
+	for _, op := range apiOperations {
+		for _, r := range op.Responses {
+			for mt := range r.Content {
+				if !seen["accept "+mt] {
+					seen["accept "+mt] = true
+					accepts = append(accepts, mt)
+				}
+			}
+		}
+		if op.RequestBody != nil {
+			for mt := range op.RequestBody.Content {
+				if !seen["content "+mt] {
+					seen["content "+mt] = true
+					contentTypes = append(contentTypes, mt)
+				}
+			}
+		}
+	}
+	return
+}
+
+// concretePath replaces the variables of a route template by an id.
+func concretePath(template string) string {
+	parts := strings.Split(template, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, "{") {
+			parts[i] = bson.NewObjectId().Hex()
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func TestRoutesAreDocumented(t *testing.T) {
+	documented := make(map[string]bool)
+	// the variables of the templates are replaced by their own name, so
+	// the built path is the template
+	var vars []string
+	for _, op := range apiOperations {
+		documented[op.Method+" "+op.Path] = true
+		for _, p := range op.Parameters {
+			if p.In == "path" {
+				vars = append(vars, p.Name, "{"+p.Name+"}")
+			}
+		}
+	}
+	accepts, contentTypes := documentedRequests()
+
+	matched := make(map[string]bool)
+	router.Walk(func(route *mux.Route, r *mux.Router, ancestors []*mux.Route) error {
+		u, err := route.URLPath(vars...)
+		if err != nil {
+			t.Errorf("a route has undocumented variables: %s", err)
+			return nil
+		}
+		for _, method := range routeMethods {
+			for _, accept := range accepts {
+				for _, contentType := range contentTypes {
+					req, _ := http.NewRequest(method, concretePath(u.Path), nil)
+					req.Header.Set("Accept", accept)
+					req.Header.Set("Content-Type", contentType)
+					if route.Match(req, &mux.RouteMatch{}) {
+						matched[method+" "+u.Path] = true
+					}
+				}
+			}
+		}
+		return nil
+	})
+
+	for op := range matched {
+		if !documented[op] {
+			t.Errorf("%s is registered but not documented", op)
+		}
+	}
+	for op := range documented {
+		if !matched[op] {
+			t.Errorf("%s is documented but not registered", op)
+		}
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var doc struct {
+		OpenAPI    string
+		Paths      map[string]map[string]json.RawMessage
+		Components struct {
+			Schemas map[string]json.RawMessage
+		}
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != "3.0.3" {
+		t.Errorf("expected OpenAPI %s, but got %s", "3.0.3", doc.OpenAPI)
+	}
+	if _, ok := doc.Paths["/api/users/{id}"]["patch"]; !ok {
+		t.Errorf("expected PATCH /api/users/{id} to be documented")
+	}
+	for _, name := range []string{"user", "newUser", "response", "data", "ModelErrors"} {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("expected the schema of %s", name)
+		}
+	}
+}
+
+func TestSchemaFor(t *testing.T) {
+	s := structSchema(reflect.TypeOf(response{}))
+	if s.Properties["message"] == nil || s.Properties["data"] == nil {
+		t.Fatalf("expected message and data, but got %v", s.Properties)
+	}
+	if len(s.Required) != 0 {
+		t.Errorf("expected no required fields, but got %v", s.Required)
+	}
+
+	u := apiSchemas["user"]
+	if u.Properties["password_digest"] != nil || u.Properties["errors"] == nil {
+		t.Errorf("expected the JSON fields of user, but got %v", u.Properties)
+	}
+	if u.Properties["id"] != objectIDSchema || u.Properties["created_at"] != dateTimeSchema {
+		t.Errorf("expected id and created_at to be typed")
+	}
+}
+
+// TestJSONRoutesRefuseForms checks that the operations documenting a JSON
+// body only don't match forms, which their handlers can't decode.
+func TestJSONRoutesRefuseForms(t *testing.T) {
+	for _, op := range apiOperations {
+		if op.RequestBody == nil || len(op.RequestBody.Content) != 1 || op.RequestBody.Content["application/json"] == nil {
+			continue
+		}
+		for _, contentType := range []string{"application/x-www-form-urlencoded", "multipart/form-data; boundary=x"} {
+			req, _ := http.NewRequest(op.Method, concretePath(op.Path), nil)
+			req.Header.Set("Accept", "application/vnd.demo_app.v1+json")
+			req.Header.Set("Content-Type", contentType)
+			if router.Match(req, &mux.RouteMatch{}) {
+				t.Errorf("%s %s accepts %s, but only decodes JSON", op.Method, op.Path, contentType)
+			}
+		}
+	}
+}
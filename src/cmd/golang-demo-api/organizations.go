@@ -0,0 +1,639 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// defaultOrganizationSlug is the slug of the organization of the requests
+// which don't name one, and of the users created before organizations.
+const defaultOrganizationSlug = "default"
+
+// validSlug is the format of the organization slugs, which are used as
+// subdomains.
+var validSlug = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// tenantLoginPath matches the routes anonymous requests can make for
+// another organization than the default one, to authenticate in it.
+var tenantLoginPath = regexp.MustCompile(`^/(api/login(/totp)?|api/sessions/refresh|oauth/[a-z]+)$`)
+
+// organization is a tenant of the API. Users, imports, webhooks and audit
+// events belong to exactly one organization and are never visible to the
+// others.
+type organization struct {
+	ID   bson.ObjectId `bson:"_id" json:"id"`
+	Name string        `bson:"name" json:"name"`
+	Slug string        `bson:"slug" json:"slug"`
+	// UserQuota is the largest number of users, 0 for no limit.
+	UserQuota int `bson:"user_quota" json:"user_quota"`
+	// MFARoles are the roles of the users who must use two-factor
+	// authentication to log in.
+	MFARoles  []string    `bson:"mfa_roles" json:"mfa_roles,omitempty"`
+	CreatedAt time.Time   `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time   `bson:"updated_at" json:"updated_at"`
+	Errors    ModelErrors `bson:"-" json:"errors,omitempty"`
+}
+
+type newOrganization struct {
+	Name      *string   `json:"name,omitempty"`
+	Slug      *string   `json:"slug,omitempty"`
+	UserQuota *int      `json:"user_quota,omitempty"`
+	MFARoles  *[]string `json:"mfa_roles,omitempty"`
+}
+
+// defaultMFARoles are the MFA roles of new organizations.
+var defaultMFARoles = []string{roleAdmin}
+
+// Organizations represents a collection of organization objects
+type Organizations []organization
+
+// defaultOrganization is loaded by ensureOrganizations.
+var defaultOrganization organization
+
+func init() {
+	organizationsRouter := router.Path("/api/organizations").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Subrouter()
+
+	organizationsRouter.Methods("GET").HandlerFunc(requireOperator(organizationsHandler))
+	organizationsRouter.Methods("POST").HandlerFunc(requireOperator(createOrganizationHandler))
+
+	organizationRouter := router.Path("/api/organizations/{id}").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Subrouter()
+
+	organizationRouter.Methods("GET").HandlerFunc(requireOperator(showOrganizationHandler))
+	organizationRouter.Methods("PUT", "PATCH").HandlerFunc(requireOperator(updateOrganizationHandler))
+	organizationRouter.Methods("DELETE").HandlerFunc(requireOperator(deleteOrganizationHandler))
+
+	organizationBody := jsonBody(struct {
+		Organization newOrganization `json:"organization"`
+	}{})
+	organizationID := pathParam("id", "ID of the organization")
+	documentOperations(
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/organizations",
+			OperationID: "listOrganizations",
+			Summary:     "Returns paginated organizations, oldest first.",
+			Tags:        []string{"organizations"},
+			Parameters:  []*openAPIParameter{pageParam},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK)),
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/organizations",
+			OperationID: "createOrganization",
+			Summary:     "Creates an organization.",
+			Tags:        []string{"organizations"},
+			RequestBody: organizationBody,
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422)),
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/organizations/{id}",
+			OperationID: "showOrganization",
+			Summary:     "Returns an organization.",
+			Tags:        []string{"organizations"},
+			Parameters:  []*openAPIParameter{organizationID},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+		&openAPIOperation{
+			Method:      "PUT",
+			Path:        "/api/organizations/{id}",
+			OperationID: "updateOrganization",
+			Summary:     "Updates an organization, fields left out are unchanged.",
+			Tags:        []string{"organizations"},
+			Parameters:  []*openAPIParameter{organizationID},
+			RequestBody: organizationBody,
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422)),
+		},
+		&openAPIOperation{
+			Method:      "PATCH",
+			Path:        "/api/organizations/{id}",
+			OperationID: "patchOrganization",
+			Summary:     "Same as updateOrganization.",
+			Tags:        []string{"organizations"},
+			Parameters:  []*openAPIParameter{organizationID},
+			RequestBody: organizationBody,
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422)),
+		},
+		&openAPIOperation{
+			Method:      "DELETE",
+			Path:        "/api/organizations/{id}",
+			OperationID: "deleteOrganization",
+			Summary:     "Deletes an organization without users, with its webhooks and imports.",
+			Tags:        []string{"organizations"},
+			Parameters:  []*openAPIParameter{organizationID},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+	)
+}
+
+// ensureOrganizations creates the indexes of the organizations, the
+// default organization, and moves the documents saved before
+// organizations to it.
+func ensureOrganizations() error {
+	err := config.organizationsCollection.EnsureIndex(mgo.Index{Key: []string{"slug"}, Unique: true})
+	if err != nil {
+		return err
+	}
+	if err = config.usersCollection.EnsureIndexKey("organization_id", "-created_at"); err != nil {
+		return err
+	}
+
+	// the id is kept when the collection is dropped, as in the tests
+	id := defaultOrganization.ID
+	if id == "" {
+		id = bson.NewObjectId()
+	}
+	now := bson.Now()
+	_, err = config.organizationsCollection.Upsert(bson.M{"slug": defaultOrganizationSlug}, bson.M{
+		"$setOnInsert": bson.M{"_id": id, "name": "Default", "user_quota": 0, "mfa_roles": defaultMFARoles, "created_at": now, "updated_at": now},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = config.organizationsCollection.UpdateAll(
+		bson.M{"mfa_roles": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"mfa_roles": defaultMFARoles}},
+	)
+	if err != nil {
+		return err
+	}
+	if err = config.organizationsCollection.Find(bson.M{"slug": defaultOrganizationSlug}).One(&defaultOrganization); err != nil {
+		return err
+	}
+
+	orphans := bson.M{"organization_id": bson.M{"$exists": false}}
+	move := bson.M{"$set": bson.M{"organization_id": defaultOrganization.ID}}
+	for _, c := range []*mgo.Collection{config.usersCollection, config.importsCollection, config.webhooksCollection, config.auditCollection} {
+		if _, err = c.UpdateAll(orphans, move); err != nil {
+			return err
+		}
+	}
+	_, err = config.avatarsFS.Files.UpdateAll(
+		bson.M{"metadata.organization_id": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"metadata.organization_id": defaultOrganization.ID}},
+	)
+	return err
+}
+
+func (o *organization) Create() error {
+	o.ID = bson.NewObjectId()
+	if o.MFARoles == nil {
+		o.MFARoles = defaultMFARoles
+	}
+	if !o.Valid() {
+		return errors.New("Organization Invalid")
+	}
+	o.CreatedAt = o.ID.Time()
+	o.UpdatedAt = o.CreatedAt
+	return config.organizationsCollection.Insert(o)
+}
+
+func (o *organization) Update(no newOrganization) error {
+	slug := o.Slug
+	o.copyFields(no)
+	if !o.Valid() {
+		return errors.New("Organization Invalid")
+	}
+	if slug == defaultOrganizationSlug && o.Slug != slug {
+		o.Errors["slug"] = append(o.Errors["slug"], "of the default organization can't be changed")
+		return errors.New("Organization Invalid")
+	}
+	o.UpdatedAt = bson.Now()
+	return config.organizationsCollection.UpdateId(o.ID, o)
+}
+
+func (o *organization) Valid() bool {
+	o.Errors = make(ModelErrors)
+	if strings.TrimSpace(o.Name) == "" {
+		o.Errors["name"] = append(o.Errors["name"], "can't be blank")
+	}
+	if o.Slug == "" {
+		o.Errors["slug"] = append(o.Errors["slug"], "can't be blank")
+	} else if !validSlug.MatchString(o.Slug) {
+		o.Errors["slug"] = append(o.Errors["slug"], "must be lowercase letters, digits and dashes")
+	} else if n, _ := config.organizationsCollection.Find(bson.M{"_id": bson.M{"$ne": o.ID}, "slug": o.Slug}).Count(); n > 0 {
+		o.Errors["slug"] = append(o.Errors["slug"], "is already taken")
+	}
+	if o.UserQuota < 0 {
+		o.Errors["user_quota"] = append(o.Errors["user_quota"], "can't be negative")
+	}
+	for _, role := range o.MFARoles {
+		if role != roleAdmin {
+			o.Errors["mfa_roles"] = append(o.Errors["mfa_roles"], "can only have the "+roleAdmin+" role")
+			break
+		}
+	}
+	return len(o.Errors) == 0
+}
+
+func (o *organization) copyFields(no newOrganization) {
+	if no.Name != nil {
+		o.Name = *no.Name
+	}
+	if no.Slug != nil {
+		o.Slug = *no.Slug
+	}
+	if no.UserQuota != nil {
+		o.UserQuota = *no.UserQuota
+	}
+	if no.MFARoles != nil {
+		o.MFARoles = *no.MFARoles
+	}
+}
+
+// errQuotaReached is the error of the users over the quota of their
+// organization.
+const errQuotaReached = "has reached its user quota"
+
+// usersLeft returns the number of users the organization can still have,
+// or -1 when it has no quota.
+func usersLeft(orgID bson.ObjectId) (int, error) {
+	var o organization
+	if err := config.organizationsCollection.FindId(orgID).One(&o); err != nil {
+		return 0, err
+	}
+	if o.UserQuota == 0 {
+		return -1, nil
+	}
+	n, err := config.usersCollection.Find(bson.M{"organization_id": orgID}).Count()
+	if err != nil || n >= o.UserQuota {
+		return 0, err
+	}
+	return o.UserQuota - n, nil
+}
+
+// withOrganization returns a shallow copy of req made for o.
+func withOrganization(req *http.Request, o *organization) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), organizationKey, o))
+}
+
+// requestOrganization returns the organization the request is made for,
+// the default one when tenantMiddleware didn't resolve one.
+func requestOrganization(req *http.Request) *organization {
+	if o, ok := req.Context().Value(organizationKey).(*organization); ok {
+		return o
+	}
+	o := defaultOrganization
+	return &o
+}
+
+// tenantDomain is the domain the organizations are subdomains of, like
+// "api.example.com" for "acme.api.example.com". Subdomains aren't used
+// when it is empty.
+func tenantDomain() string {
+	return os.Getenv("TENANT_DOMAIN")
+}
+
+// hostTenant returns the slug of the subdomain of domain in host.
+func hostTenant(host, domain string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if domain == "" || !strings.HasSuffix(host, "."+domain) {
+		return ""
+	}
+	slug := strings.TrimSuffix(host, "."+domain)
+	if strings.Contains(slug, ".") {
+		return ""
+	}
+	return slug
+}
+
+// tenantMiddleware resolves the organization of the request. It is the
+// organization of the authenticated actor, else the one named by the
+// "X-Organization" header or the subdomain, else the default one. Actors
+// can't make requests for other organizations than theirs, and anonymous
+// requests can only name another organization than the default one to
+// authenticate in it.
+func tenantMiddleware(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	slug := req.Header.Get("X-Organization")
+	if slug == "" {
+		slug = hostTenant(req.Host, tenantDomain())
+	}
+
+	var o organization
+	var err error
+	a := requestActor(req)
+	switch {
+	case a.OrganizationID != "":
+		err = config.organizationsCollection.FindId(a.OrganizationID).One(&o)
+		if err == nil && slug != "" && slug != o.Slug {
+			writeTenantError(w, http.StatusForbidden, "Access to this organization is denied.")
+			return
+		}
+	case slug != "" && slug != defaultOrganizationSlug:
+		if !tenantLoginPath.MatchString(req.URL.Path) {
+			writeTenantError(w, http.StatusUnauthorized, "Authentication required for this organization.")
+			return
+		}
+		err = config.organizationsCollection.Find(bson.M{"slug": slug}).One(&o)
+	default:
+		o = defaultOrganization
+	}
+	if err == mgo.ErrNotFound {
+		writeTenantError(w, http.StatusBadRequest, "Unknown organization.")
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	next(w, withOrganization(req, &o))
+}
+
+func writeTenantError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response{Message: message}); err != nil {
+		log.Println(err)
+	}
+}
+
+// requireOperator only lets the admins of the default organization, who
+// run the service, call the handler.
+func requireOperator(handler http.HandlerFunc) http.HandlerFunc {
+	return requireAdmin(func(w http.ResponseWriter, req *http.Request) {
+		if requestOrganization(req).ID != defaultOrganization.ID {
+			writeTenantError(w, http.StatusForbidden, "Admin access required.")
+			return
+		}
+		handler(w, req)
+	})
+}
+
+// organizationsHandler returns paginated organizations, oldest first.
+// URL: GET /api/organizations
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"page": Current page number(per page 20 records)
+func organizationsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var offset int
+	page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+	if page != 0 {
+		offset = (page - 1) * perPage
+	}
+	var organizations Organizations
+	err := config.organizationsCollection.Find(bson.M{}).Sort("_id").Limit(perPage).Skip(offset).All(&organizations)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	total, err := config.organizationsCollection.Count()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := response{data: &data{Total: total, Organizations: organizations}}
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// createOrganizationHandler can be used to add an organization.
+// URL: POST /api/organizations
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// BODY:
+//	organization[name]: Name of the organization. (required)
+//	organization[slug]: Lowercase letters, digits and dashes naming the
+//	organization in the "X-Organization" header and subdomains. (required)
+//	organization[user_quota]: Largest number of users, 0 for no limit.
+//	organization[mfa_roles]: Roles of the users who must use two-factor
+//	authentication, ["admin"] by default.
+// EXAMPLE:
+//	{
+//		"organization": {
+//			"name": "Acme",
+//			"slug": "acme",
+//			"user_quota": 100
+//		}
+//	}
+func createOrganizationHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	no, err := decodeOrganizationParams(req)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var resp *response
+	o := &organization{}
+	o.copyFields(no)
+	if err = o.Create(); err != nil {
+		log.Println(err)
+		resp = &response{
+			Message: "Unable to save organization. Please correct the errors and try again.",
+			data:    &data{Errors: o.Errors},
+		}
+		w.WriteHeader(422)
+	} else {
+		resp = &response{Message: "Organization successfully created.", data: &data{organization: o}}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// showOrganizationHandler returns an organization.
+// URL: GET /api/organizations/:id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the organization
+func showOrganizationHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var resp *response
+	if o, err := loadOrganization(mux.Vars(req)["id"]); err != nil {
+		log.Println(err)
+		resp = &response{Message: "Organization not found."}
+		w.WriteHeader(422)
+	} else {
+		resp = &response{data: &data{organization: o}}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// updateOrganizationHandler can be used to update an organization.
+// Lowering the quota under the number of users only prevents new users.
+// URL: PUT|PATCH /api/organizations/:id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// BODY:
+//	Same as createOrganizationHandler, fields left out are unchanged.
+func updateOrganizationHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	no, err := decodeOrganizationParams(req)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	o, err := loadOrganization(mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		w.Write([]byte(`{"message": "Organization not found."}`))
+		return
+	}
+
+	var resp *response
+	if err = o.Update(no); err != nil {
+		log.Println(err)
+		resp = &response{
+			Message: "Unable to update organization. Please correct the errors and try again.",
+			data:    &data{Errors: o.Errors},
+		}
+		w.WriteHeader(422)
+	} else {
+		if o.ID == defaultOrganization.ID {
+			defaultOrganization = *o
+		}
+		resp = &response{Message: "Organization updated successfully.", data: &data{organization: o}}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// deleteOrganizationHandler deletes an organization with its webhooks and
+// imports. Organizations with users and the default organization can't
+// be deleted.
+// URL: DELETE /api/organizations/:id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the organization
+func deleteOrganizationHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var resp *response
+	o, err := loadOrganization(mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		resp = &response{Message: "Organization not found."}
+		w.WriteHeader(422)
+	} else if o.ID == defaultOrganization.ID {
+		resp = &response{Message: "The default organization can't be deleted."}
+		w.WriteHeader(422)
+	} else if n, _ := config.usersCollection.Find(bson.M{"organization_id": o.ID}).Count(); n > 0 {
+		resp = &response{Message: "Unable to delete an organization with users."}
+		w.WriteHeader(422)
+	} else if err = config.organizationsCollection.RemoveId(o.ID); err != nil {
+		log.Println(err)
+		resp = &response{Message: "Unable to delete organization."}
+		w.WriteHeader(422)
+	} else {
+		removeOrganizationData(o)
+		resp = &response{Message: "Organization deleted successfully."}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// removeOrganizationData removes the webhooks, with their deliveries, the
+// groups, with their memberships, and the imports of a deleted
+// organization. The audit log is kept.
+func removeOrganizationData(o *organization) {
+	var groups Groups
+	if err := config.groupsCollection.Find(bson.M{"organization_id": o.ID}).Select(bson.M{"_id": 1}).All(&groups); err != nil {
+		log.Println(err)
+	}
+	for _, g := range groups {
+		if _, err := config.membershipsCollection.RemoveAll(bson.M{"group_id": g.ID}); err != nil {
+			log.Println(err)
+		}
+	}
+	var webhooks Webhooks
+	if err := config.webhooksCollection.Find(bson.M{"organization_id": o.ID}).Select(bson.M{"_id": 1}).All(&webhooks); err != nil {
+		log.Println(err)
+	}
+	for _, wh := range webhooks {
+		if _, err := config.webhookDeliveriesCollection.RemoveAll(bson.M{"webhook_id": wh.ID}); err != nil {
+			log.Println(err)
+		}
+	}
+	collections := []*mgo.Collection{
+		config.webhooksCollection,
+		config.groupsCollection,
+		config.importsCollection,
+		config.importErrorsCollection,
+		config.oauthClientsCollection,
+		config.oauthCodesCollection,
+		config.oauthTokensCollection,
+		config.apiKeysCollection,
+		config.sessionsCollection,
+	}
+	for _, c := range collections {
+		if _, err := c.RemoveAll(bson.M{"organization_id": o.ID}); err != nil {
+			log.Println(err)
+		}
+	}
+	if err := config.seedSequencesCollection.RemoveId(o.ID); err != nil && err != mgo.ErrNotFound {
+		log.Println(err)
+	}
+}
+
+func decodeOrganizationParams(req *http.Request) (newOrganization, error) {
+	var params struct {
+		Organization newOrganization `json:"organization"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&params)
+	return params.Organization, err
+}
+
+func loadOrganization(id string) (*organization, error) {
+	var o organization
+	if !bson.IsObjectIdHex(id) {
+		return &o, errors.New("Invalid organization id.")
+	}
+	err := config.organizationsCollection.FindId(bson.ObjectIdHex(id)).One(&o)
+	return &o, err
+}
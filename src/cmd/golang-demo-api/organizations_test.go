@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"client"
+
+	"github.com/codegangsta/negroni"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// actorServer serves the router like newTestServer with every request
+// made by a.
+func actorServer(a actor) *httptest.Server {
+	n := negroni.New()
+	n.UseFunc(func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		next(w, withActor(req, a))
+	})
+	n.UseFunc(tenantMiddleware)
+	n.UseHandler(withContract(router))
+	return httptest.NewServer(n)
+}
+
+func doOrganizationRequest(t *testing.T, method, url, body string) (int, response) {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	req.Header.Add("Content-Type", "application/json")
+	actResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer actResp.Body.Close()
+	resp := response{data: &data{}}
+	json.NewDecoder(actResp.Body).Decode(&resp)
+	return actResp.StatusCode, resp
+}
+
+// setupOrganization creates an organization with a user.
+func setupOrganization(t *testing.T, slug string, quota int) (*organization, user) {
+	o := &organization{Name: slug, Slug: slug, UserQuota: quota}
+	if err := o.Create(); err != nil {
+		t.Fatal("Unable to create organization: ", err, o.Errors)
+	}
+	u := user{
+		OrganizationID:       o.ID,
+		Name:                 "Test User",
+		Username:             "test_user",
+		Email:                "test@sample.com",
+		Password:             "test123#",
+		PasswordConfirmation: "test123#",
+	}
+	if err := u.Create(); err != nil {
+		t.Fatal("Unable to create user: ", err, u.Errors)
+	}
+	return o, u
+}
+
+func TestHostTenant(t *testing.T) {
+	cases := map[string]string{
+		"acme.api.example.com":      "acme",
+		"ACME.api.example.com:3000": "acme",
+		"api.example.com":           "",
+		"a.b.api.example.com":       "",
+		"acme.example.org":          "",
+		"localhost:3000":            "",
+	}
+	for host, expected := range cases {
+		if actual := hostTenant(host, "api.example.com"); actual != expected {
+			t.Errorf("%s: expected %q, but got %q", host, expected, actual)
+		}
+	}
+	if actual := hostTenant("acme.api.example.com", ""); actual != "" {
+		t.Errorf("expected no tenant without a domain, but got %q", actual)
+	}
+}
+
+func TestTenantLoginPath(t *testing.T) {
+	cases := map[string]bool{
+		"/api/login":            true,
+		"/api/login/totp":       true,
+		"/api/sessions/refresh": true,
+		"/oauth/token":          true,
+		"/oauth/authorize":      true,
+		"/api/users":            false,
+		"/api/login/other":      false,
+		"/oauth/token/x":        false,
+	}
+	for path, expected := range cases {
+		if actual := tenantLoginPath.MatchString(path); actual != expected {
+			t.Errorf("%s: expected %v, but got %v", path, expected, actual)
+		}
+	}
+}
+
+func TestOrganizationHandlers(t *testing.T) {
+	ts := actorServer(actor{Type: "user", ID: bson.NewObjectId().Hex(), Role: roleAdmin})
+	defer ts.Close()
+
+	status, r := doOrganizationRequest(t, "POST", ts.URL+"/api/organizations", `{"organization":{"name":"Acme","slug":"Acme Inc"}}`)
+	if status != 422 || len(r.Errors["slug"]) == 0 {
+		t.Errorf("expected the slug to be refused, but got %d %v", status, r.Errors)
+	}
+	status, r = doOrganizationRequest(t, "POST", ts.URL+"/api/organizations", `{"organization":{"name":"Acme","slug":"acme","user_quota":10}}`)
+	if status != http.StatusOK || r.organization == nil {
+		t.Fatalf("expected %d, but got %d: %s %v", http.StatusOK, status, r.Message, r.Errors)
+	}
+	acmeID := r.organization.ID
+	url := ts.URL + "/api/organizations/" + acmeID.Hex()
+
+	status, r = doOrganizationRequest(t, "GET", ts.URL+"/api/organizations", "")
+	if status != http.StatusOK || r.Total != 2 {
+		t.Errorf("expected the default organization and acme, but got %d %v", status, r.Organizations)
+	}
+	status, r = doOrganizationRequest(t, "PATCH", url, `{"organization":{"user_quota":20}}`)
+	if status != http.StatusOK || r.organization.UserQuota != 20 || r.organization.Slug != "acme" {
+		t.Errorf("expected the quota to change, but got %d %+v", status, r.organization)
+	}
+	status, r = doOrganizationRequest(t, "PATCH", ts.URL+"/api/organizations/"+defaultOrganization.ID.Hex(), `{"organization":{"slug":"other"}}`)
+	if status != 422 || len(r.Errors["slug"]) == 0 {
+		t.Errorf("expected the default slug to be kept, but got %d %v", status, r.Errors)
+	}
+
+	// organizations with users are kept
+	other := user{
+		OrganizationID:       acmeID,
+		Name:                 "Acme User",
+		Username:             "acme",
+		Email:                "acme@sample.com",
+		Password:             "test123#",
+		PasswordConfirmation: "test123#",
+	}
+	if err := other.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ = doOrganizationRequest(t, "DELETE", url, ""); status != 422 {
+		t.Errorf("expected %d, but got %d", 422, status)
+	}
+	config.usersCollection.RemoveId(other.ID)
+	if status, _ = doOrganizationRequest(t, "DELETE", url, ""); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+
+	// only the admins of the default organization manage them
+	ts.Close()
+	o, _ := setupOrganization(t, "tenant", 0)
+	ts = actorServer(actor{Type: "user", ID: bson.NewObjectId().Hex(), Role: roleAdmin, OrganizationID: o.ID})
+	if status, _ = doOrganizationRequest(t, "GET", ts.URL+"/api/organizations", ""); status != http.StatusForbidden {
+		t.Errorf("expected %d, but got %d", http.StatusForbidden, status)
+	}
+
+	dropAllCollections(t)
+}
+
+func TestNoCrossTenantAccess(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	acme, acmeUser := setupOrganization(t, "acme", 0)
+	globex, globexUser := setupOrganization(t, "globex", 0)
+	acmeAdmin := actorServer(actor{Type: actorUser, ID: acmeUser.ID.Hex(), Role: roleAdmin, OrganizationID: acme.ID})
+	defer acmeAdmin.Close()
+	globexAdmin := actorServer(actor{Type: actorUser, ID: globexUser.ID.Hex(), Role: roleAdmin, OrganizationID: globex.ID})
+	defer globexAdmin.Close()
+	ctx := context.Background()
+	c := client.New(acmeAdmin.URL)
+	c.Organization = acme.Slug
+
+	// usernames and emails are unique per organization only
+	if acmeUser.Username != globexUser.Username {
+		t.Fatalf("expected the same username in both organizations")
+	}
+
+	page, err := c.ListUsers(ctx, client.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || page.Users[0].ID != acmeUser.ID.Hex() {
+		t.Errorf("expected only the user of acme, but got %v", page.Users)
+	}
+
+	// the users of globex can't be read or written through acme
+	if _, err = c.GetUser(ctx, globexUser.ID.Hex()); err == nil {
+		t.Errorf("expected the user of globex not to be found")
+	}
+	name := "Changed"
+	if _, err = c.PatchUser(ctx, globexUser.ID.Hex(), client.UserParams{Name: &name}); err == nil {
+		t.Errorf("expected the user of globex not to be updated")
+	}
+	if err = c.DeleteUser(ctx, globexUser.ID.Hex()); err == nil {
+		t.Errorf("expected the user of globex not to be deleted")
+	}
+	var u user
+	config.usersCollection.FindId(globexUser.ID).One(&u)
+	if u.Name != globexUser.Name {
+		t.Errorf("expected the user of globex to be unchanged, but got %+v", u)
+	}
+
+	// users are created in the organization of the request
+	email, password := "changed@sample.com", "test123#"
+	created, err := c.CreateUser(ctx, client.UserParams{
+		Name:                 &name,
+		Username:             &name,
+		Email:                &email,
+		Password:             &password,
+		PasswordConfirmation: &password,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.OrganizationID != acme.ID.Hex() {
+		t.Errorf("expected the user in acme, but got %s", created.OrganizationID)
+	}
+	c = client.New(globexAdmin.URL)
+	c.Organization = globex.Slug
+	if page, _ = c.ListUsers(ctx, client.ListOptions{}); page == nil || page.Total != 1 {
+		t.Errorf("expected only the user of globex")
+	}
+
+	// anonymous requests are made for the default organization
+	c = client.New(ts.URL)
+	if page, _ = c.ListUsers(ctx, client.ListOptions{}); page == nil || page.Total != 0 {
+		t.Errorf("expected no user in the default organization")
+	}
+	for _, slug := range []string{globex.Slug, "unknown"} {
+		c.Organization = slug
+		if _, err = c.ListUsers(ctx, client.ListOptions{}); err == nil {
+			t.Errorf("expected an anonymous request for %s to be refused", slug)
+		} else if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected %d, but got %v", http.StatusUnauthorized, err)
+		}
+	}
+	// they only name an organization to log in to it
+	req, _ := http.NewRequest("POST", ts.URL+"/api/login", bytes.NewBufferString(`{"login":{"username":"test_user","password":"test123#"}}`))
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("X-Organization", globex.Slug)
+	login := response{data: &data{}}
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else {
+		json.NewDecoder(resp.Body).Decode(&login)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || login.Tokens == nil {
+			t.Errorf("expected the login in globex, but got %d %s", resp.StatusCode, login.Message)
+		}
+	}
+
+	// actors are bound to their organization
+	c = client.New(acmeAdmin.URL)
+	c.Organization = globex.Slug
+	if _, err = c.ListUsers(ctx, client.ListOptions{}); err == nil {
+		t.Errorf("expected the actor of acme to be denied globex")
+	} else if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusForbidden {
+		t.Errorf("expected %d, but got %v", http.StatusForbidden, err)
+	}
+	status, events := getAuditEvents(t, acmeAdmin.URL+"/api/users/"+globexUser.ID.Hex()+"/audit")
+	if status != http.StatusOK || len(events) != 0 {
+		t.Errorf("expected no audit event of globex, but got %d %v", status, events)
+	}
+	avatarURL := acmeAdmin.URL + "/api/users/" + globexUser.ID.Hex() + "/avatar"
+	if status, _ = putAvatar(t, avatarURL, "image/png", testImage(t, 32, 32)); status != 422 {
+		t.Errorf("expected the avatar of globex not to be saved, but got %d", status)
+	}
+	if resp, _ := getAvatar(t, avatarURL, nil); resp.StatusCode != 422 {
+		t.Errorf("expected the avatar of globex not to be found, but got %d", resp.StatusCode)
+	}
+
+	dropAllCollections(t)
+}
+
+func TestUserQuota(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	o, u := setupOrganization(t, "acme", 2)
+	admin := actorServer(actor{Type: actorUser, ID: u.ID.Hex(), Role: roleAdmin, OrganizationID: o.ID})
+	defer admin.Close()
+	c := client.New(admin.URL)
+	c.Organization = o.Slug
+	ctx := context.Background()
+
+	password := "test123#"
+	params := func(username string) client.UserParams {
+		email := username + "@sample.com"
+		return client.UserParams{Name: &username, Username: &username, Email: &email, Password: &password, PasswordConfirmation: &password}
+	}
+	if _, err := c.CreateUser(ctx, params("second")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.CreateUser(ctx, params("third"))
+	if e, ok := err.(*client.ValidationError); !ok || e.Errors["organization"][0] != errQuotaReached {
+		t.Errorf("expected the quota to be reached, but got %v", err)
+	}
+
+	// the other organizations aren't limited
+	c = client.New(ts.URL)
+	if _, err = c.CreateUser(ctx, params("third")); err != nil {
+		t.Errorf("expected the user in the default organization, but got %v", err)
+	}
+
+	// rows over the quota of a bulk import are rejected
+	o.UserQuota = 4
+	config.organizationsCollection.UpdateId(o.ID, o)
+	req, _ := http.NewRequest("POST", admin.URL+"/api/users/bulk", bytes.NewBufferString(
+		`{"name":"Fourth","username":"fourth","email":"fourth@sample.com","password":"test123#","password_confirmation":"test123#"}
+{"name":"Fifth","username":"fifth","email":"fifth@sample.com","password":"test123#","password_confirmation":"test123#"}
+{"name":"Sixth","username":"sixth","email":"sixth@sample.com","password":"test123#","password_confirmation":"test123#"}`))
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	req.Header.Add("X-Organization", o.Slug)
+	actResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer actResp.Body.Close()
+	resp := response{data: &data{}}
+	json.NewDecoder(actResp.Body).Decode(&resp)
+	if len(resp.Results) != 3 || resp.Results[1].Status != bulkCreated || resp.Results[2].Status != bulkInvalid {
+		t.Errorf("expected the last row over the quota, but got %+v", resp.Results)
+	}
+	if n, _ := config.usersCollection.Find(bson.M{"organization_id": o.ID}).Count(); n != 4 {
+		t.Errorf("expected %d users, but got %d", 4, n)
+	}
+
+	dropAllCollections(t)
+}
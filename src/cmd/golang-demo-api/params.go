@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// requestContentTypes is the pattern matched against the "Content-Type"
+// header by the routers. Bodies can be sent as JSON or as HTML form data.
+const requestContentTypes = `^(application/json|application/x-www-form-urlencoded|multipart/form-data)(;.*)?$`
+
+// jsonContentTypes is the pattern of the routers whose bodies can only be
+// sent as JSON.
+const jsonContentTypes = `^application/json(;.*)?$`
+
+// maxMultipartMemory is the part of a multipart body kept in memory,
+// the rest is stored in temporary files.
+const maxMultipartMemory int64 = 10 << 20
+
+// decodeUserParams reads the "user" parameters of the request body into nu.
+// JSON bodies are expected as {"user": {...}} while form bodies
+// (urlencoded or multipart) use bracketed keys like "user[name]".
+func decodeUserParams(req *http.Request, nu *newUser) error {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+
+	switch mediaType {
+	case "application/json":
+		var params struct {
+			// use 'newUser' because if field is left empty intentionally,
+			// then json decoder throws error
+			User struct{ newUser } `json:"user"`
+		}
+		if err = json.NewDecoder(req.Body).Decode(&params); err != nil {
+			return err
+		}
+		*nu = params.User.newUser
+		return nil
+	case "application/x-www-form-urlencoded":
+		err = req.ParseForm()
+	case "multipart/form-data":
+		err = req.ParseMultipartForm(maxMultipartMemory)
+	default:
+		return fmt.Errorf("Unsupported Content-Type %q", mediaType)
+	}
+	if err != nil {
+		return err
+	}
+	return decodeForm(req.PostForm, "user", nu)
+}
+
+// decodeForm copies form values with keys like "prefix[field]" into the
+// string fields of dst, using the field's json tag as the field name.
+// Fields without a matching key are left untouched.
+func decodeForm(values url.Values, prefix string, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return errors.New("decodeForm: dst must be a pointer to a struct")
+	}
+	v = v.Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		vals, ok := values[prefix+"["+name+"]"]
+		if !ok || len(vals) == 0 {
+			continue
+		}
+
+		field := v.Field(i)
+		switch {
+		case field.Kind() == reflect.String:
+			field.SetString(vals[0])
+		case field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.String:
+			s := vals[0]
+			field.Set(reflect.ValueOf(&s))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// rateLimit allows Requests requests in every Per interval. It is enforced
+// as a token bucket holding at most Requests tokens, refilled continuously.
+type rateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (l rateLimit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// rateLimitRule overrides the default limit for the requests matching
+// Methods and Path. Every rule has its own bucket per client, named by Name.
+type rateLimitRule struct {
+	Name    string
+	Methods []string
+	Path    *regexp.Regexp
+	Limit   rateLimit
+}
+
+func (r rateLimitRule) matches(method, path string) bool {
+	if !r.Path.MatchString(path) {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultRateLimit applies to the requests not matched by rateLimitRules.
+var defaultRateLimit = rateLimit{Requests: 300, Per: time.Minute}
+
+// rateLimitRules are the stricter limits of expensive or sensitive routes.
+var rateLimitRules = []rateLimitRule{
+	// creating a user runs bcrypt
+	{
+		Name:    "create_user",
+		Methods: []string{"POST"},
+		Path:    regexp.MustCompile(`^/api/users/?$`),
+		Limit:   rateLimit{Requests: 10, Per: time.Minute},
+	},
+	{
+		Name:    "bulk_create_users",
+		Methods: []string{"POST"},
+		Path:    regexp.MustCompile(`^/api/users/bulk/?$`),
+		Limit:   rateLimit{Requests: 5, Per: time.Minute},
+	},
+	// stop clients from guessing the passwords of many users
+	{
+		Name:    "login",
+		Methods: []string{"POST"},
+		Path:    regexp.MustCompile(`^/api/login/?$`),
+		Limit:   rateLimit{Requests: 10, Per: time.Minute},
+	},
+	{
+		Name:    "oauth_authorize",
+		Methods: []string{"POST"},
+		Path:    regexp.MustCompile(`^/oauth/authorize/?$`),
+		Limit:   rateLimit{Requests: 10, Per: time.Minute},
+	},
+	// stop clients from enumerating user ids
+	{
+		Name:    "show_user",
+		Methods: []string{"GET"},
+		Path:    regexp.MustCompile(`^/api/users/[^/]+(/edit)?/?$`),
+		Limit:   rateLimit{Requests: 60, Per: time.Minute},
+	},
+}
+
+// rateLimitResult is the state of a bucket after taking a token from it.
+type rateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// rateLimitStore keeps the token buckets. Take and Peek must be safe for
+// concurrent use. Peek tells whether Take would be allowed, without taking
+// a token.
+type rateLimitStore interface {
+	Take(key string, l rateLimit, now time.Time) (rateLimitResult, error)
+	Peek(key string, l rateLimit, now time.Time) (rateLimitResult, error)
+}
+
+// rateLimitBucket is a token bucket as saved by the rate limit stores.
+type rateLimitBucket struct {
+	Key       string    `bson:"_id"`
+	Tokens    float64   `bson:"tokens"`
+	Version   int       `bson:"version"`
+	UpdatedAt time.Time `bson:"updated_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// take refills the bucket for the time elapsed since its last update and
+// removes one token from it if available.
+func (b *rateLimitBucket) take(l rateLimit, now time.Time) rateLimitResult {
+	burst := float64(l.Requests)
+	if b.UpdatedAt.IsZero() {
+		b.Tokens = burst
+	} else if elapsed := now.Sub(b.UpdatedAt).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(burst, b.Tokens+elapsed*l.rate())
+	}
+	b.UpdatedAt = now
+	b.Version++
+
+	res := rateLimitResult{Limit: l.Requests}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.Tokens) / l.rate() * float64(time.Second))
+	}
+	res.Remaining = int(b.Tokens)
+	res.Reset = time.Duration((burst - b.Tokens) / l.rate() * float64(time.Second))
+	// a full bucket holds no information, so it can be forgotten
+	b.ExpiresAt = now.Add(res.Reset)
+	return res
+}
+
+// peek returns what take would, without changing the bucket.
+func (b rateLimitBucket) peek(l rateLimit, now time.Time) rateLimitResult {
+	return b.take(l, now)
+}
+
+// memoryRateLimitStore keeps the buckets in the memory of this process.
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*rateLimitBucket
+	sweep   time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]*rateLimitBucket)}
+}
+
+func (s *memoryRateLimitStore) Take(key string, l rateLimit, now time.Time) (rateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// drop expired buckets once a minute so idle clients don't pile up
+	if now.Sub(s.sweep) > time.Minute {
+		for k, b := range s.buckets {
+			if now.After(b.ExpiresAt) {
+				delete(s.buckets, k)
+			}
+		}
+		s.sweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &rateLimitBucket{Key: key}
+		s.buckets[key] = b
+	}
+	return b.take(l, now), nil
+}
+
+func (s *memoryRateLimitStore) Peek(key string, l rateLimit, now time.Time) (rateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &rateLimitBucket{Key: key}
+	}
+	return b.peek(l, now), nil
+}
+
+// mongoRateLimitStore keeps the buckets in a collection, so that the limits
+// are shared by every instance of the API using the same database.
+type mongoRateLimitStore struct {
+	c *mgo.Collection
+}
+
+// maxRateLimitRetries is how many times a bucket update is retried when
+// another instance changed the bucket concurrently.
+const maxRateLimitRetries = 5
+
+func newMongoRateLimitStore(c *mgo.Collection) (*mongoRateLimitStore, error) {
+	err := c.EnsureIndex(mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoRateLimitStore{c: c}, nil
+}
+
+func (s *mongoRateLimitStore) Take(key string, l rateLimit, now time.Time) (rateLimitResult, error) {
+	// buckets are updated optimistically, the update only applies if
+	// the version read is still the one in the collection
+	for i := 0; i < maxRateLimitRetries; i++ {
+		var b rateLimitBucket
+		err := s.c.FindId(key).One(&b)
+		if err == mgo.ErrNotFound {
+			b = rateLimitBucket{Key: key}
+			res := b.take(l, now)
+			if err = s.c.Insert(&b); mgo.IsDup(err) {
+				continue
+			}
+			return res, err
+		} else if err != nil {
+			return rateLimitResult{}, err
+		}
+
+		version := b.Version
+		res := b.take(l, now)
+		err = s.c.Update(bson.M{"_id": key, "version": version}, &b)
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		return res, err
+	}
+	return rateLimitResult{}, errors.New("Unable to update rate limit bucket " + key)
+}
+
+func (s *mongoRateLimitStore) Peek(key string, l rateLimit, now time.Time) (rateLimitResult, error) {
+	b := rateLimitBucket{Key: key}
+	if err := s.c.FindId(key).One(&b); err != nil && err != mgo.ErrNotFound {
+		return rateLimitResult{}, err
+	}
+	return b.peek(l, now), nil
+}
+
+// rateLimiter is a negroni middleware throttling requests per client.
+// Requests over the limit are answered with 429 Too Many Requests.
+type rateLimiter struct {
+	store        rateLimitStore
+	defaultLimit rateLimit
+	rules        []rateLimitRule
+	// identify returns the key a client is throttled by.
+	identify func(req *http.Request) string
+	now      func() time.Time
+}
+
+func newRateLimiter(store rateLimitStore, defaultLimit rateLimit, rules ...rateLimitRule) *rateLimiter {
+	return &rateLimiter{
+		store:        store,
+		defaultLimit: defaultLimit,
+		rules:        rules,
+		identify:     clientIdentity,
+		now:          time.Now,
+	}
+}
+
+// apiRateLimiter is the rateLimiter of the API, none when nil. Handlers
+// doing the work of several routes charge it for each of them.
+var apiRateLimiter *rateLimiter
+
+// take charges the client of req for a request to method and path.
+func (rl *rateLimiter) take(req *http.Request, method, path string) (rateLimitResult, error) {
+	name, limit := "default", rl.defaultLimit
+	for _, rule := range rl.rules {
+		if rule.matches(method, path) {
+			name, limit = rule.Name, rule.Limit
+			break
+		}
+	}
+	return rl.store.Take(name+":"+rl.identify(req), limit, rl.now())
+}
+
+func (rl *rateLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	res, err := rl.take(req, req.Method, req.URL.Path)
+	if err != nil {
+		// don't lock everybody out when the store is unavailable
+		log.Println(err)
+		next(w, req)
+		return
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	if res.Allowed {
+		next(w, req)
+		return
+	}
+	refuseTooManyRequests(w, res)
+}
+
+func refuseTooManyRequests(w http.ResponseWriter, res rateLimitResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+	w.WriteHeader(http.StatusTooManyRequests)
+	resp := response{Message: "Too many requests. Please try again later."}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+}
+
+// failedAuthLimit is how many requests with invalid credentials an
+// address can make, so credentials can't be guessed.
+var failedAuthLimit = rateLimit{Requests: 20, Per: time.Minute}
+
+// authFailureLimiter throttles by IP address the requests with invalid
+// credentials, which authMiddleware refuses before the rate limiter keyed
+// by actor. The addresses over the limit are refused before their
+// credentials are looked up.
+type authFailureLimiter struct {
+	store rateLimitStore
+	limit rateLimit
+	now   func() time.Time
+}
+
+// authFailures is the authFailureLimiter of authMiddleware, none when nil.
+var authFailures *authFailureLimiter
+
+func newAuthFailureLimiter(store rateLimitStore, limit rateLimit) *authFailureLimiter {
+	return &authFailureLimiter{store: store, limit: limit, now: time.Now}
+}
+
+func authFailureKey(req *http.Request) string {
+	return "auth_failure:ip:" + clientIP(req)
+}
+
+// allow refuses the request when its address made too many requests with
+// invalid credentials, and tells whether it was allowed.
+func (l *authFailureLimiter) allow(w http.ResponseWriter, req *http.Request) bool {
+	res, err := l.store.Peek(authFailureKey(req), l.limit, l.now())
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+	if !res.Allowed {
+		refuseTooManyRequests(w, res)
+	}
+	return res.Allowed
+}
+
+// failed charges invalid credentials to the address of the request.
+func (l *authFailureLimiter) failed(req *http.Request) {
+	if _, err := l.store.Take(authFailureKey(req), l.limit, l.now()); err != nil {
+		log.Println(err)
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// clientIdentity identifies a client by its actor, so the clients sharing
+// an address keep their own limits. Anonymous clients are identified by
+// their IP address.
+func clientIdentity(req *http.Request) string {
+	if a := requestActor(req); a.ID != "" {
+		return a.Type + ":" + a.ID
+	}
+	return "ip:" + clientIP(req)
+}
+
+// trustProxyHeaders makes clientIP honour the "X-Forwarded-For" header.
+// Only enable it when the API is served behind a proxy setting the header.
+var trustProxyHeaders = false
+
+// clientIP returns the IP address of the client making the request.
+func clientIP(req *http.Request) string {
+	if trustProxyHeaders {
+		if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
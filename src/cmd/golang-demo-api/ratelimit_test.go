@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/negroni"
+)
+
+func rateLimitedServer(store rateLimitStore, now *time.Time) *httptest.Server {
+	rl := newRateLimiter(store, rateLimit{Requests: 2, Per: time.Minute},
+		rateLimitRule{
+			Name:    "create_user",
+			Methods: []string{"POST"},
+			Path:    rateLimitRules[0].Path,
+			Limit:   rateLimit{Requests: 1, Per: time.Minute},
+		})
+	rl.now = func() time.Time { return *now }
+
+	n := negroni.New()
+	n.Use(rl)
+	n.UseHandler(router)
+	return httptest.NewServer(n)
+}
+
+func doUsersRequest(t *testing.T, method, url string) *http.Response {
+	client := &http.Client{}
+	req, err := http.NewRequest(method, url, nil)
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func testRateLimiter(t *testing.T, store rateLimitStore) {
+	now := time.Now()
+	ts := rateLimitedServer(store, &now)
+	defer ts.Close()
+
+	for i := 0; i < 2; i++ {
+		resp := doUsersRequest(t, "GET", ts.URL+"/api/users")
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected %d, but got %d", http.StatusOK, resp.StatusCode)
+		}
+	}
+	resp := doUsersRequest(t, "GET", ts.URL+"/api/users")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected %d, but got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") != "30" {
+		t.Errorf("expected Retry-After to be %s, but got %s", "30", resp.Header.Get("Retry-After"))
+	}
+	if resp.Header.Get("RateLimit-Remaining") != "0" {
+		t.Errorf("expected RateLimit-Remaining to be %s, but got %s", "0", resp.Header.Get("RateLimit-Remaining"))
+	}
+
+	// the create rule has its own, stricter bucket
+	resp = doUsersRequest(t, "POST", ts.URL+"/api/users")
+	if resp.StatusCode == http.StatusTooManyRequests {
+		t.Errorf("expected first create not to be limited")
+	}
+	resp = doUsersRequest(t, "POST", ts.URL+"/api/users")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected %d, but got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+
+	// a token is refilled every 30 seconds
+	now = now.Add(30 * time.Second)
+	resp = doUsersRequest(t, "GET", ts.URL+"/api/users")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	testRateLimiter(t, newMemoryRateLimitStore())
+	dropAllCollections(t)
+}
+
+func TestMongoRateLimiter(t *testing.T) {
+	store, err := newMongoRateLimitStore(config.db.C("rate_limits"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRateLimiter(t, store)
+	dropAllCollections(t)
+}
+
+func TestClientIdentity(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if id := clientIdentity(req); id != "ip:192.0.2.1" {
+		t.Errorf("expected anonymous clients to be identified by address, but got %s", id)
+	}
+	for _, test := range []struct {
+		actor    actor
+		expected string
+	}{
+		{actor{Type: actorUser, ID: "u1"}, "user:u1"},
+		{actor{Type: actorAPIKey, ID: "k1"}, "api_key:k1"},
+	} {
+		if id := clientIdentity(withActor(req, test.actor)); id != test.expected {
+			t.Errorf("expected %s, but got %s", test.expected, id)
+		}
+	}
+}
+
+func TestAuthFailureLimiter(t *testing.T) {
+	now := time.Now()
+	l := newAuthFailureLimiter(newMemoryRateLimitStore(), rateLimit{Requests: 2, Per: time.Minute})
+	l.now = func() time.Time { return now }
+	req := httptest.NewRequest("GET", "/api/users", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	for i := 0; i < 2; i++ {
+		if w := httptest.NewRecorder(); !l.allow(w, req) {
+			t.Fatalf("%d: expected the request to be allowed, but got %d", i, w.Code)
+		}
+		l.failed(req)
+	}
+	w := httptest.NewRecorder()
+	if l.allow(w, req) || w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "30" {
+		t.Errorf("expected %d after 2 failures, but got %d %v", http.StatusTooManyRequests, w.Code, w.Header())
+	}
+	// other addresses aren't limited
+	other := httptest.NewRequest("GET", "/api/users", nil)
+	other.RemoteAddr = "192.0.2.2:1234"
+	if !l.allow(httptest.NewRecorder(), other) {
+		t.Errorf("expected another address to be allowed")
+	}
+}
+
+func TestAuthFailuresLimited(t *testing.T) {
+	authFailures = newAuthFailureLimiter(newMemoryRateLimitStore(), rateLimit{Requests: 2, Per: time.Minute})
+	defer func() { authFailures = nil }()
+	ts := newTestServer()
+	defer ts.Close()
+
+	for _, expected := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		if status, _ := bearerRequest(t, "GET", ts.URL+"/api/users", apiKeyPrefix+"guessed"); status != expected {
+			t.Errorf("expected %d, but got %d", expected, status)
+		}
+	}
+	// without credentials the requests go on
+	if resp := doUsersRequest(t, "GET", ts.URL+"/api/users"); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+}
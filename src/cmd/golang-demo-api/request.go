@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	actorKey
+	organizationKey
+)
+
+// roleAdmin is the role of the users allowed to use the admin endpoints.
+const roleAdmin = "admin"
+
+// actor is who a request is made by. Requests without credentials are
+// made by an anonymous actor. Authenticated actors belong to an
+// organization and can only make requests for it.
+type actor struct {
+	Type           string        `bson:"type" json:"type"`
+	ID             string        `bson:"id,omitempty" json:"id,omitempty"`
+	Role           string        `bson:"role,omitempty" json:"role,omitempty"`
+	OrganizationID bson.ObjectId `bson:"organization_id,omitempty" json:"organization_id,omitempty"`
+	// Scopes are those of the access token or API key of the request.
+	Scopes []string `bson:"scopes,omitempty" json:"scopes,omitempty"`
+	// Scoped actors can only call the routes their scopes allow.
+	Scoped bool `bson:"-" json:"-"`
+	// SessionID is the session of the access token of the request.
+	SessionID string `bson:"session_id,omitempty" json:"session_id,omitempty"`
+}
+
+// Types of the actors authenticated with an access token or an API key.
+const (
+	actorUser   = "user"
+	actorClient = "client"
+	actorAPIKey = "api_key"
+)
+
+var anonymous = actor{Type: "anonymous"}
+
+// withActor returns a shallow copy of req made by a.
+func withActor(req *http.Request, a actor) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), actorKey, a))
+}
+
+// requestActor returns who made the request.
+func requestActor(req *http.Request) actor {
+	if a, ok := req.Context().Value(actorKey).(actor); ok {
+		return a
+	}
+	return anonymous
+}
+
+// requireAdmin only lets admins call the handler.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		a := requestActor(req)
+		if a.Role == roleAdmin {
+			handler(w, req)
+			return
+		}
+		refuseAccess(w, a, "Admin access required.")
+	}
+}
+
+// requireSelfOrAdmin only lets the user of the "id" route variable and
+// the admins call the handler.
+func requireSelfOrAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		a := requestActor(req)
+		if a.selfOrAdmin(mux.Vars(req)["id"]) {
+			handler(w, req)
+			return
+		}
+		refuseAccess(w, a, errSelfOrAdmin)
+	}
+}
+
+// errSelfOrAdmin is the message refusing the actors other than the user
+// and the admins.
+const errSelfOrAdmin = "Only the user or an admin can do this."
+
+// selfOrAdmin tells whether the actor is the user with id, or an admin.
+func (a actor) selfOrAdmin(id string) bool {
+	return a.Role == roleAdmin || (a.Type == actorUser && a.ID == id)
+}
+
+// refuseAccess asks anonymous actors to authenticate, and refuses the
+// others with message.
+func refuseAccess(w http.ResponseWriter, a actor, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	if a.Type == anonymous.Type {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(response{Message: "Authentication required."})
+	} else {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(response{Message: message})
+	}
+}
+
+// validRequestID is the format of the request ids accepted from clients.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestIDMiddleware gives every request an id, taken from the
+// "X-Request-ID" header when the client sends one. The id is sent back
+// in the same header, so logs of both sides can be matched.
+func requestIDMiddleware(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	id := req.Header.Get("X-Request-ID")
+	if !validRequestID.MatchString(id) {
+		id = bson.NewObjectId().Hex()
+	}
+	w.Header().Set("X-Request-ID", id)
+	next(w, req.WithContext(context.WithValue(req.Context(), requestIDKey, id)))
+}
+
+// requestID returns the id given to the request by requestIDMiddleware.
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey).(string)
+	return id
+}
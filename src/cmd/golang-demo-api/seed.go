@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"factory"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// seedCommand fills the database with the users of fixture files and
+// generated users. The generated users are inserted in bulk, without
+// the validation, audit log and events of the API, so hundreds of
+// thousands of them only take seconds.
+func seedCommand(c *cliCommand, fs *flag.FlagSet, args []string) error {
+	seed := fs.Int64("seed", 1, "`seed` of the generated users, the same seed gives the same users")
+	n := fs.Int("users", 100, "`number` of users to generate")
+	from := fs.String("from", factory.DefaultFrom.Format(time.RFC3339), "RFC 3339 `time` of the oldest users")
+	to := fs.String("to", factory.DefaultTo.Format(time.RFC3339), "RFC 3339 `time` of the newest users")
+	password := fs.String("password", factory.DefaultPassword, "`password` of the generated users")
+	fixturesDir := fs.String("fixtures", "fixtures", "`directory` of the fixtures given by name")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	store, ok := c.store.(dbUserStore)
+	if !ok {
+		return errors.New("seed only works with the database, not through the API")
+	}
+
+	f := factory.New(*seed)
+	f.Password = *password
+	for _, t := range []struct {
+		value string
+		dst   *time.Time
+	}{{*from, &f.From}, {*to, &f.To}} {
+		v, err := time.Parse(time.RFC3339, t.value)
+		if err != nil {
+			return fmt.Errorf("invalid time %q, expected an RFC 3339 time", t.value)
+		}
+		*t.dst = v
+	}
+
+	// generated users follow the ones already there, so seeding again
+	// adds more users instead of repeating usernames
+	seq, err := reserveSeedSeqs(store.org.ID, *n)
+	if err != nil {
+		return err
+	}
+	f.Seq = seq
+
+	for _, name := range fs.Args() {
+		fixture, err := factory.LoadFixture(*fixturesDir, name)
+		if err != nil {
+			return err
+		}
+		created, err := seedFixture(store.org.ID, fixture)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "Created %d of the %d users of %s.\n", created, len(fixture.Users), name)
+	}
+
+	start := time.Now()
+	if err = seedUsers(store.org.ID, f, *n); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "Generated %d users in %s.\n", *n, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// reserveSeedSeqs reserves n sequence numbers for the users generated in
+// the organization and returns the first. The next one is counted in a
+// document of the organization, so seeding concurrently or after deleting
+// users doesn't repeat usernames.
+func reserveSeedSeqs(orgID bson.ObjectId, n int) (int, error) {
+	var counter struct {
+		Seq int `bson:"seq"`
+	}
+	_, err := config.seedSequencesCollection.FindId(orgID).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"seq": n}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &counter)
+	return counter.Seq - n, err
+}
+
+// seedFixture creates the users of a fixture in the organization like the
+// API does. Users whose username is taken are left as they are, so
+// fixtures can be loaded again.
+func seedFixture(orgID bson.ObjectId, fixture *factory.Fixture) (created int, err error) {
+	for _, fu := range fixture.Users {
+		if n, _ := config.usersCollection.Find(bson.M{"organization_id": orgID, "username": fu.Username}).Count(); n > 0 {
+			continue
+		}
+		if err = checkRole(fu.Role); err != nil {
+			return created, fmt.Errorf("%s: %s", fu.Username, err)
+		}
+		password := fu.Password
+		if password == "" {
+			password = factory.DefaultPassword
+		}
+		u := &user{
+			OrganizationID:       orgID,
+			Name:                 fu.Name,
+			Username:             fu.Username,
+			Email:                fu.Email,
+			Mobile:               fu.Mobile,
+			Role:                 fu.Role,
+			Password:             password,
+			PasswordConfirmation: password,
+		}
+		if err = u.Create(); err != nil {
+			return created, fmt.Errorf("%s: %s", fu.Username, modelError("Unable to save user.", u.Errors, err))
+		}
+		created++
+	}
+	return created, nil
+}
+
+// seedUsers inserts n users of f in the organization. They all have
+// f.Password, which is only hashed once. The quota of the organization
+// isn't checked.
+func seedUsers(orgID bson.ObjectId, f *factory.Factory, n int) error {
+	digest, err := bcrypt.GenerateFromPassword([]byte(f.Password), 0)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < n; start += bulkBatchSize {
+		end := start + bulkBatchSize
+		if end > n {
+			end = n
+		}
+		bulk := config.usersCollection.Bulk()
+		bulk.Unordered()
+		for _, fu := range f.Users(end - start) {
+			bulk.Insert(&user{
+				ID:             objectIDAt(fu.CreatedAt),
+				OrganizationID: orgID,
+				Name:           fu.Name,
+				Username:       fu.Username,
+				Email:          fu.Email,
+				Mobile:         fu.Mobile,
+				Role:           fu.Role,
+				PasswordDigest: string(digest),
+				CreatedAt:      fu.CreatedAt,
+				UpdatedAt:      fu.CreatedAt,
+			})
+		}
+		if _, err = bulk.Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectIDAt returns a new id with the time t, like the ids of the users
+// created at t. bson.NewObjectIdWithTime isn't used as its ids aren't
+// unique.
+func objectIDAt(t time.Time) bson.ObjectId {
+	id := []byte(bson.NewObjectId())
+	binary.BigEndian.PutUint32(id[:4], uint32(t.Unix()))
+	return bson.ObjectId(id)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSeedCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fixture := "users:\n  - name: Admin\n    username: admin\n    email: admin@example.com\n    role: admin\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "admins.yml"), []byte(fixture), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	args := []string{"-env", "test", "seed", "-users", "2500", "-fixtures", dir,
+		"-from", from.Format(time.RFC3339), "-to", to.Format(time.RFC3339), "admins"}
+
+	// seeding again adds other users
+	for i, expected := range []int{2501, 5001} {
+		status, _, stderr := runTestCLI(t, "", args...)
+		if status != 0 {
+			t.Fatalf("expected status %d, but got %d: %s", 0, status, stderr)
+		}
+		total, _ := config.usersCollection.Count()
+		if total != expected {
+			t.Errorf("%d: expected %d users, but got %d", i, expected, total)
+		}
+		var usernames []string
+		config.usersCollection.Find(nil).Distinct("username", &usernames)
+		if len(usernames) != total {
+			t.Errorf("%d: expected %d usernames, but got %d", i, total, len(usernames))
+		}
+	}
+
+	// seeding after deletions doesn't repeat the usernames of the last users
+	var deleted []user
+	config.usersCollection.Find(bson.M{"username": bson.M{"$ne": "admin"}}).Limit(100).All(&deleted)
+	for _, u := range deleted {
+		config.usersCollection.RemoveId(u.ID)
+	}
+	if status, _, stderr := runTestCLI(t, "", args...); status != 0 {
+		t.Fatalf("expected status %d, but got %d: %s", 0, status, stderr)
+	}
+	if total, _ := config.usersCollection.Count(); total != 7401 {
+		t.Errorf("expected %d users, but got %d", 7401, total)
+	}
+
+	var admin user
+	config.usersCollection.Find(bson.M{"username": "admin"}).One(&admin)
+	if admin.Role != roleAdmin {
+		t.Errorf("expected role to be %s, but got %s", roleAdmin, admin.Role)
+	}
+
+	var generated user
+	config.usersCollection.Find(bson.M{"username": bson.M{"$ne": "admin"}}).One(&generated)
+	if generated.CreatedAt.Before(from) || !generated.CreatedAt.Before(to) {
+		t.Errorf("expected created_at in %s - %s, but got %s", from, to, generated.CreatedAt)
+	}
+	if !generated.ID.Time().Equal(generated.CreatedAt) {
+		t.Errorf("expected the id to be of %s, but got %s", generated.CreatedAt, generated.ID.Time())
+	}
+	if err = bcrypt.CompareHashAndPassword([]byte(generated.PasswordDigest), []byte("password")); err != nil {
+		t.Errorf("expected password to be %s, but got mismatch", "password")
+	}
+
+	dropAllCollections(t)
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// sessionAccessTokenTTL is short, the clients get new access tokens
+	// with the refresh token of the session.
+	sessionAccessTokenTTL = 15 * time.Minute
+	// sessionTTL is how long a session lasts without being refreshed.
+	sessionTTL = 30 * 24 * time.Hour
+	// maxUserAgentLength is the length of the user agents kept.
+	maxUserAgentLength = 512
+)
+
+// session is a login of a user on a device. Its tokens are kept with the
+// OAuth ones, without client and with the session as family.
+type session struct {
+	ID             bson.ObjectId `bson:"_id" json:"id"`
+	UserID         bson.ObjectId `bson:"user_id" json:"user_id"`
+	OrganizationID bson.ObjectId `bson:"organization_id" json:"-"`
+	// Device describes the user agent, like "Firefox on Linux".
+	Device    string `bson:"device" json:"device"`
+	UserAgent string `bson:"user_agent,omitempty" json:"user_agent,omitempty"`
+	// IP is the address of the login, then of the last refresh.
+	IP         string    `bson:"ip" json:"ip"`
+	CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+	LastUsedAt time.Time `bson:"last_used_at" json:"last_used_at"`
+	ExpiresAt  time.Time `bson:"expires_at" json:"expires_at"`
+	// Current tells whether the request was made with the session.
+	Current bool `bson:"-" json:"current,omitempty"`
+}
+
+// Sessions represents a collection of session objects
+type Sessions []session
+
+type refreshParams struct {
+	RefreshToken *string `json:"refresh_token,omitempty"`
+}
+
+func init() {
+	router.Path("/api/sessions/refresh").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("POST").
+		HandlerFunc(refreshSessionHandler)
+
+	sessionsRouter := router.Path("/api/users/{id}/sessions").
+		HeadersRegexp("Content-Type", requestContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Subrouter()
+
+	sessionsRouter.Methods("GET").Handler(requireScope(scopeUsersRead, requireSelfOrAdmin(sessionsHandler)))
+	sessionsRouter.Methods("DELETE").Handler(requireScope(scopeUsersWrite, requireSelfOrAdmin(revokeOtherSessionsHandler)))
+
+	router.Path("/api/users/{id}/sessions/{session_id}").
+		HeadersRegexp("Content-Type", requestContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("DELETE").
+		Handler(requireScope(scopeUsersWrite, requireSelfOrAdmin(revokeSessionHandler)))
+
+	// the sessions of deleted users end with them, their tokens are
+	// removed with the OAuth ones
+	onUserEvent(func(e userEvent) {
+		if e.Type == userDeleted {
+			if _, err := config.sessionsCollection.RemoveAll(bson.M{"user_id": e.User.ID}); err != nil {
+				log.Println(err)
+			}
+		}
+	})
+
+	userID := pathParam("id", "ID of the user")
+	documentOperations(
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/sessions/refresh",
+			OperationID: "refreshSession",
+			Summary:     "Returns new tokens for the refresh token of a session. Refresh tokens can only be used once, using one again revokes the session.",
+			Tags:        []string{"login"},
+			RequestBody: jsonBody(struct {
+				Session refreshParams `json:"session"`
+			}{}),
+			Responses: envelopeResponses(http.StatusOK, http.StatusBadRequest, http.StatusUnauthorized),
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/users/{id}/sessions",
+			OperationID: "listSessions",
+			Summary:     "Returns the sessions of a user, last used first.",
+			Tags:        []string{"login"},
+			Parameters:  []*openAPIParameter{userID},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+		&openAPIOperation{
+			Method:      "DELETE",
+			Path:        "/api/users/{id}/sessions",
+			OperationID: "revokeOtherSessions",
+			Summary:     "Revokes the sessions of a user, except the one of the request.",
+			Tags:        []string{"login"},
+			Parameters:  []*openAPIParameter{userID},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+		&openAPIOperation{
+			Method:      "DELETE",
+			Path:        "/api/users/{id}/sessions/{session_id}",
+			OperationID: "revokeSession",
+			Summary:     "Revokes a session of a user.",
+			Tags:        []string{"login"},
+			Parameters:  []*openAPIParameter{userID, pathParam("session_id", "ID of the session")},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+	)
+}
+
+// ensureSessionIndexes creates the indexes of the sessions, and the one
+// removing the expired sessions.
+func ensureSessionIndexes() error {
+	if err := config.sessionsCollection.EnsureIndexKey("user_id", "-last_used_at"); err != nil {
+		return err
+	}
+	return config.sessionsCollection.EnsureIndex(mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second})
+}
+
+var (
+	// browsers and systems are matched in order, since user agents name
+	// several, like Chrome with Safari or Android with Linux.
+	browsers = []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	}
+	systems = []struct{ token, name string }{
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	}
+)
+
+// deviceName describes the browser and system of a user agent, so the
+// users recognize their sessions.
+func deviceName(userAgent string) string {
+	var browser, system string
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, s := range systems {
+		if strings.Contains(userAgent, s.token) {
+			system = s.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	return "Unknown device"
+}
+
+// startSession starts a session of u on the device of the request and
+// returns its tokens.
+func startSession(req *http.Request, u *user) (*session, *tokenResponse, error) {
+	now := bson.Now()
+	userAgent := req.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	s := &session{
+		ID:             bson.NewObjectId(),
+		UserID:         u.ID,
+		OrganizationID: u.OrganizationID,
+		Device:         deviceName(userAgent),
+		UserAgent:      userAgent,
+		IP:             clientIP(req),
+		CreatedAt:      now,
+		LastUsedAt:     now,
+		ExpiresAt:      now.Add(sessionTTL),
+	}
+	if err := config.sessionsCollection.Insert(s); err != nil {
+		return nil, nil, err
+	}
+	tokens, err := s.issueTokens(now)
+	return s, tokens, err
+}
+
+// issueTokens issues an access token and a refresh token of the session.
+func (s *session) issueTokens(now time.Time) (*tokenResponse, error) {
+	t := oauthToken{
+		UserID:         s.UserID,
+		OrganizationID: s.OrganizationID,
+		FamilyID:       s.ID,
+		AuthTime:       s.CreatedAt,
+		CreatedAt:      now,
+	}
+	access, err := t.save(tokenAccess, sessionAccessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := t.save(tokenRefresh, sessionTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenResponse{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(sessionAccessTokenTTL.Seconds()),
+		RefreshToken: refresh,
+	}, nil
+}
+
+// revokeSession ends a session, removing its tokens.
+func revokeSession(id bson.ObjectId) error {
+	if _, err := config.oauthTokensCollection.RemoveAll(bson.M{"family_id": id, "client_id": bson.M{"$exists": false}}); err != nil {
+		return err
+	}
+	err := config.sessionsCollection.RemoveId(id)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// revokeSessions ends the sessions of a user but except, and returns how
+// many were.
+func revokeSessions(userID, except bson.ObjectId) (int, error) {
+	filter := bson.M{"user_id": userID}
+	if except != "" {
+		filter["_id"] = bson.M{"$ne": except}
+	}
+	var sessions Sessions
+	if err := config.sessionsCollection.Find(filter).Select(bson.M{"_id": 1}).All(&sessions); err != nil {
+		return 0, err
+	}
+	for _, s := range sessions {
+		if err := revokeSession(s.ID); err != nil {
+			return 0, err
+		}
+	}
+	return len(sessions), nil
+}
+
+// refreshSessionHandler returns new tokens for the refresh token of a
+// session. Refresh tokens are rotated: each is used once, and using one
+// again revokes the session, since one of its users stole it.
+// URL: POST /api/sessions/refresh
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// BODY:
+//	session[refresh_token]: Refresh token of the session. (required)
+// EXAMPLE:
+//	{
+//		"session": {
+//			"refresh_token": "0b6f7c1e2d3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c"
+//		}
+//	}
+func refreshSessionHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	encoder := json.NewEncoder(w)
+
+	var params struct {
+		Session refreshParams `json:"session"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&params); err != nil || params.Session.RefreshToken == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	now := bson.Now()
+	var old oauthToken
+	_, err := config.oauthTokensCollection.Find(bson.M{
+		"_id":       hashToken(*params.Session.RefreshToken),
+		"type":      tokenRefresh,
+		"client_id": bson.M{"$exists": false},
+	}).Apply(mgo.Change{Update: bson.M{"$set": bson.M{"revoked_at": now}}}, &old)
+	if err != nil && err != mgo.ErrNotFound {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err == nil && !old.RevokedAt.IsZero() {
+		if err = revokeSession(old.FamilyID); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		encoder.Encode(response{Message: "The refresh token was already used, the session is revoked."})
+		return
+	}
+
+	var s session
+	if err == nil && now.Before(old.ExpiresAt) {
+		_, err = config.sessionsCollection.FindId(old.FamilyID).Apply(mgo.Change{
+			Update: bson.M{"$set": bson.M{
+				"ip":           clientIP(req),
+				"last_used_at": now,
+				"expires_at":   now.Add(sessionTTL),
+			}},
+			ReturnNew: true,
+		}, &s)
+	}
+	if err != nil || s.ID == "" {
+		if err != nil && err != mgo.ErrNotFound {
+			log.Println(err)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		encoder.Encode(response{Message: "Invalid or expired refresh token."})
+		return
+	}
+
+	tokens, err := s.issueTokens(now)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if err = encoder.Encode(response{Message: "Session refreshed.", data: &data{session: &s, Tokens: tokens}}); err != nil {
+		log.Println(err)
+	}
+}
+
+// sessionsHandler returns the sessions of a user, the one of the request
+// being current.
+// URL: GET /api/users/:id/sessions
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the user
+func sessionsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	u, err := loadUser(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "User not found."})
+		return
+	}
+	var sessions Sessions
+	if err = config.sessionsCollection.Find(bson.M{"user_id": u.ID}).Sort("-last_used_at").All(&sessions); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	current := requestActor(req).SessionID
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID.Hex() == current
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err = encoder.Encode(response{data: &data{Total: len(sessions), Sessions: sessions}}); err != nil {
+		log.Println(err)
+	}
+}
+
+// revokeOtherSessionsHandler revokes the sessions of a user, except the
+// one the request is made with, to log out everywhere else.
+// URL: DELETE /api/users/:id/sessions
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the user
+func revokeOtherSessionsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	u, err := loadUser(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "User not found."})
+		return
+	}
+	var except bson.ObjectId
+	if current := requestActor(req).SessionID; bson.IsObjectIdHex(current) {
+		except = bson.ObjectIdHex(current)
+	}
+	n, err := revokeSessions(u.ID, except)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err = encoder.Encode(response{Message: "Other sessions revoked successfully.", data: &data{Total: n}}); err != nil {
+		log.Println(err)
+	}
+}
+
+// revokeSessionHandler revokes a session of a user, whose tokens stop
+// working at once.
+// URL: DELETE /api/users/:id/sessions/:session_id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the user
+//	"session_id": ID of the session
+func revokeSessionHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	var s session
+	err := mgo.ErrNotFound
+	u, uerr := loadUser(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if id := mux.Vars(req)["session_id"]; uerr == nil && bson.IsObjectIdHex(id) {
+		err = config.sessionsCollection.Find(bson.M{"_id": bson.ObjectIdHex(id), "user_id": u.ID}).One(&s)
+	}
+	if err == nil {
+		err = revokeSession(s.ID)
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "Session not found."})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err = encoder.Encode(response{Message: "Session revoked successfully."}); err != nil {
+		log.Println(err)
+	}
+}
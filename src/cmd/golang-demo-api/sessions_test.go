@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDeviceName(t *testing.T) {
+	for userAgent, expected := range map[string]string{
+		"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0":                                                    "Firefox on Linux",
+		"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Mobile Safari/537.36":                  "Chrome on Android",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/604.1": "Safari on iOS",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36 Edg/120.0":     "Edge on Windows",
+		"curl/8.4.0": "curl",
+		"":           "Unknown device",
+	} {
+		if name := deviceName(userAgent); name != expected {
+			t.Errorf("expected %q for %q, but got %q", expected, userAgent, name)
+		}
+	}
+}
+
+// sessionRequest makes a request with the access token of a session.
+func sessionRequest(t *testing.T, method, url, token, body string) (int, response) {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	req.Header.Set("Accept", apiContentType)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := response{data: &data{}}
+	json.NewDecoder(resp.Body).Decode(&r)
+	return resp.StatusCode, r
+}
+
+func TestSessions(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	u := setupUser(t)
+
+	login := func(userAgent string) *data {
+		req, _ := http.NewRequest("POST", ts.URL+"/api/login", bytes.NewBufferString(`{"login":{"username":"test_user","password":"test123#"}}`))
+		req.Header.Set("Accept", apiContentType)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", userAgent)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		r := response{data: &data{}}
+		json.NewDecoder(resp.Body).Decode(&r)
+		if resp.StatusCode != http.StatusOK || r.session == nil || r.Tokens == nil || r.Tokens.RefreshToken == "" {
+			t.Fatalf("expected a session, but got %d %s", resp.StatusCode, r.Message)
+		}
+		return r.data
+	}
+	refresh := func(token string) (int, response) {
+		return doOrganizationRequest(t, "POST", ts.URL+"/api/sessions/refresh", `{"session":{"refresh_token":"`+token+`"}}`)
+	}
+	sessionsURL := ts.URL + "/api/users/" + u.ID.Hex() + "/sessions"
+
+	laptop := login("Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0")
+	if laptop.session.Device != "Firefox on Linux" || laptop.session.IP != "127.0.0.1" {
+		t.Errorf("expected the device of the session, but got %+v", laptop.session)
+	}
+	phone := login("Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Mobile Safari/537.36")
+
+	// the user sees where they are logged in
+	status, r := sessionRequest(t, "GET", sessionsURL, laptop.Tokens.AccessToken, "")
+	if status != http.StatusOK || len(r.Sessions) != 2 {
+		t.Fatalf("expected 2 sessions, but got %d %d", status, len(r.Sessions))
+	}
+	for _, s := range r.Sessions {
+		if s.Current != (s.ID == laptop.session.ID) {
+			t.Errorf("expected the session of the laptop to be the current one, but got %+v", s)
+		}
+	}
+	if status, _ = doOrganizationRequest(t, "GET", sessionsURL, ""); status != http.StatusUnauthorized {
+		t.Errorf("expected %d, but got %d", http.StatusUnauthorized, status)
+	}
+	other := actorServer(actor{Type: actorUser, ID: bson.NewObjectId().Hex(), OrganizationID: defaultOrganization.ID})
+	defer other.Close()
+	if status, _ = doOrganizationRequest(t, "GET", other.URL+"/api/users/"+u.ID.Hex()+"/sessions", ""); status != http.StatusForbidden {
+		t.Errorf("expected the sessions of others to be refused, but got %d", status)
+	}
+
+	// refresh tokens are rotated, and a replay revokes the session
+	status, r = refresh(phone.Tokens.RefreshToken)
+	if status != http.StatusOK || r.Tokens == nil || r.Tokens.RefreshToken == phone.Tokens.RefreshToken {
+		t.Fatalf("expected new tokens, but got %d %s", status, r.Message)
+	}
+	refreshed := r.Tokens
+	if status, _ = sessionRequest(t, "GET", sessionsURL, refreshed.AccessToken, ""); status != http.StatusOK {
+		t.Errorf("expected the refreshed access token to work, but got %d", status)
+	}
+	if status, _ = refresh(phone.Tokens.RefreshToken); status != http.StatusUnauthorized {
+		t.Errorf("expected the reuse to be refused, but got %d", status)
+	}
+	if status, _ = refresh(refreshed.RefreshToken); status != http.StatusUnauthorized {
+		t.Errorf("expected the session to be revoked, but got %d", status)
+	}
+	if status, _ = sessionRequest(t, "GET", sessionsURL, refreshed.AccessToken, ""); status != http.StatusUnauthorized {
+		t.Errorf("expected the access token to be revoked, but got %d", status)
+	}
+
+	// logging out everywhere else keeps the current session
+	tablet := login("Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/604.1")
+	status, r = sessionRequest(t, "DELETE", sessionsURL, laptop.Tokens.AccessToken, "")
+	if status != http.StatusOK || r.Total != 1 {
+		t.Errorf("expected 1 session to be revoked, but got %d %d", status, r.Total)
+	}
+	if status, _ = sessionRequest(t, "GET", sessionsURL, tablet.Tokens.AccessToken, ""); status != http.StatusUnauthorized {
+		t.Errorf("expected the other session to be revoked, but got %d", status)
+	}
+
+	desktop := login("Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36")
+	sessionURL := sessionsURL + "/" + desktop.session.ID.Hex()
+	if status, _ = sessionRequest(t, "DELETE", sessionURL, laptop.Tokens.AccessToken, ""); status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	if status, _ = sessionRequest(t, "GET", sessionsURL, desktop.Tokens.AccessToken, ""); status != http.StatusUnauthorized {
+		t.Errorf("expected the session to be revoked, but got %d", status)
+	}
+	if status, _ = sessionRequest(t, "DELETE", sessionURL, laptop.Tokens.AccessToken, ""); status != 422 {
+		t.Errorf("expected %d, but got %d", 422, status)
+	}
+
+	// changing the password logs out every device and client
+	c := &oauthClient{ID: bson.NewObjectId(), OrganizationID: defaultOrganization.ID, GrantTypes: []string{grantRefreshToken}}
+	if _, err := issueTokens(&http.Request{}, c, &u, []string{scopeUsersRead}, "", time.Now(), ""); err != nil {
+		t.Fatal(err)
+	}
+	status, r = sessionRequest(t, "PUT", ts.URL+"/api/users/"+u.ID.Hex(), laptop.Tokens.AccessToken,
+		`{"user":{"password":"changed123#","password_confirmation":"changed123#","current_password":"test123#"}}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected the password to change, but got %d %v", status, r.Errors)
+	}
+	if status, _ = sessionRequest(t, "GET", sessionsURL, laptop.Tokens.AccessToken, ""); status != http.StatusUnauthorized {
+		t.Errorf("expected the sessions to be revoked, but got %d", status)
+	}
+	if n, _ := config.sessionsCollection.Find(bson.M{"user_id": u.ID}).Count(); n != 0 {
+		t.Errorf("expected no session left, but got %d", n)
+	}
+	if n, _ := config.oauthTokensCollection.Find(bson.M{"client_id": c.ID, "revoked_at": bson.M{"$exists": false}}).Count(); n != 0 {
+		t.Errorf("expected the tokens of the client to be revoked, but got %d", n)
+	}
+
+	dropAllCollections(t)
+}
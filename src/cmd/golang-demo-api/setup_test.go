@@ -1,18 +1,53 @@
 package main
 
-import "testing"
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"factory"
+
+	"github.com/codegangsta/negroni"
+)
 
 func init() {
-	config.env = "test"
-	config.db = config.session.DB("golang_demo_api_" + config.env)
-	config.usersCollection = config.db.C("users")
+	if err := connect("test"); err != nil {
+		log.Fatalln(err)
+	}
+	if err := ensureOrganizations(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := ensureEventBus(); err != nil {
+		log.Fatalln(err)
+	}
+	head, err := userEventBus.head()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	go userEventBus.run(head, nil)
 }
 
+// dropAllCollections drops everything but the event bus, which is tailed
+// for the whole run, and creates the default organization again.
 func dropAllCollections(t *testing.T) {
-	err := config.usersCollection.DropCollection()
+	names, err := config.db.CollectionNames()
 	if err != nil {
 		t.Errorf("%s", err)
 	}
+	for _, name := range names {
+		if name == config.eventsCollection.Name || strings.HasPrefix(name, "system.") {
+			continue
+		}
+		if err = config.db.C(name).DropCollection(); err != nil {
+			t.Errorf("%s", err)
+		}
+	}
+	if err = ensureOrganizations(); err != nil {
+		t.Errorf("%s", err)
+	}
 }
 
 func setupUser(t *testing.T) user {
@@ -30,3 +65,27 @@ func setupUser(t *testing.T) user {
 	}
 	return u
 }
+
+// setupUsers inserts n generated users, the same ones in every run.
+func setupUsers(t *testing.T, n int) {
+	if err := seedUsers(defaultOrganization.ID, factory.New(1), n); err != nil {
+		t.Fatal("Unable to create users: ", err)
+	}
+}
+
+// newTestServer serves the router behind the credentials, the tenant
+// resolution and the contract validation, so the handler tests also check
+// the responses against the OpenAPI document.
+func newTestServer() *httptest.Server {
+	n := negroni.New()
+	n.UseFunc(authMiddleware)
+	n.UseFunc(tenantMiddleware)
+	n.UseHandler(withContract(router))
+	return httptest.NewServer(n)
+}
+
+func withContract(h http.Handler) http.Handler {
+	n := negroni.New(newContractValidator(openAPISpec(), contractStrict))
+	n.UseHandler(h)
+	return n
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// streamBacklog is the number of missed events sent to a resumed
+	// stream, older ones are left out after a "reset" event.
+	streamBacklog = 1000
+	// streamBuffer is the number of events a slow client can lag behind
+	// before it is disconnected. It resumes from the bus when it
+	// reconnects.
+	streamBuffer = 64
+)
+
+// streamHeartbeat is the interval of the comments keeping idle streams open.
+var streamHeartbeat = 15 * time.Second
+
+// streamEvent is a user event as sent on the streams. ID is its position
+// in the event bus.
+type streamEvent struct {
+	ID             int64
+	Type           string
+	UserID         bson.ObjectId
+	OrganizationID bson.ObjectId
+	Data           []byte
+}
+
+func newStreamEvent(seq int64, e userEvent) (streamEvent, error) {
+	data, err := json.Marshal(e.User)
+	return streamEvent{ID: seq, Type: e.Type, UserID: e.User.ID, OrganizationID: e.User.OrganizationID, Data: data}, err
+}
+
+// userStream fans out the user events of the bus to the connected streams.
+type userStream struct {
+	sync.Mutex
+	subscribers map[chan streamEvent]bool
+}
+
+var usersStream = &userStream{subscribers: make(map[chan streamEvent]bool)}
+
+func init() {
+	onClusterUserEvent(usersStream.publish)
+
+	documentOperations(&openAPIOperation{
+		Method:      "GET",
+		Path:        "/api/users/stream",
+		OperationID: "streamUsers",
+		Summary:     "Streams the changes of users as server-sent events.",
+		Description: "Send the last event id back in the Last-Event-ID header to resume a stream.",
+		Tags:        []string{"users"},
+		Parameters: []*openAPIParameter{
+			queryParam("types", "Comma separated event types, all by default", &openAPISchema{Type: "string"}),
+			queryParam("user_id", "Only the events of this user", objectIDSchema),
+			queryParam("last_event_id", "Same as the Last-Event-ID header", &openAPISchema{Type: "integer"}),
+			{Name: "Last-Event-ID", In: "header", Description: "ID of the last event received", Schema: &openAPISchema{Type: "integer"}},
+		},
+		Responses: adminOnly(map[string]*openAPIResponse{
+			"200": {
+				Description: "The events, sent until the client disconnects.",
+				Content:     map[string]*openAPIMediaType{"text/event-stream": {Schema: &openAPISchema{Type: "string"}}},
+			},
+		}),
+	})
+}
+
+func (s *userStream) publish(seq int64, e userEvent) {
+	se, err := newStreamEvent(seq, e)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- se:
+		default:
+			// too slow, the client has to reconnect
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel receiving the next events.
+func (s *userStream) subscribe() chan streamEvent {
+	s.Lock()
+	defer s.Unlock()
+	ch := make(chan streamEvent, streamBuffer)
+	s.subscribers[ch] = true
+	return ch
+}
+
+func (s *userStream) unsubscribe(ch chan streamEvent) {
+	s.Lock()
+	defer s.Unlock()
+	if s.subscribers[ch] {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+// streamFilter selects the events sent on a stream, which only get the
+// events of their organization.
+type streamFilter struct {
+	organizationID bson.ObjectId
+	types          map[string]bool
+	userID         string
+}
+
+func (f streamFilter) match(se streamEvent) bool {
+	if se.OrganizationID != f.organizationID {
+		return false
+	}
+	if len(f.types) > 0 && !f.types[se.Type] {
+		return false
+	}
+	return f.userID == "" || f.userID == se.UserID.Hex()
+}
+
+// usersStreamHandler streams the changes of users as server-sent events.
+// The id of every event can be sent back in the "Last-Event-ID" header to
+// resume a stream on any instance, a "reset" event is sent first when some
+// events after it were lost.
+// URL: GET /api/users/stream
+// HEADERS:
+//	"Accept": "text/event-stream"
+//	"Last-Event-ID": ID of the last event received
+// PARAMETERS:
+//	"types": Comma separated event types, all by default
+//	"user_id": Only the events of this user
+//	"last_event_id": Same as the "Last-Event-ID" header
+func usersStreamHandler(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	filter := streamFilter{organizationID: requestOrganization(req).ID, userID: req.URL.Query().Get("user_id")}
+	if types := req.URL.Query().Get("types"); types != "" {
+		filter.types = make(map[string]bool)
+		for _, t := range strings.Split(types, ",") {
+			filter.types[strings.TrimSpace(t)] = true
+		}
+	}
+	lastEventID := req.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = req.URL.Query().Get("last_event_id")
+	}
+	lastID, _ := strconv.ParseInt(lastEventID, 10, 64)
+
+	// subscribe before reading the missed events so none falls in between,
+	// the ones received twice are skipped.
+	ch := usersStream.subscribe()
+	defer usersStream.unsubscribe(ch)
+
+	complete := true
+	var backlog []busEvent
+	if lastID > 0 {
+		var err error
+		backlog, complete, err = userEventBus.since(lastID, streamBacklog)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if len(backlog) == streamBacklog {
+			complete = false
+			backlog = backlog[:0]
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// ask proxies not to buffer the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, be := range backlog {
+		se, err := newStreamEvent(be.Seq, be.Event)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		writeStreamEvent(w, filter, se)
+		lastID = se.ID
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case se, open := <-ch:
+			if !open {
+				return
+			}
+			if se.ID <= lastID {
+				continue
+			}
+			lastID = se.ID
+			if writeStreamEvent(w, filter, se) {
+				flusher.Flush()
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// writeStreamEvent writes se if it matches the filter.
+func writeStreamEvent(w http.ResponseWriter, filter streamFilter, se streamEvent) bool {
+	if !filter.match(se) {
+		return false
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", se.ID, se.Type, se.Data)
+	return true
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readStreamEvent reads the next event of a stream, skipping comments.
+func readStreamEvent(t *testing.T, r *bufio.Reader) (id, event, data string) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return
+		case strings.HasPrefix(line, "id: "):
+			id = line[len("id: "):]
+		case strings.HasPrefix(line, "event: "):
+			event = line[len("event: "):]
+		case strings.HasPrefix(line, "data: "):
+			data = line[len("data: "):]
+		}
+	}
+}
+
+func openStream(t *testing.T, url, lastEventID string) *http.Response {
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, err := http.NewRequest("GET", url, nil)
+	req.Header.Add("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Add("Last-Event-ID", lastEventID)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected Content-Type to be %s, but got %s", "text/event-stream", ct)
+	}
+	return resp
+}
+
+func TestUsersStreamHandler(t *testing.T) {
+	ts := adminServer()
+	defer ts.Close()
+
+	resp := openStream(t, ts.URL+"/api/users/stream?types=user.updated,user.deleted", "")
+	defer resp.Body.Close()
+
+	u := setupUser(t)
+	userChanged(&http.Request{}, auditCreate, nil, &u)
+	userChanged(&http.Request{}, auditDelete, &u, nil)
+
+	r := bufio.NewReader(resp.Body)
+	_, event, data := readStreamEvent(t, r)
+	if event != userDeleted {
+		t.Errorf("expected event to be %s, but got %s", userDeleted, event)
+	}
+	var streamed user
+	if err := json.Unmarshal([]byte(data), &streamed); err != nil {
+		t.Fatal(err)
+	}
+	if streamed.ID != u.ID {
+		t.Errorf("expected user %s, but got %s", u.ID.Hex(), streamed.ID.Hex())
+	}
+	dropAllCollections(t)
+}
+
+func TestUsersStreamHandlerResume(t *testing.T) {
+	ts := adminServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	userChanged(&http.Request{}, auditCreate, nil, &u)
+	lastID, err := userEventBus.head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userChanged(&http.Request{}, auditUpdate, &u, &u)
+	userChanged(&http.Request{}, auditDelete, &u, nil)
+
+	resp := openStream(t, ts.URL+"/api/users/stream", strconv.FormatInt(lastID, 10))
+	defer resp.Body.Close()
+
+	r := bufio.NewReader(resp.Body)
+	for i, expected := range []string{userUpdated, userDeleted} {
+		id, event, _ := readStreamEvent(t, r)
+		if event != expected {
+			t.Errorf("expected event to be %s, but got %s", expected, event)
+		}
+		if id != strconv.FormatInt(lastID+int64(i)+1, 10) {
+			t.Errorf("expected id %d, but got %s", lastID+int64(i)+1, id)
+		}
+	}
+	dropAllCollections(t)
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The codes are the ones of RFC 6238 with its defaults, which the
+// authenticator apps expect.
+const (
+	totpDigits      = 6
+	totpPeriod      = 30
+	totpSecretBytes = 20
+	// totpSkew is the number of periods a code is still valid after, or
+	// already valid before, its own, for the clocks of the phones.
+	totpSkew = 1
+	// totpIssuer names the API in the authenticator apps.
+	totpIssuer = "golang-demo-api"
+
+	recoveryCodes = 10
+)
+
+// totpEnrollment is what the apps need to generate the codes of a user.
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type totpParams struct {
+	Password string `json:"password,omitempty"`
+	// Code is a code of the app, or a recovery code when disabling.
+	Code string `json:"code,omitempty"`
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func init() {
+	router.Path("/api/users/{id}/totp").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("POST").
+		HandlerFunc(requireSelfOrAdmin(enrollTOTPHandler))
+	router.Path("/api/users/{id}/totp").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("DELETE").
+		HandlerFunc(requireSelfOrAdmin(disableTOTPHandler))
+	router.Path("/api/users/{id}/totp/verify").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("POST").
+		HandlerFunc(requireSelfOrAdmin(verifyTOTPHandler))
+
+	totpBody := jsonBody(struct {
+		TOTP totpParams `json:"totp"`
+	}{})
+	userID := pathParam("id", "ID of the user")
+	documentOperations(
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/users/{id}/totp",
+			OperationID: "enrollTOTP",
+			Summary:     "Starts the two-factor authentication of a user with its password, and returns the secret of the codes.",
+			Tags:        []string{"login"},
+			Parameters:  []*openAPIParameter{userID},
+			RequestBody: totpBody,
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422)),
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/users/{id}/totp/verify",
+			OperationID: "verifyTOTP",
+			Summary:     "Enables the two-factor authentication with a first code, and returns the recovery codes.",
+			Tags:        []string{"login"},
+			Parameters:  []*openAPIParameter{userID},
+			RequestBody: totpBody,
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422)),
+		},
+		&openAPIOperation{
+			Method:      "DELETE",
+			Path:        "/api/users/{id}/totp",
+			OperationID: "disableTOTP",
+			Summary:     "Disables the two-factor authentication with the password and a code.",
+			Tags:        []string{"login"},
+			Parameters:  []*openAPIParameter{userID},
+			RequestBody: totpBody,
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422)),
+		},
+	)
+}
+
+// totpCode returns the code of the secret for the counter (RFC 4226).
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000)
+}
+
+// totpCounter returns the counter of the period of t.
+func totpCounter(t time.Time) uint64 {
+	return uint64(t.Unix() / totpPeriod)
+}
+
+// checkTOTP returns the counter of code when it is a code of the secret
+// at now, within the skew, and after the counter last.
+func checkTOTP(secret []byte, code string, now time.Time, last uint64) (uint64, bool) {
+	c := totpCounter(now)
+	for i := c - totpSkew; i <= c+totpSkew; i++ {
+		if i <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, i)), []byte(code)) == 1 {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI returns the otpauth URI of the secret, as read by the
+// authenticator apps from a QR code.
+func totpURI(account string, secret []byte) string {
+	v := url.Values{}
+	v.Set("secret", totpEncoding.EncodeToString(secret))
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+// totpKey returns the key the secrets are encrypted with, the 32 bytes
+// encoded in base64 in TOTP_KEY, which the API doesn't start without. Only
+// the tests use a key derived from the environment when none is set, a
+// key anyone can derive from the source.
+func totpKey() ([]byte, error) {
+	if s := os.Getenv("TOTP_KEY"); s != "" {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("TOTP_KEY must be 32 bytes in base64")
+		}
+		return key, nil
+	}
+	if config.env != "test" {
+		return nil, errors.New("TOTP_KEY is required")
+	}
+	key := sha256.Sum256([]byte(totpIssuer + " " + config.env))
+	return key[:], nil
+}
+
+// encryptSecret encrypts the secret with AES-GCM, the nonce first.
+func encryptSecret(secret []byte) (string, error) {
+	gcm, err := totpCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, secret, nil)), nil
+}
+
+func decryptSecret(s string) ([]byte, error) {
+	gcm, err := totpCipher()
+	if err != nil {
+		return nil, err
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) < gcm.NonceSize() {
+		return nil, errors.New("invalid encrypted secret")
+	}
+	return gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+}
+
+func totpCipher() (cipher.AEAD, error) {
+	key, err := totpKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newRecoveryCodes returns recovery codes like "3f9a-c07e-51bd" and their
+// digests.
+func newRecoveryCodes() (codes, digests []string, err error) {
+	for i := 0; i < recoveryCodes; i++ {
+		token, err := randomToken(6)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := token[0:4] + "-" + token[4:8] + "-" + token[8:12]
+		digest, err := bcrypt.GenerateFromPassword([]byte(code), 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		digests = append(digests, string(digest))
+	}
+	return codes, digests, nil
+}
+
+// checkSecondFactor tells whether code is a code of the app or a recovery
+// code of the user. The codes used can't be used again.
+func (u *user) checkSecondFactor(code string, now time.Time) (bool, error) {
+	code = strings.TrimSpace(code)
+	secret, err := decryptSecret(u.TOTPSecret)
+	if err != nil {
+		return false, err
+	}
+	if counter, ok := checkTOTP(secret, code, now, uint64(u.TOTPLastCounter)); ok {
+		// only the first request using the code saves the counter
+		err = config.usersCollection.Update(
+			bson.M{"_id": u.ID, "totp_last_counter": bson.M{"$not": bson.M{"$gte": int64(counter)}}},
+			bson.M{"$set": bson.M{"totp_last_counter": int64(counter)}},
+		)
+		if err != nil {
+			return false, nil
+		}
+		u.TOTPLastCounter = int64(counter)
+		return true, nil
+	}
+
+	code = strings.ToLower(code)
+	for _, digest := range u.RecoveryCodeDigests {
+		if bcrypt.CompareHashAndPassword([]byte(digest), []byte(code)) == nil {
+			err = config.usersCollection.Update(
+				bson.M{"_id": u.ID, "recovery_code_digests": digest},
+				bson.M{"$pull": bson.M{"recovery_code_digests": digest}},
+			)
+			if err != nil {
+				return false, nil
+			}
+			for i, d := range u.RecoveryCodeDigests {
+				if d == digest {
+					u.RecoveryCodeDigests = append(u.RecoveryCodeDigests[:i], u.RecoveryCodeDigests[i+1:]...)
+					break
+				}
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// requiresTOTP tells whether the organization of the user makes its role
+// use two-factor authentication.
+func (u *user) requiresTOTP() (bool, error) {
+	var o organization
+	if err := config.organizationsCollection.FindId(u.OrganizationID).One(&o); err != nil {
+		return false, err
+	}
+	for _, role := range o.MFARoles {
+		if role == u.Role {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// passwordMatches tells whether password is the one of the user.
+func (u *user) passwordMatches(password string) bool {
+	return u.PasswordDigest != "" && bcrypt.CompareHashAndPassword([]byte(u.PasswordDigest), []byte(password)) == nil
+}
+
+func decodeTOTPParams(req *http.Request) (totpParams, error) {
+	var params struct {
+		TOTP totpParams `json:"totp"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&params)
+	return params.TOTP, err
+}
+
+// enrollTOTPHandler creates the secret of the codes of a user, who must
+// confirm with a first code to enable them. Starting again replaces the
+// secret until then.
+// URL: POST /api/users/:id/totp
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the user
+// BODY:
+//	totp[password]: Password of the user. (required)
+// EXAMPLE:
+//	{
+//		"totp": {
+//			"password": "test123#"
+//		}
+//	}
+func enrollTOTPHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	params, err := decodeTOTPParams(req)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	u, err := loadUser(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "User not found."})
+		return
+	}
+
+	errs := make(ModelErrors)
+	if !u.passwordMatches(params.Password) {
+		errs["password"] = append(errs["password"], "is invalid")
+	} else if u.TOTPEnabled {
+		errs["totp"] = append(errs["totp"], "is already enabled")
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(422)
+		encoder.Encode(response{
+			Message: "Unable to enable two-factor authentication.",
+			data:    &data{Errors: errs},
+		})
+		return
+	}
+
+	secret := make([]byte, totpSecretBytes)
+	if _, err = rand.Read(secret); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	encrypted, err := encryptSecret(secret)
+	if err == nil {
+		err = config.usersCollection.UpdateId(u.ID, bson.M{"$set": bson.M{"totp_secret": encrypted}})
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	enrollment := &totpEnrollment{
+		Secret: totpEncoding.EncodeToString(secret),
+		URI:    totpURI(u.Email, secret),
+	}
+	w.WriteHeader(http.StatusOK)
+	if err = encoder.Encode(response{
+		Message: "Scan the code with an authenticator app, and verify a first code.",
+		data:    &data{TOTP: enrollment},
+	}); err != nil {
+		log.Println(err)
+	}
+}
+
+// verifyTOTPHandler enables the codes of a user with a first code, and
+// returns the recovery codes. They are only ever shown here.
+// URL: POST /api/users/:id/totp/verify
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the user
+// BODY:
+//	totp[code]: Code of the authenticator app. (required)
+func verifyTOTPHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	params, err := decodeTOTPParams(req)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	u, err := loadUser(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "User not found."})
+		return
+	}
+
+	errs := make(ModelErrors)
+	if u.TOTPEnabled {
+		errs["totp"] = append(errs["totp"], "is already enabled")
+	} else if u.TOTPSecret == "" {
+		errs["totp"] = append(errs["totp"], "must be enrolled first")
+	} else if secret, err := decryptSecret(u.TOTPSecret); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if counter, ok := checkTOTP(secret, strings.TrimSpace(params.Code), bson.Now(), 0); !ok {
+		errs["code"] = append(errs["code"], "is invalid")
+	} else {
+		u.TOTPLastCounter = int64(counter)
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(422)
+		encoder.Encode(response{
+			Message: "Unable to enable two-factor authentication.",
+			data:    &data{Errors: errs},
+		})
+		return
+	}
+
+	codes, digests, err := newRecoveryCodes()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	before := *u
+	u.TOTPEnabled, u.RecoveryCodeDigests = true, digests
+	err = config.usersCollection.UpdateId(u.ID, bson.M{"$set": bson.M{
+		"totp_enabled":          true,
+		"totp_last_counter":     u.TOTPLastCounter,
+		"recovery_code_digests": digests,
+	}})
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userChanged(req, auditUpdate, &before, u)
+
+	w.WriteHeader(http.StatusOK)
+	if err = encoder.Encode(response{
+		Message: "Two-factor authentication enabled. Keep the recovery codes, they won't be shown again.",
+		data:    &data{RecoveryCodes: codes},
+	}); err != nil {
+		log.Println(err)
+	}
+}
+
+// disableTOTPHandler disables the codes of a user.
+// URL: DELETE /api/users/:id/totp
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the user
+// BODY:
+//	totp[password]: Password of the user. (required)
+//	totp[code]: Code of the authenticator app, or a recovery code. (required)
+func disableTOTPHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+
+	params, err := decodeTOTPParams(req)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	u, err := loadUser(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		encoder.Encode(response{Message: "User not found."})
+		return
+	}
+
+	errs := make(ModelErrors)
+	if !u.TOTPEnabled {
+		errs["totp"] = append(errs["totp"], "is not enabled")
+	} else if !u.passwordMatches(params.Password) {
+		errs["password"] = append(errs["password"], "is invalid")
+	} else if ok, err := u.checkSecondFactor(params.Code, bson.Now()); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if !ok {
+		errs["code"] = append(errs["code"], "is invalid")
+	}
+	if len(errs) > 0 {
+		w.WriteHeader(422)
+		encoder.Encode(response{
+			Message: "Unable to disable two-factor authentication.",
+			data:    &data{Errors: errs},
+		})
+		return
+	}
+
+	before := *u
+	u.TOTPEnabled, u.TOTPSecret, u.TOTPLastCounter, u.RecoveryCodeDigests = false, "", 0, nil
+	err = config.usersCollection.UpdateId(u.ID, bson.M{"$unset": bson.M{
+		"totp_enabled":          "",
+		"totp_secret":           "",
+		"totp_last_counter":     "",
+		"recovery_code_digests": "",
+	}})
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userChanged(req, auditUpdate, &before, u)
+
+	w.WriteHeader(http.StatusOK)
+	if err = encoder.Encode(response{Message: "Two-factor authentication disabled."}); err != nil {
+		log.Println(err)
+	}
+}
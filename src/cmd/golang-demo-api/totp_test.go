@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// the SHA1 vectors of RFC 6238, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	cases := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, expected := range cases {
+		if actual := totpCode(secret, totpCounter(time.Unix(unix, 0))); actual != expected {
+			t.Errorf("%d: expected %s, but got %s", unix, expected, actual)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	c := totpCounter(now)
+
+	for _, counter := range []uint64{c - 1, c, c + 1} {
+		if actual, ok := checkTOTP(secret, totpCode(secret, counter), now, 0); !ok || actual != counter {
+			t.Errorf("expected the code of %d to be valid, but got %d %v", counter, actual, ok)
+		}
+	}
+	if _, ok := checkTOTP(secret, totpCode(secret, c-2), now, 0); ok {
+		t.Errorf("expected an old code to be refused")
+	}
+	// codes can't be used twice
+	if _, ok := checkTOTP(secret, totpCode(secret, c), now, c); ok {
+		t.Errorf("expected a used code to be refused")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(totpURI("test@sample.com", []byte("12345678901234567890")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/"+totpIssuer+":test@sample.com" {
+		t.Errorf("expected the account of the issuer, but got %s", u)
+	}
+	if q.Get("secret") != "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" || q.Get("issuer") != totpIssuer || q.Get("digits") != "6" {
+		t.Errorf("expected the parameters of the codes, but got %v", q)
+	}
+}
+
+func TestTOTPKey(t *testing.T) {
+	env, key := config.env, os.Getenv("TOTP_KEY")
+	defer func() {
+		config.env = env
+		os.Setenv("TOTP_KEY", key)
+	}()
+
+	os.Unsetenv("TOTP_KEY")
+	for _, env := range []string{"development", "production"} {
+		config.env = env
+		if _, err := totpKey(); err == nil {
+			t.Errorf("%s: expected TOTP_KEY to be required", env)
+		}
+	}
+	os.Setenv("TOTP_KEY", "c2hvcnQ=")
+	if _, err := totpKey(); err == nil {
+		t.Errorf("expected a short key to be refused")
+	}
+	os.Setenv("TOTP_KEY", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if k, err := totpKey(); err != nil || string(k) != "0123456789abcdef0123456789abcdef" {
+		t.Errorf("expected the key of TOTP_KEY, but got %q %v", k, err)
+	}
+}
+
+func TestEncryptSecret(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	encrypted, err := encryptSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := encryptSecret(secret)
+	if encrypted == again {
+		t.Errorf("expected a new nonce for every encryption")
+	}
+	decrypted, err := decryptSecret(encrypted)
+	if err != nil || string(decrypted) != string(secret) {
+		t.Errorf("expected %s, but got %s %v", secret, decrypted, err)
+	}
+	if _, err = decryptSecret(encrypted[:len(encrypted)-4] + "AAAA"); err == nil {
+		t.Errorf("expected a changed secret to be refused")
+	}
+}
+
+func TestTOTPLogin(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	self := actorServer(actor{Type: actorUser, ID: u.ID.Hex(), OrganizationID: defaultOrganization.ID})
+	defer self.Close()
+	url := self.URL + "/api/users/" + u.ID.Hex() + "/totp"
+	login := func() (int, response) {
+		return doOrganizationRequest(t, "POST", ts.URL+"/api/login", `{"login":{"username":"test_user","password":"test123#"}}`)
+	}
+	loginTOTP := func(token, code string) (int, response) {
+		return doOrganizationRequest(t, "POST", ts.URL+"/api/login/totp", `{"login":{"mfa_token":"`+token+`","code":"`+code+`"}}`)
+	}
+
+	status, r := doOrganizationRequest(t, "POST", url, `{"totp":{"password":"wrong"}}`)
+	if status != 422 || len(r.Errors["password"]) == 0 {
+		t.Errorf("expected the password to be refused, but got %d %v", status, r.Errors)
+	}
+	status, r = doOrganizationRequest(t, "POST", url, `{"totp":{"password":"test123#"}}`)
+	if status != http.StatusOK || r.TOTP == nil {
+		t.Fatalf("expected the secret, but got %d %s %v", status, r.Message, r.Errors)
+	}
+	secret, err := totpEncoding.DecodeString(r.TOTP.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the codes are only asked once verified
+	if status, r = login(); status != http.StatusOK || r.MFAToken != "" {
+		t.Errorf("expected to log in without a code, but got %d %q", status, r.MFAToken)
+	}
+	now := time.Now()
+	status, r = doOrganizationRequest(t, "POST", url+"/verify", `{"totp":{"code":"`+totpCode(secret, totpCounter(now)-1)+`"}}`)
+	if status != http.StatusOK || len(r.RecoveryCodes) != recoveryCodes {
+		t.Fatalf("expected the recovery codes, but got %d %s %v", status, r.Message, r.Errors)
+	}
+	recovery := r.RecoveryCodes
+
+	status, r = login()
+	if status != http.StatusOK || r.MFAToken == "" || r.User != nil {
+		t.Fatalf("expected a code to be required, but got %d %+v", status, r.data)
+	}
+	token := r.MFAToken
+	if status, _ = loginTOTP(token, "000000"); status != http.StatusUnauthorized {
+		t.Errorf("expected %d, but got %d", http.StatusUnauthorized, status)
+	}
+	// the code used to verify can't be used again
+	if status, _ = loginTOTP(token, totpCode(secret, totpCounter(now)-1)); status != http.StatusUnauthorized {
+		t.Errorf("expected %d, but got %d", http.StatusUnauthorized, status)
+	}
+	status, r = loginTOTP(token, totpCode(secret, totpCounter(now)))
+	if status != http.StatusOK || r.User == nil || r.User.ID != u.ID {
+		t.Errorf("expected to log in, but got %d %s", status, r.Message)
+	}
+	if status, _ = loginTOTP(token, totpCode(secret, totpCounter(now)+1)); status != http.StatusUnauthorized {
+		t.Errorf("expected the token to be used, but got %d", status)
+	}
+
+	// recovery codes are used once
+	_, r = login()
+	if status, _ = loginTOTP(r.MFAToken, recovery[0]); status != http.StatusOK {
+		t.Errorf("expected to log in with a recovery code, but got %d", status)
+	}
+	_, r = login()
+	if status, _ = loginTOTP(r.MFAToken, recovery[0]); status != http.StatusUnauthorized {
+		t.Errorf("expected the recovery code to be used, but got %d", status)
+	}
+
+	status, r = doOrganizationRequest(t, "DELETE", url, `{"totp":{"password":"test123#","code":"`+recovery[1]+`"}}`)
+	if status != http.StatusOK {
+		t.Errorf("expected %d, but got %d %v", http.StatusOK, status, r.Errors)
+	}
+	if status, r = login(); status != http.StatusOK || r.User == nil {
+		t.Errorf("expected to log in without a code, but got %d", status)
+	}
+
+	dropAllCollections(t)
+}
+
+func TestTOTPRequiredByRole(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	config.usersCollection.UpdateId(u.ID, bson.M{"$set": bson.M{"role": roleAdmin}})
+	status, _ := doOrganizationRequest(t, "POST", ts.URL+"/api/login", `{"login":{"username":"test_user","password":"test123#"}}`)
+	if status != http.StatusForbidden {
+		t.Errorf("expected admins to need two-factor authentication, but got %d", status)
+	}
+
+	config.organizationsCollection.UpdateId(defaultOrganization.ID, bson.M{"$set": bson.M{"mfa_roles": []string{}}})
+	status, _ = doOrganizationRequest(t, "POST", ts.URL+"/api/login", `{"login":{"username":"test_user","password":"test123#"}}`)
+	if status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+
+	dropAllCollections(t)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"log"
 	"time"
@@ -21,7 +22,24 @@ type user struct {
 	PasswordDigest       string        `bson:"password_digest,omitempty" json:"-"`
 	CreatedAt            time.Time     `bson:"created_at,omitempty" json:"created_at,omitempty"`
 	UpdatedAt            time.Time     `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
-	Errors               ModelErrors   `bson:"-" json:"errors,omitempty"`
+	Role                 string        `bson:"role,omitempty" json:"role,omitempty"`
+	Invited              bool          `bson:"invited,omitempty" json:"invited,omitempty"`
+	OrganizationID       bson.ObjectId `bson:"organization_id,omitempty" json:"organization_id,omitempty"`
+	// FailedLogins are the failed logins in a row, which lock the user
+	// until LockedUntil.
+	FailedLogins      int       `bson:"failed_logins,omitempty" json:"-"`
+	LastFailedLoginAt time.Time `bson:"last_failed_login_at,omitempty" json:"-"`
+	LockedUntil       time.Time `bson:"locked_until,omitempty" json:"-"`
+	// TOTPSecret is the encrypted secret of the two-factor codes, which
+	// are asked at login once TOTPEnabled.
+	TOTPSecret          string      `bson:"totp_secret,omitempty" json:"-"`
+	TOTPEnabled         bool        `bson:"totp_enabled,omitempty" json:"totp_enabled,omitempty"`
+	TOTPLastCounter     int64       `bson:"totp_last_counter,omitempty" json:"-"`
+	RecoveryCodeDigests []string    `bson:"recovery_code_digests,omitempty" json:"-"`
+	Errors              ModelErrors `bson:"-" json:"errors,omitempty"`
+
+	// fields are the only fields written to JSON, all of them when nil.
+	fields []string
 }
 
 type newUser struct {
@@ -31,10 +49,33 @@ type newUser struct {
 	Mobile               *string `bson:"mobile,omitempty" json:"mobile,omitempty"`
 	Password             *string `bson:"-" json:"password,omitempty"`
 	PasswordConfirmation *string `bson:"-" json:"password_confirmation,omitempty"`
+	// CurrentPassword is asked to the users changing their own password.
+	CurrentPassword *string `bson:"-" json:"current_password,omitempty"`
+}
+
+// MarshalJSON writes the fields of the user, only the selected ones when
+// it was loaded with selectFields.
+func (u user) MarshalJSON() ([]byte, error) {
+	type plainUser user
+	b, err := json.Marshal(plainUser(u))
+	if err != nil || u.fields == nil {
+		return b, err
+	}
+	return onlyFields(b, u.fields)
+}
+
+// selectFields limits the JSON of the users to the fields.
+func (users Users) selectFields(fields []string) {
+	for i := range users {
+		users[i].fields = fields
+	}
 }
 
 func (u *user) Create() error {
 	u.ID = bson.NewObjectId()
+	if u.OrganizationID == "" {
+		u.OrganizationID = defaultOrganization.ID
+	}
 
 	err := u.generatePasswordDigest()
 	if err != nil {
@@ -46,6 +87,9 @@ func (u *user) Create() error {
 		return errors.New("User Invalid")
 	}
 	// after validation callback
+	if err = u.checkQuota(); err != nil {
+		return err
+	}
 
 	// Update Timestamps
 	u.CreatedAt = u.ID.Time()
@@ -64,6 +108,9 @@ func (u *user) Update(nu newUser) error {
 		err := u.generatePasswordDigest()
 		if err != nil {
 			log.Println(err)
+		} else {
+			// invited users accept the invitation by setting a password
+			u.Invited = false
 		}
 	}
 
@@ -77,12 +124,68 @@ func (u *user) Update(nu newUser) error {
 	u.UpdatedAt = bson.Now()
 
 	// before update callback
-	err := config.usersCollection.UpdateId(u.ID, u)
+	// only the fields of an update are written, so the failed logins and
+	// two-factor counters saved meanwhile by logins are kept
+	set, unset := bson.M{"updated_at": u.UpdatedAt}, bson.M{}
+	fields := map[string]string{"name": u.Name, "username": u.Username, "email": u.Email, "mobile": u.Mobile, "role": u.Role}
+	for field, value := range fields {
+		if value == "" {
+			unset[field] = ""
+		} else {
+			set[field] = value
+		}
+	}
+	if nu.Password != nil || nu.PasswordConfirmation != nil {
+		set["password_digest"] = u.PasswordDigest
+		unset["invited"] = ""
+	}
+	change := bson.M{"$set": set}
+	if len(unset) > 0 {
+		change["$unset"] = unset
+	}
+	err := config.usersCollection.UpdateId(u.ID, change)
 	// after update callback
+	if err == nil && nu.Password != nil {
+		// a new password logs the user out of every device and client
+		if _, err = revokeSessions(u.ID, ""); err == nil {
+			err = revokeUserTokens(u.ID)
+		}
+	}
 	return err
 }
 
 func (u *user) Valid() bool {
+	return u.validate(u.takenInCollection)
+}
+
+// takenInCollection reports whether another user of the organization
+// has the same value for field.
+func (u *user) takenInCollection(field, value string) bool {
+	n, _ := config.usersCollection.Find(bson.M{
+		"_id":             bson.M{"$ne": u.ID},
+		"organization_id": u.OrganizationID,
+		field:             value,
+	}).Count()
+	return n > 0
+}
+
+// checkQuota adds an error to u.Errors when the organization of the user
+// can't have more users.
+func (u *user) checkQuota() error {
+	left, err := usersLeft(u.OrganizationID)
+	if err != nil {
+		return err
+	}
+	if left == 0 {
+		u.Errors["organization"] = append(u.Errors["organization"], errQuotaReached)
+		return errors.New("User quota reached")
+	}
+	return nil
+}
+
+// validate checks the fields of the user, using taken to check the
+// uniqueness of username and email, and stores the errors in u.Errors.
+func (u *user) validate(taken func(field, value string) bool) bool {
 	var userErrors ModelErrors
 	if u.Errors != nil {
 		userErrors = u.Errors
@@ -90,25 +193,19 @@ func (u *user) Valid() bool {
 		userErrors = make(ModelErrors)
 	}
 	// Name, Username and Email are required fields
-	// Username and Email must be unique in users collection
+	// Username and Email must be unique in the organization
 	if u.Name == "" {
 		userErrors["name"] = append(userErrors["name"], "can't be blank")
 	}
 	if u.Username == "" {
 		userErrors["username"] = append(userErrors["username"], "can't be blank")
-	} else {
-		n, _ := config.usersCollection.Find(bson.M{"_id": bson.M{"$ne": u.ID}, "username": u.Username}).Count()
-		if n > 0 {
-			userErrors["username"] = append(userErrors["username"], "is already taken")
-		}
+	} else if taken("username", u.Username) {
+		userErrors["username"] = append(userErrors["username"], "is already taken")
 	}
 	if u.Email == "" {
 		userErrors["email"] = append(userErrors["email"], "can't be blank")
-	} else {
-		n, _ := config.usersCollection.Find(bson.M{"_id": bson.M{"$ne": u.ID}, "email": u.Email}).Count()
-		if n > 0 {
-			userErrors["email"] = append(userErrors["email"], "is already taken")
-		}
+	} else if taken("email", u.Email) {
+		userErrors["email"] = append(userErrors["email"], "is already taken")
 	}
 
 	u.Errors = userErrors
@@ -144,7 +241,30 @@ func (u *user) copyFields(nu newUser) {
 	}
 }
 
+// withoutSecrets returns a copy of the user without its password, its
+// two-factor secrets and its failed logins.
+func (u *user) withoutSecrets() *user {
+	c := *u
+	c.Password, c.PasswordConfirmation, c.PasswordDigest = "", "", ""
+	c.FailedLogins, c.LastFailedLoginAt, c.LockedUntil = 0, time.Time{}, time.Time{}
+	c.TOTPSecret, c.TOTPLastCounter, c.RecoveryCodeDigests = "", 0, nil
+	c.Errors, c.fields = nil, nil
+	return &c
+}
+
 func (u *user) generatePasswordDigest() (err error) {
+	if err = u.checkPassword(); err != nil {
+		return
+	}
+	digest, err := bcrypt.GenerateFromPassword([]byte(u.Password), 0)
+	if err == nil {
+		u.PasswordDigest = string(digest)
+	}
+	return
+}
+
+// checkPassword adds the errors of the password fields to u.Errors.
+func (u *user) checkPassword() (err error) {
 	if u.Errors == nil {
 		u.Errors = make(ModelErrors)
 	}
@@ -154,11 +274,6 @@ func (u *user) generatePasswordDigest() (err error) {
 	} else if u.Password != u.PasswordConfirmation {
 		u.Errors["password_confirmation"] = append(u.Errors["password_confirmation"], "Password and Password Confirmation do not match")
 		err = errors.New("Password and Password Confirmation do not match")
-	} else {
-		digest, err := bcrypt.GenerateFromPassword([]byte(u.Password), 0)
-		if err == nil {
-			u.PasswordDigest = string(digest)
-		}
 	}
 	return
 }
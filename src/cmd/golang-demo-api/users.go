@@ -16,41 +16,143 @@ type Users []user
 
 func init() {
 	usersRouter := router.Path("/api/users").
-		Headers("Content-Type", "application/json", "Accept", "application/vnd.demo_app.v1+json").
+		HeadersRegexp("Content-Type", requestContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
 		Subrouter()
 
-	usersRouter.Methods("GET").HandlerFunc(usersHandler)
-	usersRouter.Methods("POST").HandlerFunc(createUserHandler)
-
-	userRouter := router.PathPrefix("/api/users/{id}").
-		Headers("Content-Type", "application/json", "Accept", "application/vnd.demo_app.v1+json").
+	usersRouter.Methods("GET").Handler(requireScope(scopeUsersRead, usersHandler))
+	usersRouter.Methods("POST").Handler(requireScope(scopeUsersWrite, createUserHandler))
+
+	// must be registered before "/api/users/{id}", which would match them too
+	router.Path("/api/users/export").
+		HeadersRegexp("Accept", exportContentTypes).
+		Methods("GET").
+		Handler(requireScope(scopeUsersRead, exportUsersHandler))
+	router.Path("/api/users/stream").
+		Headers("Accept", "text/event-stream").
+		Methods("GET").
+		Handler(requireScope(scopeUsersRead, requireAdmin(usersStreamHandler)))
+
+	userRouter := router.Path("/api/users/{id}").
+		HeadersRegexp("Content-Type", requestContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
 		Subrouter()
 
-	userRouter.Methods("GET").HandlerFunc(showUserHandler)
-	userRouter.Methods("GET").Path("/edit").HandlerFunc(editUserHandler)
-	userRouter.Methods("PUT", "PATCH").HandlerFunc(updateUserHandler)
-	userRouter.Methods("DELETE").HandlerFunc(deleteUserHandler)
+	userRouter.Methods("GET").Handler(requireScope(scopeUsersRead, showUserHandler))
+	userRouter.Methods("PUT", "PATCH").Handler(requireScope(scopeUsersWrite, requireSelfOrAdmin(updateUserHandler)))
+	userRouter.Methods("DELETE").Handler(requireScope(scopeUsersWrite, requireSelfOrAdmin(deleteUserHandler)))
+
+	router.Path("/api/users/{id}/edit").
+		HeadersRegexp("Content-Type", requestContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("GET").
+		Handler(requireScope(scopeUsersRead, editUserHandler))
+
+	userBody := jsonBody(struct {
+		User newUser `json:"user"`
+	}{})
+	userBody.Content["application/x-www-form-urlencoded"] = &openAPIMediaType{Schema: formSchema("user", newUser{})}
+	userBody.Content["multipart/form-data"] = &openAPIMediaType{Schema: formSchema("user", newUser{})}
+	userID := pathParam("id", "ID of the user")
+
+	documentOperations(
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/users",
+			OperationID: "listUsers",
+			Summary:     "Returns paginated users, newest first.",
+			Tags:        []string{"users"},
+			Parameters:  []*openAPIParameter{pageParam, fieldsParam},
+			Responses:   scoped(envelopeResponses(http.StatusOK, http.StatusBadRequest)),
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/users",
+			OperationID: "createUser",
+			Summary:     "Creates a user.",
+			Tags:        []string{"users"},
+			RequestBody: userBody,
+			Responses:   scoped(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422)),
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/users/{id}",
+			OperationID: "showUser",
+			Summary:     "Returns a user.",
+			Tags:        []string{"users"},
+			Parameters:  []*openAPIParameter{userID, fieldsParam},
+			Responses:   scoped(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422)),
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/users/{id}/edit",
+			OperationID: "editUser",
+			Summary:     "Returns a user to edit.",
+			Tags:        []string{"users"},
+			Parameters:  []*openAPIParameter{userID},
+			Responses:   scoped(envelopeResponses(http.StatusOK, 422)),
+		},
+		&openAPIOperation{
+			Method:      "PUT",
+			Path:        "/api/users/{id}",
+			OperationID: "updateUser",
+			Summary:     "Updates a user, fields left out are unchanged. Only the user and the admins can, users changing their own password give the current one.",
+			Tags:        []string{"users"},
+			Parameters:  []*openAPIParameter{userID},
+			RequestBody: userBody,
+			Responses:   scoped(adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422))),
+		},
+		&openAPIOperation{
+			Method:      "PATCH",
+			Path:        "/api/users/{id}",
+			OperationID: "patchUser",
+			Summary:     "Same as updateUser.",
+			Tags:        []string{"users"},
+			Parameters:  []*openAPIParameter{userID},
+			RequestBody: userBody,
+			Responses:   scoped(adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422))),
+		},
+		&openAPIOperation{
+			Method:      "DELETE",
+			Path:        "/api/users/{id}",
+			OperationID: "deleteUser",
+			Summary:     "Deletes a user. Only the user and the admins can.",
+			Tags:        []string{"users"},
+			Parameters:  []*openAPIParameter{userID},
+			Responses:   scoped(adminOnly(envelopeResponses(http.StatusOK, 422))),
+		},
+	)
 }
 
 // usersHandler returns paginated users in the collection.
 // URL: GET /api/users
 // HEADERS:
 //	"Content-Type": "application/json"
-//	"Accept": "application/vnd.botsworth.v1+json"
+//	"Accept": "application/vnd.demo_app.v1+json"
 // PARAMETERS:
 //	"page": Current page number(per page 20 records)
+//	"fields": Comma separated fields to return, id, name, username, email and created_at by default. The id is always returned
 func usersHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	filter := bson.M{"organization_id": requestOrganization(req).ID}
+	fields, err := parseFields(req.URL.Query(), userFields, defaultUsersFields)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response{Message: err.Error()})
+		return
+	}
+
 	var users Users
 	var offset int
 	page, _ := strconv.Atoi(req.URL.Query().Get("page"))
 	if page != 0 {
 		offset = (page - 1) * perPage
 	}
-	config.usersCollection.Find(bson.M{}).Sort("-created_at").Limit(perPage).Skip(offset).All(&users)
+	config.usersCollection.Find(filter).Select(projection(fields, userFields)).Sort("-created_at").Limit(perPage).Skip(offset).All(&users)
+	users.selectFields(fields)
 
-	totalUsers, err := config.usersCollection.Find(bson.M{}).Count()
+	totalUsers, err := config.usersCollection.Find(filter).Count()
 	if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -79,13 +181,15 @@ func usersHandler(w http.ResponseWriter, req *http.Request) {
 // createUserHandler can be used to add a user.
 // URL: POST /api/users
 // HEADERS:
-//	"Content-Type": "application/json"
-//	"Accept": "application/vnd.botsworth.v1+json"
+//	"Content-Type": "application/json", "application/x-www-form-urlencoded" or "multipart/form-data"
+//	"Accept": "application/vnd.demo_app.v1+json"
 // BODY:
 //	user[name]: Name of the user. (required).
 //	user[username]: Username of the user. (required)
 //	user[email]: Name of the email. (required)
 //	user[mobile]: Mobile number of the user.
+//	user[password]: Password of the user. (required)
+//	user[password_confirmation]: Must match the password. (required)
 // EXAMPLE:
 //	{
 //		"user": {
@@ -95,15 +199,12 @@ func usersHandler(w http.ResponseWriter, req *http.Request) {
 //			"mobile": "9876543210"
 //		}
 //	}
+//	user[name]=Aditya+Shedge&user[username]=aditya&user[email]=test%40sample.com
 func createUserHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	var params struct {
-		User struct{ newUser } `json:"user"`
-	}
-
-	decoder := json.NewDecoder(req.Body)
-	err := decoder.Decode(&params)
+	var nu newUser
+	err := decodeUserParams(req, &nu)
 
 	if err != nil {
 		log.Println(err.Error())
@@ -112,9 +213,8 @@ func createUserHandler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	var resp *response
-	nu := params.User.newUser
 
-	var u = &user{}
+	var u = &user{OrganizationID: requestOrganization(req).ID}
 	u.copyFields(nu)
 	err = u.Create()
 	if err != nil {
@@ -123,12 +223,13 @@ func createUserHandler(w http.ResponseWriter, req *http.Request) {
 			Message: "Unable to save user. Please correct the errors and try again.",
 			data: &data{
 				Errors: u.Errors,
-				user:   nil,
+				User:   nil,
 			},
 		}
 		w.WriteHeader(422)
 	} else {
-		resp = &response{Message: "User successfully created.", data: nil}
+		userChanged(req, auditCreate, nil, u)
+		resp = &response{Message: "User successfully created.", data: &data{User: u}}
 		w.WriteHeader(http.StatusOK)
 	}
 
@@ -146,6 +247,7 @@ func createUserHandler(w http.ResponseWriter, req *http.Request) {
 //	"Authorization": "4g27B3m8ZyFRiN8HHvD1u1500yHF9R6G"
 // PARAMETERS:
 //	"id": ID of the user for which info is to be returned
+//	"fields": Comma separated fields to return, all of them by default. The id is always returned
 func showUserHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -153,13 +255,20 @@ func showUserHandler(w http.ResponseWriter, req *http.Request) {
 	var resp *response
 	encoder := json.NewEncoder(w)
 
-	if u, err := loadUser(vars["id"]); err != nil {
+	fields, err := parseFields(req.URL.Query(), userFields, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(response{Message: err.Error()})
+		return
+	}
+
+	if u, err := loadUserFields(requestOrganization(req).ID, vars["id"], fields); err != nil {
 		log.Println(err)
 
 		resp = &response{Message: "User not found.", data: nil}
 		w.WriteHeader(422)
 	} else {
-		resp = &response{data: &data{user: u}}
+		resp = &response{data: &data{User: u}}
 		w.WriteHeader(http.StatusOK)
 	}
 	if err := encoder.Encode(resp); err != nil {
@@ -172,7 +281,7 @@ func showUserHandler(w http.ResponseWriter, req *http.Request) {
 // URL: GET /api/users/:id/edit
 // HEADERS:
 //	"Content-Type": "application/json"
-//	"Accept": "application/vnd.botsworth.v1+json"
+//	"Accept": "application/vnd.demo_app.v1+json"
 // PARAMETERS:
 //	"id": ID of the user for which info is to be returned
 func editUserHandler(w http.ResponseWriter, req *http.Request) {
@@ -182,13 +291,13 @@ func editUserHandler(w http.ResponseWriter, req *http.Request) {
 	var resp *response
 	encoder := json.NewEncoder(w)
 
-	if u, err := loadUser(vars["id"]); err != nil {
+	if u, err := loadUser(requestOrganization(req).ID, vars["id"]); err != nil {
 		log.Println(err)
 
 		resp = &response{Message: "User not found.", data: nil}
 		w.WriteHeader(422)
 	} else {
-		resp = &response{data: &data{user: u}}
+		resp = &response{data: &data{User: u}}
 		w.WriteHeader(http.StatusOK)
 	}
 	if err := encoder.Encode(resp); err != nil {
@@ -197,16 +306,20 @@ func editUserHandler(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
-// updateUserHandler can be used to update a particular user.
+// updateUserHandler can be used to update a particular user. Only the
+// fields sent are changed, the others are kept.
 // URL: PUT|PATCH /api/users/:id
 // HEADERS:
-//	"Content-Type": "application/json"
-//	"Accept": "application/vnd.botsworth.v1+json"
+//	"Content-Type": "application/json", "application/x-www-form-urlencoded" or "multipart/form-data"
+//	"Accept": "application/vnd.demo_app.v1+json"
 // BODY:
-//	user[name]: Name of the user. (required).
-//	user[username]: Username of the user. (required)
-//	user[email]: Name of the email. (required)
+//	user[name]: Name of the user.
+//	user[username]: Username of the user.
+//	user[email]: Name of the email.
 //	user[mobile]: Mobile number of the user.
+//	user[password]: New password of the user.
+//	user[password_confirmation]: Must match the password, when it is changed.
+//	user[current_password]: Current password, when users change their own.
 // EXAMPLE:
 //	{
 //		"user": {
@@ -216,17 +329,12 @@ func editUserHandler(w http.ResponseWriter, req *http.Request) {
 //			"mobile": "9876543210"
 //		}
 //	}
+//	user[name]=Aditya+Shedge&user[username]=aditya&user[email]=test%40sample.com
 func updateUserHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	var params struct {
-		// use 'newUser' because if field is left empty intentionally,
-		// then json decoder throws error
-		User struct{ newUser } `json:"user"`
-	}
-
-	decoder := json.NewDecoder(req.Body)
-	err := decoder.Decode(&params)
+	var nu newUser
+	err := decodeUserParams(req, &nu)
 
 	if err != nil {
 		log.Println(err.Error())
@@ -235,8 +343,7 @@ func updateUserHandler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	var resp *response
-	nu := params.User.newUser
-	u, err := loadUser(mux.Vars(req)["id"])
+	u, err := loadUser(requestOrganization(req).ID, mux.Vars(req)["id"])
 	if err != nil {
 		log.Println(err.Error())
 		w.WriteHeader(422)
@@ -244,15 +351,23 @@ func updateUserHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err = u.Update(nu); err != nil {
+	before := *u
+	if !checkCurrentPassword(requestActor(req), u, nu) {
+		resp = &response{
+			Message: "Unable to update user. Please correct the errors and try again.",
+			data:    &data{Errors: u.Errors, User: nil},
+		}
+		w.WriteHeader(422)
+	} else if err = u.Update(nu); err != nil {
 		log.Println(err)
 		resp = &response{
 			Message: "Unable to update user. Please correct the errors and try again.",
-			data:    &data{Errors: u.Errors, user: nil},
+			data:    &data{Errors: u.Errors, User: nil},
 		}
 		w.WriteHeader(422)
 	} else {
-		resp = &response{Message: "User updated successfully.", data: nil}
+		userChanged(req, auditUpdate, &before, u)
+		resp = &response{Message: "User updated successfully.", data: &data{User: u}}
 		w.WriteHeader(http.StatusOK)
 	}
 
@@ -263,11 +378,26 @@ func updateUserHandler(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
+// checkCurrentPassword asks the users changing their own password for
+// the current one, in nu.CurrentPassword, so a stolen session can't take
+// over the account. Admins changing the password of others don't give
+// it. The error is added to u.Errors.
+func checkCurrentPassword(a actor, u *user, nu newUser) bool {
+	if (nu.Password == nil && nu.PasswordConfirmation == nil) || a.Type != actorUser || a.ID != u.ID.Hex() {
+		return true
+	}
+	if nu.CurrentPassword != nil && u.passwordMatches(*nu.CurrentPassword) {
+		return true
+	}
+	u.Errors = ModelErrors{"current_password": {"Invalid Password"}}
+	return false
+}
+
 // deleteUserHandler Delete a particular user.
 // URL: DELETE /api/users/:id
 // HEADERS:
 //	"Content-Type": "application/json"
-//	"Accept": "application/vnd.botsworth.v1+json"
+//	"Accept": "application/vnd.demo_app.v1+json"
 // PARAMETERS:
 //	"id": ID of the user to be deleted.
 func deleteUserHandler(w http.ResponseWriter, req *http.Request) {
@@ -276,23 +406,22 @@ func deleteUserHandler(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	encoder := json.NewEncoder(w)
 	var resp *response
-	var objectID bson.ObjectId
 
-	// valid bson id
-	if valid := bson.IsObjectIdHex(vars["id"]); !valid {
-		log.Println(valid)
+	// load the user first, the audit log keeps its last state
+	if u, err := loadUser(requestOrganization(req).ID, vars["id"]); err != nil {
+		log.Println(err)
 
 		resp = &response{Message: "User not found.", data: nil}
 		w.WriteHeader(422)
 	} else {
-		objectID = bson.ObjectIdHex(vars["id"])
 		// delete user
-		if err := config.usersCollection.RemoveId(objectID); err != nil {
+		if err := config.usersCollection.RemoveId(u.ID); err != nil {
 			log.Println(err)
 
 			resp = &response{Message: "Unable to delete user.", data: nil}
 			w.WriteHeader(422)
 		} else {
+			userChanged(req, auditDelete, u, nil)
 			resp = &response{Message: "User deleted successfully.", data: nil}
 			w.WriteHeader(http.StatusOK)
 		}
@@ -303,7 +432,15 @@ func deleteUserHandler(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
-func loadUser(id string) (*user, error) {
+// loadUser loads a user of the organization, the users of the other
+// organizations are not found.
+func loadUser(orgID bson.ObjectId, id string) (*user, error) {
+	return loadUserFields(orgID, id, nil)
+}
+
+// loadUserFields loads only the fields of a user, all of them when fields
+// is nil. Users loaded with some fields can't be saved.
+func loadUserFields(orgID bson.ObjectId, id string, fields []string) (*user, error) {
 	var u user
 	var objectID bson.ObjectId
 
@@ -311,6 +448,7 @@ func loadUser(id string) (*user, error) {
 		return &u, errors.New("Invalid user id.")
 	}
 	objectID = bson.ObjectIdHex(id)
-	err := config.usersCollection.FindId(objectID).One(&u)
+	err := config.usersCollection.Find(bson.M{"_id": objectID, "organization_id": orgID}).Select(projection(fields, userFields)).One(&u)
+	u.fields = fields
 	return &u, err
 }
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"runtime"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxBulkUsers is the largest number of users accepted by one bulk import.
+const maxBulkUsers = 10000
+
+// bulkBatchSize is the number of users sent to the database per bulk insert.
+const bulkBatchSize = 1000
+
+var errTooManyUsers = fmt.Errorf("A bulk import can't have more than %d users", maxBulkUsers)
+
+// Status of a row in a bulk import.
+const (
+	bulkCreated = "created"
+	bulkInvalid = "invalid"
+	bulkSkipped = "skipped"
+	bulkFailed  = "failed"
+)
+
+// bulkResult reports what happened to one row of a bulk import.
+type bulkResult struct {
+	Row    int           `json:"row"`
+	ID     bson.ObjectId `json:"id,omitempty"`
+	Status string        `json:"status"`
+	Errors ModelErrors   `json:"errors,omitempty"`
+}
+
+func init() {
+	router.Path("/api/users/bulk").
+		HeadersRegexp("Content-Type", `^application/(json|x-ndjson)(;.*)?$`).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("POST").
+		HandlerFunc(requireAdmin(bulkCreateUsersHandler))
+
+	body := jsonBody([]newUser{})
+	body.Content["application/x-ndjson"] = &openAPIMediaType{Schema: &openAPISchema{Type: "string", Description: "A JSON user per line."}}
+	documentOperations(&openAPIOperation{
+		Method:      "POST",
+		Path:        "/api/users/bulk",
+		OperationID: "bulkCreateUsers",
+		Summary:     "Creates up to 10000 users, with a result per row in data.results. Admins only.",
+		Tags:        []string{"users"},
+		Parameters: []*openAPIParameter{
+			queryParam("atomic", "true to create nothing when any row is invalid", &openAPISchema{Type: "boolean"}),
+		},
+		RequestBody: body,
+		Responses:   adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, http.StatusRequestEntityTooLarge, 422)),
+	})
+}
+
+// bulkCreateUsersHandler can be used to add many users at once.
+// Rows are validated like in createUserHandler, usernames and emails must
+// also be unique within the import. Valid rows are inserted even if other
+// rows are rejected, unless "atomic" is set. Only admins can import users,
+// and only the passwords of the rows inserted are hashed.
+// URL: POST /api/users/bulk
+// HEADERS:
+//	"Content-Type": "application/json" or "application/x-ndjson"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"atomic": "true" to import nothing when any row is invalid.
+// BODY:
+//	A JSON array of users or one JSON user per line, at most 10000 users.
+// EXAMPLE:
+//	[
+//		{"name": "Aditya Shedge", "username": "aditya", "email": "test@sample.com", "password": "test123#", "password_confirmation": "test123#"},
+//		{"name": "Test User", "username": "test_user", "email": "test@test.com", "password": "test123#", "password_confirmation": "test123#"}
+//	]
+func bulkCreateUsersHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	atomic := req.URL.Query().Get("atomic") == "true"
+	rows, err := decodeBulkUsers(req)
+	if err == errTooManyUsers {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(response{Message: err.Error()})
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	orgID := requestOrganization(req).ID
+	users := newBulkUsers(orgID, rows)
+	results := make([]bulkResult, len(users))
+	valid, err := validateBulkUsers(orgID, users)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var toInsert []*user
+	for i, u := range users {
+		results[i] = bulkResult{Row: i + 1, ID: u.ID, Status: bulkCreated}
+		if !valid[i] {
+			results[i] = bulkResult{Row: i + 1, Status: bulkInvalid, Errors: u.Errors}
+		} else {
+			toInsert = append(toInsert, u)
+		}
+	}
+
+	var resp *response
+	status := http.StatusOK
+	switch {
+	case atomic && len(toInsert) < len(users):
+		for i := range results {
+			if results[i].Status == bulkCreated {
+				results[i] = bulkResult{Row: i + 1, Status: bulkSkipped}
+			}
+		}
+		resp = &response{Message: "Unable to import users. Please correct the errors and try again."}
+		status = 422
+	default:
+		generatePasswordDigests(toInsert)
+		created, err := insertBulkUsers(toInsert, atomic)
+		if err != nil {
+			log.Println(err)
+		}
+		for i := range results {
+			if results[i].Status == bulkCreated && !created[results[i].ID] {
+				results[i] = bulkResult{Row: i + 1, Status: bulkFailed}
+			}
+		}
+		var createdUsers []*user
+		for _, u := range toInsert {
+			if created[u.ID] {
+				createdUsers = append(createdUsers, u)
+			}
+		}
+		n := len(createdUsers)
+		if !atomic || err == nil {
+			usersCreated(req, createdUsers)
+		}
+		if atomic && err != nil {
+			resp = &response{Message: "Unable to import users."}
+			status = http.StatusInternalServerError
+		} else {
+			resp = &response{Message: fmt.Sprintf("Imported %d of %d users.", n, len(users))}
+		}
+	}
+
+	resp.data = &data{Total: len(users), Results: results}
+	w.WriteHeader(status)
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// decodeBulkUsers reads the users of a bulk import, sent either as a
+// JSON array or as newline delimited JSON.
+func decodeBulkUsers(req *http.Request) ([]newUser, error) {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []newUser
+	decoder := json.NewDecoder(req.Body)
+	if mediaType == "application/json" {
+		tok, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+			return nil, errors.New("Bulk import expects an array of users")
+		}
+		for decoder.More() {
+			if len(rows) == maxBulkUsers {
+				return nil, errTooManyUsers
+			}
+			var nu newUser
+			if err = decoder.Decode(&nu); err != nil {
+				return nil, err
+			}
+			rows = append(rows, nu)
+		}
+		_, err = decoder.Token()
+		return rows, err
+	}
+
+	for {
+		var nu newUser
+		err := decoder.Decode(&nu)
+		if err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(rows) == maxBulkUsers {
+			return nil, errTooManyUsers
+		}
+		rows = append(rows, nu)
+	}
+}
+
+// newBulkUsers builds the users of the rows in the organization and checks
+// their passwords, leaving bcrypt to the rows that will be inserted.
+func newBulkUsers(orgID bson.ObjectId, rows []newUser) []*user {
+	users := make([]*user, len(rows))
+	for j := range rows {
+		u := &user{ID: bson.NewObjectId(), OrganizationID: orgID}
+		u.copyFields(rows[j])
+		// errors are kept in u.Errors
+		u.checkPassword()
+		u.CreatedAt = u.ID.Time()
+		u.UpdatedAt = u.CreatedAt
+		users[j] = u
+	}
+	return users
+}
+
+// generatePasswordDigests generates the password digests of the users,
+// spreading the bcrypt work over all CPUs. Errors are kept in u.Errors.
+func generatePasswordDigests(users []*user) {
+	jobs := make(chan *user)
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range jobs {
+				u.generatePasswordDigest()
+			}
+		}()
+	}
+	for _, u := range users {
+		jobs <- u
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// validateBulkUsers validates every user with a single query for the
+// usernames and emails already in the organization. A username or email
+// used by an earlier valid row of the import is also considered taken.
+// The valid rows over the user quota of the organization are rejected.
+func validateBulkUsers(orgID bson.ObjectId, users []*user) ([]bool, error) {
+	taken := map[string]map[string]bool{
+		"username": make(map[string]bool),
+		"email":    make(map[string]bool),
+	}
+
+	var usernames, emails []string
+	for _, u := range users {
+		usernames = append(usernames, u.Username)
+		emails = append(emails, u.Email)
+	}
+	var existing []user
+	err := config.usersCollection.Find(bson.M{
+		"organization_id": orgID,
+		"$or": []bson.M{
+			{"username": bson.M{"$in": usernames}},
+			{"email": bson.M{"$in": emails}},
+		},
+	}).Select(bson.M{"username": 1, "email": 1}).All(&existing)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range existing {
+		taken["username"][u.Username] = true
+		taken["email"][u.Email] = true
+	}
+
+	left, err := usersLeft(orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	valid := make([]bool, len(users))
+	for i, u := range users {
+		valid[i] = u.validate(func(field, value string) bool {
+			return taken[field][value]
+		})
+		if valid[i] && left == 0 {
+			u.Errors["organization"] = append(u.Errors["organization"], errQuotaReached)
+			valid[i] = false
+		}
+		if valid[i] {
+			taken["username"][u.Username] = true
+			taken["email"][u.Email] = true
+			left--
+		}
+	}
+	return valid, nil
+}
+
+// insertBulkUsers inserts the users with unordered bulk operations and
+// returns the ids of the users that were saved. When atomic is set and
+// any insert fails, the users already saved are removed again.
+func insertBulkUsers(users []*user, atomic bool) (map[bson.ObjectId]bool, error) {
+	var lastErr error
+	ids := make([]bson.ObjectId, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+	}
+	for start := 0; start < len(users); start += bulkBatchSize {
+		end := start + bulkBatchSize
+		if end > len(users) {
+			end = len(users)
+		}
+
+		bulk := config.usersCollection.Bulk()
+		bulk.Unordered()
+		for _, u := range users[start:end] {
+			bulk.Insert(u)
+		}
+		if _, err := bulk.Run(); err != nil {
+			lastErr = err
+			if atomic {
+				break
+			}
+		}
+	}
+
+	created := make(map[bson.ObjectId]bool)
+	if lastErr == nil {
+		for _, id := range ids {
+			created[id] = true
+		}
+		return created, nil
+	}
+
+	if atomic {
+		_, err := config.usersCollection.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			log.Println(err)
+		}
+		return created, lastErr
+	}
+
+	// the bulk error doesn't tell which inserts failed, so look them up
+	var saved []user
+	err := config.usersCollection.Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"_id": 1}).All(&saved)
+	if err != nil {
+		return created, err
+	}
+	for _, u := range saved {
+		created[u.ID] = true
+	}
+	return created, lastErr
+}
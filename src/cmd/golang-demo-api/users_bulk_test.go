@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func postBulkUsers(t *testing.T, url, contentType, body string) (int, response) {
+	client := &http.Client{}
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	req.Header.Add("Content-Type", contentType)
+	actResp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer actResp.Body.Close()
+	// data is unexported, so it must be allocated before decoding
+	resp := response{data: &data{}}
+	err = json.NewDecoder(actResp.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) == 0 {
+		t.Fatal("expected a bulk report, but got none")
+	}
+	return actResp.StatusCode, resp
+}
+
+func TestBulkCreateUsersHandler(t *testing.T) {
+	ts := adminServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	body := `[
+		{"name":"One","username":"one","email":"one@test.com","password":"test123","password_confirmation":"test123"},
+		{"name":"Two","username":"one","email":"two@test.com","password":"test123","password_confirmation":"test123"},
+		{"name":"Three","username":"three","email":"` + u.Email + `","password":"test123","password_confirmation":"test123"},
+		{"name":"Four","username":"four","email":"four@test.com","password":"test123","password_confirmation":"test123"}
+	]`
+	status, resp := postBulkUsers(t, ts.URL+"/api/users/bulk", "application/json", body)
+	if status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	msg := "Imported 2 of 4 users."
+	if resp.Message != msg {
+		t.Errorf("expected %s, but got %s", msg, resp.Message)
+	}
+
+	expected := []string{bulkCreated, bulkInvalid, bulkInvalid, bulkCreated}
+	for i, result := range resp.Results {
+		if result.Status != expected[i] {
+			t.Errorf("expected row %d to be %s, but got %s", i+1, expected[i], result.Status)
+		}
+	}
+	if len(resp.Results[1].Errors["username"]) == 0 {
+		t.Errorf("expected username error for a username repeated in the batch")
+	}
+	if len(resp.Results[2].Errors["email"]) == 0 {
+		t.Errorf("expected email error for an existing email")
+	}
+
+	totalUsers, _ := config.usersCollection.Find(bson.M{}).Count()
+	if totalUsers != 3 {
+		t.Errorf("expected %d, but got %d", 3, totalUsers)
+	}
+	var saved user
+	config.usersCollection.FindId(resp.Results[0].ID).One(&saved)
+	if !saved.passwordMatches("test123") {
+		t.Errorf("expected the password of the created user to be hashed")
+	}
+
+	// only admins import users
+	anonymous := newTestServer()
+	defer anonymous.Close()
+	req, _ := http.NewRequest("POST", anonymous.URL+"/api/users/bulk", strings.NewReader(body))
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	req.Header.Add("Content-Type", "application/json")
+	actResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actResp.Body.Close()
+	if actResp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected %d, but got %d", http.StatusUnauthorized, actResp.StatusCode)
+	}
+
+	dropAllCollections(t)
+}
+
+func TestBulkCreateUsersHandlerWithNDJSON(t *testing.T) {
+	ts := adminServer()
+	defer ts.Close()
+
+	body := `{"name":"One","username":"one","email":"one@test.com","password":"test123","password_confirmation":"test123"}
+{"name":"Two","username":"two","email":"two@test.com","password":"test123","password_confirmation":"test123"}
+`
+	status, resp := postBulkUsers(t, ts.URL+"/api/users/bulk", "application/x-ndjson", body)
+	if status != http.StatusOK {
+		t.Errorf("expected %d, but got %d", http.StatusOK, status)
+	}
+	if resp.Total != 2 {
+		t.Errorf("expected %d, but got %d", 2, resp.Total)
+	}
+
+	totalUsers, _ := config.usersCollection.Find(bson.M{}).Count()
+	if totalUsers != 2 {
+		t.Errorf("expected %d, but got %d", 2, totalUsers)
+	}
+
+	dropAllCollections(t)
+}
+
+func TestBulkCreateUsersHandlerAtomic(t *testing.T) {
+	ts := adminServer()
+	defer ts.Close()
+
+	body := `[
+		{"name":"One","username":"one","email":"one@test.com","password":"test123","password_confirmation":"test123"},
+		{"name":"","username":"two","email":"two@test.com","password":"test123","password_confirmation":"test123"}
+	]`
+	status, resp := postBulkUsers(t, ts.URL+"/api/users/bulk?atomic=true", "application/json", body)
+	if status != 422 {
+		t.Errorf("expected %d, but got %d", 422, status)
+	}
+	if resp.Results[0].Status != bulkSkipped {
+		t.Errorf("expected row 1 to be %s, but got %s", bulkSkipped, resp.Results[0].Status)
+	}
+	if resp.Results[1].Status != bulkInvalid {
+		t.Errorf("expected row 2 to be %s, but got %s", bulkInvalid, resp.Results[1].Status)
+	}
+
+	totalUsers, _ := config.usersCollection.Find(bson.M{}).Count()
+	if totalUsers != 0 {
+		t.Errorf("expected %d, but got %d", 0, totalUsers)
+	}
+
+	dropAllCollections(t)
+}
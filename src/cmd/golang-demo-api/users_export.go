@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// exportContentTypes is the pattern matched against the "Accept" header of
+// exports, the first supported type in the header picks the format.
+const exportContentTypes = `text/csv|application/x-ndjson|application/json`
+
+// exportFlushEvery is the number of users written between flushes, so the
+// client receives the export while it is being read from the database.
+const exportFlushEvery = 500
+
+// exportColumns are the user fields that can be exported, by column name.
+var exportColumns = map[string]struct {
+	field string
+	value func(u *user) interface{}
+}{
+	"id":         {"_id", func(u *user) interface{} { return u.ID.Hex() }},
+	"name":       {"name", func(u *user) interface{} { return u.Name }},
+	"username":   {"username", func(u *user) interface{} { return u.Username }},
+	"email":      {"email", func(u *user) interface{} { return u.Email }},
+	"mobile":     {"mobile", func(u *user) interface{} { return u.Mobile }},
+	"created_at": {"created_at", func(u *user) interface{} { return u.CreatedAt.UTC().Format(time.RFC3339) }},
+	"updated_at": {"updated_at", func(u *user) interface{} { return u.UpdatedAt.UTC().Format(time.RFC3339) }},
+}
+
+// defaultExportColumns are exported when no columns are requested.
+var defaultExportColumns = []string{"id", "name", "username", "email", "mobile", "created_at", "updated_at"}
+
+// exportWriter writes the exported users in one format. Flush writes the
+// buffered users, it is called every exportFlushEvery users.
+type exportWriter interface {
+	Begin(columns []string) error
+	Write(columns []string, u *user) error
+	Flush() error
+	End() error
+}
+
+func init() {
+	csvSchema := &openAPISchema{Type: "string", Description: "A header row with the column names, then a row per user."}
+	documentOperations(&openAPIOperation{
+		Method:      "GET",
+		Path:        "/api/users/export",
+		OperationID: "exportUsers",
+		Summary:     "Streams every user, newest first.",
+		Description: "The format is chosen with the Accept header.",
+		Tags:        []string{"users"},
+		Parameters: []*openAPIParameter{
+			queryParam("columns", "Comma separated columns to export, all by default", &openAPISchema{Type: "string"}),
+		},
+		Responses: scoped(map[string]*openAPIResponse{
+			"200": {
+				Description: "The users.",
+				Content: map[string]*openAPIMediaType{
+					"text/csv":             {Schema: csvSchema},
+					"application/x-ndjson": {Schema: &openAPISchema{Type: "string", Description: "A JSON object per line."}},
+					"application/json":     {Schema: &openAPISchema{Type: "array", Items: &openAPISchema{Type: "object"}}},
+				},
+			},
+			"400": {
+				Description: "Invalid column.",
+				Content:     map[string]*openAPIMediaType{"application/json": {Schema: schemaFor(response{})}},
+			},
+		}),
+	})
+}
+
+// exportUsersHandler streams every user of the organization, in CSV,
+// newline delimited JSON or as a JSON array.
+// URL: GET /api/users/export
+// HEADERS:
+//	"Accept": "text/csv", "application/x-ndjson" or "application/json"
+// PARAMETERS:
+//	"columns": Comma separated columns to export, all by default
+func exportUsersHandler(w http.ResponseWriter, req *http.Request) {
+	columns, err := exportColumnList(req.URL.Query().Get("columns"))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response{Message: err.Error()})
+		return
+	}
+
+	contentType, ext := exportFormat(req.Header.Get("Accept"))
+	var ew exportWriter
+	switch contentType {
+	case "text/csv":
+		ew = &csvExportWriter{w: csv.NewWriter(w)}
+	case "application/x-ndjson":
+		ew = &jsonExportWriter{w: w}
+	default:
+		ew = &jsonExportWriter{w: w, array: true}
+	}
+
+	projection := bson.M{}
+	for _, col := range columns {
+		projection[exportColumns[col].field] = 1
+	}
+	iter := config.usersCollection.Find(bson.M{"organization_id": requestOrganization(req).ID}).Sort("-created_at").Select(projection).Iter()
+
+	filename := fmt.Sprintf("users-%s.%s", time.Now().UTC().Format("20060102-150405"), ext)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	if err = ew.Begin(columns); err != nil {
+		log.Println(err)
+		iter.Close()
+		return
+	}
+	var u user
+	for n := 1; iter.Next(&u); n++ {
+		if err = ew.Write(columns, &u); err != nil {
+			// most likely the client went away
+			log.Println(err)
+			iter.Close()
+			return
+		}
+		if n%exportFlushEvery == 0 {
+			if err = ew.Flush(); err != nil {
+				log.Println(err)
+				iter.Close()
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		u = user{}
+	}
+	if err = iter.Close(); err != nil {
+		// the status is already sent, the export is cut short
+		log.Println(err)
+		return
+	}
+	if err = ew.End(); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// exportFormat picks the content type and file extension of an export
+// from the "Accept" header.
+func exportFormat(accept string) (string, string) {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.Split(part, ";")[0])
+		switch mediaType {
+		case "text/csv":
+			return "text/csv", "csv"
+		case "application/x-ndjson":
+			return "application/x-ndjson", "ndjson"
+		case "application/json":
+			return "application/json", "json"
+		}
+	}
+	return "application/json", "json"
+}
+
+func exportColumnList(param string) ([]string, error) {
+	if param == "" {
+		return defaultExportColumns, nil
+	}
+	var columns []string
+	for _, col := range strings.Split(param, ",") {
+		col = strings.TrimSpace(col)
+		if _, ok := exportColumns[col]; !ok {
+			return nil, errors.New("Unknown column " + col + ".")
+		}
+		columns = append(columns, col)
+	}
+	return columns, nil
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (cw *csvExportWriter) Begin(columns []string) error {
+	return cw.w.Write(columns)
+}
+
+func (cw *csvExportWriter) Write(columns []string, u *user) error {
+	record := make([]string, len(columns))
+	for i, col := range columns {
+		record[i] = fmt.Sprint(exportColumns[col].value(u))
+	}
+	return cw.w.Write(record)
+}
+
+func (cw *csvExportWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+func (cw *csvExportWriter) End() error {
+	return cw.Flush()
+}
+
+// jsonExportWriter writes one JSON object per user, either one per line or
+// as the elements of an array.
+type jsonExportWriter struct {
+	w     io.Writer
+	array bool
+	count int
+}
+
+func (jw *jsonExportWriter) Begin(columns []string) error {
+	if jw.array {
+		_, err := io.WriteString(jw.w, "[")
+		return err
+	}
+	return nil
+}
+
+func (jw *jsonExportWriter) Write(columns []string, u *user) error {
+	row := make(map[string]interface{}, len(columns))
+	for _, col := range columns {
+		row[col] = exportColumns[col].value(u)
+	}
+	b, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	if jw.array && jw.count > 0 {
+		b = append([]byte(","), b...)
+	}
+	if !jw.array {
+		b = append(b, '\n')
+	}
+	jw.count++
+	_, err = jw.w.Write(b)
+	return err
+}
+
+// Flush does nothing, the users are written unbuffered.
+func (jw *jsonExportWriter) Flush() error {
+	return nil
+}
+
+func (jw *jsonExportWriter) End() error {
+	if jw.array {
+		_, err := io.WriteString(jw.w, "]\n")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func exportUsers(t *testing.T, url, accept string) *http.Response {
+	client := &http.Client{}
+	req, err := http.NewRequest("GET", url, nil)
+	req.Header.Add("Accept", accept)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	return resp
+}
+
+func TestCSVExportWriterFlush(t *testing.T) {
+	var buf bytes.Buffer
+	cw := &csvExportWriter{w: csv.NewWriter(&buf)}
+	columns := []string{"username"}
+	if err := cw.Begin(columns); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Write(columns, &user{Username: "test_user"}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected the rows to be buffered until the flush, but got %q", buf.String())
+	}
+	if err := cw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "username\ntest_user\n" {
+		t.Errorf("expected the rows after the flush, but got %q", buf.String())
+	}
+}
+
+func TestExportUsersHandlerCSV(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	resp := exportUsers(t, ts.URL+"/api/users/export?columns=id,username,email", "text/csv")
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("expected Content-Type to be %s, but got %s", "text/csv", ct)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); !strings.HasSuffix(cd, `.csv"`) {
+		t.Errorf("expected a csv attachment, but got %s", cd)
+	}
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"id", "username", "email"},
+		{u.ID.Hex(), u.Username, u.Email},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d records, but got %d", len(expected), len(records))
+	}
+	for i := range expected {
+		if strings.Join(records[i], ",") != strings.Join(expected[i], ",") {
+			t.Errorf("expected %v, but got %v", expected[i], records[i])
+		}
+	}
+	dropAllCollections(t)
+}
+
+func TestExportUsersHandlerNDJSON(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	resp := exportUsers(t, ts.URL+"/api/users/export", "application/x-ndjson")
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	var rows []map[string]interface{}
+	for scanner.Scan() {
+		var row map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("expected %d rows, but got %d", 1, len(rows))
+	}
+	if rows[0]["email"] != u.Email {
+		t.Errorf("expected email to be %s, but got %v", u.Email, rows[0]["email"])
+	}
+	if _, ok := rows[0]["password_digest"]; ok {
+		t.Errorf("expected password digest not to be exported")
+	}
+	dropAllCollections(t)
+}
+
+func TestExportUsersHandlerJSONArray(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	resp := exportUsers(t, ts.URL+"/api/users/export", "application/json")
+	defer resp.Body.Close()
+
+	var rows []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 0 {
+		t.Errorf("expected %d rows, but got %d", 0, len(rows))
+	}
+	dropAllCollections(t)
+}
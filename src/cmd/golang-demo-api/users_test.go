@@ -2,12 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
-	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
+
+	"client"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -16,50 +21,130 @@ import (
 
 // Index
 func TestUsersHandler(t *testing.T) {
-	ts := httptest.NewServer(router)
+	ts := newTestServer()
 	defer ts.Close()
 
 	u := setupUser(t)
-	us := Users{u}
-	r := response{data: &data{Users: us, Total: 1}}
-	expectedResp, err := json.Marshal(r)
+	page, err := client.New(ts.URL).ListUsers(context.Background(), client.ListOptions{})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if page.Total != 1 || len(page.Users) != 1 {
+		t.Fatalf("expected %d user, but got %d of %d", 1, len(page.Users), page.Total)
 	}
+	expectClientUser(t, u, page.Users[0])
+	dropAllCollections(t)
+}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", ts.URL+"/api/users", nil)
-	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
-	req.Header.Add("Content-Type", "application/json")
-	actualResp, err := client.Do(req)
-	if err != nil {
-		t.Error(err)
+// Index of many pages
+func TestUsersHandlerPages(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	setupUsers(t, 45)
+	it := client.New(ts.URL).IterateUsers(context.Background(), client.ListOptions{})
+	seen := make(map[string]bool)
+	var last time.Time
+	for it.Next() {
+		u := it.User()
+		if seen[u.ID] {
+			t.Errorf("expected every user once, but got %s again", u.ID)
+		}
+		seen[u.ID] = true
+		if !last.IsZero() && u.CreatedAt.After(last) {
+			t.Errorf("expected the newest users first, but got %s after %s", u.CreatedAt, last)
+		}
+		last = u.CreatedAt
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 45 {
+		t.Errorf("expected %d users, but got %d", 45, len(seen))
 	}
-	defer actualResp.Body.Close()
-	resp, err := ioutil.ReadAll(actualResp.Body)
+	dropAllCollections(t)
+}
+
+// Create
+func TestCreateUsersHandler(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	cu, err := client.New(ts.URL).CreateUser(context.Background(), client.UserParams{
+		Name:                 client.String("Test"),
+		Username:             client.String("test"),
+		Email:                client.String("test@test.com"),
+		Password:             client.String("test123"),
+		PasswordConfirmation: client.String("test123"),
+	})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	body := strings.TrimSpace(string(resp))
-	if body != string(expectedResp) {
-		t.Errorf("expected %s, but got %s", string(expectedResp), body)
+
+	var nu user
+	config.usersCollection.Find(bson.M{"_id": bson.M{"$ne": u.ID}}).One(&nu)
+	expectClientUser(t, nu, *cu)
+	if nu.Name != "Test" {
+		t.Errorf("expected name to be %s, but got %s", "Test", nu.Name)
+	}
+	if nu.Username != "test" {
+		t.Errorf("expected username to be %s, but got %s", "test", nu.Username)
 	}
+	if nu.Email != "test@test.com" {
+		t.Errorf("expected email to be %s, but got %s", "test@test.com", nu.Email)
+	}
+	if err = bcrypt.CompareHashAndPassword([]byte(nu.PasswordDigest), []byte("test123")); err != nil {
+		t.Errorf("expected password to be %s, but got mismatch", "test123")
+	}
+	totalUsers, _ := config.usersCollection.Find(bson.M{}).Count()
+	if totalUsers != 2 {
+		t.Errorf("expected %d, but got %d", 2, totalUsers)
+	}
+
 	dropAllCollections(t)
 }
 
-// Create
-func TestCreateUsersHandler(t *testing.T) {
-	ts := httptest.NewServer(router)
+// Create with invalid fields
+func TestCreateUsersHandlerWithErrors(t *testing.T) {
+	ts := newTestServer()
 	defer ts.Close()
 
 	u := setupUser(t)
-	var b bytes.Buffer
-	b.Write([]byte(`{"user":{"name":"Test","username":"test","email":"test@test.com","password":"test123","password_confirmation":"test123"}}`))
+	_, err := client.New(ts.URL).CreateUser(context.Background(), client.UserParams{
+		Username:             client.String(u.Username),
+		Email:                client.String("test@test.com"),
+		Password:             client.String("test123"),
+		PasswordConfirmation: client.String("test123"),
+	})
+	verr, ok := err.(*client.ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, but got %v", err)
+	}
+	expected := "name can't be blank; username is already taken"
+	if verr.Errors.String() != expected {
+		t.Errorf("expected %s, but got %s", expected, verr.Errors.String())
+	}
+
+	dropAllCollections(t)
+}
+
+// Create with form body
+func TestCreateUsersHandlerWithForm(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	form := url.Values{}
+	form.Set("user[name]", "Test")
+	form.Set("user[username]", "test")
+	form.Set("user[email]", "test@test.com")
+	form.Set("user[password]", "test123")
+	form.Set("user[password_confirmation]", "test123")
 
 	client := &http.Client{}
-	req, err := http.NewRequest("POST", ts.URL+"/api/users", &b)
+	req, err := http.NewRequest("POST", ts.URL+"/api/users", strings.NewReader(form.Encode()))
 	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
-	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	actResp, err := client.Do(req)
 	if err != nil {
 		t.Error(err)
@@ -76,66 +161,46 @@ func TestCreateUsersHandler(t *testing.T) {
 	}
 
 	var nu user
-	config.usersCollection.Find(bson.M{"_id": bson.M{"$ne": u.ID}}).One(&nu)
+	config.usersCollection.Find(bson.M{"username": "test"}).One(&nu)
 	if nu.Name != "Test" {
 		t.Errorf("expected name to be %s, but got %s", "Test", nu.Name)
 	}
-	if nu.Username != "test" {
-		t.Errorf("expected username to be %s, but got %s", "test", nu.Username)
-	}
 	if nu.Email != "test@test.com" {
 		t.Errorf("expected email to be %s, but got %s", "test@test.com", nu.Email)
 	}
 	if err = bcrypt.CompareHashAndPassword([]byte(nu.PasswordDigest), []byte("test123")); err != nil {
 		t.Errorf("expected password to be %s, but got mismatch", "test123")
 	}
-	totalUsers, _ := config.usersCollection.Find(bson.M{}).Count()
-	if totalUsers != 2 {
-		t.Errorf("expected %d, but got %d", 2, totalUsers)
-	}
 
 	dropAllCollections(t)
 }
 
 // Show
 func TestShowUserHandler(t *testing.T) {
-	ts := httptest.NewServer(router)
+	ts := newTestServer()
 	defer ts.Close()
 
 	u := setupUser(t)
-	r := response{data: &data{user: &u}}
-	expResp, err := json.Marshal(r)
+	cu, err := client.New(ts.URL).GetUser(context.Background(), u.ID.Hex())
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	expectClientUser(t, u, *cu)
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", ts.URL+"/api/users/"+u.ID.Hex(), nil)
-	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
-	req.Header.Add("Content-Type", "application/json")
-	actResp, err := client.Do(req)
-	if err != nil {
-		t.Error(err)
-	}
-	defer actResp.Body.Close()
-	resp, err := ioutil.ReadAll(actResp.Body)
-	if err != nil {
-		t.Error(err)
-	}
-	body := strings.TrimSpace(string(resp))
-	if body != string(expResp) {
-		t.Errorf("expected %s, but got %s", string(expResp), body)
+	_, err = client.New(ts.URL).GetUser(context.Background(), bson.NewObjectId().Hex())
+	if apiErr, ok := err.(*client.Error); !ok || apiErr.StatusCode != 422 {
+		t.Errorf("expected a %d error, but got %v", 422, err)
 	}
 	dropAllCollections(t)
 }
 
 // Edit
 func TestEditUserHandler(t *testing.T) {
-	ts := httptest.NewServer(router)
+	ts := newTestServer()
 	defer ts.Close()
 
 	u := setupUser(t)
-	r := response{data: &data{user: &u}}
+	r := response{data: &data{User: &u}}
 	expResp, err := json.Marshal(r)
 	if err != nil {
 		t.Error(err)
@@ -163,34 +228,24 @@ func TestEditUserHandler(t *testing.T) {
 
 // Update
 func TestUpdateUsersHandler(t *testing.T) {
-	ts := httptest.NewServer(router)
+	ts := adminServer()
 	defer ts.Close()
 
 	u := setupUser(t)
-	var b bytes.Buffer
-	b.Write([]byte(`{"user":{"name":"Test","username":"test","email":"test@test.com","password":"testing123","password_confirmation":"testing123"}}`))
-
-	client := &http.Client{}
-	req, err := http.NewRequest("PUT", ts.URL+"/api/users/"+u.ID.Hex(), &b)
-	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
-	req.Header.Add("Content-Type", "application/json")
-	actResp, err := client.Do(req)
+	cu, err := client.New(ts.URL).UpdateUser(context.Background(), u.ID.Hex(), client.UserParams{
+		Name:                 client.String("Test"),
+		Username:             client.String("test"),
+		Email:                client.String("test@test.com"),
+		Password:             client.String("testing123"),
+		PasswordConfirmation: client.String("testing123"),
+	})
 	if err != nil {
-		t.Error(err)
-	}
-	defer actResp.Body.Close()
-	var resp response
-	err = json.NewDecoder(actResp.Body).Decode(&resp)
-	if err != nil {
-		t.Error(err)
-	}
-	msg := "User updated successfully."
-	if resp.Message != msg {
-		t.Errorf("expected %s, but got %s", msg, resp.Message)
+		t.Fatal(err)
 	}
 
 	var nu user
 	config.usersCollection.Find(bson.M{"_id": u.ID}).One(&nu)
+	expectClientUser(t, nu, *cu)
 	if nu.Name != "Test" {
 		t.Errorf("expected name to be %s, but got %s", u.Name, nu.Name)
 	}
@@ -211,17 +266,42 @@ func TestUpdateUsersHandler(t *testing.T) {
 	dropAllCollections(t)
 }
 
-// Delete
-func TestDeleteUserHandler(t *testing.T) {
-	ts := httptest.NewServer(router)
+// Patch
+func TestPatchUsersHandler(t *testing.T) {
+	ts := adminServer()
 	defer ts.Close()
 
 	u := setupUser(t)
+	cu, err := client.New(ts.URL).PatchUser(context.Background(), u.ID.Hex(), client.UserParams{
+		Mobile: client.String("1234567890"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cu.Mobile != "1234567890" || cu.Name != u.Name {
+		t.Errorf("expected only the mobile to change, but got %+v", cu)
+	}
+
+	dropAllCollections(t)
+}
+
+// Update with multipart body
+func TestUpdateUsersHandlerWithMultipart(t *testing.T) {
+	ts := adminServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	mw.WriteField("user[name]", "Test")
+	mw.WriteField("user[password]", "testing123")
+	mw.WriteField("user[password_confirmation]", "testing123")
+	mw.Close()
 
 	client := &http.Client{}
-	req, err := http.NewRequest("DELETE", ts.URL+"/api/users/"+u.ID.Hex(), nil)
+	req, err := http.NewRequest("PATCH", ts.URL+"/api/users/"+u.ID.Hex(), &b)
 	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
-	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Type", mw.FormDataContentType())
 	actResp, err := client.Do(req)
 	if err != nil {
 		t.Error(err)
@@ -232,11 +312,109 @@ func TestDeleteUserHandler(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	msg := "User deleted successfully."
+	msg := "User updated successfully."
 	if resp.Message != msg {
 		t.Errorf("expected %s, but got %s", msg, resp.Message)
 	}
 
+	var nu user
+	config.usersCollection.Find(bson.M{"_id": u.ID}).One(&nu)
+	if nu.Name != "Test" {
+		t.Errorf("expected name to be %s, but got %s", "Test", nu.Name)
+	}
+	if nu.Username != u.Username {
+		t.Errorf("expected username to be %s, but got %s", u.Username, nu.Username)
+	}
+	if err = bcrypt.CompareHashAndPassword([]byte(nu.PasswordDigest), []byte("testing123")); err != nil {
+		t.Errorf("expected password to be %s, but got mismatch", "testing123")
+	}
+
+	dropAllCollections(t)
+}
+
+// Only the user and the admins change a user
+func TestUpdateKeepsConcurrentChanges(t *testing.T) {
+	u := setupUser(t)
+	// a failed login counted after the user was loaded
+	config.usersCollection.UpdateId(u.ID, bson.M{"$set": bson.M{"failed_logins": 2, "totp_last_counter": 42}})
+
+	name := "Renamed"
+	if err := u.Update(newUser{Name: &name}); err != nil {
+		t.Fatal(err, u.Errors)
+	}
+	var saved user
+	config.usersCollection.FindId(u.ID).One(&saved)
+	if saved.Name != name || saved.FailedLogins != 2 || saved.TOTPLastCounter != 42 {
+		t.Errorf("expected the name to change and the counters to be kept, but got %+v", saved)
+	}
+	dropAllCollections(t)
+}
+
+func TestUpdateUserRequiresSelfOrAdmin(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	ctx := context.Background()
+	password := client.UserParams{Password: client.String("taken123#"), PasswordConfirmation: client.String("taken123#")}
+	if _, err := client.New(ts.URL).PatchUser(ctx, u.ID.Hex(), password); err == nil {
+		t.Errorf("expected anonymous requests to be refused")
+	} else if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected %d, but got %v", http.StatusUnauthorized, err)
+	}
+	other := actorServer(actor{Type: actorUser, ID: bson.NewObjectId().Hex(), OrganizationID: defaultOrganization.ID})
+	defer other.Close()
+	if _, err := client.New(other.URL).PatchUser(ctx, u.ID.Hex(), password); err == nil {
+		t.Errorf("expected other users to be refused")
+	} else if e, ok := err.(*client.Error); !ok || e.StatusCode != http.StatusForbidden {
+		t.Errorf("expected %d, but got %v", http.StatusForbidden, err)
+	}
+	if err := client.New(other.URL).DeleteUser(ctx, u.ID.Hex()); err == nil {
+		t.Errorf("expected other users not to delete the user")
+	}
+	result := postGraphQL(t, ts.URL, `mutation($id: ID!) { updateUser(id: $id, input: {password: "taken123#", passwordConfirmation: "taken123#"}) { user { id } } }`,
+		map[string]interface{}{"id": u.ID.Hex()})
+	if len(result.Errors) != 1 || result.Errors[0].Message != errSelfOrAdmin {
+		t.Errorf("expected the mutation to be refused, but got %+v", result.Errors)
+	}
+	var nu user
+	config.usersCollection.FindId(u.ID).One(&nu)
+	if !nu.passwordMatches("test123#") {
+		t.Fatalf("expected the password to be unchanged")
+	}
+
+	// users give their current password to change it
+	self := actorServer(actor{Type: actorUser, ID: u.ID.Hex(), OrganizationID: defaultOrganization.ID})
+	defer self.Close()
+	for _, current := range []*string{nil, client.String("wrong")} {
+		password.CurrentPassword = current
+		_, err := client.New(self.URL).PatchUser(ctx, u.ID.Hex(), password)
+		if e, ok := err.(*client.ValidationError); !ok || len(e.Errors["current_password"]) != 1 {
+			t.Errorf("expected the current password to be asked, but got %v", err)
+		}
+	}
+	password.CurrentPassword = client.String("test123#")
+	if _, err := client.New(self.URL).PatchUser(ctx, u.ID.Hex(), password); err != nil {
+		t.Fatal(err)
+	}
+	config.usersCollection.FindId(u.ID).One(&nu)
+	if !nu.passwordMatches("taken123#") {
+		t.Errorf("expected the password to change")
+	}
+
+	dropAllCollections(t)
+}
+
+// Delete
+func TestDeleteUserHandler(t *testing.T) {
+	ts := adminServer()
+	defer ts.Close()
+
+	u := setupUser(t)
+	if err := client.New(ts.URL).DeleteUser(context.Background(), u.ID.Hex()); err != nil {
+		t.Fatal(err)
+	}
+
 	totalUsers, _ := config.usersCollection.Find(bson.M{}).Count()
 	if totalUsers != 0 {
 		t.Errorf("expected %d, but got %d", 0, totalUsers)
@@ -244,3 +422,17 @@ func TestDeleteUserHandler(t *testing.T) {
 
 	dropAllCollections(t)
 }
+
+// expectClientUser compares the user returned by the API to the stored one.
+func expectClientUser(t *testing.T, expected user, actual client.User) {
+	if actual.ID != expected.ID.Hex() {
+		t.Errorf("expected id to be %s, but got %s", expected.ID.Hex(), actual.ID)
+	}
+	if actual.Name != expected.Name || actual.Username != expected.Username || actual.Email != expected.Email {
+		t.Errorf("expected %s (%s, %s), but got %s (%s, %s)",
+			expected.Name, expected.Username, expected.Email, actual.Name, actual.Username, actual.Email)
+	}
+	if !actual.CreatedAt.Equal(expected.CreatedAt) {
+		t.Errorf("expected created_at to be %s, but got %s", expected.CreatedAt, actual.CreatedAt)
+	}
+}
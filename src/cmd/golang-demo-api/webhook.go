@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Status of a webhook delivery.
+const (
+	deliveryPending   = "pending"
+	deliverySending   = "sending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead"
+)
+
+const (
+	// maxDeliveryAttempts is the number of failed attempts after which a
+	// delivery is dead-lettered.
+	maxDeliveryAttempts = 8
+	// deliveryBackoff is the wait after the first failed attempt, it
+	// doubles after every other failure up to maxDeliveryBackoff.
+	deliveryBackoff    = 30 * time.Second
+	maxDeliveryBackoff = 6 * time.Hour
+	// deliveryLock is how long a delivery stays claimed by one worker.
+	deliveryLock = time.Minute
+	// maxDeliveryLogs is the number of attempts kept per delivery.
+	maxDeliveryLogs = 10
+)
+
+// webhookClient sends the deliveries. It only connects to public
+// addresses, so that webhooks can't reach the services next to the API.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: refusePrivateAddress}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+var errPrivateAddress = errors.New("webhooks can't be delivered to private addresses")
+
+// refusePrivateAddress refuses the connections to loopback, link-local and
+// private addresses. It runs once the host is resolved, so host names
+// pointing to such addresses and redirects to them are refused too.
+func refusePrivateAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// webhook is a subscription of an URL to the user events of an
+// organization.
+type webhook struct {
+	ID             bson.ObjectId `bson:"_id" json:"id"`
+	OrganizationID bson.ObjectId `bson:"organization_id" json:"-"`
+	URL            string        `bson:"url" json:"url"`
+	Events         []string      `bson:"events" json:"events"`
+	Description    string        `bson:"description,omitempty" json:"description,omitempty"`
+	Active         bool          `bson:"active" json:"active"`
+	// Secret signs the payloads, it's only returned on creation.
+	Secret    string      `bson:"secret" json:"secret,omitempty"`
+	CreatedAt time.Time   `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time   `bson:"updated_at" json:"updated_at"`
+	Errors    ModelErrors `bson:"-" json:"errors,omitempty"`
+}
+
+type newWebhook struct {
+	URL         *string   `json:"url,omitempty"`
+	Events      *[]string `json:"events,omitempty"`
+	Description *string   `json:"description,omitempty"`
+	Active      *bool     `json:"active,omitempty"`
+}
+
+// Webhooks represents a collection of webhook objects
+type Webhooks []webhook
+
+// webhookDelivery is the delivery of one event to one webhook.
+type webhookDelivery struct {
+	ID            bson.ObjectId     `bson:"_id" json:"id"`
+	WebhookID     bson.ObjectId     `bson:"webhook_id" json:"webhook_id"`
+	Event         string            `bson:"event" json:"event"`
+	Payload       string            `bson:"payload" json:"payload"`
+	Status        string            `bson:"status" json:"status"`
+	Attempts      int               `bson:"attempts" json:"attempts"`
+	NextAttemptAt time.Time         `bson:"next_attempt_at" json:"next_attempt_at"`
+	LockedUntil   time.Time         `bson:"locked_until,omitempty" json:"-"`
+	Logs          []deliveryAttempt `bson:"logs,omitempty" json:"logs,omitempty"`
+	CreatedAt     time.Time         `bson:"created_at" json:"created_at"`
+	DeliveredAt   time.Time         `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+}
+
+// deliveryAttempt logs one attempt of a delivery.
+type deliveryAttempt struct {
+	At         time.Time `bson:"at" json:"at"`
+	StatusCode int       `bson:"status_code,omitempty" json:"status_code,omitempty"`
+	Error      string    `bson:"error,omitempty" json:"error,omitempty"`
+	Duration   float64   `bson:"duration" json:"duration"`
+}
+
+// WebhookDeliveries represents a collection of webhook deliveries
+type WebhookDeliveries []webhookDelivery
+
+func init() {
+	onUserEvent(enqueueWebhookDeliveries)
+}
+
+// ensureWebhookIndexes creates the indexes of the webhook collections.
+func ensureWebhookIndexes() error {
+	if err := config.webhooksCollection.EnsureIndexKey("organization_id", "events", "active"); err != nil {
+		return err
+	}
+	if err := config.webhookDeliveriesCollection.EnsureIndexKey("status", "next_attempt_at"); err != nil {
+		return err
+	}
+	return config.webhookDeliveriesCollection.EnsureIndexKey("webhook_id", "-_id")
+}
+
+func (wh *webhook) Create() error {
+	wh.ID = bson.NewObjectId()
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	wh.Secret = hex.EncodeToString(secret)
+
+	if !wh.Valid() {
+		return errors.New("Webhook Invalid")
+	}
+	wh.CreatedAt = wh.ID.Time()
+	wh.UpdatedAt = wh.CreatedAt
+	return config.webhooksCollection.Insert(wh)
+}
+
+func (wh *webhook) Update(nw newWebhook) error {
+	wh.copyFields(nw)
+	if !wh.Valid() {
+		return errors.New("Webhook Invalid")
+	}
+	wh.UpdatedAt = bson.Now()
+	return config.webhooksCollection.UpdateId(wh.ID, wh)
+}
+
+func (wh *webhook) Valid() bool {
+	wh.Errors = make(ModelErrors)
+	if wh.URL == "" {
+		wh.Errors["url"] = append(wh.Errors["url"], "can't be blank")
+	} else if u, err := url.Parse(wh.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		wh.Errors["url"] = append(wh.Errors["url"], "must be an http or https URL")
+	}
+	if len(wh.Events) == 0 {
+		wh.Errors["events"] = append(wh.Errors["events"], "can't be blank")
+	}
+	for _, event := range wh.Events {
+		if !wh.knownEvent(event) {
+			wh.Errors["events"] = append(wh.Errors["events"], event+" is not an event")
+		}
+	}
+	return len(wh.Errors) == 0
+}
+
+func (wh *webhook) knownEvent(event string) bool {
+	if event == "*" {
+		return true
+	}
+	for _, known := range userEventTypes {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+func (wh *webhook) copyFields(nw newWebhook) {
+	if nw.URL != nil {
+		wh.URL = *nw.URL
+	}
+	if nw.Events != nil {
+		wh.Events = *nw.Events
+	}
+	if nw.Description != nil {
+		wh.Description = *nw.Description
+	}
+	if nw.Active != nil {
+		wh.Active = *nw.Active
+	}
+}
+
+// sign returns the signature of a payload sent at t, the hex HMAC-SHA256
+// of "<unix time>.<payload>" keyed with the secret of the webhook.
+func (wh *webhook) sign(t time.Time, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(wh.Secret))
+	fmt.Fprintf(mac, "%d.", t.Unix())
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// enqueueWebhookDeliveries queues the event for every active webhook of
+// the organization of the user subscribed to it. The deliveries are sent
+// by processWebhookDeliveries.
+func enqueueWebhookDeliveries(e userEvent) {
+	var webhooks Webhooks
+	err := config.webhooksCollection.Find(bson.M{
+		"organization_id": e.User.OrganizationID,
+		"active":          true,
+		"events":          bson.M{"$in": []string{e.Type, "*"}},
+	}).All(&webhooks)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	now := bson.Now()
+	for _, wh := range webhooks {
+		d := &webhookDelivery{
+			ID:            bson.NewObjectId(),
+			WebhookID:     wh.ID,
+			Event:         e.Type,
+			Payload:       string(payload),
+			Status:        deliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+		if err = config.webhookDeliveriesCollection.Insert(d); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// processWebhookDeliveries sends the deliveries due and returns how many
+// were attempted. Every delivery is claimed before being sent, so several
+// instances can process the queue at the same time. The clock is read for
+// every claim, so the last claims of a long run are locked long enough.
+func processWebhookDeliveries(clock func() time.Time) int {
+	n := 0
+	for {
+		now := clock()
+		var d webhookDelivery
+		_, err := config.webhookDeliveriesCollection.Find(bson.M{
+			"status":          bson.M{"$in": []string{deliveryPending, deliverySending}},
+			"next_attempt_at": bson.M{"$lte": now},
+			"$or": []bson.M{
+				{"locked_until": bson.M{"$exists": false}},
+				{"locked_until": bson.M{"$lte": now}},
+			},
+		}).Sort("next_attempt_at").Apply(mgo.Change{
+			Update:    bson.M{"$set": bson.M{"status": deliverySending, "locked_until": now.Add(deliveryLock)}},
+			ReturnNew: true,
+		}, &d)
+		if err == mgo.ErrNotFound {
+			return n
+		} else if err != nil {
+			log.Println(err)
+			return n
+		}
+		d.attempt(now)
+		n++
+	}
+}
+
+// attempt sends the delivery and saves the outcome.
+func (d *webhookDelivery) attempt(now time.Time) {
+	var wh webhook
+	if err := config.webhooksCollection.FindId(d.WebhookID).One(&wh); err != nil {
+		// the webhook was deleted, nobody is listening anymore
+		d.Status = deliveryDead
+		d.Logs = append(d.Logs, deliveryAttempt{At: now, Error: "webhook not found"})
+		d.save()
+		return
+	}
+
+	start := time.Now()
+	status, err := wh.send(d, now)
+	entry := deliveryAttempt{At: now, StatusCode: status, Duration: time.Since(start).Seconds()}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	d.Attempts++
+	d.Logs = append(d.Logs, entry)
+	if len(d.Logs) > maxDeliveryLogs {
+		d.Logs = d.Logs[len(d.Logs)-maxDeliveryLogs:]
+	}
+
+	switch {
+	case err == nil:
+		d.Status = deliveryDelivered
+		d.DeliveredAt = now
+	case d.Attempts >= maxDeliveryAttempts:
+		d.Status = deliveryDead
+	default:
+		d.Status = deliveryPending
+		d.NextAttemptAt = now.Add(deliveryRetryIn(d.Attempts))
+	}
+	d.save()
+}
+
+func (d *webhookDelivery) save() {
+	d.LockedUntil = time.Time{}
+	if err := config.webhookDeliveriesCollection.UpdateId(d.ID, d); err != nil {
+		log.Println(err)
+	}
+}
+
+// deliveryRetryIn is the wait before the next attempt after the given
+// number of failed attempts.
+func deliveryRetryIn(attempts int) time.Duration {
+	wait := deliveryBackoff
+	for i := 1; i < attempts && wait < maxDeliveryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxDeliveryBackoff {
+		wait = maxDeliveryBackoff
+	}
+	return wait
+}
+
+// send posts the payload of the delivery to the webhook. Any response
+// other than 2xx is a failure.
+func (wh *webhook) send(d *webhookDelivery, now time.Time) (int, error) {
+	payload := []byte(d.Payload)
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "golang-demo-api-webhooks")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", d.ID.Hex())
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set("X-Webhook-Signature", "sha256="+wh.sign(now, payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("unexpected status " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// runWebhookWorker processes the delivery queue every interval.
+func runWebhookWorker(interval time.Duration) {
+	for range time.Tick(interval) {
+		processWebhookDeliveries(bson.Now)
+	}
+}
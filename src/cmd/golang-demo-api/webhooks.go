@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	webhooksRouter := router.Path("/api/webhooks").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Subrouter()
+
+	webhooksRouter.Methods("GET").HandlerFunc(requireAdmin(webhooksHandler))
+	webhooksRouter.Methods("POST").HandlerFunc(requireAdmin(createWebhookHandler))
+
+	webhookRouter := router.Path("/api/webhooks/{id}").
+		HeadersRegexp("Content-Type", jsonContentTypes).
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Subrouter()
+
+	webhookRouter.Methods("GET").HandlerFunc(requireAdmin(showWebhookHandler))
+	webhookRouter.Methods("PUT", "PATCH").HandlerFunc(requireAdmin(updateWebhookHandler))
+	webhookRouter.Methods("DELETE").HandlerFunc(requireAdmin(deleteWebhookHandler))
+
+	router.Path("/api/webhooks/{id}/deliveries").
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("GET").
+		HandlerFunc(requireAdmin(webhookDeliveriesHandler))
+
+	router.Path("/api/webhooks/{id}/deliveries/{delivery_id}/redeliver").
+		Headers("Accept", "application/vnd.demo_app.v1+json").
+		Methods("POST").
+		HandlerFunc(requireAdmin(redeliverWebhookHandler))
+
+	webhookBody := jsonBody(struct {
+		Webhook newWebhook `json:"webhook"`
+	}{})
+	webhookID := pathParam("id", "ID of the webhook")
+	documentOperations(
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/webhooks",
+			OperationID: "listWebhooks",
+			Summary:     "Returns all the webhooks.",
+			Tags:        []string{"webhooks"},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK)),
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/webhooks",
+			OperationID: "createWebhook",
+			Summary:     "Subscribes an URL to user events.",
+			Description: "The response holds the secret signing the payloads, it can't be read again afterwards.",
+			Tags:        []string{"webhooks"},
+			RequestBody: webhookBody,
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422)),
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/webhooks/{id}",
+			OperationID: "showWebhook",
+			Summary:     "Returns a webhook.",
+			Tags:        []string{"webhooks"},
+			Parameters:  []*openAPIParameter{webhookID},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+		&openAPIOperation{
+			Method:      "PUT",
+			Path:        "/api/webhooks/{id}",
+			OperationID: "updateWebhook",
+			Summary:     "Updates a webhook, fields left out are unchanged.",
+			Tags:        []string{"webhooks"},
+			Parameters:  []*openAPIParameter{webhookID},
+			RequestBody: webhookBody,
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422)),
+		},
+		&openAPIOperation{
+			Method:      "PATCH",
+			Path:        "/api/webhooks/{id}",
+			OperationID: "patchWebhook",
+			Summary:     "Same as updateWebhook.",
+			Tags:        []string{"webhooks"},
+			Parameters:  []*openAPIParameter{webhookID},
+			RequestBody: webhookBody,
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, http.StatusBadRequest, 422)),
+		},
+		&openAPIOperation{
+			Method:      "DELETE",
+			Path:        "/api/webhooks/{id}",
+			OperationID: "deleteWebhook",
+			Summary:     "Deletes a webhook and its deliveries.",
+			Tags:        []string{"webhooks"},
+			Parameters:  []*openAPIParameter{webhookID},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+		&openAPIOperation{
+			Method:      "GET",
+			Path:        "/api/webhooks/{id}/deliveries",
+			OperationID: "listWebhookDeliveries",
+			Summary:     "Returns the deliveries of a webhook, latest first.",
+			Tags:        []string{"webhooks"},
+			Parameters: []*openAPIParameter{
+				webhookID,
+				pageParam,
+				queryParam("status", "Status of the deliveries", &openAPISchema{
+					Type: "string",
+					Enum: []string{deliveryPending, deliverySending, deliveryDelivered, deliveryDead},
+				}),
+			},
+			Responses: adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+		&openAPIOperation{
+			Method:      "POST",
+			Path:        "/api/webhooks/{id}/deliveries/{delivery_id}/redeliver",
+			OperationID: "redeliverWebhook",
+			Summary:     "Queues a delivery again, whatever its status.",
+			Tags:        []string{"webhooks"},
+			Parameters:  []*openAPIParameter{webhookID, pathParam("delivery_id", "ID of the delivery")},
+			Responses:   adminOnly(envelopeResponses(http.StatusOK, 422)),
+		},
+	)
+}
+
+// webhooksHandler returns all the webhooks of the organization.
+// URL: GET /api/webhooks
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+func webhooksHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var webhooks Webhooks
+	if err := config.webhooksCollection.Find(bson.M{"organization_id": requestOrganization(req).ID}).Sort("-_id").All(&webhooks); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := response{data: &data{Total: len(webhooks), Webhooks: webhooks}}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// createWebhookHandler subscribes an URL to user events. The response holds
+// the secret signing the payloads, it can't be read again afterwards.
+// Receivers should check the "X-Webhook-Signature" header, it is
+// "sha256=" followed by the hex HMAC-SHA256 of the "X-Webhook-Timestamp"
+// header, a dot and the body, keyed with the secret.
+// URL: POST /api/webhooks
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// BODY:
+//	webhook[url]: URL receiving the events. (required)
+//	webhook[events]: Events sent, any of user.created, user.updated,
+//	user.deleted and user.restored or "*" for all. (required)
+//	webhook[description]: What the webhook is used for.
+//	webhook[active]: Whether events are sent.
+// EXAMPLE:
+//	{
+//		"webhook": {
+//			"url": "https://crm.example.com/hooks/users",
+//			"events": ["user.created", "user.deleted"],
+//			"active": true
+//		}
+//	}
+func createWebhookHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	nw, err := decodeWebhookParams(req)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var resp *response
+	wh := &webhook{OrganizationID: requestOrganization(req).ID, Active: true}
+	wh.copyFields(nw)
+	if err = wh.Create(); err != nil {
+		log.Println(err)
+		resp = &response{
+			Message: "Unable to save webhook. Please correct the errors and try again.",
+			data:    &data{Errors: wh.Errors},
+		}
+		w.WriteHeader(422)
+	} else {
+		resp = &response{Message: "Webhook successfully created.", data: &data{webhook: wh}}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// showWebhookHandler returns a webhook.
+// URL: GET /api/webhooks/:id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the webhook
+func showWebhookHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var resp *response
+	if wh, err := loadWebhook(requestOrganization(req).ID, mux.Vars(req)["id"]); err != nil {
+		log.Println(err)
+		resp = &response{Message: "Webhook not found."}
+		w.WriteHeader(422)
+	} else {
+		wh.Secret = ""
+		resp = &response{data: &data{webhook: wh}}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// updateWebhookHandler can be used to update a webhook.
+// URL: PUT|PATCH /api/webhooks/:id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// BODY:
+//	Same as createWebhookHandler, fields left out are unchanged.
+func updateWebhookHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	nw, err := decodeWebhookParams(req)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	wh, err := loadWebhook(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		w.Write([]byte(`{"message": "Webhook not found."}`))
+		return
+	}
+
+	var resp *response
+	if err = wh.Update(nw); err != nil {
+		log.Println(err)
+		resp = &response{
+			Message: "Unable to update webhook. Please correct the errors and try again.",
+			data:    &data{Errors: wh.Errors},
+		}
+		w.WriteHeader(422)
+	} else {
+		resp = &response{Message: "Webhook updated successfully."}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// deleteWebhookHandler deletes a webhook and its deliveries.
+// URL: DELETE /api/webhooks/:id
+// HEADERS:
+//	"Content-Type": "application/json"
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the webhook
+func deleteWebhookHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var resp *response
+	if wh, err := loadWebhook(requestOrganization(req).ID, mux.Vars(req)["id"]); err != nil {
+		log.Println(err)
+		resp = &response{Message: "Webhook not found."}
+		w.WriteHeader(422)
+	} else if err = config.webhooksCollection.RemoveId(wh.ID); err != nil {
+		log.Println(err)
+		resp = &response{Message: "Unable to delete webhook."}
+		w.WriteHeader(422)
+	} else {
+		if _, err = config.webhookDeliveriesCollection.RemoveAll(bson.M{"webhook_id": wh.ID}); err != nil {
+			log.Println(err)
+		}
+		resp = &response{Message: "Webhook deleted successfully."}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// webhookDeliveriesHandler returns the deliveries of a webhook, latest
+// first, with the log of their attempts.
+// URL: GET /api/webhooks/:id/deliveries
+// HEADERS:
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the webhook
+//	"status": One of pending, sending, delivered and dead
+//	"page": Current page number(per page 20 records)
+func webhookDeliveriesHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	wh, err := loadWebhook(requestOrganization(req).ID, mux.Vars(req)["id"])
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(422)
+		w.Write([]byte(`{"message": "Webhook not found."}`))
+		return
+	}
+
+	filter := bson.M{"webhook_id": wh.ID}
+	if status := req.URL.Query().Get("status"); status != "" {
+		filter["status"] = status
+	}
+	var offset int
+	page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+	if page != 0 {
+		offset = (page - 1) * perPage
+	}
+
+	var deliveries WebhookDeliveries
+	err = config.webhookDeliveriesCollection.Find(filter).Sort("-_id").Limit(perPage).Skip(offset).All(&deliveries)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	total, err := config.webhookDeliveriesCollection.Find(filter).Count()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	resp := response{data: &data{Total: total, WebhookDeliveries: deliveries}}
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+// redeliverWebhookHandler queues a delivery again, whatever its status.
+// It is sent with the next run of the delivery worker.
+// URL: POST /api/webhooks/:id/deliveries/:delivery_id/redeliver
+// HEADERS:
+//	"Accept": "application/vnd.demo_app.v1+json"
+// PARAMETERS:
+//	"id": ID of the webhook
+//	"delivery_id": ID of the delivery
+func redeliverWebhookHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(req)
+	var resp *response
+	if wh, err := loadWebhook(requestOrganization(req).ID, vars["id"]); err != nil || !bson.IsObjectIdHex(vars["delivery_id"]) {
+		resp = &response{Message: "Delivery not found."}
+		w.WriteHeader(422)
+	} else if err = config.webhookDeliveriesCollection.Update(
+		bson.M{"_id": bson.ObjectIdHex(vars["delivery_id"]), "webhook_id": wh.ID},
+		bson.M{
+			"$set":   bson.M{"status": deliveryPending, "attempts": 0, "next_attempt_at": bson.Now()},
+			"$unset": bson.M{"locked_until": 1},
+		},
+	); err != nil {
+		log.Println(err)
+		resp = &response{Message: "Delivery not found."}
+		w.WriteHeader(422)
+	} else {
+		resp = &response{Message: "Delivery queued."}
+		w.WriteHeader(http.StatusOK)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+	return
+}
+
+func decodeWebhookParams(req *http.Request) (newWebhook, error) {
+	var params struct {
+		Webhook newWebhook `json:"webhook"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&params)
+	return params.Webhook, err
+}
+
+func loadWebhook(orgID bson.ObjectId, id string) (*webhook, error) {
+	var wh webhook
+	if !bson.IsObjectIdHex(id) {
+		return &wh, errors.New("Invalid webhook id.")
+	}
+	err := config.webhooksCollection.Find(bson.M{"_id": bson.ObjectIdHex(id), "organization_id": orgID}).One(&wh)
+	return &wh, err
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// webhookReceiver records the deliveries it receives and answers them
+// with status.
+type webhookReceiver struct {
+	sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	wr.Lock()
+	wr.requests = append(wr.requests, req)
+	wr.bodies = append(wr.bodies, body)
+	wr.Unlock()
+	w.WriteHeader(wr.status)
+}
+
+// allowLocalWebhooks lets the deliveries reach the receivers of the tests,
+// served on the loopback address, until the returned func is called.
+func allowLocalWebhooks() func() {
+	client := webhookClient
+	webhookClient = &http.Client{Timeout: client.Timeout}
+	return func() { webhookClient = client }
+}
+
+func createWebhook(t *testing.T, apiURL, hookURL string) *webhook {
+	var b bytes.Buffer
+	b.Write([]byte(`{"webhook":{"url":"` + hookURL + `","events":["user.created"]}}`))
+
+	client := &http.Client{}
+	req, err := http.NewRequest("POST", apiURL+"/api/webhooks", &b)
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	req.Header.Add("Content-Type", "application/json")
+	actResp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer actResp.Body.Close()
+	resp := response{data: &data{}}
+	if err = json.NewDecoder(actResp.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.webhook == nil || resp.webhook.Secret == "" {
+		t.Fatalf("expected a webhook with its secret, but got %s", resp.Message)
+	}
+	return resp.webhook
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	ts := adminServer()
+	defer ts.Close()
+	defer allowLocalWebhooks()()
+	receiver := &webhookReceiver{status: http.StatusNoContent}
+	hook := httptest.NewServer(receiver)
+	defer hook.Close()
+
+	wh := createWebhook(t, ts.URL, hook.URL)
+	var b bytes.Buffer
+	b.Write([]byte(`{"user":{"name":"Test","username":"test","email":"test@test.com","password":"test123","password_confirmation":"test123"}}`))
+	client := &http.Client{}
+	req, err := http.NewRequest("POST", ts.URL+"/api/users", &b)
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	req.Header.Add("Content-Type", "application/json")
+	if _, err = client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := processWebhookDeliveries(bson.Now); n != 1 {
+		t.Fatalf("expected %d delivery, but got %d", 1, n)
+	}
+	if len(receiver.requests) != 1 {
+		t.Fatalf("expected %d request, but got %d", 1, len(receiver.requests))
+	}
+
+	hr := receiver.requests[0]
+	if hr.Header.Get("X-Webhook-Event") != userCreated {
+		t.Errorf("expected event to be %s, but got %s", userCreated, hr.Header.Get("X-Webhook-Event"))
+	}
+	ts64, _ := strconv.ParseInt(hr.Header.Get("X-Webhook-Timestamp"), 10, 64)
+	expected := "sha256=" + wh.sign(time.Unix(ts64, 0), receiver.bodies[0])
+	if !hmac.Equal([]byte(hr.Header.Get("X-Webhook-Signature")), []byte(expected)) {
+		t.Errorf("expected signature %s, but got %s", expected, hr.Header.Get("X-Webhook-Signature"))
+	}
+	var event userEvent
+	if err = json.Unmarshal(receiver.bodies[0], &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.User == nil || event.User.Username != "test" || strings.Contains(string(receiver.bodies[0]), "password") {
+		t.Errorf("unexpected payload %s", receiver.bodies[0])
+	}
+
+	var d webhookDelivery
+	config.webhookDeliveriesCollection.Find(bson.M{"webhook_id": wh.ID}).One(&d)
+	if d.Status != deliveryDelivered || d.Attempts != 1 {
+		t.Errorf("expected delivered after %d attempt, but got %s after %d", 1, d.Status, d.Attempts)
+	}
+	dropAllCollections(t)
+}
+
+func TestWebhookRetriesAndDeadLetter(t *testing.T) {
+	ts := adminServer()
+	defer ts.Close()
+	defer allowLocalWebhooks()()
+	receiver := &webhookReceiver{status: http.StatusInternalServerError}
+	hook := httptest.NewServer(receiver)
+	defer hook.Close()
+
+	wh := createWebhook(t, ts.URL, hook.URL)
+	u := setupUser(t)
+	userChanged(&http.Request{}, auditCreate, nil, &u)
+
+	now := bson.Now()
+	for i := 1; i <= maxDeliveryAttempts; i++ {
+		if n := processWebhookDeliveries(func() time.Time { return now }); n != 1 {
+			t.Fatalf("expected attempt %d to be made, but got %d deliveries", i, n)
+		}
+		// nothing is due before the backoff
+		if n := processWebhookDeliveries(func() time.Time { return now }); n != 0 {
+			t.Errorf("expected no delivery during backoff, but got %d", n)
+		}
+		now = now.Add(maxDeliveryBackoff)
+	}
+
+	var d webhookDelivery
+	config.webhookDeliveriesCollection.Find(bson.M{"webhook_id": wh.ID}).One(&d)
+	if d.Status != deliveryDead || d.Attempts != maxDeliveryAttempts {
+		t.Fatalf("expected dead after %d attempts, but got %s after %d", maxDeliveryAttempts, d.Status, d.Attempts)
+	}
+	if d.Logs[0].StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected logged status %d, but got %d", http.StatusInternalServerError, d.Logs[0].StatusCode)
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequest("POST", ts.URL+"/api/webhooks/"+wh.ID.Hex()+"/deliveries/"+d.ID.Hex()+"/redeliver", nil)
+	req.Header.Add("Accept", "application/vnd.demo_app.v1+json")
+	actResp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actResp.Body.Close()
+
+	receiver.status = http.StatusOK
+	if n := processWebhookDeliveries(bson.Now); n != 1 {
+		t.Fatalf("expected redelivery, but got %d deliveries", n)
+	}
+	config.webhookDeliveriesCollection.FindId(d.ID).One(&d)
+	if d.Status != deliveryDelivered {
+		t.Errorf("expected %s, but got %s", deliveryDelivered, d.Status)
+	}
+	dropAllCollections(t)
+}
+
+func TestDeliveryRetryIn(t *testing.T) {
+	expected := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for i, wait := range expected {
+		if actual := deliveryRetryIn(i + 1); actual != wait {
+			t.Errorf("expected %s after %d attempts, but got %s", wait, i+1, actual)
+		}
+	}
+	if actual := deliveryRetryIn(50); actual != maxDeliveryBackoff {
+		t.Errorf("expected %s, but got %s", maxDeliveryBackoff, actual)
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusNoContent}
+	hook := httptest.NewServer(receiver)
+	defer hook.Close()
+
+	urls := []string{hook.URL, "http://[::1]:80", "http://10.0.0.1", "http://169.254.169.254/latest/meta-data"}
+	for _, u := range urls {
+		resp, err := webhookClient.Post(u, "application/json", strings.NewReader("{}"))
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("expected %s to be refused", u)
+		} else if !strings.Contains(err.Error(), errPrivateAddress.Error()) {
+			t.Errorf("expected %s to be refused as private, but got %v", u, err)
+		}
+	}
+	if len(receiver.requests) != 0 {
+		t.Errorf("expected no delivery to the loopback address, but got %d", len(receiver.requests))
+	}
+}
@@ -0,0 +1,144 @@
+// Package factory generates realistic users for development and tests.
+// The users only depend on the seed, so a seed always gives the same
+// users:
+//
+//	f := factory.New(1)
+//	f.From = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+//	for _, u := range f.Users(1000) {
+//		...
+//	}
+package factory
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPassword is the password of the generated users.
+const DefaultPassword = "password"
+
+// DefaultFrom and DefaultTo bound the creation times by default. They are
+// fixed, not relative to now, so a seed gives the same users every day.
+var (
+	DefaultFrom = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	DefaultTo   = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// User is a generated user, with the fields of the API.
+type User struct {
+	Name      string    `json:"name" yaml:"name"`
+	Username  string    `json:"username" yaml:"username"`
+	Email     string    `json:"email" yaml:"email"`
+	Mobile    string    `json:"mobile,omitempty" yaml:"mobile,omitempty"`
+	Password  string    `json:"password,omitempty" yaml:"password,omitempty"`
+	Role      string    `json:"role,omitempty" yaml:"role,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty" yaml:"created_at,omitempty"`
+}
+
+// Factory generates users. It isn't safe for concurrent use.
+type Factory struct {
+	// From and To bound the creation times, spread uniformly between
+	// them. They default to DefaultFrom and DefaultTo.
+	From, To time.Time
+	// Password is given to every user.
+	Password string
+	// Seq is the sequence number of the next user. Usernames, emails and
+	// mobile numbers are unique across sequence numbers, start after the
+	// users generated before to add more, see Seq.
+	Seq int
+
+	rand *rand.Rand
+}
+
+// New returns a factory generating the users of seed.
+func New(seed int64) *Factory {
+	return &Factory{
+		From:     DefaultFrom,
+		To:       DefaultTo,
+		Password: DefaultPassword,
+		rand:     rand.New(rand.NewSource(seed)),
+	}
+}
+
+// User returns the next user.
+func (f *Factory) User() User {
+	first := firstNames[f.rand.Intn(len(firstNames))]
+	last := lastNames[f.rand.Intn(len(lastNames))]
+	domain := emailDomains[f.rand.Intn(len(emailDomains))]
+	username := fmt.Sprintf("%s.%s%d", strings.ToLower(first), strings.ToLower(last), f.Seq)
+
+	u := User{
+		Name:      first + " " + last,
+		Username:  username,
+		Email:     username + "@" + domain,
+		Mobile:    mobile(f.Seq),
+		Password:  f.Password,
+		CreatedAt: f.createdAt(),
+	}
+	f.Seq++
+	return u
+}
+
+// generatedUsername matches the usernames of the generated users, which
+// end with their sequence number.
+var generatedUsername = regexp.MustCompile(`^[a-z]+\.[a-z]+([0-9]+)$`)
+
+// Seq returns the sequence number of a generated username, and false for
+// the other usernames.
+func Seq(username string) (int, bool) {
+	m := generatedUsername.FindStringSubmatch(username)
+	if m == nil {
+		return 0, false
+	}
+	seq, err := strconv.Atoi(m[1])
+	return seq, err == nil
+}
+
+// Users returns the next n users.
+func (f *Factory) Users(n int) []User {
+	users := make([]User, n)
+	for i := range users {
+		users[i] = f.User()
+	}
+	return users
+}
+
+func (f *Factory) createdAt() time.Time {
+	span := f.To.Sub(f.From)
+	if span <= 0 {
+		return f.From
+	}
+	return f.From.Add(time.Duration(f.rand.Int63n(int64(span)))).Truncate(time.Second)
+}
+
+// mobile returns the 10 digit mobile number of the sequence number seq.
+// The digits after the first are seq multiplied by a number coprime with
+// 10^9, which is a permutation, so they look random without repeating
+// for the first billion users.
+func mobile(seq int) string {
+	const digits = 1000000000
+	return fmt.Sprintf("9%09d", (int64(seq)%digits)*387420489%digits)
+}
+
+var firstNames = []string{
+	"Aarav", "Aditya", "Ananya", "Arjun", "Ayesha", "Carlos", "Chen", "Daniel",
+	"Diya", "Elena", "Emma", "Fatima", "Gabriel", "Hana", "Ishaan", "Isabella",
+	"James", "Kavya", "Liam", "Lucia", "Mateo", "Maya", "Mei", "Mohammed",
+	"Noah", "Olivia", "Omar", "Priya", "Rahul", "Riya", "Rohan", "Sakura",
+	"Sara", "Sofia", "Tanvi", "Thomas", "Vihaan", "Wei", "Yusuf", "Zara",
+}
+
+var lastNames = []string{
+	"Ahmed", "Bose", "Brown", "Chen", "Das", "Desai", "Fernandes", "Garcia",
+	"Gupta", "Iyer", "Jones", "Joshi", "Kapoor", "Khan", "Kim", "Kulkarni",
+	"Lopez", "Martin", "Mehta", "Menon", "Nair", "Patel", "Pillai", "Rao",
+	"Reddy", "Rossi", "Sato", "Shah", "Sharma", "Shedge", "Silva", "Singh",
+	"Smith", "Tanaka", "Verma", "Wang", "Williams", "Yadav", "Zhang", "Ziegler",
+}
+
+// emailDomains are reserved for examples, mails sent to them go nowhere.
+var emailDomains = []string{"example.com", "example.net", "example.org"}
@@ -0,0 +1,91 @@
+package factory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeterministic(t *testing.T) {
+	a, b := New(42), New(42)
+	if !reflect.DeepEqual(a.Users(100), b.Users(100)) {
+		t.Errorf("expected the same users for the same seed")
+	}
+	if reflect.DeepEqual(New(42).Users(10), New(43).Users(10)) {
+		t.Errorf("expected other users for another seed")
+	}
+}
+
+func TestSeq(t *testing.T) {
+	f := New(1)
+	f.Seq = 1234
+	if seq, ok := Seq(f.User().Username); !ok || seq != 1234 {
+		t.Errorf("expected sequence number %d, but got %d", 1234, seq)
+	}
+	for _, username := range []string{"admin", "test_user", "jane.doe"} {
+		if _, ok := Seq(username); ok {
+			t.Errorf("expected %s not to be generated", username)
+		}
+	}
+}
+
+func TestUnique(t *testing.T) {
+	f := New(1)
+	f.From = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	f.To = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	seen := make(map[string]bool)
+	for _, u := range f.Users(100000) {
+		for _, v := range []string{"username " + u.Username, "email " + u.Email, "mobile " + u.Mobile} {
+			if seen[v] {
+				t.Fatalf("%s is repeated", v)
+			}
+			seen[v] = true
+		}
+		if len(u.Mobile) != 10 {
+			t.Fatalf("expected a 10 digit mobile, but got %s", u.Mobile)
+		}
+		if u.CreatedAt.Before(f.From) || !u.CreatedAt.Before(f.To) {
+			t.Fatalf("expected created_at in %s - %s, but got %s", f.From, f.To, u.CreatedAt)
+		}
+	}
+}
+
+func TestLoadFixture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"admins.yml": "users:\n  - name: Admin\n    username: admin\n    email: admin@example.com\n    role: admin\n",
+		"team.json":  `{"users": [{"name": "Admin", "username": "admin", "email": "admin@example.com", "role": "admin"}]}`,
+		"bad.yml":    "users:\n  - nickname: admin\n",
+	}
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []User{{Name: "Admin", Username: "admin", Email: "admin@example.com", Role: "admin"}}
+	for _, path := range []string{"admins", filepath.Join(dir, "team.json")} {
+		fixture, err := LoadFixture(dir, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(fixture.Users, expected) {
+			t.Errorf("%s: expected %v, but got %v", path, expected, fixture.Users)
+		}
+	}
+
+	for _, path := range []string{"bad", "missing"} {
+		if _, err = LoadFixture(dir, path); err == nil {
+			t.Errorf("%s: expected an error", path)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package factory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// fixtureExtensions are the extensions of the fixture files, in the
+// order they are looked for.
+var fixtureExtensions = []string{".yml", ".yaml", ".json"}
+
+// Fixture is a file of users, in YAML or JSON:
+//
+//	users:
+//	  - name: Admin
+//	    username: admin
+//	    email: admin@example.com
+//	    password: secret123
+//	    role: admin
+type Fixture struct {
+	Users []User `json:"users" yaml:"users"`
+}
+
+// LoadFixture reads the fixture at path. Names without an extension are
+// looked for in dir, like "admins" for "fixtures/admins.yml".
+func LoadFixture(dir, path string) (*Fixture, error) {
+	if filepath.Ext(path) == "" {
+		found, err := findFixture(dir, path)
+		if err != nil {
+			return nil, err
+		}
+		path = found
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fixture Fixture
+	switch filepath.Ext(path) {
+	case ".yml", ".yaml":
+		err = yaml.UnmarshalStrict(b, &fixture)
+	case ".json":
+		err = json.Unmarshal(b, &fixture)
+	default:
+		return nil, fmt.Errorf("%s: fixtures are .yml, .yaml or .json files", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &fixture, nil
+}
+
+func findFixture(dir, name string) (string, error) {
+	for _, ext := range fixtureExtensions {
+		path := filepath.Join(dir, name+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no fixture %q in %s", name, dir)
+}